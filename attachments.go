@@ -0,0 +1,268 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Attachment is what the index knows of an attachment: its name, type,
+// decoded size and SHA-256, and where the message carrying it was filed,
+// Folder being relative to Maildir and File the maildir unique name.
+type Attachment struct {
+	Time      time.Time `json:"time"`
+	Maildir   string    `json:"maildir"`
+	Folder    string    `json:"folder"`
+	File      string    `json:"file"`
+	MessageId string    `json:"message_id,omitempty"`
+	Subject   string    `json:"subject,omitempty"`
+	Name      string    `json:"name"`
+	Type      string    `json:"type"`
+	Size      int64     `json:"size"`
+	Sha256    string    `json:"sha256"`
+
+	path string
+}
+
+func attachments_path(homedir string) string {
+	return filepath.Join(homedir, ".pmda", "attachments.json")
+}
+
+// attachments_scan returns the attachments of a stored message, parts
+// with an attachment disposition or a filename.
+func attachments_scan(pathname string) ([]*Attachment, error) {
+	attachments := make([]*Attachment, 0)
+	err := mime_walk_file(pathname, func(part *MimePart) error {
+		if part.Disposition != "attachment" && part.Filename == "" {
+			return nil
+		}
+		hash := sha256.New()
+		size, err := io.Copy(hash, part.Body)
+		if err != nil {
+			return err
+		}
+		attachments = append(attachments, &Attachment{
+			Name:   notify_decode(part.Filename),
+			Type:   part.MediaType,
+			Size:   size,
+			Sha256: hex.EncodeToString(hash.Sum(nil)),
+		})
+		return nil
+	})
+	return attachments, err
+}
+
+// attachments_record appends the attachments of a delivered message to
+// the index, a file of JSON lines which the attachments command reads
+// back.
+func attachments_record(homedir string, maildir string, folder string, pathname string, hdr *Header) {
+	attachments, err := attachments_scan(pathname)
+	if err != nil {
+		log_error("Error indexing attachments: %s", err)
+	}
+	if len(attachments) == 0 {
+		return
+	}
+
+	lines := make([]byte, 0)
+	for _, attachment := range attachments {
+		attachment.Time = time.Now()
+		attachment.Maildir = maildir
+		attachment.Folder = folder
+		attachment.File = maildir_unique(filepath.Base(pathname))
+		attachment.MessageId = message_id(hdr.Get("Message-ID"))
+		attachment.Subject = header_oneline(notify_decode(hdr.Get("Subject")))
+		data, err := json.Marshal(attachment)
+		if err != nil {
+			log_error("Error encoding attachment: %s", err)
+			return
+		}
+		lines = append(append(lines, data...), '\n')
+	}
+
+	index := attachments_path(homedir)
+	if err := os.MkdirAll(filepath.Dir(index), 0700); err != nil {
+		log_error("Error indexing attachments: %s", err)
+		return
+	}
+	file, err := os.OpenFile(index, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		log_error("Error indexing attachments: %s", err)
+		return
+	}
+	defer file.Close()
+	if _, err := file.Write(lines); err != nil {
+		log_error("Error indexing attachments: %s", err)
+	}
+}
+
+// attachments_load reads back the index, keeping the entries matched by
+// fn.
+func attachments_load(homedir string, fn func(attachment *Attachment) bool) ([]*Attachment, error) {
+	file, err := os.Open(attachments_path(homedir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	attachments := make([]*Attachment, 0)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), LINE_READ_MAX)
+	for scanner.Scan() {
+		attachment := &Attachment{}
+		if json.Unmarshal(scanner.Bytes(), attachment) != nil || !fn(attachment) {
+			continue
+		}
+		attachments = append(attachments, attachment)
+	}
+	return attachments, scanner.Err()
+}
+
+// attachments_locate finds where the messages of the attachments are now,
+// walking each folder once, and drops those of messages since deleted.
+func attachments_locate(attachments []*Attachment) []*Attachment {
+	folders := make(map[string]map[string]string)
+	located := make([]*Attachment, 0, len(attachments))
+	for _, attachment := range attachments {
+		folder := filepath.Join(attachment.Maildir, attachment.Folder)
+		files, found := folders[folder]
+		if !found {
+			files = make(map[string]string)
+			for _, subdir := range []string{"new", "cur"} {
+				maildir_walk(filepath.Join(folder, subdir), func(pathname string, entry fs.DirEntry) error {
+					files[maildir_unique(entry.Name())] = pathname
+					return nil
+				})
+			}
+			folders[folder] = files
+		}
+		if attachment.path = files[attachment.File]; attachment.path != "" {
+			located = append(located, attachment)
+		}
+	}
+	return located
+}
+
+var attachmentsFlags = flag.NewFlagSet("attachments", flag.ExitOnError)
+var attachmentsLargerThan = attachmentsFlags.String("larger-than", "", "only list attachments larger than this size")
+var attachmentsName = attachmentsFlags.String("name", "", "only list attachments whose name matches this pattern")
+var attachmentsType = attachmentsFlags.String("type", "", "only list attachments of this media type, or of this pattern")
+var attachmentsJson = attachmentsFlags.Bool("json", false, "output the attachments as JSON")
+var attachmentsRemove = attachmentsFlags.Bool("remove", false, "remove the messages carrying the attachments listed, to the trash unless it is off")
+
+// attachments_main implements "mail.pmda attachments", which queries the
+// attachment index, largest first, to find and prune large attachments:
+//
+//	mail.pmda attachments -larger-than 10m -type "video/*"
+func attachments_main(args []string) int {
+	attachmentsFlags.Parse(args)
+	if attachmentsFlags.NArg() != 0 {
+		fmt.Fprintf(os.Stderr, "Usage: %s attachments [-json] [-remove] [-larger-than size] [-name pattern] [-type type]\n", os.Args[0])
+		return 1
+	}
+	larger := int64(-1)
+	if *attachmentsLargerThan != "" {
+		size, err := config_size(*attachmentsLargerThan)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			return 1
+		}
+		larger = size
+	}
+
+	homedir := os.Getenv("HOME")
+	cfg, err := config_read(filepath.Join(homedir, ".pmda.conf"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading configuration: %s\n", err)
+		return 1
+	}
+	attachments, err := attachments_load(homedir, func(attachment *Attachment) bool {
+		if attachment.Size <= larger {
+			return false
+		}
+		if *attachmentsName != "" {
+			if ok, _ := path.Match(strings.ToLower(*attachmentsName), strings.ToLower(attachment.Name)); !ok {
+				return false
+			}
+		}
+		if *attachmentsType != "" {
+			if ok, _ := path.Match(strings.ToLower(*attachmentsType), attachment.Type); !ok {
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading attachment index: %s\n", err)
+		return 1
+	}
+	attachments = attachments_locate(attachments)
+	sort.SliceStable(attachments, func(i, j int) bool {
+		return attachments[i].Size > attachments[j].Size
+	})
+
+	if *attachmentsJson {
+		data, err := json.MarshalIndent(attachments, "", "  ")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error encoding attachments: %s\n", err)
+			return 1
+		}
+		fmt.Println(string(data))
+	} else {
+		for _, attachment := range attachments {
+			fmt.Printf("%10d  %-24s  %-30s  %s\n", attachment.Size, attachment.Type, attachment.Name, attachment.path)
+		}
+	}
+
+	if !*attachmentsRemove {
+		return 0
+	}
+	removed, freed := 0, int64(0)
+	for _, attachment := range attachments {
+		size := message_size(attachment.path)
+		if err := trash_remove(cfg, homedir, attachment.Maildir, attachment.path, attachment.Folder, "attachments"); err != nil {
+			if !os.IsNotExist(err) {
+				fmt.Fprintf(os.Stderr, "Error removing %s: %s\n", attachment.path, err)
+			}
+			continue
+		}
+		removed++
+		freed += size
+	}
+	if cfg.Trash != nil {
+		fmt.Printf("%d messages moved to %s, %d bytes to be freed once purged\n", removed, cfg.Trash.Folder, freed)
+	} else {
+		fmt.Printf("%d messages removed, %d bytes freed\n", removed, freed)
+	}
+	return 0
+}
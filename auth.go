@@ -0,0 +1,124 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"time"
+)
+
+const AUTH_TIMEOUT = 30 * time.Second
+
+// auth_checkpassword checks credentials with the checkpassword interface,
+// the program reads "user\0password\0timestamp\0" on descriptor 3 and
+// exits zero, after running the program given as argument, on success.
+// Unless running as root, only the running user may authenticate.
+func auth_checkpassword(program string, username string, password string) (*user.User, error) {
+	account, err := user.Lookup(username)
+	if err != nil {
+		return nil, err
+	}
+	if os.Getuid() != 0 && account.Uid != strconv.Itoa(os.Getuid()) {
+		return nil, fmt.Errorf("can only serve the running user")
+	}
+
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), AUTH_TIMEOUT)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, program, "/bin/true")
+	cmd.ExtraFiles = []*os.File{reader}
+	if err := cmd.Start(); err != nil {
+		writer.Close()
+		return nil, err
+	}
+	fmt.Fprintf(writer, "%s\x00%s\x00%d\x00", username, password, time.Now().Unix())
+	writer.Close()
+	if err := cmd.Wait(); err != nil {
+		return nil, err
+	}
+	return account, nil
+}
+
+// account_chown hands a file created on behalf of a user over to them,
+// which only matters when running as root.
+func account_chown(account *user.User, pathname string) {
+	if os.Getuid() != 0 {
+		return
+	}
+	uid, _ := strconv.Atoi(account.Uid)
+	gid, _ := strconv.Atoi(account.Gid)
+	os.Lchown(pathname, uid, gid)
+}
+
+// account_fchown is account_chown for a file already open.
+func account_fchown(account *user.User, file *os.File) error {
+	if os.Getuid() != 0 {
+		return nil
+	}
+	uid, _ := strconv.Atoi(account.Uid)
+	gid, _ := strconv.Atoi(account.Gid)
+	return file.Chown(uid, gid)
+}
+
+func http_error(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{"error": err.Error()})
+}
+
+// http_authenticated wraps a handler with basic authentication checked by
+// a checkpassword program, cleartext is only accepted on loopback.
+func http_authenticated(service string, program string, handler func(http.ResponseWriter, *http.Request, *user.User)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil {
+			local, _ := r.Context().Value(http.LocalAddrContextKey).(*net.TCPAddr)
+			if local == nil || !local.IP.IsLoopback() {
+				http_error(w, http.StatusForbidden, fmt.Errorf("TLS required"))
+				return
+			}
+		}
+
+		username, password, ok := r.BasicAuth()
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="mail.pmda"`)
+			http_error(w, http.StatusUnauthorized, fmt.Errorf("authentication required"))
+			return
+		}
+		account, err := auth_checkpassword(program, username, password)
+		if err != nil {
+			log_info("%s authentication failed for %s from %s: %s", service, username, r.RemoteAddr, err)
+			time.Sleep(time.Second)
+			w.Header().Set("WWW-Authenticate", `Basic realm="mail.pmda"`)
+			http_error(w, http.StatusUnauthorized, fmt.Errorf("authentication failed"))
+			return
+		}
+		handler(w, r, account)
+	}
+}
@@ -0,0 +1,194 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// AuthResultsConfig has the MDA verify the DKIM signatures of messages
+// and record its findings in an RFC 8601 Authentication-Results field:
+//
+//	authentication-results authserv-id "mx.example.org"
+//
+// The authserv-id defaults to the hostname. Authentication-Results that
+// claim it but came with the message, below the Received field of our
+// MTA, are forged and removed before delivery. SPF needs the connecting
+// client, which the MDA does not see, so DMARC is only reported when
+// DKIM settles it: pass for a signature aligned with the From domain,
+// none when the domain publishes no policy.
+type AuthResultsConfig struct {
+	ServId string
+}
+
+var authresultsTokenRegexp = regexp.MustCompile(`[^A-Za-z0-9._@-]`)
+
+func authresults_parse(args []string) (*AuthResultsConfig, error) {
+	switch {
+	case len(args) == 0:
+		return &AuthResultsConfig{}, nil
+	case len(args) == 2 && args[0] == "authserv-id" && args[1] != "" && !strings.ContainsAny(args[1], " \t;()\""):
+		return &AuthResultsConfig{ServId: args[1]}, nil
+	}
+	return nil, fmt.Errorf("usage: authentication-results [authserv-id name]")
+}
+
+// authresults_servid returns the authserv-id the results are issued
+// under.
+func authresults_servid(cfg *Config, hostname string) string {
+	if cfg.AuthResults.ServId != "" {
+		return cfg.AuthResults.ServId
+	}
+	return hostname
+}
+
+// authserv_id returns the authserv-id an Authentication-Results value
+// starts with, comments aside.
+func authserv_id(value string) string {
+	var id strings.Builder
+	depth := 0
+	for _, c := range value {
+		switch {
+		case c == '(':
+			depth++
+		case c == ')' && depth > 0:
+			depth--
+		case depth > 0:
+		case c == ';' || c == ' ' || c == '\t':
+			if id.Len() != 0 {
+				return id.String()
+			}
+		default:
+			id.WriteRune(c)
+		}
+	}
+	return id.String()
+}
+
+// authresults_strip removes the Authentication-Results fields claiming
+// our authserv-id that our MTA did not add.
+func authresults_strip(hdr *Header, servid string) {
+	fields := hdr.Fields[:0]
+	received := false
+	for _, field := range hdr.Fields {
+		received = received || strings.EqualFold(field.Name, "Received")
+		if received && strings.EqualFold(field.Name, "Authentication-Results") && strings.EqualFold(authserv_id(field.Value), servid) {
+			log_info("removed forged Authentication-Results: %s", header_oneline(field.Value))
+			continue
+		}
+		fields = append(fields, field)
+	}
+	hdr.edited = hdr.edited || len(fields) != len(hdr.Fields)
+	hdr.Fields = fields
+}
+
+// dmarc_lookup returns the tags of the DMARC policy covering a domain
+// and the domain it was found at, walking up to the parent domains.
+func dmarc_lookup(domain string) (map[string]string, string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), DKIM_TIMEOUT)
+	defer cancel()
+	for ; strings.Contains(domain, "."); _, domain, _ = strings.Cut(domain, ".") {
+		var records []string
+		err := chaos_inject("dns", DKIM_TIMEOUT)
+		if err == nil {
+			records, err = net.DefaultResolver.LookupTXT(ctx, "_dmarc."+domain)
+		}
+		if err != nil {
+			var dnsErr *net.DNSError
+			if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+				continue
+			}
+			return nil, "", err
+		}
+		for _, record := range records {
+			if strings.HasPrefix(record, "v=DMARC1") {
+				return dkim_tags(record), domain, nil
+			}
+		}
+	}
+	return nil, "", nil
+}
+
+// dmarc_result is the DMARC result of a message as far as DKIM goes: a
+// passing signature of the From domain, or of a parent domain within
+// the policy domain when alignment is relaxed.
+func dmarc_result(hdr *Header, signatures []*DKIMResult) string {
+	authors := hdr.Addresses("From")
+	if len(authors) != 1 {
+		return ""
+	}
+	_, from, _ := strings.Cut(authors[0], "@")
+	policy, domain, err := dmarc_lookup(from)
+	switch {
+	case err != nil:
+		return "temperror"
+	case policy == nil:
+		return "none"
+	}
+	for _, signature := range signatures {
+		if signature.Result != "pass" {
+			continue
+		}
+		d := signature.Domain
+		if d == from {
+			return "pass"
+		}
+		if policy["adkim"] != "s" && strings.HasSuffix(from, "."+d) && (d == domain || strings.HasSuffix(d, "."+domain)) {
+			return "pass"
+		}
+	}
+	return ""
+}
+
+// authresults_check verifies a stored message and returns the value of
+// its Authentication-Results field.
+func authresults_check(cfg *Config, hdr *Header, pathname string, hostname string) string {
+	methods := []string{authresults_servid(cfg, hostname)}
+	signatures, err := dkim_check(pathname, time.Now())
+	if err != nil {
+		log_info("error verifying signatures: %s", err)
+		signatures = nil
+		methods = append(methods, "dkim=temperror")
+	} else if len(signatures) == 0 {
+		methods = append(methods, "dkim=none")
+	}
+	for _, signature := range signatures {
+		method := "dkim=" + signature.Result
+		if signature.Reason != "" {
+			method += " reason=" + config_quote(signature.Reason)
+		}
+		method += " header.d=" + authresultsTokenRegexp.ReplaceAllString(signature.Domain, "")
+		method += " header.s=" + authresultsTokenRegexp.ReplaceAllString(signature.Selector, "")
+		if signature.Signature != "" {
+			method += " header.b=" + config_quote(signature.Signature)
+		}
+		methods = append(methods, method)
+	}
+	if authors := hdr.Addresses("From"); len(authors) == 1 {
+		if result := dmarc_result(hdr, signatures); result != "" {
+			_, from, _ := strings.Cut(authors[0], "@")
+			methods = append(methods, "dmarc="+result+" header.from="+authresultsTokenRegexp.ReplaceAllString(from, ""))
+		}
+	}
+	return strings.Join(methods, "; ")
+}
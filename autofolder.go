@@ -0,0 +1,185 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the marker of an auto-created folder, its mtime the last delivery
+const AUTOFOLDER_MARKER = "pmda-autofolder"
+
+// AutoFolderConfig expires the folders created on demand, for address
+// extensions and lists, once unused for so many months:
+//
+//	autofolders expire 6 archive ".Archive"
+//
+// Empty folders are removed. Those holding messages are kept, unless an
+// archive is set in which case their messages first move under it, as
+// .Archive.newproject for .newproject, before the folder is removed.
+type AutoFolderConfig struct {
+	Months  int
+	Archive string
+}
+
+func autofolders_parse(args []string) (*AutoFolderConfig, error) {
+	if len(args) != 2 && (len(args) != 4 || args[2] != "archive") || args[0] != "expire" {
+		return nil, fmt.Errorf("usage: autofolders expire months [archive folder]")
+	}
+	months, err := strconv.Atoi(args[1])
+	if err != nil || months < 1 {
+		return nil, fmt.Errorf("invalid months: %s", args[1])
+	}
+	autofolders := &AutoFolderConfig{Months: months}
+	if len(args) == 4 {
+		if !strings.HasPrefix(args[3], ".") {
+			return nil, fmt.Errorf("invalid archive folder: %s", args[3])
+		}
+		autofolders.Archive = args[3]
+	}
+	return autofolders, nil
+}
+
+// autofolder_create creates a folder on demand, subscribed to and marked
+// as such, and reports whether it did.
+func autofolder_create(cfg *Config, maildir string, folder string) bool {
+	if !maildir_mkdirs(filepath.Join(maildir, folder)) {
+		return false
+	}
+	folder_metadata(cfg, folder)
+	folder_subscribe(maildir, folder)
+	autofolder_mark(filepath.Join(maildir, folder))
+	return true
+}
+
+// autofolder_mark records a folder as created on demand.
+func autofolder_mark(directory string) {
+	if err := os.WriteFile(filepath.Join(directory, AUTOFOLDER_MARKER), nil, 0600); err != nil {
+		log_info("error marking %s: %s", directory, err)
+	}
+}
+
+// autofolder_touch records a delivery to a folder, if it was created on
+// demand.
+func autofolder_touch(directory string, now time.Time) {
+	marker := filepath.Join(directory, AUTOFOLDER_MARKER)
+	if err := os.Chtimes(marker, now, now); err != nil && !os.IsNotExist(err) {
+		log_info("error marking %s: %s", directory, err)
+	}
+}
+
+// autofolder_count returns how many messages a folder holds, including
+// those classified into folders of its own.
+func autofolder_count(directory string) (int64, error) {
+	folders, err := maildir_folders(directory)
+	if err != nil {
+		return 0, err
+	}
+	total := int64(0)
+	for _, folder := range folders {
+		_, count := folder_size(filepath.Join(directory, folder))
+		total += count
+	}
+	return total, nil
+}
+
+// autofolder_archive moves the messages of a folder, and of the folders
+// it holds, to another keeping their subdirectory and name.
+func autofolder_archive(cfg *Config, maildir string, folder string, target string) error {
+	folders, err := maildir_folders(filepath.Join(maildir, folder))
+	if err != nil {
+		return err
+	}
+	maildir_folder(cfg, maildir, target)
+	folder_subscribe(maildir, target)
+	depth := shard_depth(maildir)
+	for _, source := range folders {
+		if err := autofolder_move(filepath.Join(maildir, folder, source), filepath.Join(maildir, target), depth); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func autofolder_move(source string, target string, depth int) error {
+	for _, subdir := range []string{"new", "cur"} {
+		err := maildir_walk(filepath.Join(source, subdir), func(pathname string, entry fs.DirEntry) error {
+			destination, err := maildir_path(filepath.Join(target, subdir), entry.Name(), depth)
+			if err != nil {
+				return err
+			}
+			if err := os.Rename(pathname, destination); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			return nil
+		})
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// autofolders_expire removes the auto-created folders of a maildir left
+// unused, archiving their messages if configured to, and returns how
+// many were removed and archived.
+func autofolders_expire(cfg *Config, maildir string, now time.Time) (int, int, error) {
+	folders, err := maildir_folders(maildir)
+	if err != nil {
+		return 0, 0, err
+	}
+	limit := now.AddDate(0, -cfg.AutoFolders.Months, 0)
+	removed, archived := 0, 0
+	for _, folder := range folders {
+		directory := filepath.Join(maildir, folder)
+		st, err := os.Stat(filepath.Join(directory, AUTOFOLDER_MARKER))
+		if folder == "" || err != nil || !st.ModTime().Before(limit) {
+			continue
+		}
+		count, err := autofolder_count(directory)
+		if err != nil {
+			return removed, archived, err
+		}
+		if count != 0 {
+			if cfg.AutoFolders.Archive == "" {
+				continue
+			}
+			if err := autofolder_archive(cfg, maildir, folder, cfg.AutoFolders.Archive+folder); err != nil {
+				return removed, archived, err
+			}
+			if count, err := autofolder_count(directory); err != nil || count != 0 {
+				continue
+			}
+			archived++
+		}
+		if err := os.RemoveAll(directory); err != nil {
+			return removed, archived, err
+		}
+		if _, err := list_edit(filepath.Join(maildir, "subscriptions"), []string{strings.TrimPrefix(folder, ".")}, true, ""); err != nil {
+			log_info("error unsubscribing from %s: %s", folder, err)
+		}
+		log_info("expired folder %s, unused since %s", folder, st.ModTime().Format("2006-01-02"))
+		removed++
+	}
+	return removed, archived, nil
+}
@@ -0,0 +1,216 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// a backend hanging, as NFS does when the server is gone, counts as down
+const BACKEND_PROBE_TIMEOUT = 10 * time.Second
+
+// Backends are tried in order, the configured maildir first, and the
+// delivery goes to the first one a message can be created in:
+//
+//	maildir "/nfs/mail/alice"
+//	fallback "/var/spool/pmda/alice"
+//
+// Only a backend failing before the message is read is fallen back from,
+// failures past that point are tempfailed as always. Messages spooled in
+// a fallback are moved back to the maildir by "mail.pmda drain".
+func backend_resolve(homedir string, pathname string) string {
+	if filepath.IsAbs(pathname) {
+		return pathname
+	}
+	return filepath.Join(homedir, pathname)
+}
+
+// backend_probe creates and removes a file in the tmp subdirectory of a
+// maildir, giving up after BACKEND_PROBE_TIMEOUT. The maildir is never
+// created here: on a filesystem that is not mounted, that would create
+// it on the mountpoint and deliver where nothing ever looks, so backends
+// are set up beforehand by "mail.pmda init".
+func backend_probe(maildir string) error {
+	done := make(chan error, 1)
+	go func() {
+		tmp := filepath.Join(maildir, "tmp")
+		for _, dir := range []string{maildir, tmp} {
+			st, err := os.Stat(dir)
+			if err == nil && !st.IsDir() {
+				err = fmt.Errorf("%s: not a directory", dir)
+			}
+			if err != nil {
+				done <- err
+				return
+			}
+		}
+		file, err := os.CreateTemp(tmp, "probe.")
+		if err != nil {
+			done <- err
+			return
+		}
+		file.Close()
+		done <- os.Remove(file.Name())
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(BACKEND_PROBE_TIMEOUT):
+		return fmt.Errorf("no response after %s", BACKEND_PROBE_TIMEOUT)
+	}
+}
+
+// backend_select returns the maildir to deliver to, the delivery
+// tempfails when all backends are down.
+func backend_select(cfg *Config, homedir string, primary string) string {
+	if len(cfg.Fallbacks) == 0 {
+		return primary
+	}
+	err := backend_probe(primary)
+	if err == nil {
+		return primary
+	}
+	log_info("maildir %s unavailable: %s", primary, err)
+	for _, fallback := range cfg.Fallbacks {
+		maildir := backend_resolve(homedir, fallback)
+		if err := backend_probe(maildir); err != nil {
+			log_info("fallback %s unavailable: %s", maildir, err)
+			continue
+		}
+		log_info("delivering to fallback %s", maildir)
+		return maildir
+	}
+	log_error("Error delivering: no maildir available")
+	tempfail()
+	return primary
+}
+
+// drain_message moves a spooled message to the same folder of the
+// primary maildir, copying it when they are on different filesystems.
+// The spooled message is removed once the copy is on disk.
+func drain_message(cfg *Config, primary string, fallback string, folder string, subdir string, pathname string) error {
+	maildir_folder(cfg, primary, folder)
+	name := filepath.Base(pathname)
+	if unique, flags, found := strings.Cut(name, ":2,"); found {
+		translated, err := keywords_translate(flags, filepath.Join(fallback, folder), filepath.Join(primary, folder))
+		if err != nil {
+			return err
+		}
+		name = unique + ":2," + translated
+	}
+	target, err := maildir_path(filepath.Join(primary, folder, subdir), name, maildir_layout(cfg, primary))
+	if err != nil {
+		return err
+	}
+
+	size := message_size(pathname)
+	err = os.Rename(pathname, target)
+	if errors.Is(err, syscall.EXDEV) {
+		err = sieve_copy_file(pathname, target, filepath.Join(primary, folder, "tmp", maildir_unique(name)))
+		if err == nil {
+			err = file_sync(target)
+		}
+		if err == nil {
+			err = dir_sync(filepath.Dir(target), filepath.Join(primary, folder, subdir))
+		}
+		if err != nil {
+			os.Remove(target)
+			return err
+		}
+		err = os.Remove(pathname)
+	} else if err == nil {
+		err = dir_sync(filepath.Dir(target), filepath.Join(primary, folder, subdir))
+	}
+	if err != nil {
+		return err
+	}
+	quota_add(cfg, primary, size, 1)
+	quota_add(cfg, fallback, -size, -1)
+	return nil
+}
+
+// backend_drain moves every message of a fallback to the primary maildir
+// and returns how many were moved.
+func backend_drain(cfg *Config, primary string, fallback string) (int, error) {
+	folders, err := maildir_folders(fallback)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	drained := 0
+	for _, folder := range folders {
+		for _, subdir := range []string{"new", "cur"} {
+			err := maildir_walk(filepath.Join(fallback, folder, subdir), func(pathname string, entry fs.DirEntry) error {
+				if err := drain_message(cfg, primary, fallback, folder, subdir, pathname); err != nil {
+					return err
+				}
+				drained++
+				return nil
+			})
+			if err != nil && !os.IsNotExist(err) {
+				return drained, err
+			}
+		}
+	}
+	return drained, nil
+}
+
+var drainFlags = flag.NewFlagSet("drain", flag.ExitOnError)
+
+// drain_main implements "mail.pmda drain", which moves the messages
+// spooled in fallbacks back to the maildir once it is available again.
+func drain_main(args []string) int {
+	drainFlags.Parse(args)
+	if drainFlags.NArg() != 0 {
+		fmt.Fprintf(os.Stderr, "Usage: %s drain\n", os.Args[0])
+		return 1
+	}
+
+	homedir := os.Getenv("HOME")
+	cfg, err := config_read(filepath.Join(homedir, ".pmda.conf"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading configuration: %s\n", err)
+		return 1
+	}
+	primary := maildir_resolve(cfg, homedir)
+	if err := backend_probe(primary); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: maildir %s unavailable: %s\n", primary, err)
+		return 1
+	}
+
+	status := 0
+	for _, fallback := range cfg.Fallbacks {
+		maildir := backend_resolve(homedir, fallback)
+		drained, err := backend_drain(cfg, primary, maildir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error draining %s: %s\n", maildir, err)
+			status = 1
+		}
+		fmt.Printf("%s: %d messages drained\n", maildir, drained)
+	}
+	return status
+}
@@ -0,0 +1,185 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// BlocklistConfig files the messages of blocked senders away:
+//
+//	blocklist folder ".Junk" list ".pmda/blocked"
+//
+// Messages go to the junk folder unless another is given. The list holds addresses and domains, one per line, a domain blocking
+// its subdomains too. The From addresses and the envelope sender are
+// checked. Paths are relative to the home directory.
+type BlocklistConfig struct {
+	Folder string
+	List   string
+}
+
+var blockDomainRegexp = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?(\.[a-z0-9]([a-z0-9-]*[a-z0-9])?)+$`)
+
+func blocklist_default() *BlocklistConfig {
+	return &BlocklistConfig{List: filepath.Join(".pmda", "blocked")}
+}
+
+func blocklist_parse(args []string) (*BlocklistConfig, error) {
+	blocklist := blocklist_default()
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == "folder" && i+1 < len(args):
+			blocklist.Folder = args[i+1]
+			i++
+		case args[i] == "list" && i+1 < len(args):
+			blocklist.List = args[i+1]
+			i++
+		default:
+			return nil, fmt.Errorf("usage: blocklist [folder name] [list path]")
+		}
+	}
+	return blocklist, nil
+}
+
+func blocklist_path(blocklist *BlocklistConfig, homedir string) string {
+	if filepath.IsAbs(blocklist.List) {
+		return blocklist.List
+	}
+	return filepath.Join(homedir, blocklist.List)
+}
+
+// block_entry normalizes an address or domain given to block.
+func block_entry(value string) (string, error) {
+	value = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(value)), "@")
+	if strings.Contains(value, "@") {
+		address := correspondent_address(value)
+		if _, domain, _ := strings.Cut(address, "@"); !blockDomainRegexp.MatchString(domain) {
+			return "", fmt.Errorf("invalid address: %s", value)
+		}
+		return address, nil
+	}
+	if !blockDomainRegexp.MatchString(value) {
+		return "", fmt.Errorf("invalid address or domain: %s", value)
+	}
+	return value, nil
+}
+
+// blocklist_match reports whether an address is blocked, by itself or
+// by its domain or a parent of it.
+func blocklist_match(blocked map[string]bool, address string) bool {
+	if blocked[address] {
+		return true
+	}
+	_, domain, found := strings.Cut(address, "@")
+	for found {
+		if blocked[domain] {
+			return true
+		}
+		_, domain, found = strings.Cut(domain, ".")
+	}
+	return false
+}
+
+// blocklist_check reports whether a message comes from a blocked sender.
+func blocklist_check(cfg *Config, env *Envelope, hdr *Header) bool {
+	blocked, err := list_read(blocklist_path(cfg.Blocklist, env.Home))
+	if err != nil {
+		log_info("error reading blocklist: %s", err)
+		return false
+	}
+	addresses := hdr.Addresses("From")
+	if env.Sender != "" {
+		addresses = append(addresses, correspondent_address(env.Sender))
+	}
+	for _, address := range addresses {
+		if blocklist_match(blocked, address) {
+			return true
+		}
+	}
+	return false
+}
+
+// blocklist_edit adds or removes senders from the blocklist, for the
+// block and unblock subcommands.
+func blocklist_edit(name string, values []string, remove bool, comment string) int {
+	homedir := os.Getenv("HOME")
+	cfg, err := config_read(filepath.Join(homedir, ".pmda.conf"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading configuration: %s\n", err)
+		return 1
+	}
+	blocklist := cfg.Blocklist
+	if blocklist == nil {
+		fmt.Fprintf(os.Stderr, "Warning: blocklist is not enabled in %s, deliveries ignore the list\n", filepath.Join(homedir, ".pmda.conf"))
+		blocklist = blocklist_default()
+	}
+
+	entries := make([]string, 0, len(values))
+	for _, value := range values {
+		entry, err := block_entry(value)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			return 1
+		}
+		entries = append(entries, entry)
+	}
+	changed, err := list_edit(blocklist_path(blocklist, homedir), entries, remove, comment)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error updating blocklist: %s\n", err)
+		return 1
+	}
+	fmt.Printf("%d senders %s\n", changed, name)
+	return 0
+}
+
+var blockFlags = flag.NewFlagSet("block", flag.ExitOnError)
+var blockComment = blockFlags.String("comment", "", "comment recorded along with the senders")
+
+// block_main implements "mail.pmda block", which adds senders to the
+// blocklist, for MUAs to bind to a key. Senders already blocked are left
+// as they are.
+func block_main(args []string) int {
+	blockFlags.Parse(args)
+	if blockFlags.NArg() == 0 {
+		fmt.Fprintf(os.Stderr, "Usage: %s block [-comment text] address|domain ...\n", os.Args[0])
+		return 1
+	}
+	comment := *blockComment
+	if comment == "" {
+		comment = "blocked " + time.Now().Format("2006-01-02")
+	}
+	return blocklist_edit("blocked", blockFlags.Args(), false, comment)
+}
+
+var unblockFlags = flag.NewFlagSet("unblock", flag.ExitOnError)
+
+// unblock_main implements "mail.pmda unblock", which removes senders
+// from the blocklist.
+func unblock_main(args []string) int {
+	unblockFlags.Parse(args)
+	if unblockFlags.NArg() == 0 {
+		fmt.Fprintf(os.Stderr, "Usage: %s unblock address|domain ...\n", os.Args[0])
+		return 1
+	}
+	return blocklist_edit("unblocked", unblockFlags.Args(), true, "")
+}
@@ -0,0 +1,52 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"io"
+	"os"
+	"syscall"
+)
+
+const (
+	SPLICE_F_MOVE = 0x1
+	SPLICE_F_MORE = 0x4
+	SPLICE_CHUNK  = 1 << 20
+)
+
+// body_copy moves the body from the stdin pipe to the message file with
+// splice(2), so the data never crosses into userland. When stdin is not a
+// pipe the kernel refuses and we fall back to a regular copy.
+func body_copy(dst *os.File, src *os.File) (int64, error) {
+	written := int64(0)
+	for {
+		n, err := syscall.Splice(int(src.Fd()), nil, int(dst.Fd()), nil, SPLICE_CHUNK, SPLICE_F_MOVE|SPLICE_F_MORE)
+		if err == syscall.EINTR || err == syscall.EAGAIN {
+			continue
+		}
+		if err == syscall.EINVAL && written == 0 {
+			return io.Copy(dst, src)
+		}
+		if err != nil {
+			return written, err
+		}
+		if n == 0 {
+			return written, nil
+		}
+		written += n
+	}
+}
@@ -0,0 +1,134 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"bufio"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// only the start of a bounce is looked at for the original headers
+const BOUNCE_SCAN_MAX = 256 * 1024
+
+// bounce_message_ids returns the Message-IDs quoted in the body of a
+// bounce, which is where DSNs and most other bounces put the headers of
+// the message that failed.
+func bounce_message_ids(pathname string) []string {
+	file, err := os.Open(pathname)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+
+	ids := make([]string, 0)
+	inHeader := true
+	reader := bufio.NewReader(io.LimitReader(file, BOUNCE_SCAN_MAX))
+	for {
+		line, _, err := line_read(reader, LINE_READ_MAX)
+		if err != nil && (err != io.EOF || line == "") {
+			break
+		}
+		if inHeader {
+			inHeader = line != ""
+			continue
+		}
+		name, value, found := strings.Cut(line, ":")
+		if !found || !strings.EqualFold(strings.TrimSpace(name), "Message-ID") {
+			continue
+		}
+		if id := message_id(value); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// bounce_lookup returns the subject of a message the user sent, looking
+// in the sent index when correspondents are learnt and in the sent folder
+// otherwise.
+func bounce_lookup(cfg *Config, env *Envelope, maildir string, ids []string) (string, string, bool) {
+	if cfg.Correspondents != nil {
+		store, err := state_open(cfg, env.Home)
+		if err != nil {
+			log_info("error opening state: %s", err)
+			return "", "", false
+		}
+		defer store.Close()
+		correspondents_update(cfg, store, env.Home, maildir)
+		for _, id := range ids {
+			if subject, found, err := store.Get(SENT_NS, id); err == nil && found {
+				return id, subject, true
+			}
+		}
+		return "", "", false
+	}
+
+	wanted := make(map[string]bool)
+	for _, id := range ids {
+		wanted[id] = true
+	}
+	var id, subject string
+	for _, root := range maildir_roots(cfg, env.Home, maildir) {
+		for _, subdir := range []string{"cur", "new"} {
+			maildir_walk(filepath.Join(root, ".Sent", subdir), func(pathname string, entry fs.DirEntry) error {
+				file, err := os.Open(pathname)
+				if err != nil {
+					return nil
+				}
+				hdr, err := header_read(file)
+				file.Close()
+				if err != nil {
+					return nil
+				}
+				if sent := message_id(hdr.Get("Message-ID")); wanted[sent] {
+					id, subject = sent, header_oneline(hdr.Get("Subject"))
+					return errWalkStop
+				}
+				return nil
+			})
+			if id != "" {
+				return id, subject, true
+			}
+		}
+	}
+	return "", "", false
+}
+
+// bounce_annotate marks a bounce with the message of the user it is
+// about, if it can be found:
+//
+//	X-PMDA-Bounced-Message: <20240301.abcd@example.org> "Quarterly report"
+func bounce_annotate(cfg *Config, env *Envelope, maildir string, pathname string, fields *Header) {
+	ids := bounce_message_ids(pathname)
+	if len(ids) == 0 {
+		return
+	}
+	id, subject, found := bounce_lookup(cfg, env, maildir, ids)
+	if !found {
+		return
+	}
+	log_info("bounce of message %s", id)
+	value := id
+	if subject != "" {
+		value += " " + config_quote(subject)
+	}
+	fields.add_line("X-PMDA-Bounced-Message: " + value)
+}
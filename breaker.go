@@ -0,0 +1,112 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+const BREAKER_NS = "breaker"
+
+// BreakerConfig enables circuit breakers around external integrations:
+//
+//	breaker threshold 5 cooldown 5m
+//
+// After threshold consecutive failures an integration is skipped for the
+// cooldown, then tried again: one more failure opens the circuit again,
+// a success closes it. Every delivery being its own process, the state
+// lives in the local store, never in Redis which is guarded too.
+type BreakerConfig struct {
+	Threshold int64
+	Cooldown  time.Duration
+}
+
+func breaker_parse(args []string) (*BreakerConfig, error) {
+	breaker := &BreakerConfig{Threshold: 5, Cooldown: 5 * time.Minute}
+	if len(args)%2 != 0 {
+		return nil, fmt.Errorf("usage: breaker [threshold count] [cooldown duration]")
+	}
+	for i := 0; i < len(args); i += 2 {
+		switch args[i] {
+		case "threshold":
+			threshold, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil || threshold < 1 {
+				return nil, fmt.Errorf("invalid threshold: %s", args[i+1])
+			}
+			breaker.Threshold = threshold
+		case "cooldown":
+			cooldown, err := time.ParseDuration(args[i+1])
+			if err != nil || cooldown <= 0 {
+				return nil, fmt.Errorf("invalid duration: %s", args[i+1])
+			}
+			breaker.Cooldown = cooldown
+		default:
+			return nil, fmt.Errorf("unknown breaker option: %s", args[i])
+		}
+	}
+	return breaker, nil
+}
+
+func breaker_store(homedir string) *LocalStore {
+	return &LocalStore{directory: filepath.Join(homedir, ".pmda", "state")}
+}
+
+// breaker_allow reports whether an integration may be called, it always
+// may when no breaker is configured.
+func breaker_allow(cfg *Config, homedir string, name string) bool {
+	if cfg.Breaker == nil {
+		return true
+	}
+	store := breaker_store(homedir)
+	if _, open, _ := store.Get(BREAKER_NS, "open:"+name); open {
+		return false
+	}
+	value, _, _ := store.Get(BREAKER_NS, "failures:"+name)
+	if failures, _ := strconv.ParseInt(value, 10, 64); failures >= cfg.Breaker.Threshold {
+		log_info("circuit %s half-open, trying again", name)
+	}
+	return true
+}
+
+// breaker_result records the outcome of a call to an integration.
+func breaker_result(cfg *Config, homedir string, name string, err error) {
+	if cfg.Breaker == nil {
+		return
+	}
+	store := breaker_store(homedir)
+	if err == nil {
+		value, exists, _ := store.Get(BREAKER_NS, "failures:"+name)
+		if !exists {
+			return
+		}
+		if failures, _ := strconv.ParseInt(value, 10, 64); failures >= cfg.Breaker.Threshold {
+			log_info("circuit %s closed", name)
+		}
+		store.Delete(BREAKER_NS, "failures:"+name)
+		return
+	}
+
+	failures, ferr := store.Incr(BREAKER_NS, "failures:"+name, 0)
+	if ferr != nil || failures < cfg.Breaker.Threshold {
+		return
+	}
+	log_info("circuit %s open for %s after %d consecutive failures: %s", name, cfg.Breaker.Cooldown, failures, err)
+	store.Set(BREAKER_NS, "open:"+name, "1", cfg.Breaker.Cooldown)
+}
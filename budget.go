@@ -0,0 +1,119 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// Budget bounds the time spent classifying a message. Stages run against
+// the time left and the first one to run out of it degrades the delivery:
+// the remaining stages are skipped and the message goes to the inbox with
+// an X-PMDA-Degraded header, mail keeps flowing when a backend is slow.
+type Budget struct {
+	limit    time.Duration
+	deadline time.Time
+	Degraded string
+}
+
+// budget_start starts the clock, a zero limit never degrades.
+func budget_start(limit time.Duration) *Budget {
+	return &Budget{limit: limit, deadline: time.Now().Add(limit)}
+}
+
+// stage runs fn within the time left and reports whether it completed.
+// A stage running late is abandoned, not interrupted, so fn must only
+// publish its results through variables the caller reads on success.
+func (budget *Budget) stage(name string, fn func()) bool {
+	if budget.Degraded != "" {
+		return false
+	}
+	if budget.limit == 0 {
+		fn()
+		return true
+	}
+
+	remaining := time.Until(budget.deadline)
+	if remaining > 0 {
+		done := make(chan struct{})
+		go func() {
+			fn()
+			close(done)
+		}()
+		timer := time.NewTimer(remaining)
+		defer timer.Stop()
+		select {
+		case <-done:
+			return true
+		case <-timer.C:
+		}
+	}
+
+	budget.Degraded = fmt.Sprintf("%s stage exceeded the %s budget", name, budget.limit)
+	log_info("classification degraded: %s", budget.Degraded)
+	return false
+}
+
+// message_prepend adds header fields on top of the message written at
+// pathname, under the Return-Path field the delivery starts it with. The
+// message is copied, once per delivery with all the fields decided on
+// the way, while it is still in tmp/.
+func message_prepend(pathname string, fields *Header) error {
+	src, err := os.Open(pathname)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmpname := pathname + ".prepend"
+	dst, err := os.OpenFile(tmpname, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	// the fields end like the first line of the message
+	first := make([]byte, LINE_READ_MAX)
+	n, _ := io.ReadFull(src, first)
+	first = first[:n]
+	offset := 0
+	if bytes.HasPrefix(first, []byte("Return-Path:")) {
+		if end := bytes.IndexByte(first, '\n'); end != -1 && end+1 < len(first) && first[end+1] != ' ' && first[end+1] != '\t' {
+			offset = end + 1
+		}
+	}
+	_, err = dst.Write(first[:offset])
+	if err == nil {
+		fields.write(dst, line_ending(first))
+		_, err = src.Seek(int64(offset), io.SeekStart)
+	}
+	if err == nil {
+		_, err = io.Copy(dst, src)
+	}
+	if err == nil {
+		err = dst.Close()
+	} else {
+		dst.Close()
+	}
+	if err != nil {
+		os.Remove(tmpname)
+		return err
+	}
+	return os.Rename(tmpname, pathname)
+}
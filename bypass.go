@@ -0,0 +1,273 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const BYPASS_NS = "bypass"
+
+// BypassConfig lets trusted upstream filters force the delivery of a
+// message to the inbox, whatever the rules say, as password resets must
+// during an incident:
+//
+//	bypass key ".pmda/bypass.key" header "X-PMDA-Bypass" max-age 1d
+//
+// The field carries the time it was signed and an HMAC-SHA256 of that
+// time, of the Message-ID, of the envelope sender and recipient and of a
+// hash of the body, keyed with the content of the key file:
+//
+//	X-PMDA-Bypass: t=1709251200; s=5d41402abc4b2a76b9719d911017c592...
+//
+// Fields are stripped from every message, only those verified bypass
+// the rules, once. The bypass-sign subcommand computes one for a message.
+type BypassConfig struct {
+	Key    string
+	Header string
+	MaxAge time.Duration
+}
+
+func bypass_parse(args []string) (*BypassConfig, error) {
+	bypass := &BypassConfig{Header: "X-PMDA-Bypass", MaxAge: 24 * time.Hour}
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == "key" && i+1 < len(args):
+			bypass.Key = args[i+1]
+			i++
+		case args[i] == "header" && i+1 < len(args):
+			bypass.Header = args[i+1]
+			i++
+		case args[i] == "max-age" && i+1 < len(args):
+			age, err := config_duration(args[i+1])
+			if err != nil {
+				return nil, err
+			}
+			if age == 0 {
+				return nil, fmt.Errorf("invalid max-age: %s", args[i+1])
+			}
+			bypass.MaxAge = age
+			i++
+		default:
+			return nil, fmt.Errorf("usage: bypass key path [header name] [max-age duration]")
+		}
+	}
+	if bypass.Key == "" {
+		return nil, fmt.Errorf("usage: bypass key path [header name] [max-age duration]")
+	}
+	return bypass, nil
+}
+
+func bypass_key(bypass *BypassConfig, homedir string) ([]byte, error) {
+	key, err := os.ReadFile(backend_resolve(homedir, bypass.Key))
+	if err != nil {
+		return nil, err
+	}
+	key = bytes.TrimSpace(key)
+	if len(key) == 0 {
+		return nil, fmt.Errorf("empty key")
+	}
+	return key, nil
+}
+
+func bypass_mac(key []byte, signed int64, id string, sender string, recipient string, body string) string {
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%d\n%s\n%s\n%s\n%s", signed, id, strings.ToLower(sender), strings.ToLower(recipient), body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// bypass_body returns the hash of the body of a message, its line endings
+// turned into LF so that it holds whatever the MTA and the delivery do
+// with them.
+func bypass_body(r io.Reader) (string, error) {
+	reader := bufio.NewReader(r)
+	for {
+		line, _, err := line_read(reader, LINE_READ_MAX)
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		if line == "" || err == io.EOF {
+			break
+		}
+	}
+	hash := sha256.New()
+	lf := &LFWriter{w: hash}
+	if _, err := io.Copy(lf, reader); err != nil {
+		return "", err
+	}
+	lf.Close()
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// bypass_verify checks the bypass field of a message, an error telling
+// why it does not hold, and returns the time it was signed.
+func bypass_verify(key []byte, bypass *BypassConfig, field string, id string, env *Envelope, body string, now time.Time) (int64, error) {
+	if id == "" {
+		return 0, fmt.Errorf("no Message-ID")
+	}
+	var signed int64
+	var sig string
+	for _, param := range strings.Split(field, ";") {
+		name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+		switch name {
+		case "t":
+			signed, _ = strconv.ParseInt(value, 10, 64)
+		case "s":
+			sig = strings.ToLower(value)
+		}
+	}
+	if signed == 0 || sig == "" {
+		return 0, fmt.Errorf("malformed field")
+	}
+	if age := now.Sub(time.Unix(signed, 0)); age > bypass.MaxAge || age < -bypass.MaxAge {
+		return 0, fmt.Errorf("signed %s ago", age.Round(time.Second))
+	}
+	if !hmac.Equal([]byte(sig), []byte(bypass_mac(key, signed, id, env.Sender, env.Recipient, body))) {
+		return 0, fmt.Errorf("bad signature")
+	}
+	return signed, nil
+}
+
+// bypass_strip removes the bypass fields of a message, whether bypass is
+// enabled or not, and returns the value of the first one.
+func bypass_strip(cfg *Config, hdr *Header) string {
+	name := "X-PMDA-Bypass"
+	if cfg.Bypass != nil {
+		name = cfg.Bypass.Header
+	}
+	field := hdr.Get(name)
+	hdr.Del(name)
+	return field
+}
+
+// bypass_check verifies the bypass field stripped from a message with the
+// Message-ID it was received with, reporting whether it may skip the
+// rules. A field only bypasses once, the deliveries it was copied to
+// going through the rules.
+func bypass_check(cfg *Config, env *Envelope, field string, id string, pathname string) bool {
+	if cfg.Bypass == nil || field == "" {
+		return false
+	}
+	key, err := bypass_key(cfg.Bypass, env.Home)
+	if err != nil {
+		log_info("error reading bypass key: %s", err)
+		return false
+	}
+	file, err := os.Open(pathname)
+	if err != nil {
+		log_info("error reading message: %s", err)
+		return false
+	}
+	body, err := bypass_body(file)
+	file.Close()
+	if err != nil {
+		log_info("error reading message: %s", err)
+		return false
+	}
+	now := time.Now()
+	signed, err := bypass_verify(key, cfg.Bypass, field, id, env, body, now)
+	if err != nil {
+		log_info("invalid bypass field: %s", err)
+		return false
+	}
+	if !dryRun {
+		store, err := state_open(cfg, env.Home)
+		if err != nil {
+			log_info("error opening state, bypass refused: %s", err)
+			return false
+		}
+		defer store.Close()
+		ttl := max(time.Unix(signed, 0).Add(cfg.Bypass.MaxAge).Sub(now), time.Second)
+		fresh, err := store.SetNX(BYPASS_NS, field, "1", ttl)
+		if err != nil {
+			log_info("error recording bypass field, bypass refused: %s", err)
+			return false
+		}
+		if !fresh {
+			log_info("bypass field already used, rules applied")
+			return false
+		}
+	}
+	log_info("bypass field verified, rules skipped")
+	return true
+}
+
+var bypassSignFlags = flag.NewFlagSet("bypass-sign", flag.ExitOnError)
+var bypassSignSender = bypassSignFlags.String("sender", os.Getenv("SENDER"), "envelope sender of the message")
+var bypassSignRecipient = bypassSignFlags.String("recipient", os.Getenv("RECIPIENT"), "envelope recipient of the message")
+
+// bypass_sign_main implements "mail.pmda bypass-sign", which prints the
+// bypass field of the message read from stdin, for upstream filters to
+// prepend. The field only holds for the envelope it was signed with.
+func bypass_sign_main(args []string) int {
+	bypassSignFlags.Parse(args)
+	if *bypassSignRecipient == "" {
+		fmt.Fprintf(os.Stderr, "Usage: %s bypass-sign [-sender address] -recipient address\n", os.Args[0])
+		return 1
+	}
+
+	homedir := os.Getenv("HOME")
+	cfg, err := config_read(filepath.Join(homedir, ".pmda.conf"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading configuration: %s\n", err)
+		return 1
+	}
+	if cfg.Bypass == nil {
+		fmt.Fprintf(os.Stderr, "Error: bypass is not enabled in %s\n", filepath.Join(homedir, ".pmda.conf"))
+		return 1
+	}
+	key, err := bypass_key(cfg.Bypass, homedir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading bypass key: %s\n", err)
+		return 1
+	}
+	data, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading message: %s\n", err)
+		return 1
+	}
+	hdr, err := header_read(bytes.NewReader(data))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading message: %s\n", err)
+		return 1
+	}
+	id := message_id(hdr.Get("Message-ID"))
+	if id == "" {
+		fmt.Fprintf(os.Stderr, "Error: message has no Message-ID\n")
+		return 1
+	}
+	body, err := bypass_body(bytes.NewReader(data))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading message: %s\n", err)
+		return 1
+	}
+	signed := time.Now().Unix()
+	fmt.Printf("%s: t=%d; s=%s\n", cfg.Bypass.Header, signed, bypass_mac(key, signed, id, *bypassSignSender, *bypassSignRecipient, body))
+	return 0
+}
@@ -0,0 +1,165 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const CALENDAR_NS = "calendar"
+
+// invitations are forgotten a year after the last one seen
+const CALENDAR_TTL = 365 * 24 * time.Hour
+
+// Calendar describes the iCalendar object of a message. An invitation
+// already seen is Known, Folder being where it was filed, and it is an
+// update when its sequence is not older than that of the one seen.
+type Calendar struct {
+	Method   string
+	UID      string
+	Sequence int
+	Known    bool
+	Update   bool
+	Folder   string
+}
+
+var errCalendarFound = errors.New("calendar found")
+
+// calendar_parse reads the method, UID and sequence of the first event
+// of an iCalendar object, unfolding lines as it goes.
+func calendar_parse(r io.Reader, method string) *Calendar {
+	calendar := &Calendar{Method: strings.ToUpper(method)}
+	reader := bufio.NewReader(io.LimitReader(r, HEADER_READ_MAX))
+	inEvent := false
+	var line string
+	flush := func() bool {
+		name, value, found := strings.Cut(line, ":")
+		if !found {
+			return false
+		}
+		name, _, _ = strings.Cut(strings.ToUpper(name), ";")
+		switch {
+		case name == "METHOD" && !inEvent:
+			calendar.Method = strings.ToUpper(strings.TrimSpace(value))
+		case name == "BEGIN" && strings.EqualFold(value, "VEVENT"):
+			inEvent = true
+		case name == "END" && strings.EqualFold(value, "VEVENT"):
+			return true
+		case name == "UID" && inEvent:
+			calendar.UID = strings.TrimSpace(value)
+		case name == "SEQUENCE" && inEvent:
+			calendar.Sequence, _ = strconv.Atoi(strings.TrimSpace(value))
+		}
+		return false
+	}
+	for {
+		text, _, err := line_read(reader, LINE_READ_MAX)
+		if err != nil && (err != io.EOF || text == "") {
+			break
+		}
+		if text != "" && (text[0] == ' ' || text[0] == '\t') {
+			line += text[1:]
+			continue
+		}
+		if flush() {
+			break
+		}
+		line = text
+	}
+	if calendar.UID == "" {
+		flush()
+	}
+	if calendar.UID == "" {
+		return nil
+	}
+	return calendar
+}
+
+// calendar_detect looks for an iCalendar part in a stored message and
+// for the invitation it relates to.
+func calendar_detect(cfg *Config, env *Envelope, pathname string) *Calendar {
+	var calendar *Calendar
+	err := mime_walk_file(pathname, func(part *MimePart) error {
+		if part.MediaType != "text/calendar" {
+			return nil
+		}
+		if calendar = calendar_parse(part.Body, part.Params["method"]); calendar != nil {
+			return errCalendarFound
+		}
+		return nil
+	})
+	if err != nil && err != errCalendarFound {
+		log_info("error looking for calendar: %s", err)
+	}
+	if calendar == nil {
+		return nil
+	}
+
+	store, err := state_open(cfg, env.Home)
+	if err != nil {
+		log_info("error opening state: %s", err)
+		return calendar
+	}
+	defer store.Close()
+	value, known, err := store.Get(CALENDAR_NS, calendar.UID)
+	if err != nil || !known {
+		return calendar
+	}
+	sequence, folder, _ := strings.Cut(value, " ")
+	seen, _ := strconv.Atoi(sequence)
+	calendar.Known = true
+	calendar.Folder = folder
+	calendar.Update = calendar.Method == "CANCEL" || (calendar.Method == "REQUEST" && calendar.Sequence >= seen)
+	return calendar
+}
+
+// calendar_record remembers where an invitation was filed, updates keep
+// the folder of the original.
+func calendar_record(cfg *Config, env *Envelope, calendar *Calendar, folder string) {
+	if calendar.Method != "REQUEST" || (calendar.Known && !calendar.Update) {
+		return
+	}
+	store, err := state_open(cfg, env.Home)
+	if err != nil {
+		log_info("error opening state: %s", err)
+		return
+	}
+	defer store.Close()
+	if err := store.Set(CALENDAR_NS, calendar.UID, strconv.Itoa(calendar.Sequence)+" "+folder, CALENDAR_TTL); err != nil {
+		log_info("error recording invitation: %s", err)
+	}
+}
+
+// calendar_method is what the calendar condition matches a message
+// against, update standing for a request or cancellation to a known
+// invitation.
+func calendar_method(calendar *Calendar, method string) bool {
+	switch {
+	case calendar == nil:
+		return false
+	case method == "any":
+		return true
+	case method == "update":
+		return calendar.Update
+	}
+	return strings.EqualFold(calendar.Method, method)
+}
@@ -0,0 +1,132 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var chaosMode = flag.Bool("chaos", false, "inject the latency and failures of the chaos directives into external integrations")
+
+// the integrations faults can be injected into
+var chaosTargets = map[string]bool{
+	"classifier": true,
+	"dns":        true,
+	"publish":    true,
+	"redis":      true,
+}
+
+// ChaosConfig is a fault injected into an external integration, to see
+// breakers, deadlines and degraded deliveries at work before relying on
+// them:
+//
+//	chaos classifier latency 3s jitter 1s failure 20%
+//
+// Every call waits latency plus up to jitter, then fails with the given
+// probability. A wait past the timeout of the integration fails it as a
+// timeout would. Directives are ignored unless mail.pmda runs with -chaos,
+// a configuration left with them does no harm in production.
+type ChaosConfig struct {
+	Latency time.Duration
+	Jitter  time.Duration
+	Failure float64
+}
+
+// the faults in effect, only ever set with -chaos
+var chaosFaults map[string]*ChaosConfig
+
+func chaos_parse(args []string) (string, *ChaosConfig, error) {
+	if len(args) < 3 || len(args)%2 != 1 {
+		return "", nil, fmt.Errorf("usage: chaos integration [latency duration] [jitter duration] [failure percent]")
+	}
+	if !chaosTargets[args[0]] {
+		return "", nil, fmt.Errorf("unknown integration: %s", args[0])
+	}
+	chaos := &ChaosConfig{}
+	for i := 1; i < len(args); i += 2 {
+		switch args[i] {
+		case "latency", "jitter":
+			duration, err := time.ParseDuration(args[i+1])
+			if err != nil || duration < 0 {
+				return "", nil, fmt.Errorf("invalid duration: %s", args[i+1])
+			}
+			if args[i] == "latency" {
+				chaos.Latency = duration
+			} else {
+				chaos.Jitter = duration
+			}
+		case "failure":
+			percent, err := strconv.ParseFloat(strings.TrimSuffix(args[i+1], "%"), 64)
+			if err != nil || percent < 0 || percent > 100 {
+				return "", nil, fmt.Errorf("invalid failure rate: %s", args[i+1])
+			}
+			chaos.Failure = percent / 100
+		default:
+			return "", nil, fmt.Errorf("unknown chaos option: %s", args[i])
+		}
+	}
+	return args[0], chaos, nil
+}
+
+// chaos_enable puts the faults of a configuration in effect when running
+// with -chaos.
+func chaos_enable(cfg *Config) {
+	if !*chaosMode || len(cfg.Chaos) == 0 {
+		return
+	}
+	chaosFaults = cfg.Chaos
+	names := make([]string, 0, len(chaosFaults))
+	for name := range chaosFaults {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	log_info("chaos mode: injecting faults into %s", strings.Join(names, ", "))
+}
+
+// chaos_inject is called in front of every call to an integration, with
+// the timeout that call is given, and returns the failure to report in
+// place of calling it.
+func chaos_inject(name string, timeout time.Duration) error {
+	chaos := chaosFaults[name]
+	if chaos == nil {
+		return nil
+	}
+	delay := chaos.Latency
+	if chaos.Jitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(chaos.Jitter)))
+	}
+	if timeout > 0 && delay >= timeout {
+		time.Sleep(timeout)
+		log_info("chaos: %s timed out after %s", name, timeout)
+		return fmt.Errorf("injected timeout after %s", timeout)
+	}
+	time.Sleep(delay)
+	if chaos.Failure > 0 && rand.Float64() < chaos.Failure {
+		log_info("chaos: %s failed after %s", name, delay)
+		return fmt.Errorf("injected failure")
+	}
+	if delay > 0 {
+		log_info("chaos: %s delayed %s", name, delay)
+	}
+	return nil
+}
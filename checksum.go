@@ -0,0 +1,187 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// checksum_file returns the hex SHA-256 and size of a file.
+func checksum_file(pathname string) (string, int64, error) {
+	file, err := os.Open(pathname)
+	if err != nil {
+		return "", 0, err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), size, nil
+}
+
+// maildir_unique strips the info part of a maildir filename, what remains
+// identifies the message whatever its flags or its new/cur location.
+func maildir_unique(filename string) string {
+	if colon := strings.IndexByte(filename, ':'); colon != -1 {
+		return filename[:colon]
+	}
+	return filename
+}
+
+// checksum_record appends the checksum of a stored message to the index,
+// lines are short enough for O_APPEND writes not to interleave.
+func checksum_record(homedir string, pathname string) error {
+	sum, size, err := checksum_file(pathname)
+	if err != nil {
+		return err
+	}
+
+	index := filepath.Join(homedir, ".pmda", "checksums")
+	if err := os.MkdirAll(filepath.Dir(index), 0700); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(index, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = fmt.Fprintf(file, "%s %s %d\n", maildir_unique(filepath.Base(pathname)), sum, size)
+	return err
+}
+
+type checksumEntry struct {
+	sum  string
+	size int64
+}
+
+func checksum_index(homedir string) (map[string]checksumEntry, error) {
+	file, err := os.Open(filepath.Join(homedir, ".pmda", "checksums"))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	index := make(map[string]checksumEntry)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 {
+			continue
+		}
+		size, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			continue
+		}
+		index[fields[0]] = checksumEntry{sum: fields[1], size: size}
+	}
+	return index, scanner.Err()
+}
+
+var verifyFlags = flag.NewFlagSet("verify", flag.ExitOnError)
+var verifyQuarantine = verifyFlags.Bool("quarantine", false, "move corrupted messages to the .Quarantine folder")
+
+// verify_main implements "mail.pmda verify", which walks the maildir and
+// its folders looking for messages that no longer match their checksum.
+func verify_main(args []string) int {
+	verifyFlags.Parse(args)
+
+	homedir := os.Getenv("HOME")
+	maildir := maildir_resolve(config_load(filepath.Join(homedir, ".pmda.conf")), homedir)
+	if verifyFlags.NArg() == 1 {
+		maildir = verifyFlags.Arg(0)
+	} else if verifyFlags.NArg() > 1 {
+		fmt.Fprintf(os.Stderr, "Usage: %s verify [-quarantine] [maildir]\n", os.Args[0])
+		return 1
+	}
+
+	index, err := checksum_index(homedir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading checksums: %s\n", err)
+		return 1
+	}
+
+	verified, unknown, corrupted := 0, 0, 0
+	err = filepath.Walk(maildir, func(pathname string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && (info.Name() == "tmp" || info.Name() == ".Quarantine") {
+			return filepath.SkipDir
+		}
+		parent := filepath.Dir(pathname)
+		for shard_name(filepath.Base(parent)) {
+			parent = filepath.Dir(parent)
+		}
+		if !info.Mode().IsRegular() || (filepath.Base(parent) != "new" && filepath.Base(parent) != "cur") {
+			return nil
+		}
+
+		entry, exists := index[maildir_unique(info.Name())]
+		if !exists {
+			unknown++
+			return nil
+		}
+
+		sum, size, err := checksum_file(pathname)
+		if err != nil {
+			return err
+		}
+		if sum == entry.sum && size == entry.size {
+			verified++
+			return nil
+		}
+
+		corrupted++
+		if size < entry.size {
+			fmt.Printf("%s: truncated, %d bytes instead of %d\n", pathname, size, entry.size)
+		} else {
+			fmt.Printf("%s: checksum mismatch\n", pathname)
+		}
+		if *verifyQuarantine {
+			maildir_mkdirs(filepath.Join(maildir, ".Quarantine"))
+			target := filepath.Join(maildir, ".Quarantine", "cur", info.Name())
+			if err := os.Rename(pathname, target); err != nil {
+				return err
+			}
+			fmt.Printf("%s: moved to %s\n", pathname, target)
+		}
+		return nil
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error verifying %s: %s\n", maildir, err)
+		return 1
+	}
+
+	fmt.Printf("%d verified, %d corrupted, %d without checksum\n", verified, corrupted, unknown)
+	if corrupted != 0 {
+		return 2
+	}
+	return 0
+}
@@ -0,0 +1,223 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the classifier is given this long to answer by default
+const CLASSIFIER_TIMEOUT = 2 * time.Second
+
+// ClassifierConfig is an external classifier queried over HTTP:
+//
+//	classifier http "http://localhost:8080/classify" body 4k timeout 2s
+//
+// The headers, envelope and optionally the start of the body are POSTed
+// as JSON, the JSON object returned is what classifier conditions test.
+type ClassifierConfig struct {
+	URL     string
+	Body    int64
+	Timeout time.Duration
+}
+
+// ClassifierRequest is the document POSTed to the classifier.
+type ClassifierRequest struct {
+	Envelope *Envelope          `json:"envelope"`
+	Headers  []ClassifierHeader `json:"headers"`
+	Body     string             `json:"body,omitempty"`
+}
+
+type ClassifierHeader struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+func classifier_parse(args []string) (*ClassifierConfig, error) {
+	if len(args) < 2 || args[0] != "http" {
+		return nil, fmt.Errorf("usage: classifier http url [body size] [timeout duration]")
+	}
+	if !strings.HasPrefix(args[1], "http://") && !strings.HasPrefix(args[1], "https://") {
+		return nil, fmt.Errorf("invalid classifier url: %s", args[1])
+	}
+	classifier := &ClassifierConfig{URL: args[1], Timeout: CLASSIFIER_TIMEOUT}
+	for i := 2; i < len(args); i++ {
+		switch {
+		case args[i] == "body" && i+1 < len(args):
+			size, err := config_size(args[i+1])
+			if err != nil {
+				return nil, err
+			}
+			classifier.Body = size
+			i++
+		case args[i] == "timeout" && i+1 < len(args):
+			timeout, err := time.ParseDuration(args[i+1])
+			if err != nil || timeout <= 0 {
+				return nil, fmt.Errorf("invalid timeout: %s", args[i+1])
+			}
+			classifier.Timeout = timeout
+			i++
+		default:
+			return nil, fmt.Errorf("usage: classifier http url [body size] [timeout duration]")
+		}
+	}
+	return classifier, nil
+}
+
+// classifier_request builds the document for a stored message, the body
+// excerpt is cut at the configured size.
+func classifier_request(cfg *Config, env *Envelope, hdr *Header, pathname string) (*ClassifierRequest, error) {
+	request := &ClassifierRequest{Envelope: env, Headers: make([]ClassifierHeader, 0, len(hdr.Fields))}
+	for _, field := range hdr.Fields {
+		request.Headers = append(request.Headers, ClassifierHeader{Name: field.Name, Value: field.Value})
+	}
+	if cfg.Classifier.Body == 0 {
+		return request, nil
+	}
+
+	file, err := os.Open(pathname)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	for {
+		line, _, err := line_read(reader, LINE_READ_MAX)
+		if err != nil {
+			return request, nil
+		}
+		if line == "" {
+			break
+		}
+	}
+	body, err := io.ReadAll(io.LimitReader(reader, cfg.Classifier.Body))
+	if err != nil {
+		return nil, err
+	}
+	request.Body = strings.ToValidUTF8(string(body), "�")
+	return request, nil
+}
+
+// classifier_check queries the classifier about a message, a classifier
+// that fails or is unreachable classifies nothing.
+func classifier_check(cfg *Config, env *Envelope, hdr *Header, pathname string) map[string]any {
+	breaker := "classifier:" + cfg.Classifier.URL
+	if !breaker_allow(cfg, env.Home, breaker) {
+		return nil
+	}
+	request, err := classifier_request(cfg, env, hdr, pathname)
+	if err != nil {
+		log_info("error preparing classifier request: %s", err)
+		return nil
+	}
+	var result map[string]any
+	if err = chaos_inject("classifier", cfg.Classifier.Timeout); err == nil {
+		result, err = classifier_query(cfg.Classifier, request)
+	}
+	breaker_result(cfg, env.Home, breaker, err)
+	if err != nil {
+		log_info("error querying classifier %s: %s", cfg.Classifier.URL, err)
+		return nil
+	}
+	return result
+}
+
+// classifier_lookup follows a dotted path through the classifier result:
+//
+//	match classifier "labels.category" = "newsletter" folder ".Newsletters"
+func classifier_lookup(result map[string]any, field string) (any, bool) {
+	var value any = result
+	for _, name := range strings.Split(field, ".") {
+		object, ok := value.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		if value, ok = object[name]; !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// classifier operators, ~ matches a regexp and the ordered ones compare
+// numbers
+var classifierOperators = map[string]bool{
+	"=": true, "!=": true, "<": true, "<=": true, ">": true, ">=": true, "~": true,
+}
+
+func classifier_condition(args []string, negate bool) (*Condition, error) {
+	if len(args) < 3 || !classifierOperators[args[1]] {
+		return nil, fmt.Errorf("usage: classifier field =|!=|<|<=|>|>=|~ value")
+	}
+	cond := &Condition{Kind: "classifier", Name: args[0], Pattern: args[1], Value: args[2], Negate: negate}
+	switch args[1] {
+	case "~":
+		re, err := regexp.Compile("(?i)" + args[2])
+		if err != nil {
+			return nil, fmt.Errorf("bad regexp: %s", err)
+		}
+		cond.Regexp = re
+	case "<", "<=", ">", ">=":
+		if _, err := strconv.ParseFloat(args[2], 64); err != nil {
+			return nil, fmt.Errorf("invalid number: %s", args[2])
+		}
+	}
+	return cond, nil
+}
+
+// classifier_match evaluates a classifier condition, fields missing from
+// the result never match. Values are compared as their JSON text, so that
+// true, 3 and "spam" are all written as such in the configuration.
+func classifier_match(cond *Condition, result map[string]any) bool {
+	value, found := classifier_lookup(result, cond.Name)
+	if !found || value == nil {
+		return false
+	}
+	var text string
+	switch value := value.(type) {
+	case string:
+		text = value
+	case float64:
+		text = strconv.FormatFloat(value, 'f', -1, 64)
+	case bool:
+		text = strconv.FormatBool(value)
+	default:
+		return false
+	}
+
+	switch cond.Pattern {
+	case "=":
+		return text == cond.Value
+	case "!=":
+		return text != cond.Value
+	case "~":
+		return cond.Regexp.MatchString(text)
+	}
+	number, ok := value.(float64)
+	if !ok {
+		return false
+	}
+	threshold, _ := strconv.ParseFloat(cond.Value, 64)
+	return condition_compare(cond.Pattern, number, threshold)
+}
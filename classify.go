@@ -0,0 +1,183 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// The built-in classification, as classify rules. These are what mail
+// goes through when no rule or script decided otherwise, after the
+// classify rules of the configuration unless they are turned off:
+//
+//	classify header "List-Id" "debian" folder ".Lists.Debian"
+//	classify lists ".Lists"
+//	classify builtin off
+//
+// Built-in rules file to the folder of their category, see
+// special-folder. The lists mode files each list to a folder of its own, created when
+// the first message arrives, instead of all of them to .List.
+var classifyBuiltin = [][]string{
+	{"header", "Return-Path", "^<>$", "folder", ".Error"},
+	{"!", "header", "Return-Path", "", "folder", ".Error"},
+	{"header", "X-Spam", "^yes$", "!", "known-correspondent", "folder", ".Junk"},
+	{"header", "X-Spam-Flag", "^yes$", "!", "known-correspondent", "folder", ".Junk"},
+	{"header", "Precedence", "^list$", "folder", ".List"},
+	{"header", "List-Id", "", "folder", ".List"},
+	{"header", "Precedence", "^bulk$", "folder", ".Marketing"},
+	{"header", "Feedback-ID", "", "folder", ".Marketing"},
+	{"is-marketing", "folder", ".Marketing"},
+}
+
+var classifyBuiltinRules []*Rule
+
+func init() {
+	for _, args := range classifyBuiltin {
+		rule, err := rule_parse(args, 0)
+		if err != nil {
+			panic(fmt.Sprintf("built-in classify rule %v: %s", args, err))
+		}
+		classifyBuiltinRules = append(classifyBuiltinRules, rule)
+	}
+}
+
+// classify_parse handles a classify directive, a rule or the switch of
+// the built-in rules.
+func classify_parse(cfg *Config, args []string, lineno int) error {
+	if len(args) != 0 && args[0] == "lists" {
+		if len(args) > 2 {
+			return fmt.Errorf("usage: classify lists [prefix]")
+		}
+		rule, err := rule_parse(append([]string{"header", "List-Id", "", "file-by-list"}, args[1:]...), 0)
+		if err != nil {
+			return err
+		}
+		cfg.ClassifyLists = rule
+		return nil
+	}
+	if len(args) != 0 && args[0] == "builtin" {
+		if len(args) != 2 || (args[1] != "on" && args[1] != "off") {
+			return fmt.Errorf("usage: classify builtin on|off")
+		}
+		cfg.ClassifyBuiltin = args[1] == "on"
+		return nil
+	}
+	rule, err := rule_parse(args, lineno)
+	if err != nil {
+		return err
+	}
+	cfg.Classify = append(cfg.Classify, rule)
+	return nil
+}
+
+// classify_rules returns the classify rules in the order they apply.
+func classify_rules(cfg *Config) []*Rule {
+	if !cfg.ClassifyBuiltin {
+		return cfg.Classify
+	}
+	rules := append([]*Rule{}, cfg.Classify...)
+	if cfg.ClassifyLists != nil {
+		rules = append(rules, cfg.ClassifyLists)
+	}
+	return append(rules, classifyBuiltinRules...)
+}
+
+// classify_reason is the verdict of a classify rule, built-in rules
+// being known by their folder as they always were.
+func classify_reason(rule *Rule) string {
+	if rule.Line == 0 && rule.Action == "file-by-list" {
+		return "lists"
+	}
+	if rule.Line == 0 {
+		return strings.ToLower(strings.TrimPrefix(rule.Args[0], "."))
+	}
+	return fmt.Sprintf("classify at line %d", rule.Line)
+}
+
+// Decision is where a message goes and why, Rule and Trace being the
+// match rule that decided and the evaluation of the match rules. Auto
+// is set for folders to create on demand, those of lists. Reinject are
+// the addresses the message is re-injected to, Discard set when it is
+// not to be kept as well.
+type Decision struct {
+	Folder   string
+	Reason   string
+	Auto     bool
+	Reinject []string
+	Discard  bool
+	Rule     *Rule
+	Trace    []string
+}
+
+// Classify decides where a message goes from the facts the delivery
+// established about it beforehand. It does no I/O and depends on nothing
+// but its arguments, side effects of the decision are for the caller.
+func Classify(cfg *Config, msg *Message, now time.Time) Decision {
+	decision := Decision{Reason: "default"}
+	if msg.Violation != "" {
+		decision.Reason = "unclassified: " + msg.Violation
+		return decision
+	}
+	decision.Rule, decision.Trace = rules_evaluate(cfg.Rules, msg)
+
+	switch rule := decision.Rule; {
+	case msg.Bypass:
+		decision.Reason = "bypass"
+	case msg.Blocked:
+		decision.Folder, decision.Reason = cfg.Blocklist.Folder, "blocked"
+		if decision.Folder == "" {
+			decision.Folder = special_folder(cfg, "junk")
+		}
+	case cfg.RoleAccount:
+		decision.Folder, decision.Reason = role_folder(cfg, now), "role-account"
+	case rule != nil:
+		decision.Folder, decision.Reason = rule_folder(cfg, rule, msg.Header, now), fmt.Sprintf("rule at line %d", rule.Line)
+		decision.Auto = rule.Action == "file-by-list"
+		decision.Reinject = rule.Copies
+		if rule.Action == "redirect" {
+			decision.Reinject = append(append([]string{}, rule.Copies...), rule.Args...)
+			decision.Discard = true
+		}
+	case msg.Muted:
+		decision.Folder, decision.Reason = cfg.Mute.Folder, "muted"
+	case cfg.Calendar && msg.Calendar != nil && msg.Calendar.Update:
+		decision.Folder, decision.Reason = msg.Calendar.Folder, "calendar "+strings.ToLower(msg.Calendar.Method)
+	case msg.Report != nil:
+		decision.Folder, decision.Reason = msg.Report.Folder, msg.Report.Kind+" report"
+	case msg.Sieve != nil:
+		if len(msg.Sieve.Deliveries) != 0 {
+			decision.Folder = msg.Sieve.Deliveries[0].Folder
+		}
+		decision.Reason = "sieve"
+	default:
+		if classified := rules_match(classify_rules(cfg), msg); classified != nil {
+			decision.Folder, decision.Reason = rule_folder(cfg, classified, msg.Header, now), classify_reason(classified)
+			decision.Auto = classified.Action == "file-by-list"
+			if classified.Line == 0 && classified.Action == "folder" {
+				decision.Folder = special_folder(cfg, decision.Reason)
+			}
+		}
+	}
+
+	if score, scored := msg.Scores["importance"]; scored && decision.Folder == "" && decision.Reason == "default" &&
+		cfg.Importance.Folder != "" && score >= cfg.Importance.Threshold {
+		decision.Folder, decision.Reason = cfg.Importance.Folder, "importance"
+	}
+	return decision
+}
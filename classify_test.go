@@ -0,0 +1,165 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func classify_test_config(t *testing.T, config string) *Config {
+	t.Helper()
+	cfg, err := config_parse(strings.NewReader(config), "test.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func classify_test_message(t *testing.T, header string) *Message {
+	t.Helper()
+	hdr, err := header_read(strings.NewReader(header + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Message{Header: hdr, Envelope: &Envelope{Sender: "sender@example.org", Recipient: "user@example.org"}}
+}
+
+func TestClassify(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	plain := "Return-Path: <sender@example.org>\nFrom: sender@example.org\nSubject: hello\n"
+
+	tests := []struct {
+		name     string
+		config   string
+		header   string
+		facts    func(msg *Message)
+		folder   string
+		reason   string
+		auto     bool
+		reinject []string
+		discard  bool
+	}{
+		{name: "inbox", header: plain, reason: "default"},
+		{name: "bounce", header: "Return-Path: <>\n", folder: ".Error", reason: "error"},
+		{name: "no return path", header: "Subject: hello\n", folder: ".Error", reason: "error"},
+		{name: "list", header: plain + "List-Id: <tech.openbsd.org>\n", folder: ".List", reason: "list"},
+		{name: "bulk", header: plain + "Precedence: bulk\n", folder: ".Marketing", reason: "marketing"},
+		{name: "marketing", header: plain, facts: func(msg *Message) { msg.Marketing = true }, folder: ".Marketing", reason: "marketing"},
+		{name: "spam", header: plain + "X-Spam-Flag: YES\n", folder: ".Junk", reason: "junk"},
+		{name: "spam from a correspondent", header: plain + "X-Spam-Flag: YES\n",
+			facts: func(msg *Message) { msg.KnownCorrespondent = true }, reason: "default"},
+		{name: "junk renamed", config: "special-folder junk \".Spam\"\n", header: plain + "X-Spam: yes\n", folder: ".Spam", reason: "junk"},
+		{name: "marketing off", config: "special-folder marketing off\n", header: plain + "Precedence: bulk\n", reason: "marketing"},
+		{name: "builtin off", config: "classify builtin off\n", header: plain + "List-Id: <tech.openbsd.org>\n", reason: "default"},
+		{name: "lists", config: "classify lists\n", header: plain + "List-Id: \"OpenBSD tech\" <tech.openbsd.org>\n",
+			folder: ".Lists.tech", reason: "lists", auto: true},
+		{name: "classify rule", config: "classify header \"List-Id\" \"debian\" folder \".Lists.Debian\"\n",
+			header: plain + "List-Id: <debian-devel.lists.debian.org>\n", folder: ".Lists.Debian", reason: "classify at line 1"},
+		{name: "match rule", config: "match header \"Subject\" \"^invoice\" folder \".Invoices\"\n",
+			header: "Return-Path: <>\nSubject: invoice 42\n", folder: ".Invoices", reason: "rule at line 1"},
+		{name: "copy", config: "match all copy-to archive@example.org folder \".All\"\n", header: plain,
+			folder: ".All", reason: "rule at line 1", reinject: []string{"archive@example.org"}},
+		{name: "redirect", config: "match all redirect other@example.org\n", header: plain,
+			reason: "rule at line 1", reinject: []string{"other@example.org"}, discard: true},
+		{name: "file by date", config: "match all file-by-date\n", header: plain + "Date: Tue, 13 Feb 2024 10:00:00 +0000\n",
+			folder: ".Archive.2024.02", reason: "rule at line 1"},
+		{name: "role account", config: "role-account\n", header: plain, folder: ".2024-03-01", reason: "role-account"},
+		{name: "bypass", config: "match all folder \".All\"\n", header: plain,
+			facts: func(msg *Message) { msg.Bypass = true }, reason: "bypass"},
+		{name: "blocked", config: "blocklist\n", header: plain, facts: func(msg *Message) { msg.Blocked = true }, folder: ".Junk", reason: "blocked"},
+		{name: "blocked to a folder", config: "blocklist folder \".Blocked\"\n", header: plain,
+			facts: func(msg *Message) { msg.Blocked = true }, folder: ".Blocked", reason: "blocked"},
+		{name: "violation", config: "match all folder \".All\"\n", header: plain,
+			facts: func(msg *Message) { msg.Violation = "more than 10 header fields" }, reason: "unclassified: more than 10 header fields"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := classify_test_config(t, test.config)
+			cfg.Timezone = time.UTC
+			msg := classify_test_message(t, test.header)
+			if test.facts != nil {
+				test.facts(msg)
+			}
+			decision := Classify(cfg, msg, now)
+			if decision.Folder != test.folder || decision.Reason != test.reason {
+				t.Errorf("got folder %q reason %q, expected folder %q reason %q", decision.Folder, decision.Reason, test.folder, test.reason)
+			}
+			if decision.Auto != test.auto || decision.Discard != test.discard {
+				t.Errorf("got auto %v discard %v, expected auto %v discard %v", decision.Auto, decision.Discard, test.auto, test.discard)
+			}
+			if len(decision.Reinject) != 0 || len(test.reinject) != 0 {
+				if !reflect.DeepEqual(decision.Reinject, test.reinject) {
+					t.Errorf("got reinject %v, expected %v", decision.Reinject, test.reinject)
+				}
+			}
+		})
+	}
+}
+
+// TestClassifyFlags checks that -special-folder reaches the decision
+// through the configuration only.
+func TestClassifyFlags(t *testing.T) {
+	specialFolderFlags["junk"] = ".Flagged"
+	defer delete(specialFolderFlags, "junk")
+
+	cfg := classify_test_config(t, "")
+	msg := classify_test_message(t, "Return-Path: <sender@example.org>\nX-Spam: yes\n")
+	now := time.Now()
+	if decision := Classify(cfg, msg, now); decision.Folder != ".Junk" {
+		t.Errorf("flag applied without the configuration: %q", decision.Folder)
+	}
+	special_folder_flags(cfg)
+	if decision := Classify(cfg, msg, now); decision.Folder != ".Flagged" {
+		t.Errorf("flag not applied through the configuration: %q", decision.Folder)
+	}
+}
+
+// TestSpecialFolderCheck checks that a folder cannot leave the maildir.
+func TestSpecialFolderCheck(t *testing.T) {
+	for _, folder := range []string{".Junk", ".Lists.Debian", "off"} {
+		if err := special_folder_check("junk", folder); err != nil {
+			t.Errorf("%q refused: %s", folder, err)
+		}
+	}
+	for _, folder := range []string{"", ".", "..", "...", ".a..b", ".Junk.", "Junk", ".a/b", ".a\x01"} {
+		if err := special_folder_check("junk", folder); err == nil {
+			t.Errorf("%q accepted", folder)
+		}
+	}
+}
+
+// TestRuleFolderCheck checks that rules cannot file outside the maildir,
+// as written or once expanded.
+func TestRuleFolderCheck(t *testing.T) {
+	for _, config := range []string{
+		"match all folder \"..\"\n",
+		"match all folder \".a/../..\"\n",
+		"match all file-by-date \".Archive..\"\n",
+		"classify lists \"..\"\n",
+	} {
+		if _, err := config_parse(strings.NewReader(config), "test.conf"); err == nil {
+			t.Errorf("%q accepted", config)
+		}
+	}
+	rule := &Rule{Action: "folder", Args: []string{"../.."}}
+	if folder := rule_folder(classify_test_config(t, ""), rule, &Header{}, time.Now()); folder != "" {
+		t.Errorf("expanded to %q", folder)
+	}
+}
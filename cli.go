@@ -0,0 +1,279 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+)
+
+// Command is a subcommand, dispatched on the first argument. The flag set
+// is what completions and the CLI description are generated from, so it
+// must hold every flag the subcommand accepts.
+type Command struct {
+	Name     string
+	Synopsis string
+	Args     string
+	Values   []string
+	Flags    *flag.FlagSet
+	Main     func(args []string) int
+}
+
+var commands []*Command
+
+var describeCli = flag.Bool("describe-cli-json", false, "describe subcommands and flags as JSON")
+
+var completionFlags = flag.NewFlagSet("completion", flag.ExitOnError)
+
+// command_register adds a subcommand, optional subsystems register theirs
+// from an init() in the file guarded by their build tag.
+func command_register(command *Command) {
+	commands = append(commands, command)
+}
+
+// registered from init() as completion_main refers back to the list.
+func init() {
+	commands = append(commands, []*Command{
+		{Name: "verify", Synopsis: "check stored messages against their checksum", Args: "[maildir]",
+			Flags: verifyFlags, Main: verify_main},
+		{Name: "attachments", Synopsis: "find the largest attachments delivered, to prune them",
+			Flags: attachmentsFlags, Main: attachments_main},
+		{Name: "table", Synopsis: "run as an OpenSMTPD proc-exec table",
+			Flags: tableFlags, Main: table_main},
+		{Name: "init", Synopsis: "set up the maildir and configuration of an account",
+			Flags: initFlags, Main: init_main},
+		{Name: "learn-sent", Synopsis: "learn known correspondents from sent mail",
+			Flags: learnSentFlags, Main: learn_sent_main},
+		{Name: "learn-outgoing", Synopsis: "learn known correspondents from messages being sent", Args: "[message ...]",
+			Flags: learnOutgoingFlags, Main: learn_outgoing_main},
+		{Name: "sent", Synopsis: "pass a message on to sendmail, keeping a copy in the sent folder", Args: "[-- sendmail arguments]",
+			Flags: sentFlags, Main: sent_main},
+		{Name: "expire", Synopsis: "expire role account folders and junk", Args: "[maildir]",
+			Flags: expireFlags, Main: expire_main},
+		{Name: "purge", Synopsis: "delete for good the messages kept in the trash past their retention",
+			Flags: purgeFlags, Main: purge_main},
+		{Name: "restore", Synopsis: "list the messages kept in the trash, or move them back", Args: "[message ...]",
+			Flags: restoreFlags, Main: restore_main},
+		{Name: "layout", Synopsis: "convert a maildir between the plain and sharded layouts", Args: "maildir|sharded [maildir]",
+			Values: []string{"maildir", "sharded"}, Flags: layoutFlags, Main: layout_main},
+		{Name: "reports", Synopsis: "summarize the postmaster reports received", Args: "dmarc|tls",
+			Values: []string{"dmarc", "tls"}, Flags: reportsFlags, Main: reports_main},
+		{Name: "mute", Synopsis: "mute threads, filing their future messages away", Args: "message-id|message ...",
+			Flags: muteFlags, Main: mute_main},
+		{Name: "block", Synopsis: "add senders to the blocklist", Args: "address|domain ...",
+			Flags: blockFlags, Main: block_main},
+		{Name: "unblock", Synopsis: "remove senders from the blocklist", Args: "address|domain ...",
+			Flags: unblockFlags, Main: unblock_main},
+		{Name: "bypass-sign", Synopsis: "print the bypass field of a message, for upstream filters",
+			Flags: bypassSignFlags, Main: bypass_sign_main},
+		{Name: "update-domains", Synopsis: "refresh the freemail and disposable domain lists",
+			Flags: updateDomainsFlags, Main: update_domains_main},
+		{Name: "reclassify", Synopsis: "run the current rules over delivered messages", Args: "[maildir]",
+			Flags: reclassifyFlags, Main: reclassify_main},
+		{Name: "junk", Synopsis: "report messages as spam, moving them to .Junk and training the filter", Args: "message ...",
+			Flags: junkFlags, Main: junk_main},
+		{Name: "train", Synopsis: "build the vocabulary of a local model from the maildir", Args: "vocabulary [maildir]",
+			Flags: trainFlags, Main: train_main},
+		{Name: "replay", Synopsis: "deliver again messages of an archive lost from the maildir", Args: "archive",
+			Flags: replayFlags, Main: replay_main},
+		{Name: "migrate", Synopsis: "move messages left behind by a change of maildir or layout",
+			Flags: migrateFlags, Main: migrate_main},
+		{Name: "drain", Synopsis: "move messages spooled in fallbacks back to the maildir",
+			Flags: drainFlags, Main: drain_main},
+		{Name: "hold", Synopsis: "hold deliveries for maintenance, or lift the hold", Args: "on|off|status",
+			Values: []string{"on", "off", "status"}, Flags: holdFlags, Main: hold_main},
+		{Name: "tail", Synopsis: "follow deliveries as they happen",
+			Flags: tailFlags, Main: tail_main},
+		{Name: "stats", Synopsis: "report resources used by deliveries",
+			Flags: statsFlags, Main: stats_main},
+		{Name: "upgrade", Synopsis: "replace the binary by the newest signed release, or roll back", Args: "[rollback]",
+			Values: []string{"rollback"}, Flags: upgradeFlags, Main: upgrade_main},
+		{Name: "cluster", Synopsis: "sync the configuration shared by a fleet, or report the one in use", Args: "sync|status",
+			Values: []string{"sync", "status"}, Flags: clusterFlags, Main: cluster_main},
+		{Name: "version", Synopsis: "print version and build information",
+			Flags: versionFlags, Main: version_main},
+		{Name: "completion", Synopsis: "print a shell completion script", Args: "bash|zsh|fish",
+			Values: []string{"bash", "zsh", "fish"}, Flags: completionFlags, Main: completion_main},
+	}...)
+}
+
+func command_lookup(name string) *Command {
+	for _, command := range commands {
+		if command.Name == name {
+			return command
+		}
+	}
+	return nil
+}
+
+type flagDescription struct {
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	Default string `json:"default"`
+	Usage   string `json:"usage"`
+}
+
+type commandDescription struct {
+	Name     string               `json:"name"`
+	Synopsis string               `json:"synopsis,omitempty"`
+	Args     string               `json:"args,omitempty"`
+	Values   []string             `json:"values,omitempty"`
+	Flags    []flagDescription    `json:"flags"`
+	Commands []commandDescription `json:"commands,omitempty"`
+}
+
+// flag_type names the type of a flag value, booleans take no argument.
+func flag_type(f *flag.Flag) string {
+	if getter, ok := f.Value.(flag.Getter); ok {
+		if value := getter.Get(); value != nil {
+			return reflect.TypeOf(value).String()
+		}
+	}
+	return "string"
+}
+
+func flag_is_bool(f *flag.Flag) bool {
+	boolean, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && boolean.IsBoolFlag()
+}
+
+func flags_describe(flags *flag.FlagSet) []flagDescription {
+	descriptions := make([]flagDescription, 0)
+	flags.VisitAll(func(f *flag.Flag) {
+		descriptions = append(descriptions, flagDescription{
+			Name:    f.Name,
+			Type:    flag_type(f),
+			Default: f.DefValue,
+			Usage:   f.Usage,
+		})
+	})
+	return descriptions
+}
+
+// describe_main prints the command line interface as JSON, for wrappers
+// and configuration management tools.
+func describe_main() int {
+	description := commandDescription{
+		Name:  "mail.pmda",
+		Args:  "[maildir]",
+		Flags: flags_describe(flag.CommandLine),
+	}
+	for _, command := range commands {
+		description.Commands = append(description.Commands, commandDescription{
+			Name:     command.Name,
+			Synopsis: command.Synopsis,
+			Args:     command.Args,
+			Values:   command.Values,
+			Flags:    flags_describe(command.Flags),
+		})
+	}
+
+	data, err := json.MarshalIndent(description, "", "  ")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error describing CLI: %s\n", err)
+		return 1
+	}
+	fmt.Printf("%s\n", data)
+	return 0
+}
+
+// completion_words lists what may follow a subcommand: its flags, then
+// its fixed positional values if any.
+func completion_words(command *Command) []string {
+	words := make([]string, 0)
+	command.Flags.VisitAll(func(f *flag.Flag) {
+		words = append(words, "-"+f.Name)
+	})
+	return append(words, command.Values...)
+}
+
+func completion_main(args []string) int {
+	completionFlags.Parse(args)
+	if completionFlags.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "Usage: %s completion bash|zsh|fish\n", os.Args[0])
+		return 1
+	}
+
+	names := make([]string, 0)
+	for _, command := range commands {
+		names = append(names, command.Name)
+	}
+
+	switch completionFlags.Arg(0) {
+	case "bash":
+		fmt.Printf("_mail_pmda() {\n")
+		fmt.Printf("\tlocal cur=${COMP_WORDS[COMP_CWORD]}\n")
+		fmt.Printf("\tif [ $COMP_CWORD -eq 1 ]; then\n")
+		fmt.Printf("\t\tCOMPREPLY=($(compgen -W \"%s -describe-cli-json\" -- \"$cur\"))\n", strings.Join(names, " "))
+		fmt.Printf("\t\treturn\n")
+		fmt.Printf("\tfi\n")
+		fmt.Printf("\tcase ${COMP_WORDS[1]} in\n")
+		for _, command := range commands {
+			fmt.Printf("\t%s) COMPREPLY=($(compgen -W \"%s\" -- \"$cur\")) ;;\n", command.Name, strings.Join(completion_words(command), " "))
+		}
+		fmt.Printf("\tesac\n")
+		fmt.Printf("}\n")
+		fmt.Printf("complete -o default -F _mail_pmda mail.pmda\n")
+
+	case "zsh":
+		fmt.Printf("#compdef mail.pmda\n")
+		fmt.Printf("_mail_pmda() {\n")
+		fmt.Printf("\tif (( CURRENT == 2 )); then\n")
+		fmt.Printf("\t\tcompadd -- %s -describe-cli-json\n", strings.Join(names, " "))
+		fmt.Printf("\t\t_files -/\n")
+		fmt.Printf("\t\treturn\n")
+		fmt.Printf("\tfi\n")
+		fmt.Printf("\tcase $words[2] in\n")
+		for _, command := range commands {
+			fmt.Printf("\t%s) compadd -- %s; _files ;;\n", command.Name, strings.Join(completion_words(command), " "))
+		}
+		fmt.Printf("\tesac\n")
+		fmt.Printf("}\n")
+		fmt.Printf("compdef _mail_pmda mail.pmda\n")
+
+	case "fish":
+		fmt.Printf("complete -c mail.pmda -n __fish_use_subcommand -o describe-cli-json -d %s\n",
+			completion_fish_quote(flag.Lookup("describe-cli-json").Usage))
+		for _, command := range commands {
+			fmt.Printf("complete -c mail.pmda -n __fish_use_subcommand -f -a %s -d %s\n",
+				command.Name, completion_fish_quote(command.Synopsis))
+			condition := completion_fish_quote("__fish_seen_subcommand_from " + command.Name)
+			command.Flags.VisitAll(func(f *flag.Flag) {
+				option := ""
+				if !flag_is_bool(f) {
+					option = " -r"
+				}
+				fmt.Printf("complete -c mail.pmda -n %s -o %s%s -d %s\n", condition, f.Name, option, completion_fish_quote(f.Usage))
+			})
+			if len(command.Values) != 0 {
+				fmt.Printf("complete -c mail.pmda -n %s -f -a %s\n", condition, completion_fish_quote(strings.Join(command.Values, " ")))
+			}
+		}
+
+	default:
+		fmt.Fprintf(os.Stderr, "unsupported shell: %s\n", completionFlags.Arg(0))
+		return 1
+	}
+	return 0
+}
+
+func completion_fish_quote(value string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(value) + "'"
+}
@@ -0,0 +1,266 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// a shared configuration larger than this is not one
+const CLUSTER_CONFIG_MAX = 1024 * 1024
+
+// the first line of a cached configuration, holding its signature
+const CLUSTER_SIGNATURE = "# signature "
+
+// ClusterConfig is the configuration shared by the hosts of a fleet,
+// merged where the directive stands in the system configuration so that
+// the directives following it are the overrides of the node:
+//
+//	cluster source "https://config.example.org/mail.pmda.conf" key "/etc/mail.pmda.pub"
+//	host "mx2.*" quota 2g
+//
+// A source fetched over HTTPS comes with an Ed25519 signature of its
+// bytes at the same URL with .sig appended, as upgrade manifests do, and
+// is kept in the cache by "mail.pmda cluster sync" run from cron, for
+// deliveries never to wait on the network. A source that is a file
+// synced by other means is read in place, signed alongside if a key is
+// given. Node names the host in host directives, the hostname unless
+// set.
+type ClusterConfig struct {
+	Source string
+	Key    string
+	Cache  string
+	Node   string
+}
+
+func cluster_parse(args []string) (*ClusterConfig, error) {
+	if len(args) < 2 || len(args)%2 != 0 || args[0] != "source" {
+		return nil, fmt.Errorf("usage: cluster source url|path [key path] [cache path] [node name]")
+	}
+	cluster := &ClusterConfig{Source: args[1], Cache: "/var/cache/mail.pmda/cluster.conf"}
+	for i := 2; i < len(args); i += 2 {
+		switch args[i] {
+		case "key":
+			cluster.Key = args[i+1]
+		case "cache":
+			cluster.Cache = args[i+1]
+		case "node":
+			cluster.Node = strings.ToLower(args[i+1])
+		default:
+			return nil, fmt.Errorf("usage: cluster source url|path [key path] [cache path] [node name]")
+		}
+	}
+	if cluster_remote(cluster) {
+		if !strings.HasPrefix(cluster.Source, "https://") {
+			return nil, fmt.Errorf("invalid source, HTTPS is required: %s", cluster.Source)
+		}
+		if cluster.Key == "" {
+			return nil, fmt.Errorf("a key is required to fetch %s", cluster.Source)
+		}
+	} else if !filepath.IsAbs(cluster.Source) {
+		return nil, fmt.Errorf("invalid source: %s", cluster.Source)
+	}
+	return cluster, nil
+}
+
+func cluster_remote(cluster *ClusterConfig) bool {
+	return strings.Contains(cluster.Source, "://")
+}
+
+// cluster_file is where the shared configuration is read from.
+func cluster_file(cluster *ClusterConfig) string {
+	if cluster_remote(cluster) {
+		return cluster.Cache
+	}
+	return cluster.Source
+}
+
+// cluster_read returns the shared configuration once its signature
+// checked, from the cache or the synced file.
+func cluster_read(cluster *ClusterConfig) ([]byte, error) {
+	pathname := cluster_file(cluster)
+	data, err := os.ReadFile(pathname)
+	if os.IsNotExist(err) && cluster_remote(cluster) {
+		return nil, fmt.Errorf("%s: not synced yet, run mail.pmda cluster sync", pathname)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if cluster.Key == "" {
+		return data, nil
+	}
+
+	var sig []byte
+	if cluster_remote(cluster) {
+		line, rest, _ := bytes.Cut(data, []byte("\n"))
+		value, found := bytes.CutPrefix(line, []byte(CLUSTER_SIGNATURE))
+		if !found {
+			return nil, fmt.Errorf("%s: not signed", pathname)
+		}
+		sig, data = value, rest
+	} else if sig, err = os.ReadFile(pathname + ".sig"); err != nil {
+		return nil, err
+	}
+	if err := signature_verify(cluster.Key, data, sig); err != nil {
+		return nil, fmt.Errorf("%s: %s", pathname, err)
+	}
+	return data, nil
+}
+
+// cluster_node returns the name of the host in host directives.
+func cluster_node(cfg *Config) string {
+	if cfg.Cluster != nil && cfg.Cluster.Node != "" {
+		return cfg.Cluster.Node
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(hostname)
+}
+
+// config_host reports whether a host directive applies to this node.
+func config_host(cfg *Config, pattern string) bool {
+	matched, _ := path.Match(strings.ToLower(pattern), cluster_node(cfg))
+	return matched
+}
+
+// cluster_system returns the cluster directive of the system
+// configuration, read without merging the shared configuration it
+// points to, nil if there is none.
+func cluster_system() (*ClusterConfig, error) {
+	file, err := os.Open(systemConfig)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		tokens, err := config_tokenize(scanner.Text())
+		if err != nil || len(tokens) == 0 || tokens[0] != "cluster" {
+			continue
+		}
+		cluster, err := cluster_parse(tokens[1:])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", systemConfig, lineno, err)
+		}
+		return cluster, nil
+	}
+	return nil, scanner.Err()
+}
+
+// cluster_sync fetches the shared configuration and replaces the cache
+// with it, its signature on the first line, if it changed. A configuration that does
+// not parse is refused rather than left to fail deliveries.
+func cluster_sync(cluster *ClusterConfig) (bool, error) {
+	var data, sig bytes.Buffer
+	if err := upgrade_fetch(cluster.Source, &data, CLUSTER_CONFIG_MAX); err != nil {
+		return false, err
+	}
+	if err := upgrade_fetch(cluster.Source+".sig", &sig, CLUSTER_CONFIG_MAX); err != nil {
+		return false, err
+	}
+	if err := signature_verify(cluster.Key, data.Bytes(), sig.Bytes()); err != nil {
+		return false, fmt.Errorf("%s: %s", cluster.Source, err)
+	}
+	if _, err := config_parse(bytes.NewReader(data.Bytes()), cluster.Source); err != nil {
+		return false, err
+	}
+
+	cached := append([]byte(CLUSTER_SIGNATURE+strings.TrimSpace(sig.String())+"\n"), data.Bytes()...)
+	if current, err := os.ReadFile(cluster.Cache); err == nil && bytes.Equal(current, cached) {
+		return false, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(cluster.Cache), 0755); err != nil {
+		return false, err
+	}
+	tmpname := fmt.Sprintf("%s.%d", cluster.Cache, os.Getpid())
+	if err := os.WriteFile(tmpname, cached, 0644); err != nil {
+		os.Remove(tmpname)
+		return false, err
+	}
+	if err := os.Rename(tmpname, cluster.Cache); err != nil {
+		os.Remove(tmpname)
+		return false, err
+	}
+	return true, nil
+}
+
+var clusterFlags = flag.NewFlagSet("cluster", flag.ExitOnError)
+
+// cluster_main implements "mail.pmda cluster", which refreshes the cache
+// of the shared configuration, or reports which one this node runs with
+// for fleets to be compared:
+//
+//	node:    mx1.example.org
+//	source:  https://config.example.org/mail.pmda.conf
+//	sha256:  6f1ed002ab5595859014ebf0951522d9...
+//	synced:  2024-03-01 04:00:12
+func cluster_main(args []string) int {
+	clusterFlags.Parse(args)
+	if clusterFlags.NArg() != 1 || (clusterFlags.Arg(0) != "sync" && clusterFlags.Arg(0) != "status") {
+		fmt.Fprintf(os.Stderr, "Usage: %s cluster sync|status\n", os.Args[0])
+		return 1
+	}
+	cluster, err := cluster_system()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading configuration: %s\n", err)
+		return 1
+	}
+	if cluster == nil {
+		fmt.Fprintf(os.Stderr, "Error: no cluster in %s\n", systemConfig)
+		return 1
+	}
+
+	if clusterFlags.Arg(0) == "sync" && cluster_remote(cluster) {
+		updated, err := cluster_sync(cluster)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error syncing cluster configuration: %s\n", err)
+			return 1
+		}
+		if updated {
+			log_info("cluster configuration updated from %s", cluster.Source)
+		}
+	}
+
+	data, err := cluster_read(cluster)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading cluster configuration: %s\n", err)
+		return 1
+	}
+	sum := sha256.Sum256(data)
+	fmt.Printf("node:    %s\n", cluster_node(&Config{Cluster: cluster}))
+	fmt.Printf("source:  %s\n", cluster.Source)
+	fmt.Printf("sha256:  %s\n", hex.EncodeToString(sum[:]))
+	if st, err := os.Stat(cluster_file(cluster)); err == nil {
+		fmt.Printf("synced:  %s\n", st.ModTime().Format("2006-01-02 15:04:05"))
+	}
+	return 0
+}
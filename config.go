@@ -0,0 +1,978 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds the per-user settings read from the configuration file.
+//
+// The file is line oriented, one directive per line, with shell-like
+// quoting and '#' comments:
+//
+//	maildir "Maildir"
+//	fallback "/var/spool/pmda/alice"
+//	migrate from "Maildir.old"
+//	recipient "*@work.example.org"
+//	layout sharded depth 1
+//	notify sender
+//	folder ".Lists.golang-nuts" color "#00add8" comment "Go mailing list"
+//	folder ".Lists.golang-nuts" deliver cur flags "S"
+//	folder ".Priority" notify on
+//	timezone "Europe/Paris"
+//	match all file-by-date ".Archive"
+//	repair message-id
+//	repair date
+//	role-account retention 90
+//	expire junk probation 14 trash 30
+//	postgresql "host=db.example.org dbname=mail" table messages
+//	publish nats "nats://localhost:4222" subject "mail.{user}.{folder}"
+//	state redis "rediss://redis.example.org:6379/2" fallback local
+//	buffer-size 256k
+//	overflow 100000
+//	quota 1g 100000
+//	checksums
+//	attachments index
+//	xattr
+//	provenance
+//	limit cpu 2s
+//	limit size 50m
+//	limit exec 30s
+//	limit headers 1000
+//	line-endings lf
+//	limit mime-depth 10
+//	limit action unclassified
+//	budget 2s
+//	breaker threshold 5 cooldown 5m
+//	chaos classifier latency 3s jitter 1s failure 20%
+//	reports dmarc ".Reports.DMARC"
+//	reports tls
+//	calendar
+//	dedup ttl 7d
+//	hold file "/var/run/mail.pmda.hold"
+//	upgrade manifest "https://example.org/manifest.json" key "/etc/mail.pmda.pub"
+//	mute folder ".Archive"
+//	extensions create depth 2
+//	autofolders expire 6 archive ".Archive"
+//	vacation days 7 address "me@example.org"
+//	forward off
+//	blocklist folder ".Junk"
+//	bypass key ".pmda/bypass.key"
+//	domains freemail "https://example.org/freemail.txt"
+//	trainer junk "rspamc learn_spam"
+//	filter "bogofilter -p -e" timeout 10s on-error pass
+//	importance threshold 50 folder ".Priority" tag
+//	marketing threshold 60 weight html 30
+//	model spam "models/spam.onnx" vocabulary "models/spam.vocab"
+//	classifier http "http://localhost:8080/classify" body 4k timeout 2s
+//	smime anchors ".pmda/smime.pem"
+//	pgp keyring ".gnupg"
+//	encrypted scan off
+//	correspondents sent ".Sent" list "contacts.txt"
+//	classify header "List-Id" "debian" folder ".Lists.Debian"
+//	classify lists ".Lists"
+//	special-folder junk ".Spam"
+//	authentication-results authserv-id "mx.example.org"
+//	syslog on
+//	events file ".pmda/events.json"
+//	metrics textfile "/var/lib/node_exporter/mail.pmda.{user}.prom"
+//	trash folder ".Trash" keep 30
+//	cluster source "https://config.example.org/mail.pmda.conf" key "/etc/mail.pmda.pub"
+//	host "mx2.*" quota 2g
+//	classify builtin off
+//
+// The system-wide /etc/mail.pmda.conf is read first, the file of the user
+// adding to it or overriding it directive by directive.
+type Config struct {
+	Maildir         string
+	Fallbacks       []string
+	MigrateFrom     string
+	Recipients      []string
+	Layout          *LayoutConfig
+	Notify          string
+	Folders         map[string]*FolderConfig
+	Extensions      *ExtensionConfig
+	AutoFolders     *AutoFolderConfig
+	Timezone        *time.Location
+	Rules           []*Rule
+	RepairMessageId bool
+	RepairDate      bool
+	RoleAccount     bool
+	RoleRetention   int
+	JunkExpiry      *JunkExpiry
+	Postgres        *PostgresConfig
+	Publishers      []*PublishConfig
+	State           *StateConfig
+	BufferSize      int
+	LineEndingsLF   bool
+	Overflow        int
+	Quota           *QuotaConfig
+	Checksums       bool
+	AttachmentIndex bool
+	Xattr           bool
+	Provenance      bool
+	Limits          UsageLimits
+	Structure       StructureLimits
+	Budget          time.Duration
+	Breaker         *BreakerConfig
+	Chaos           map[string]*ChaosConfig
+	Reports         []*ReportConfig
+	Calendar        bool
+	Classifier      *ClassifierConfig
+	Models          []*ModelConfig
+	Importance      *ImportanceConfig
+	Marketing       *MarketingConfig
+	Mute            *MuteConfig
+	Vacation        *VacationConfig
+	Forward         bool
+	Blocklist       *BlocklistConfig
+	Bypass          *BypassConfig
+	Domains         map[string]string
+	Trainers        map[string]string
+	Filters         []*FilterConfig
+	Correspondents  *CorrespondentsConfig
+	SMIME           *SMIMEConfig
+	PGP             *PGPConfig
+	ScanEncrypted   bool
+	Hold            *HoldConfig
+	Upgrade         *UpgradeConfig
+	Dedup           *DedupConfig
+	Classify        []*Rule
+	ClassifyBuiltin bool
+	ClassifyLists   *Rule
+	SpecialFolders  map[string]string
+	AuthResults     *AuthResultsConfig
+	Syslog          bool
+	EventLog        *EventLogConfig
+	Metrics         *MetricsConfig
+	Trash           *TrashConfig
+	Cluster         *ClusterConfig
+}
+
+// FolderConfig holds the settings attached to a folder by name, the
+// inbox being known as INBOX.
+type FolderConfig struct {
+	Metadata   map[string]string
+	DeliverCur bool
+	Flags      string
+	Notify     bool
+}
+
+func config_default() *Config {
+	return &Config{
+		Notify:   "none",
+		Folders:  make(map[string]*FolderConfig),
+		Timezone: time.Local,
+		Rules:    make([]*Rule, 0),
+		Trainers: make(map[string]string),
+		Domains:  make(map[string]string),
+		State:    &StateConfig{Kind: "local"},
+		Hold:     hold_default(),
+		Trash:    trash_default(),
+
+		Marketing: marketing_default(),
+
+		SpecialFolders:  make(map[string]string),
+		ClassifyBuiltin: true,
+		Forward:         true,
+		ScanEncrypted:   true,
+
+		BufferSize: 256 * 1024,
+	}
+}
+
+// config_duration parses a duration, days and weeks included as in 7d
+// or 2w.
+func config_duration(value string) (time.Duration, error) {
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if count, found := strings.CutSuffix(value, suffix); found {
+			n, err := strconv.Atoi(count)
+			if err != nil || n < 0 {
+				return 0, fmt.Errorf("invalid duration: %s", value)
+			}
+			return time.Duration(n) * unit, nil
+		}
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration < 0 {
+		return 0, fmt.Errorf("invalid duration: %s", value)
+	}
+	return duration, nil
+}
+
+// config_size parses a size with an optional k, m or g suffix.
+func config_size(value string) (int64, error) {
+	if value == "" {
+		return 0, fmt.Errorf("invalid size: %s", value)
+	}
+	multiplier := int64(1)
+	switch strings.ToLower(value[len(value)-1:]) {
+	case "k":
+		multiplier = 1024
+	case "m":
+		multiplier = 1024 * 1024
+	case "g":
+		multiplier = 1024 * 1024 * 1024
+	}
+	if multiplier != 1 {
+		value = value[:len(value)-1]
+	}
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("invalid size: %s", value)
+	}
+	return size * multiplier, nil
+}
+
+// folder_config returns the settings of a folder, or nil if it has none.
+func (cfg *Config) folder_config(folder string) *FolderConfig {
+	if folder == "" {
+		folder = "INBOX"
+	}
+	return cfg.Folders[folder]
+}
+
+func (cfg *Config) folder(name string) *FolderConfig {
+	if folder, exists := cfg.Folders[name]; exists {
+		return folder
+	}
+	folder := &FolderConfig{
+		Metadata: make(map[string]string),
+	}
+	cfg.Folders[name] = folder
+	return folder
+}
+
+// config_quote quotes a value so that config_tokenize reads it back as is.
+func config_quote(value string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value) + `"`
+}
+
+// config_tokenize splits a configuration line into words, honoring
+// double-quoted strings and stripping trailing comments.
+func config_tokenize(line string) ([]string, error) {
+	tokens := make([]string, 0)
+	var token strings.Builder
+	inToken := false
+	inQuote := false
+	escaped := false
+
+	for _, c := range line {
+		switch {
+		case escaped:
+			token.WriteRune(c)
+			escaped = false
+		case inQuote && c == '\\':
+			escaped = true
+		case c == '"':
+			inQuote = !inQuote
+			inToken = true
+		case !inQuote && c == '#':
+			if inToken {
+				tokens = append(tokens, token.String())
+			}
+			return tokens, nil
+		case !inQuote && (c == ' ' || c == '\t'):
+			if inToken {
+				tokens = append(tokens, token.String())
+				token.Reset()
+				inToken = false
+			}
+		default:
+			token.WriteRune(c)
+			inToken = true
+		}
+	}
+	if inQuote {
+		return nil, fmt.Errorf("unterminated quoted string")
+	}
+	if inToken {
+		tokens = append(tokens, token.String())
+	}
+	return tokens, nil
+}
+
+func config_parse(r io.Reader, name string) (*Config, error) {
+	return config_merge(config_default(), r, name)
+}
+
+// config_merge reads directives over an existing configuration.
+func config_merge(cfg *Config, r io.Reader, name string) (*Config, error) {
+	scanner := bufio.NewScanner(r)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		tokens, err := config_tokenize(scanner.Text())
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", name, lineno, err)
+		}
+		if len(tokens) == 0 {
+			continue
+		}
+
+		keyword, args := tokens[0], tokens[1:]
+		if keyword == "host" {
+			if len(args) < 2 {
+				return nil, fmt.Errorf("%s:%d: usage: host pattern directive ...", name, lineno)
+			}
+			if !config_host(cfg, args[0]) {
+				continue
+			}
+			keyword, args = args[1], args[2:]
+		}
+		switch keyword {
+		case "maildir":
+			if len(args) != 1 {
+				return nil, fmt.Errorf("%s:%d: usage: maildir path", name, lineno)
+			}
+			cfg.Maildir = args[0]
+
+		case "fallback":
+			if len(args) != 1 {
+				return nil, fmt.Errorf("%s:%d: usage: fallback path", name, lineno)
+			}
+			cfg.Fallbacks = append(cfg.Fallbacks, args[0])
+
+		case "migrate":
+			if len(args) != 2 || args[0] != "from" {
+				return nil, fmt.Errorf("%s:%d: usage: migrate from path", name, lineno)
+			}
+			cfg.MigrateFrom = args[1]
+
+		case "recipient":
+			if len(args) != 1 {
+				return nil, fmt.Errorf("%s:%d: usage: recipient address-pattern", name, lineno)
+			}
+			pattern := strings.ToLower(args[0])
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("%s:%d: bad address pattern: %s", name, lineno, args[0])
+			}
+			cfg.Recipients = append(cfg.Recipients, pattern)
+
+		case "layout":
+			layout, err := layout_parse(args)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %s", name, lineno, err)
+			}
+			cfg.Layout = layout
+
+		case "notify":
+			if len(args) != 1 {
+				return nil, fmt.Errorf("%s:%d: usage: notify none|minimal|sender|full", name, lineno)
+			}
+			switch args[0] {
+			case "none", "minimal", "sender", "full":
+				cfg.Notify = args[0]
+			default:
+				return nil, fmt.Errorf("%s:%d: unknown notify level: %s", name, lineno, args[0])
+			}
+
+		case "folder":
+			if len(args) < 1 || len(args)%2 != 1 {
+				return nil, fmt.Errorf("%s:%d: usage: folder name [option value ...]", name, lineno)
+			}
+			folder := cfg.folder(args[0])
+			for i := 1; i < len(args); i += 2 {
+				switch args[i] {
+				case "color", "comment", "display-name":
+					folder.Metadata[args[i]] = args[i+1]
+				case "deliver":
+					if args[i+1] != "new" && args[i+1] != "cur" {
+						return nil, fmt.Errorf("%s:%d: usage: deliver new|cur", name, lineno)
+					}
+					folder.DeliverCur = args[i+1] == "cur"
+				case "notify":
+					if args[i+1] != "on" && args[i+1] != "off" {
+						return nil, fmt.Errorf("%s:%d: usage: notify on|off", name, lineno)
+					}
+					folder.Notify = args[i+1] == "on"
+				case "flags":
+					flags, err := maildir_flags(args[i+1])
+					if err != nil {
+						return nil, fmt.Errorf("%s:%d: %s", name, lineno, err)
+					}
+					folder.Flags = flags
+				default:
+					return nil, fmt.Errorf("%s:%d: unknown folder option: %s", name, lineno, args[i])
+				}
+			}
+
+		case "timezone":
+			if len(args) != 1 {
+				return nil, fmt.Errorf("%s:%d: usage: timezone name", name, lineno)
+			}
+			location, err := time.LoadLocation(args[0])
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %s", name, lineno, err)
+			}
+			cfg.Timezone = location
+
+		case "repair":
+			if len(args) != 1 {
+				return nil, fmt.Errorf("%s:%d: usage: repair message-id|date", name, lineno)
+			}
+			switch args[0] {
+			case "message-id":
+				cfg.RepairMessageId = true
+			case "date":
+				cfg.RepairDate = true
+			default:
+				return nil, fmt.Errorf("%s:%d: unknown repair: %s", name, lineno, args[0])
+			}
+
+		case "role-account":
+			cfg.RoleAccount = true
+			if len(args) == 0 {
+				break
+			}
+			if len(args) != 2 || args[0] != "retention" {
+				return nil, fmt.Errorf("%s:%d: usage: role-account [retention days]", name, lineno)
+			}
+			days, err := strconv.Atoi(args[1])
+			if err != nil || days < 0 {
+				return nil, fmt.Errorf("%s:%d: invalid retention: %s", name, lineno, args[1])
+			}
+			cfg.RoleRetention = days
+
+		case "expire":
+			expiry, err := expire_parse(args)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %s", name, lineno, err)
+			}
+			cfg.JunkExpiry = expiry
+
+		case "postgresql":
+			if len(args) < 1 {
+				return nil, fmt.Errorf("%s:%d: usage: postgresql conninfo [table name] [exclusive]", name, lineno)
+			}
+			if !features["postgresql"] {
+				return nil, fmt.Errorf("%s:%d: postgresql support not compiled in", name, lineno)
+			}
+			cfg.Postgres = &PostgresConfig{Conninfo: args[0], Table: "messages"}
+			for i := 1; i < len(args); i++ {
+				switch {
+				case args[i] == "table" && i+1 < len(args):
+					cfg.Postgres.Table = args[i+1]
+					i++
+				case args[i] == "exclusive":
+					cfg.Postgres.Exclusive = true
+				default:
+					return nil, fmt.Errorf("%s:%d: usage: postgresql conninfo [table name] [exclusive]", name, lineno)
+				}
+			}
+
+		case "publish":
+			pub, err := publish_parse(args)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %s", name, lineno, err)
+			}
+			cfg.Publishers = append(cfg.Publishers, pub)
+
+		case "state":
+			state, err := state_parse(args)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %s", name, lineno, err)
+			}
+			cfg.State = state
+
+		case "overflow":
+			if len(args) != 1 {
+				return nil, fmt.Errorf("%s:%d: usage: overflow count", name, lineno)
+			}
+			count, err := strconv.Atoi(args[0])
+			if err != nil || count < 100 {
+				return nil, fmt.Errorf("%s:%d: overflow must be a count of at least 100", name, lineno)
+			}
+			cfg.Overflow = count
+
+		case "quota":
+			if len(args) < 1 || len(args) > 2 {
+				return nil, fmt.Errorf("%s:%d: usage: quota size [count]", name, lineno)
+			}
+			size, err := config_size(args[0])
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %s", name, lineno, err)
+			}
+			cfg.Quota = &QuotaConfig{Size: size}
+			if len(args) == 2 {
+				count, err := strconv.ParseInt(args[1], 10, 64)
+				if err != nil || count < 0 {
+					return nil, fmt.Errorf("%s:%d: invalid count: %s", name, lineno, args[1])
+				}
+				cfg.Quota.Count = count
+			}
+			if size == 0 && cfg.Quota.Count == 0 {
+				return nil, fmt.Errorf("%s:%d: usage: quota size [count]", name, lineno)
+			}
+
+		case "buffer-size":
+			if len(args) != 1 {
+				return nil, fmt.Errorf("%s:%d: usage: buffer-size size", name, lineno)
+			}
+			size, err := config_size(args[0])
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %s", name, lineno, err)
+			}
+			if size < 4096 || size > 64*1024*1024 {
+				return nil, fmt.Errorf("%s:%d: buffer-size must be between 4k and 64m", name, lineno)
+			}
+			cfg.BufferSize = int(size)
+
+		case "limit":
+			if len(args) != 2 {
+				return nil, fmt.Errorf("%s:%d: usage: limit cpu|exec duration | limit size|header-size size | limit headers|mime-depth|mime-parts count | limit action tempfail|unclassified", name, lineno)
+			}
+			switch args[0] {
+			case "cpu", "exec":
+				duration, err := time.ParseDuration(args[1])
+				if err != nil || duration <= 0 {
+					return nil, fmt.Errorf("%s:%d: invalid duration: %s", name, lineno, args[1])
+				}
+				if args[0] == "cpu" {
+					cfg.Limits.CPU = duration
+				} else {
+					cfg.Limits.Exec = duration
+				}
+			case "size":
+				size, err := config_size(args[1])
+				if err != nil || size == 0 {
+					return nil, fmt.Errorf("%s:%d: invalid size: %s", name, lineno, args[1])
+				}
+				cfg.Limits.Size = size
+			case "header-size":
+				size, err := config_size(args[1])
+				if err != nil || size == 0 {
+					return nil, fmt.Errorf("%s:%d: invalid size: %s", name, lineno, args[1])
+				}
+				cfg.Structure.HeaderSize = int(size)
+			case "headers", "mime-depth", "mime-parts":
+				count, err := strconv.Atoi(args[1])
+				if err != nil || count <= 0 {
+					return nil, fmt.Errorf("%s:%d: invalid count: %s", name, lineno, args[1])
+				}
+				switch args[0] {
+				case "headers":
+					cfg.Structure.Headers = count
+				case "mime-depth":
+					cfg.Structure.MimeDepth = count
+				case "mime-parts":
+					cfg.Structure.MimeParts = count
+				}
+			case "action":
+				if args[1] != "tempfail" && args[1] != "unclassified" {
+					return nil, fmt.Errorf("%s:%d: usage: limit action tempfail|unclassified", name, lineno)
+				}
+				cfg.Structure.Tempfail = args[1] == "tempfail"
+			default:
+				return nil, fmt.Errorf("%s:%d: unknown limit: %s", name, lineno, args[0])
+			}
+
+		case "budget":
+			if len(args) != 1 {
+				return nil, fmt.Errorf("%s:%d: usage: budget duration", name, lineno)
+			}
+			duration, err := time.ParseDuration(args[0])
+			if err != nil || duration <= 0 {
+				return nil, fmt.Errorf("%s:%d: invalid duration: %s", name, lineno, args[0])
+			}
+			cfg.Budget = duration
+
+		case "breaker":
+			breaker, err := breaker_parse(args)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %s", name, lineno, err)
+			}
+			cfg.Breaker = breaker
+
+		case "chaos":
+			integration, chaos, err := chaos_parse(args)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %s", name, lineno, err)
+			}
+			if cfg.Chaos == nil {
+				cfg.Chaos = make(map[string]*ChaosConfig)
+			}
+			cfg.Chaos[integration] = chaos
+
+		case "reports":
+			report, err := reports_parse(args)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %s", name, lineno, err)
+			}
+			cfg.Reports = append(cfg.Reports, report)
+
+		case "correspondents":
+			correspondents, err := correspondents_parse(args)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %s", name, lineno, err)
+			}
+			cfg.Correspondents = correspondents
+
+		case "hold":
+			if err := hold_parse(cfg.Hold, args); err != nil {
+				return nil, fmt.Errorf("%s:%d: %s", name, lineno, err)
+			}
+
+		case "line-endings":
+			lf, err := line_endings_parse(args)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %s", name, lineno, err)
+			}
+			cfg.LineEndingsLF = lf
+
+		case "dedup":
+			dedup, err := dedup_parse(args)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %s", name, lineno, err)
+			}
+			cfg.Dedup = dedup
+
+		case "calendar":
+			if len(args) != 0 {
+				return nil, fmt.Errorf("%s:%d: usage: calendar", name, lineno)
+			}
+			cfg.Calendar = true
+
+		case "classifier":
+			if !features["classifier"] {
+				return nil, fmt.Errorf("%s:%d: classifier support not compiled in", name, lineno)
+			}
+			classifier, err := classifier_parse(args)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %s", name, lineno, err)
+			}
+			cfg.Classifier = classifier
+
+		case "smime":
+			smime, err := smime_parse(args)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %s", name, lineno, err)
+			}
+			cfg.SMIME = smime
+
+		case "pgp":
+			if !features["pgp"] {
+				return nil, fmt.Errorf("%s:%d: pgp support not compiled in", name, lineno)
+			}
+			pgp, err := pgp_parse(args)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %s", name, lineno, err)
+			}
+			cfg.PGP = pgp
+
+		case "encrypted":
+			scan, err := encrypted_parse(args)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %s", name, lineno, err)
+			}
+			cfg.ScanEncrypted = scan
+
+		case "importance":
+			if cfg.Importance == nil {
+				cfg.Importance = importance_default()
+			}
+			if err := importance_parse(cfg.Importance, args); err != nil {
+				return nil, fmt.Errorf("%s:%d: %s", name, lineno, err)
+			}
+
+		case "marketing":
+			if err := marketing_parse(cfg, args); err != nil {
+				return nil, fmt.Errorf("%s:%d: %s", name, lineno, err)
+			}
+
+		case "forward":
+			if len(args) != 1 || (args[0] != "on" && args[0] != "off") {
+				return nil, fmt.Errorf("%s:%d: usage: forward on|off", name, lineno)
+			}
+			cfg.Forward = args[0] == "on"
+
+		case "extensions":
+			extensions, err := extensions_parse(args)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %s", name, lineno, err)
+			}
+			cfg.Extensions = extensions
+
+		case "autofolders":
+			autofolders, err := autofolders_parse(args)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %s", name, lineno, err)
+			}
+			cfg.AutoFolders = autofolders
+
+		case "vacation":
+			vacation, err := vacation_parse(args)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %s", name, lineno, err)
+			}
+			cfg.Vacation = vacation
+
+		case "mute":
+			mute, err := mute_parse(args)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %s", name, lineno, err)
+			}
+			cfg.Mute = mute
+
+		case "blocklist":
+			blocklist, err := blocklist_parse(args)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %s", name, lineno, err)
+			}
+			cfg.Blocklist = blocklist
+
+		case "upgrade":
+			if name != systemConfig {
+				return nil, fmt.Errorf("%s:%d: upgrade is only allowed in %s", name, lineno, systemConfig)
+			}
+			upgrade, err := upgrade_parse(args)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %s", name, lineno, err)
+			}
+			cfg.Upgrade = upgrade
+
+		case "bypass":
+			bypass, err := bypass_parse(args)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %s", name, lineno, err)
+			}
+			cfg.Bypass = bypass
+
+		case "domains":
+			list, url, err := domains_parse(args)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %s", name, lineno, err)
+			}
+			cfg.Domains[list] = url
+
+		case "trainer":
+			kind, command, err := trainer_parse(args)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %s", name, lineno, err)
+			}
+			cfg.Trainers[kind] = command
+
+		case "filter":
+			filter, err := filter_parse(args)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %s", name, lineno, err)
+			}
+			cfg.Filters = append(cfg.Filters, filter)
+
+		case "model":
+			model, err := model_parse(args)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %s", name, lineno, err)
+			}
+			cfg.Models = append(cfg.Models, model)
+
+		case "checksums":
+			if len(args) != 0 {
+				return nil, fmt.Errorf("%s:%d: usage: checksums", name, lineno)
+			}
+			cfg.Checksums = true
+
+		case "attachments":
+			if len(args) != 1 || args[0] != "index" {
+				return nil, fmt.Errorf("%s:%d: usage: attachments index", name, lineno)
+			}
+			cfg.AttachmentIndex = true
+
+		case "xattr":
+			if len(args) != 0 {
+				return nil, fmt.Errorf("%s:%d: usage: xattr", name, lineno)
+			}
+			cfg.Xattr = true
+
+		case "provenance":
+			if len(args) != 0 {
+				return nil, fmt.Errorf("%s:%d: usage: provenance", name, lineno)
+			}
+			cfg.Provenance = true
+
+		case "match":
+			rule, err := rule_parse(args, lineno)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %s", name, lineno, err)
+			}
+			cfg.Rules = append(cfg.Rules, rule)
+
+		case "syslog":
+			on, err := syslog_parse(args)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %s", name, lineno, err)
+			}
+			cfg.Syslog = on
+
+		case "events":
+			events, err := events_parse(args)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %s", name, lineno, err)
+			}
+			cfg.EventLog = events
+
+		case "metrics":
+			metrics, err := metrics_parse(args)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %s", name, lineno, err)
+			}
+			cfg.Metrics = metrics
+
+		case "trash":
+			trash, err := trash_parse(args)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %s", name, lineno, err)
+			}
+			cfg.Trash = trash
+
+		case "cluster":
+			if name != systemConfig {
+				return nil, fmt.Errorf("%s:%d: cluster is only allowed in %s", name, lineno, systemConfig)
+			}
+			cluster, err := cluster_parse(args)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %s", name, lineno, err)
+			}
+			data, err := cluster_read(cluster)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %s", name, lineno, err)
+			}
+			cfg.Cluster = cluster
+			if cfg, err = config_merge(cfg, bytes.NewReader(data), cluster_file(cluster)); err != nil {
+				return nil, err
+			}
+
+		case "authentication-results":
+			authresults, err := authresults_parse(args)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %s", name, lineno, err)
+			}
+			cfg.AuthResults = authresults
+
+		case "special-folder":
+			if err := special_folder_parse(cfg, args); err != nil {
+				return nil, fmt.Errorf("%s:%d: %s", name, lineno, err)
+			}
+
+		case "classify":
+			if err := classify_parse(cfg, args, lineno); err != nil {
+				return nil, fmt.Errorf("%s:%d: %s", name, lineno, err)
+			}
+
+		default:
+			return nil, fmt.Errorf("%s:%d: unknown keyword: %s", name, lineno, keyword)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %s", name, err)
+	}
+	if cfg.Classifier == nil && cfg.rules_use("classifier") {
+		return nil, fmt.Errorf("%s: classifier condition without a classifier", name)
+	}
+	if cfg.PGP == nil && (cfg.rules_use("pgp") || cfg.rules_use("pgp-signer")) {
+		return nil, fmt.Errorf("%s: pgp condition without pgp", name)
+	}
+	for _, rule := range append(append([]*Rule{}, cfg.Rules...), cfg.Classify...) {
+		for _, cond := range rule.Conditions {
+			if cond.Kind == "score" && !config_scored(cfg, cond.Name) {
+				return nil, fmt.Errorf("%s:%d: no model named %s", name, rule.Line, cond.Name)
+			}
+		}
+	}
+	return cfg, nil
+}
+
+// config_scored reports whether a score of that name is computed.
+func config_scored(cfg *Config, name string) bool {
+	if name == "importance" {
+		return cfg.Importance != nil
+	}
+	if name == "marketing" {
+		return cfg.Marketing != nil
+	}
+	if name == "phishing" {
+		return true
+	}
+	for _, model := range cfg.Models {
+		if model.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// rules_use reports whether a match or classify rule has a condition of
+// the given kind.
+func (cfg *Config) rules_use(kind string) bool {
+	return rules_use(cfg.Rules, kind) || rules_use(cfg.Classify, kind)
+}
+
+// the configuration shared by all users of the system
+var systemConfig = "/etc/mail.pmda.conf"
+
+// config_read reads the system configuration then the configuration file
+// at pathname, a missing file is not an error and results in the default
+// configuration.
+func config_read(pathname string) (*Config, error) {
+	cfg, err := config_system()
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(pathname)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return cfg, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+	return config_merge(cfg, file, pathname)
+}
+
+// config_system returns the defaults merged with the system configuration,
+// which user configurations are read over.
+func config_system() (*Config, error) {
+	cfg := config_default()
+	file, err := os.Open(systemConfig)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return cfg, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+	return config_merge(cfg, file, systemConfig)
+}
+
+// config_load is config_read for the MDA, errors are fatal.
+func config_load(pathname string) *Config {
+	cfg, err := config_read(pathname)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading configuration: %s\n", err)
+		os.Exit(EX_TEMPFAIL)
+	}
+	return cfg
+}
@@ -0,0 +1,298 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// ContractCase is a delivery as an MTA makes it, in a scratch home: the
+// environment it exports, the message on stdin, and what the MTA expects
+// of us, an exit status it interprets and the maildir left behind.
+type ContractCase struct {
+	MTA   string
+	Name  string
+	Setup func(home string) error
+	Env   []string
+	Stdin string
+	Exit  int
+	Check func(home string, stdin string) error
+}
+
+// the environment of an OpenSMTPD mda action
+func contract_opensmtpd(extension string) []string {
+	return []string{"SENDER=alice@example.org", "RECIPIENT=bob@example.net", "ORIGINAL_RECIPIENT=bob@example.net",
+		"EXTENSION=" + extension, "DOMAIN=example.net", "LOCAL=bob", "USER=bob"}
+}
+
+// the environment of a Postfix mailbox_command
+func contract_postfix(extension string) []string {
+	return []string{"SENDER=alice@example.org", "RECIPIENT=bob@example.net", "ORIGINAL_RECIPIENT=bob@example.net",
+		"EXTENSION=" + extension, "DOMAIN=example.net", "LOCAL=bob", "USER=bob", "LOGNAME=bob", "SHELL=/bin/sh",
+		"CLIENT_ADDRESS=192.0.2.1", "CLIENT_HOSTNAME=mx.example.org"}
+}
+
+const contractMessage = "Received: from mx.example.org (mx.example.org [192.0.2.1])\n" +
+	"\tby mail.example.net with ESMTPS id 5f0c1a2b; Tue, 5 Mar 2024 09:12:44 +0100\n" +
+	"From: Alice <alice@example.org>\n" +
+	"To: Bob <bob@example.net>\n" +
+	"Subject: contract\n" +
+	"Date: Tue, 5 Mar 2024 09:12:40 +0100\n" +
+	"Message-ID: <contract@example.org>\n" +
+	"\n" +
+	"Hello Bob.\n"
+
+// Postfix pipes the message in mbox framing, the delivery fields already
+// prepended
+const contractPostfixMessage = "From alice@example.org  Tue Mar  5 09:12:44 2024\n" +
+	"Return-Path: <alice@example.org>\n" +
+	"X-Original-To: bob@example.net\n" +
+	"Delivered-To: bob@example.net\n" + contractMessage
+
+// fetchmail hands over what the server had, trace fields of the mailbox
+// provider included, after a Received field of its own
+const contractFetchmailMessage = "Received: from pop.example.com [198.51.100.7]\r\n" +
+	"\tby localhost with POP3 (fetchmail-6.4.38) for <bob@localhost>; Tue, 5 Mar 2024 09:13:00 +0100\r\n" +
+	"Return-Path: <alice@example.org>\r\n" +
+	"Delivered-To: bob@example.com\r\n" +
+	"From: Alice <alice@example.org>\r\n" +
+	"To: Bob <bob@example.com>\r\n" +
+	"Subject: contract\r\n" +
+	"Message-ID: <contract@example.org>\r\n" +
+	"\r\n" +
+	"Hello Bob.\r\n"
+
+// looping messages carry our Delivered-To below a Received field
+const contractLoopMessage = "Received: from mx.example.org\n\tby mail.example.net; Tue, 5 Mar 2024 09:12:44 +0100\n" +
+	"Delivered-To: bob@example.net\n" + contractMessage
+
+var contractCases = []ContractCase{
+	{MTA: "opensmtpd", Name: "delivers to the inbox with the trace fields of the envelope",
+		Env: contract_opensmtpd(""), Stdin: contractMessage, Exit: 0,
+		Check: func(home string, stdin string) error {
+			message, err := contract_message(home, "")
+			if err != nil {
+				return err
+			}
+			return contract_fields(message, map[string]int{"Return-Path: <alice@example.org>": 1,
+				"Delivered-To: bob@example.net": 1, "X-Original-To: bob@example.net": 1})
+		}},
+	{MTA: "opensmtpd", Name: "files to the folder of an address extension",
+		Setup: func(home string) error { return contract_folder(home, "lists") },
+		Env:   contract_opensmtpd("lists"), Stdin: contractMessage, Exit: 0,
+		Check: func(home string, stdin string) error {
+			_, err := contract_message(home, "lists")
+			return err
+		}},
+	{MTA: "opensmtpd", Name: "files bounces, with a null sender, to the error folder",
+		Env: append(contract_opensmtpd(""), "SENDER="), Stdin: contractMessage, Exit: 0,
+		Check: func(home string, stdin string) error {
+			message, err := contract_message(home, ".Error")
+			if err != nil {
+				return err
+			}
+			return contract_fields(message, map[string]int{"Return-Path: <>": 1})
+		}},
+	{MTA: "opensmtpd", Name: "bounces forwarding loops as unavailable",
+		Env: contract_opensmtpd(""), Stdin: contractLoopMessage, Exit: EX_UNAVAILABLE,
+		Check: contract_empty},
+	{MTA: "opensmtpd", Name: "tempfails when the maildir cannot be written",
+		Setup: contract_broken, Env: contract_opensmtpd(""), Stdin: contractMessage, Exit: EX_TEMPFAIL},
+
+	{MTA: "postfix", Name: "drops the From_ line and keeps the delivery fields prepended",
+		Env: contract_postfix(""), Stdin: contractPostfixMessage, Exit: 0,
+		Check: func(home string, stdin string) error {
+			message, err := contract_message(home, "")
+			if err != nil {
+				return err
+			}
+			if strings.Contains(message, "\nFrom alice@") || strings.HasPrefix(message, "From ") {
+				return fmt.Errorf("From_ line stored")
+			}
+			return contract_fields(message, map[string]int{"Return-Path: <alice@example.org>": 1,
+				"Delivered-To: bob@example.net": 1, "X-Original-To: bob@example.net": 1})
+		}},
+	{MTA: "postfix", Name: "delivers to the inbox for an extension without folder",
+		Env: contract_postfix("unknown"), Stdin: contractPostfixMessage, Exit: 0,
+		Check: func(home string, stdin string) error {
+			_, err := contract_message(home, "")
+			return err
+		}},
+	{MTA: "postfix", Name: "bounces forwarding loops as unavailable",
+		Env: contract_postfix(""), Stdin: contractLoopMessage, Exit: EX_UNAVAILABLE,
+		Check: contract_empty},
+	{MTA: "postfix", Name: "defers when the maildir cannot be written",
+		Setup: contract_broken, Env: contract_postfix(""), Stdin: contractPostfixMessage, Exit: EX_TEMPFAIL},
+
+	{MTA: "fetchmail", Name: "delivers without an envelope, leaving the message untouched",
+		Stdin: contractFetchmailMessage, Exit: 0,
+		Check: func(home string, stdin string) error {
+			message, err := contract_message(home, "")
+			if err != nil {
+				return err
+			}
+			if !strings.HasSuffix(message, stdin) {
+				return fmt.Errorf("message altered")
+			}
+			return contract_fields(message, map[string]int{"Delivered-To: ": 1, "X-Original-To: ": 0})
+		}},
+	{MTA: "fetchmail", Name: "fails when the maildir cannot be written, the message staying on the server",
+		Setup: contract_broken, Stdin: contractFetchmailMessage, Exit: EX_TEMPFAIL},
+}
+
+// contract_folder creates a folder of the scratch maildir.
+func contract_folder(home string, folder string) error {
+	for _, subdir := range []string{"cur", "new", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(home, "Maildir", folder, subdir), 0700); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// contract_broken leaves a file where the maildir should be.
+func contract_broken(home string) error {
+	return os.WriteFile(filepath.Join(home, "Maildir"), nil, 0600)
+}
+
+// contract_message returns the single message delivered to a folder.
+func contract_message(home string, folder string) (string, error) {
+	pathnames, err := filepath.Glob(filepath.Join(home, "Maildir", folder, "new", "*"))
+	if err != nil {
+		return "", err
+	}
+	if len(pathnames) != 1 {
+		return "", fmt.Errorf("%d messages in %s, expected 1", len(pathnames), contract_display(folder))
+	}
+	data, err := os.ReadFile(pathnames[0])
+	return string(data), err
+}
+
+// contract_empty checks that nothing was left in the maildir.
+func contract_empty(home string, stdin string) error {
+	count := 0
+	err := filepath.WalkDir(filepath.Join(home, "Maildir"), func(pathname string, entry os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		subdir := filepath.Base(filepath.Dir(pathname))
+		if entry.Type().IsRegular() && (subdir == "new" || subdir == "cur" || subdir == "tmp") {
+			count++
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if count != 0 {
+		return fmt.Errorf("%d messages left in the maildir", count)
+	}
+	return nil
+}
+
+// contract_fields checks how many header lines start with each prefix.
+func contract_fields(message string, expected map[string]int) error {
+	header, _, _ := strings.Cut(strings.ReplaceAll(message, "\r\n", "\n"), "\n\n")
+	lines := strings.Split(header, "\n")
+	prefixes := make([]string, 0, len(expected))
+	for prefix := range expected {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	for _, prefix := range prefixes {
+		count := 0
+		for _, line := range lines {
+			if strings.HasPrefix(line, prefix) {
+				count++
+			}
+		}
+		if count != expected[prefix] {
+			return fmt.Errorf("%d %q fields, expected %d", count, strings.TrimSpace(prefix), expected[prefix])
+		}
+	}
+	return nil
+}
+
+func contract_display(folder string) string {
+	if folder == "" {
+		return "INBOX"
+	}
+	return folder
+}
+
+// contract_run makes the delivery of a case with the test binary standing
+// in for mail.pmda and returns its output and what went against the
+// expectations of the MTA.
+func contract_run(test *ContractCase) (string, error) {
+	home, err := os.MkdirTemp("", "pmda-contract")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(home)
+	if test.Setup != nil {
+		if err := test.Setup(home); err != nil {
+			return "", err
+		}
+	}
+
+	var output bytes.Buffer
+	cmd := exec.Command(os.Args[0])
+	cmd.Dir = home
+	cmd.Stdin = strings.NewReader(test.Stdin)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	cmd.Env = append([]string{"PMDA_TEST_MAIN=1", "HOME=" + home, "PATH=/usr/bin:/bin:/usr/sbin:/sbin"}, test.Env...)
+	status := 0
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			return output.String(), err
+		}
+		status = exitErr.ExitCode()
+	}
+	if status != test.Exit {
+		return output.String(), fmt.Errorf("exit status %d, expected %d", status, test.Exit)
+	}
+	if test.Check != nil {
+		if err := test.Check(home, test.Stdin); err != nil {
+			return output.String(), err
+		}
+	}
+	return output.String(), nil
+}
+
+// TestContract checks that deliveries behave as OpenSMTPD, Postfix and
+// fetchmail expect of an MDA: how they export the envelope, frame the
+// message on stdin and read our exit status.
+func TestContract(t *testing.T) {
+	for i := range contractCases {
+		test := &contractCases[i]
+		t.Run(test.MTA+"/"+test.Name, func(t *testing.T) {
+			if output, err := contract_run(test); err != nil {
+				t.Errorf("%s\n%s", err, output)
+			}
+		})
+	}
+}
@@ -0,0 +1,310 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io/fs"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const CORRESPONDENTS_NS = "correspondents"
+const CORRESPONDENTS_INDEX_NS = "correspondents-index"
+
+// sent messages are indexed by Message-ID too, for bounce correlation
+const SENT_NS = "sent"
+
+// CorrespondentsConfig lists where the addresses the user writes to are
+// learnt from, sent folders are relative to the maildir and lists hold
+// one address per line:
+//
+//	correspondents sent ".Sent" list "contacts.txt"
+//
+// Mail from a known correspondent is never classified as junk and can be
+// matched with the known-correspondent rule condition.
+type CorrespondentsConfig struct {
+	Sent  []string
+	Lists []string
+}
+
+func correspondents_parse(args []string) (*CorrespondentsConfig, error) {
+	correspondents := &CorrespondentsConfig{}
+	for i := 0; i < len(args); i += 2 {
+		if i+1 >= len(args) || (args[i] != "sent" && args[i] != "list") {
+			return nil, fmt.Errorf("usage: correspondents [sent folder] [list file]")
+		}
+		if args[i] == "sent" {
+			correspondents.Sent = append(correspondents.Sent, args[i+1])
+		} else {
+			correspondents.Lists = append(correspondents.Lists, args[i+1])
+		}
+	}
+	if len(correspondents.Sent) == 0 && len(correspondents.Lists) == 0 {
+		correspondents.Sent = []string{".Sent"}
+	}
+	return correspondents, nil
+}
+
+// correspondent_address normalizes an address for use as an index key.
+func correspondent_address(address string) string {
+	if parsed, err := mail.ParseAddress(address); err == nil {
+		address = parsed.Address
+	}
+	return strings.ToLower(strings.TrimSpace(address))
+}
+
+// correspondents_learn_dir indexes the recipients and Message-IDs of the
+// messages in a maildir folder. It is incremental: a subdirectory is only
+// listed when its mtime changed, and only messages not older than the
+// newest one seen last time are read, unless full is set. It returns the
+// number of messages read.
+func correspondents_learn_dir(store StateStore, folder string, full bool) (int, error) {
+	learnt := 0
+	for _, subdir := range []string{"new", "cur"} {
+		directory := filepath.Join(folder, subdir)
+		st, err := os.Stat(directory)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return learnt, err
+		}
+
+		mtime := strconv.FormatInt(maildir_mtime(directory, st).UnixNano(), 10)
+		if seen, _, _ := store.Get(CORRESPONDENTS_INDEX_NS, "dir:"+directory); seen == mtime && !full {
+			continue
+		}
+		watermark := int64(0)
+		if !full {
+			value, _, _ := store.Get(CORRESPONDENTS_INDEX_NS, "watermark:"+directory)
+			watermark, _ = strconv.ParseInt(value, 10, 64)
+		}
+
+		newest := watermark
+		err = maildir_walk(directory, func(pathname string, entry fs.DirEntry) error {
+			info, err := entry.Info()
+			if err != nil || !info.Mode().IsRegular() || info.ModTime().UnixNano() < watermark {
+				return nil
+			}
+			newest = max(newest, info.ModTime().UnixNano())
+
+			file, err := os.Open(pathname)
+			if err != nil {
+				return nil
+			}
+			hdr, err := header_read(file)
+			file.Close()
+			if err != nil {
+				return nil
+			}
+			if err := correspondents_learn_header(store, hdr); err != nil {
+				return err
+			}
+			learnt++
+			return nil
+		})
+		if err != nil {
+			return learnt, err
+		}
+
+		if err := store.Set(CORRESPONDENTS_INDEX_NS, "watermark:"+directory, strconv.FormatInt(newest, 10), 0); err != nil {
+			return learnt, err
+		}
+		if err := store.Set(CORRESPONDENTS_INDEX_NS, "dir:"+directory, mtime, 0); err != nil {
+			return learnt, err
+		}
+	}
+	return learnt, nil
+}
+
+// correspondents_learn_header indexes the recipients and Message-ID of a
+// message the user sent.
+func correspondents_learn_header(store StateStore, hdr *Header) error {
+	for _, name := range []string{"To", "Cc", "Bcc"} {
+		for _, address := range hdr.Addresses(name) {
+			if err := store.Set(CORRESPONDENTS_NS, address, "1", 0); err != nil {
+				return err
+			}
+		}
+	}
+	if id := message_id(hdr.Get("Message-ID")); id != "" {
+		if err := store.Set(SENT_NS, id, header_oneline(hdr.Get("Subject")), 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// correspondents_learn_list indexes an exported address list, again only
+// when it changed since last time.
+func correspondents_learn_list(store StateStore, pathname string) (int, error) {
+	st, err := os.Stat(pathname)
+	if err != nil {
+		return 0, err
+	}
+	mtime := strconv.FormatInt(st.ModTime().UnixNano(), 10)
+	if seen, _, _ := store.Get(CORRESPONDENTS_INDEX_NS, "list:"+pathname); seen == mtime {
+		return 0, nil
+	}
+
+	file, err := os.Open(pathname)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	learnt := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if err := store.Set(CORRESPONDENTS_NS, correspondent_address(line), "1", 0); err != nil {
+			return learnt, err
+		}
+		learnt++
+	}
+	if err := scanner.Err(); err != nil {
+		return learnt, err
+	}
+	return learnt, store.Set(CORRESPONDENTS_INDEX_NS, "list:"+pathname, mtime, 0)
+}
+
+// correspondents_update brings the index up to date with the configured
+// sources, relative list paths being relative to the home directory.
+func correspondents_update(cfg *Config, store StateStore, homedir string, maildir string) {
+	for _, root := range maildir_roots(cfg, homedir, maildir) {
+		for _, folder := range cfg.Correspondents.Sent {
+			if _, err := correspondents_learn_dir(store, filepath.Join(root, folder), false); err != nil {
+				log_info("error learning correspondents from %s: %s", folder, err)
+			}
+		}
+	}
+	for _, list := range cfg.Correspondents.Lists {
+		if !filepath.IsAbs(list) {
+			list = filepath.Join(homedir, list)
+		}
+		if _, err := correspondents_learn_list(store, list); err != nil {
+			log_info("error learning correspondents from %s: %s", list, err)
+		}
+	}
+}
+
+// correspondents_check reports whether the author or envelope sender of a
+// message is someone the user wrote to.
+func correspondents_check(cfg *Config, env *Envelope, maildir string, hdr *Header) bool {
+	store, err := state_open(cfg, env.Home)
+	if err != nil {
+		log_info("error opening state: %s", err)
+		return false
+	}
+	defer store.Close()
+	correspondents_update(cfg, store, env.Home, maildir)
+
+	addresses := hdr.Addresses("From")
+	if env.Sender != "" {
+		addresses = append(addresses, correspondent_address(env.Sender))
+	}
+	for _, address := range addresses {
+		if _, known, err := store.Get(CORRESPONDENTS_NS, address); err == nil && known {
+			return true
+		}
+	}
+	return false
+}
+
+// correspondents_reply reports whether a message replies to one the user
+// sent, as found in the sent index.
+func correspondents_reply(cfg *Config, env *Envelope, maildir string, hdr *Header) bool {
+	ids := message_ids(hdr.Get("In-Reply-To"))
+	for _, references := range hdr.Values("References") {
+		ids = append(ids, message_ids(references)...)
+	}
+	if len(ids) == 0 {
+		return false
+	}
+
+	store, err := state_open(cfg, env.Home)
+	if err != nil {
+		log_info("error opening state: %s", err)
+		return false
+	}
+	defer store.Close()
+	if cfg.Correspondents != nil {
+		correspondents_update(cfg, store, env.Home, maildir)
+	}
+	for _, id := range ids {
+		if _, sent, err := store.Get(SENT_NS, id); err == nil && sent {
+			return true
+		}
+	}
+	return false
+}
+
+var learnSentFlags = flag.NewFlagSet("learn-sent", flag.ExitOnError)
+var learnSentDir = learnSentFlags.String("dir", "", "sent folder to learn from, defaults to the configured ones")
+var learnSentFull = learnSentFlags.Bool("full", false, "read every message instead of only the new ones")
+
+// learn_sent_main implements "mail.pmda learn-sent", which feeds the known
+// correspondents index from sent mail. It is incremental and cheap when
+// nothing changed, so it can run from cron.
+func learn_sent_main(args []string) int {
+	learnSentFlags.Parse(args)
+	if learnSentFlags.NArg() != 0 {
+		fmt.Fprintf(os.Stderr, "Usage: %s learn-sent [-full] [-dir folder]\n", os.Args[0])
+		return 1
+	}
+
+	homedir := os.Getenv("HOME")
+	cfg := config_load(filepath.Join(homedir, ".pmda.conf"))
+	maildir := maildir_resolve(cfg, homedir)
+
+	folders := []string{}
+	if *learnSentDir != "" {
+		folders = append(folders, *learnSentDir)
+	} else if cfg.Correspondents != nil {
+		for _, folder := range cfg.Correspondents.Sent {
+			folders = append(folders, filepath.Join(maildir, folder))
+		}
+	} else {
+		folders = append(folders, filepath.Join(maildir, ".Sent"))
+	}
+
+	store, err := state_open(cfg, homedir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error opening state: %s\n", err)
+		return 1
+	}
+	defer store.Close()
+
+	status := 0
+	for _, folder := range folders {
+		learnt, err := correspondents_learn_dir(store, folder, *learnSentFull)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error learning from %s: %s\n", folder, err)
+			status = 1
+		}
+		fmt.Printf("%s: %d messages read\n", folder, learnt)
+	}
+	return status
+}
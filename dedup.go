@@ -0,0 +1,95 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const DEDUP_NS = "dedup"
+
+// DedupConfig suppresses duplicate deliveries of a message to the same
+// recipient, as MTAs retrying after a lost acknowledgement and lists
+// resending make them:
+//
+//	dedup ttl 7d
+//
+// Messages are known by Message-ID and envelope recipient for the TTL,
+// those without a Message-ID are always delivered.
+type DedupConfig struct {
+	TTL time.Duration
+}
+
+func dedup_parse(args []string) (*DedupConfig, error) {
+	dedup := &DedupConfig{TTL: 7 * 24 * time.Hour}
+	switch {
+	case len(args) == 0:
+	case len(args) == 2 && args[0] == "ttl":
+		ttl, err := config_duration(args[1])
+		if err != nil {
+			return nil, err
+		}
+		if ttl == 0 {
+			return nil, fmt.Errorf("invalid ttl: %s", args[1])
+		}
+		dedup.TTL = ttl
+	default:
+		return nil, fmt.Errorf("usage: dedup [ttl duration]")
+	}
+	return dedup, nil
+}
+
+// dedup_key is what a delivery is known by, empty when it can't be.
+func dedup_key(hdr *Header, env *Envelope) string {
+	id := message_id(hdr.Get("Message-ID"))
+	if id == "" {
+		return ""
+	}
+	return id + " " + strings.ToLower(env.Recipient)
+}
+
+// dedup_seen reports whether a message was already delivered, a state
+// that can't be read letting the delivery through.
+func dedup_seen(cfg *Config, env *Envelope, key string) bool {
+	store, err := state_open(cfg, env.Home)
+	if err != nil {
+		log_info("error opening state: %s", err)
+		return false
+	}
+	defer store.Close()
+	_, seen, err := store.Get(DEDUP_NS, key)
+	if err != nil {
+		log_info("error looking up duplicates: %s", err)
+	}
+	return seen
+}
+
+// dedup_record remembers a delivery once it is committed, a delivery
+// failing before that must not hide its retry.
+func dedup_record(cfg *Config, env *Envelope, key string) {
+	store, err := state_open(cfg, env.Home)
+	if err != nil {
+		log_info("error opening state: %s", err)
+		return
+	}
+	defer store.Close()
+	if err := store.Set(DEDUP_NS, key, "1", cfg.Dedup.TTL); err != nil {
+		log_info("error recording delivery: %s", err)
+	}
+}
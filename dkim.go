@@ -0,0 +1,381 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const DKIM_TIMEOUT = 10 * time.Second
+
+// signatures beyond these are not verified
+const DKIM_SIGNATURES_MAX = 8
+
+// DKIMResult is the outcome of verifying a DKIM-Signature, in the terms
+// of RFC 8601: pass, fail, neutral, policy, temperror or permerror.
+type DKIMResult struct {
+	Result    string
+	Reason    string
+	Domain    string
+	Selector  string
+	Identity  string
+	Signature string
+}
+
+var dkimSignatureRegexp = regexp.MustCompile(`([:;][ \t\n]*b[ \t\n]*=)[^;]*`)
+
+// dkim_tags splits a tag list, whitespace being dropped from the values
+// where it may only be folding.
+func dkim_tags(value string) map[string]string {
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(value, ";") {
+		name, value, found := strings.Cut(tag, "=")
+		if !found {
+			continue
+		}
+		tags[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+	for _, name := range []string{"b", "bh", "h", "p"} {
+		if value, found := tags[name]; found {
+			tags[name] = strings.Join(strings.Fields(value), "")
+		}
+	}
+	return tags
+}
+
+// dkim_header_relaxed canonicalizes a header field the relaxed way:
+// lowercase name, unfolded value with its runs of whitespace reduced.
+func dkim_header_relaxed(raw string) string {
+	name, value, _ := strings.Cut(raw, ":")
+	return strings.ToLower(strings.TrimSpace(name)) + ":" + strings.Join(strings.Fields(value), " ")
+}
+
+func dkim_header(field HeaderField, relaxed bool) string {
+	if relaxed {
+		return dkim_header_relaxed(strings.Join(field.Raw, ""))
+	}
+	return strings.Join(field.Raw, "\r\n")
+}
+
+// dkimBody hashes a body as it is canonicalized, empty lines being held
+// back until something follows them so that those ending the body are
+// left out.
+type dkimBody struct {
+	hash    hash.Hash
+	relaxed bool
+	limit   int64
+	written int64
+	line    int
+	blank   int
+	space   bool
+	cr      bool
+}
+
+func (body *dkimBody) emit(data string) {
+	if body.limit >= 0 {
+		data = data[:min(int64(len(data)), max(body.limit-body.written, 0))]
+	}
+	io.WriteString(body.hash, data)
+	body.written += int64(len(data))
+}
+
+func (body *dkimBody) write(c byte) {
+	if body.cr {
+		body.cr = false
+		if c != '\n' {
+			body.write_char('\r')
+		}
+	}
+	switch {
+	case c == '\r':
+		body.cr = true
+	case c == '\n':
+		body.space = false
+		if body.line == 0 {
+			body.blank++
+		} else {
+			body.emit("\r\n")
+		}
+		body.line = 0
+	case body.relaxed && (c == ' ' || c == '\t'):
+		body.space = true
+	default:
+		body.write_char(c)
+	}
+}
+
+func (body *dkimBody) write_char(c byte) {
+	if body.line == 0 {
+		body.emit(strings.Repeat("\r\n", body.blank))
+		body.blank = 0
+	}
+	if body.space {
+		body.emit(" ")
+		body.space = false
+	}
+	body.emit(string(c))
+	body.line++
+}
+
+func (body *dkimBody) close() {
+	if body.cr {
+		body.cr = false
+		body.write_char('\r')
+	}
+	if body.line != 0 {
+		body.emit("\r\n")
+	} else if !body.relaxed && body.written == 0 {
+		body.emit("\r\n")
+	}
+}
+
+// dkim_key fetches the public key of a selector.
+func dkim_key(domain string, selector string) (crypto.PublicKey, string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), DKIM_TIMEOUT)
+	defer cancel()
+	var records []string
+	err := chaos_inject("dns", DKIM_TIMEOUT)
+	if err == nil {
+		records, err = net.DefaultResolver.LookupTXT(ctx, selector+"._domainkey."+domain)
+	}
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return nil, "permerror", fmt.Errorf("no key for signature")
+		}
+		return nil, "temperror", fmt.Errorf("key unavailable")
+	}
+	if len(records) == 0 {
+		return nil, "permerror", fmt.Errorf("no key for signature")
+	}
+	tags := dkim_tags(records[0])
+	if version, found := tags["v"]; found && version != "DKIM1" {
+		return nil, "permerror", fmt.Errorf("invalid key version")
+	}
+	if tags["p"] == "" {
+		return nil, "fail", fmt.Errorf("key revoked")
+	}
+	data, err := base64.StdEncoding.DecodeString(tags["p"])
+	if err != nil {
+		return nil, "permerror", fmt.Errorf("invalid key")
+	}
+	switch tags["k"] {
+	case "", "rsa":
+		key, err := x509.ParsePKIXPublicKey(data)
+		if err != nil {
+			if key, err = x509.ParsePKCS1PublicKey(data); err != nil {
+				return nil, "permerror", fmt.Errorf("invalid key")
+			}
+		}
+		if key, ok := key.(*rsa.PublicKey); ok && key.N.BitLen() >= 1024 {
+			return key, "", nil
+		}
+	case "ed25519":
+		if len(data) == ed25519.PublicKeySize {
+			return ed25519.PublicKey(data), "", nil
+		}
+	}
+	return nil, "permerror", fmt.Errorf("unsupported key")
+}
+
+// dkim_verify checks one DKIM-Signature of a message, index being that
+// of the field in the header.
+func dkim_verify(pathname string, hdr *Header, index int, now time.Time) *DKIMResult {
+	signature := hdr.Fields[index]
+	tags := dkim_tags(signature.Value)
+	result := &DKIMResult{Domain: strings.ToLower(tags["d"]), Selector: tags["s"], Identity: tags["i"]}
+	if len(tags["b"]) >= 8 {
+		result.Signature = tags["b"][:8]
+	}
+	fail := func(status string, reason string) *DKIMResult {
+		result.Result, result.Reason = status, reason
+		return result
+	}
+
+	if tags["v"] != "1" || result.Domain == "" || result.Selector == "" || tags["b"] == "" || tags["bh"] == "" || tags["h"] == "" {
+		return fail("permerror", "invalid signature")
+	}
+	if result.Identity == "" {
+		result.Identity = "@" + result.Domain
+	}
+	_, identity, _ := strings.Cut(strings.ToLower(result.Identity), "@")
+	if identity != result.Domain && !strings.HasSuffix(identity, "."+result.Domain) {
+		return fail("permerror", "identity outside of domain")
+	}
+	signed := strings.Split(strings.ToLower(tags["h"]), ":")
+	from := false
+	for _, name := range signed {
+		from = from || strings.TrimSpace(name) == "from"
+	}
+	if !from {
+		return fail("permerror", "From not signed")
+	}
+	if expiry, err := strconv.ParseInt(tags["x"], 10, 64); err == nil && now.Unix() > expiry {
+		return fail("neutral", "signature expired")
+	}
+
+	var verify func(key crypto.PublicKey, hashed []byte, sig []byte) bool
+	switch tags["a"] {
+	case "rsa-sha256":
+		verify = func(key crypto.PublicKey, hashed []byte, sig []byte) bool {
+			rsaKey, ok := key.(*rsa.PublicKey)
+			return ok && rsa.VerifyPKCS1v15(rsaKey, crypto.SHA256, hashed, sig) == nil
+		}
+	case "ed25519-sha256":
+		verify = func(key crypto.PublicKey, hashed []byte, sig []byte) bool {
+			edKey, ok := key.(ed25519.PublicKey)
+			return ok && ed25519.Verify(edKey, hashed, sig)
+		}
+	case "rsa-sha1":
+		// RFC 8301 deprecates it
+		return fail("policy", "rsa-sha1 not accepted")
+	default:
+		return fail("permerror", "unsupported algorithm")
+	}
+	headerCanon, bodyCanon, _ := strings.Cut(tags["c"], "/")
+	if headerCanon == "" {
+		headerCanon = "simple"
+	}
+	if bodyCanon == "" {
+		bodyCanon = "simple"
+	}
+	if headerCanon != "simple" && headerCanon != "relaxed" || bodyCanon != "simple" && bodyCanon != "relaxed" {
+		return fail("permerror", "unsupported canonicalization")
+	}
+
+	body := &dkimBody{hash: sha256.New(), relaxed: bodyCanon == "relaxed", limit: -1}
+	if value, found := tags["l"]; found {
+		limit, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || limit < 0 {
+			return fail("permerror", "invalid body length")
+		}
+		body.limit = limit
+	}
+	if err := dkim_body(pathname, body); err != nil {
+		return fail("temperror", "body unreadable")
+	}
+	if base64.StdEncoding.EncodeToString(body.hash.Sum(nil)) != tags["bh"] {
+		return fail("fail", "body hash mismatch")
+	}
+
+	key, status, err := dkim_key(result.Domain, result.Selector)
+	if err != nil {
+		return fail(status, err.Error())
+	}
+
+	// fields are taken from the bottom up, one instance per mention
+	headers := sha256.New()
+	used := make(map[int]bool)
+	for _, name := range signed {
+		name = strings.TrimSpace(name)
+		for i := len(hdr.Fields) - 1; i >= 0; i-- {
+			if i == index || used[i] || !strings.EqualFold(hdr.Fields[i].Name, name) {
+				continue
+			}
+			used[i] = true
+			io.WriteString(headers, dkim_header(hdr.Fields[i], headerCanon == "relaxed")+"\r\n")
+			break
+		}
+	}
+	unsigned := signature
+	unsigned.Raw = strings.Split(dkimSignatureRegexp.ReplaceAllString(strings.Join(signature.Raw, "\n"), "$1"), "\n")
+	io.WriteString(headers, dkim_header(unsigned, headerCanon == "relaxed"))
+
+	sig, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		return fail("permerror", "invalid signature")
+	}
+	if !verify(key, headers.Sum(nil), sig) {
+		return fail("fail", "signature mismatch")
+	}
+	result.Result = "pass"
+	return result
+}
+
+// dkim_body hashes the body of a stored message.
+func dkim_body(pathname string, body *dkimBody) error {
+	file, err := os.Open(pathname)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReaderSize(file, 64*1024)
+	for {
+		line, _, err := line_read(reader, LINE_READ_MAX)
+		if line == "" || err != nil {
+			if err != nil && err != io.EOF {
+				return err
+			}
+			break
+		}
+	}
+	for {
+		c, err := reader.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		body.write(c)
+	}
+	body.close()
+	return nil
+}
+
+// dkim_check verifies the DKIM signatures of a stored message.
+func dkim_check(pathname string, now time.Time) ([]*DKIMResult, error) {
+	file, err := os.Open(pathname)
+	if err != nil {
+		return nil, err
+	}
+	hdr, err := header_read(file)
+	file.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]*DKIMResult, 0)
+	for i, field := range hdr.Fields {
+		if !strings.EqualFold(field.Name, "DKIM-Signature") {
+			continue
+		}
+		if len(results) == DKIM_SIGNATURES_MAX {
+			break
+		}
+		results = append(results, dkim_verify(pathname, hdr, i, now))
+	}
+	return results, nil
+}
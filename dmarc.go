@@ -0,0 +1,211 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// dmarcFeedback is the part of an RFC 7489 aggregate report kept.
+type dmarcFeedback struct {
+	XMLName  xml.Name `xml:"feedback"`
+	Metadata struct {
+		OrgName   string `xml:"org_name"`
+		ReportId  string `xml:"report_id"`
+		DateRange struct {
+			Begin int64 `xml:"begin"`
+			End   int64 `xml:"end"`
+		} `xml:"date_range"`
+	} `xml:"report_metadata"`
+	Policy struct {
+		Domain string `xml:"domain"`
+		P      string `xml:"p"`
+	} `xml:"policy_published"`
+	Records []struct {
+		Row struct {
+			SourceIp string `xml:"source_ip"`
+			Count    int64  `xml:"count"`
+			Policy   struct {
+				Disposition string `xml:"disposition"`
+				DKIM        string `xml:"dkim"`
+				SPF         string `xml:"spf"`
+			} `xml:"policy_evaluated"`
+		} `xml:"row"`
+		Identifiers struct {
+			HeaderFrom string `xml:"header_from"`
+		} `xml:"identifiers"`
+	} `xml:"record"`
+}
+
+// DmarcReport is the normalized summary of an aggregate report.
+type DmarcReport struct {
+	Org      string        `json:"org"`
+	ReportId string        `json:"report_id"`
+	Domain   string        `json:"domain"`
+	Policy   string        `json:"policy"`
+	Begin    time.Time     `json:"begin"`
+	End      time.Time     `json:"end"`
+	Records  []DmarcRecord `json:"records"`
+}
+
+type DmarcRecord struct {
+	SourceIp    string `json:"source_ip"`
+	Count       int64  `json:"count"`
+	HeaderFrom  string `json:"header_from"`
+	Disposition string `json:"disposition"`
+	DKIM        string `json:"dkim"`
+	SPF         string `json:"spf"`
+}
+
+func init() {
+	report_register(&ReportKind{
+		Name:      "dmarc",
+		Folder:    ".Reports.DMARC",
+		parse:     dmarc_parse,
+		key:       dmarc_key,
+		summarize: dmarc_summarize,
+	})
+}
+
+// dmarc_parse recognizes an aggregate report, an XML document possibly
+// compressed, whatever the content type senders chose to label it with.
+func dmarc_parse(part *MimePart) (any, error) {
+	switch part.MediaType {
+	case "application/zip", "application/x-zip-compressed", "application/gzip", "application/x-gzip",
+		"application/xml", "text/xml", "application/octet-stream":
+	default:
+		return nil, nil
+	}
+
+	data, err := report_payload(part)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Contains(data[:min(len(data), 1024)], []byte("<feedback")) {
+		return nil, nil
+	}
+
+	var feedback dmarcFeedback
+	if err := xml.Unmarshal(data, &feedback); err != nil {
+		return nil, err
+	}
+	report := &DmarcReport{
+		Org:      feedback.Metadata.OrgName,
+		ReportId: feedback.Metadata.ReportId,
+		Domain:   strings.ToLower(feedback.Policy.Domain),
+		Policy:   feedback.Policy.P,
+		Begin:    time.Unix(feedback.Metadata.DateRange.Begin, 0).UTC(),
+		End:      time.Unix(feedback.Metadata.DateRange.End, 0).UTC(),
+		Records:  make([]DmarcRecord, 0, len(feedback.Records)),
+	}
+	for _, record := range feedback.Records {
+		report.Records = append(report.Records, DmarcRecord{
+			SourceIp:    record.Row.SourceIp,
+			Count:       record.Row.Count,
+			HeaderFrom:  strings.ToLower(record.Identifiers.HeaderFrom),
+			Disposition: record.Row.Policy.Disposition,
+			DKIM:        record.Row.Policy.DKIM,
+			SPF:         record.Row.Policy.SPF,
+		})
+	}
+	return report, nil
+}
+
+func dmarc_key(summary json.RawMessage) string {
+	var report DmarcReport
+	if json.Unmarshal(summary, &report) != nil || report.ReportId == "" {
+		return ""
+	}
+	return report.Org + "\x00" + report.ReportId
+}
+
+// DmarcSource aggregates what reporters saw of a sending address.
+type DmarcSource struct {
+	Domain      string `json:"domain"`
+	SourceIp    string `json:"source_ip"`
+	Messages    int64  `json:"messages"`
+	DKIMPass    int64  `json:"dkim_pass"`
+	SPFPass     int64  `json:"spf_pass"`
+	Quarantined int64  `json:"quarantined"`
+	Rejected    int64  `json:"rejected"`
+}
+
+// dmarc_summarize reports, per domain and source address, how many
+// messages passed DKIM and SPF alignment and what was done with them.
+func dmarc_summarize(summaries []json.RawMessage, asJson bool) error {
+	sources := make(map[string]*DmarcSource)
+	for _, summary := range summaries {
+		var report DmarcReport
+		if err := json.Unmarshal(summary, &report); err != nil {
+			continue
+		}
+		for _, record := range report.Records {
+			key := report.Domain + " " + record.SourceIp
+			source, exists := sources[key]
+			if !exists {
+				source = &DmarcSource{Domain: report.Domain, SourceIp: record.SourceIp}
+				sources[key] = source
+			}
+			source.Messages += record.Count
+			if record.DKIM == "pass" {
+				source.DKIMPass += record.Count
+			}
+			if record.SPF == "pass" {
+				source.SPFPass += record.Count
+			}
+			switch record.Disposition {
+			case "quarantine":
+				source.Quarantined += record.Count
+			case "reject":
+				source.Rejected += record.Count
+			}
+		}
+	}
+
+	sorted := make([]*DmarcSource, 0, len(sources))
+	for _, source := range sources {
+		sorted = append(sorted, source)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Domain != sorted[j].Domain {
+			return sorted[i].Domain < sorted[j].Domain
+		}
+		return sorted[i].Messages > sorted[j].Messages
+	})
+
+	if asJson {
+		data, err := json.MarshalIndent(sorted, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s\n", data)
+		return nil
+	}
+
+	fmt.Printf("%d reports\n", len(summaries))
+	for _, source := range sorted {
+		fmt.Printf("%s %s: %d messages, %d dkim pass, %d spf pass, %d quarantined, %d rejected\n",
+			source.Domain, source.SourceIp, source.Messages, source.DKIMPass, source.SPFPass, source.Quarantined, source.Rejected)
+	}
+	return nil
+}
@@ -0,0 +1,203 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const DOMAINS_TIMEOUT = 30 * time.Second
+
+// a published list larger than this is not a list of domains
+const DOMAINS_MAX = 16 * 1024 * 1024
+
+// The freemail and disposable lists tell the senders of webmail services
+// and of throwaway addresses apart, for the sender-is-freemail and
+// sender-is-disposable conditions. A list is bundled for each, the
+// update-domains subcommand replacing it with one fetched from the URL
+// configured:
+//
+//	domains disposable "https://example.org/disposable.txt"
+//
+// Fetched lists are kept in ~/.pmda/domains, each a list file of domains.
+var domainLists = map[string][]string{
+	"freemail": {
+		"126.com", "163.com", "aol.com", "fastmail.com", "free.fr", "gmail.com",
+		"gmx.com", "gmx.de", "gmx.net", "googlemail.com", "hotmail.co.uk",
+		"hotmail.com", "hotmail.fr", "icloud.com", "laposte.net", "libero.it",
+		"live.com", "mac.com", "mail.com", "mail.ru", "me.com", "msn.com",
+		"orange.fr", "outlook.com", "proton.me", "protonmail.com", "qq.com",
+		"tutanota.com", "web.de", "yahoo.co.uk", "yahoo.com", "yahoo.fr",
+		"yandex.com", "yandex.ru", "ymail.com", "zoho.com",
+	},
+	"disposable": {
+		"10minutemail.com", "burnermail.io", "discard.email", "dispostable.com",
+		"emailondeck.com", "fakeinbox.com", "getnada.com", "guerrillamail.com",
+		"guerrillamail.net", "mailcatch.com", "maildrop.cc", "mailinator.com",
+		"mailnesia.com", "mintemail.com", "mohmal.com", "sharklasers.com",
+		"spamgourmet.com", "throwawaymail.com", "trashmail.com", "yopmail.com",
+		"yopmail.fr",
+	},
+}
+
+func domains_parse(args []string) (string, string, error) {
+	if len(args) != 2 || domainLists[args[0]] == nil {
+		return "", "", fmt.Errorf("usage: domains freemail|disposable url")
+	}
+	if !strings.HasPrefix(args[1], "https://") && !strings.HasPrefix(args[1], "http://") {
+		return "", "", fmt.Errorf("invalid url: %s", args[1])
+	}
+	return args[0], args[1], nil
+}
+
+func domains_path(homedir string, name string) string {
+	return filepath.Join(homedir, ".pmda", "domains", name)
+}
+
+// domains_read returns a domain list, that last fetched or the bundled
+// one if it never was.
+func domains_read(homedir string, name string) map[string]bool {
+	domains, err := list_read(domains_path(homedir, name))
+	if err != nil {
+		log_info("error reading %s domains: %s", name, err)
+	}
+	if len(domains) != 0 {
+		return domains
+	}
+	domains = make(map[string]bool)
+	for _, domain := range domainLists[name] {
+		domains[domain] = true
+	}
+	return domains
+}
+
+// sender_in_domains reports whether the author of a message, or the
+// envelope sender of a message without one, is in a domain of a list or
+// a subdomain of it.
+func sender_in_domains(env *Envelope, hdr *Header, name string) bool {
+	sender := correspondent_address(env.Sender)
+	if authors := hdr.Addresses("From"); len(authors) != 0 {
+		sender = authors[0]
+	}
+	if address_domain(sender) == "" {
+		return false
+	}
+	return blocklist_match(domains_read(env.Home, name), sender)
+}
+
+// domains_fetch returns the domains of a published list, one per line,
+// comments and entries that are not domains being ignored.
+func domains_fetch(url string) ([]string, error) {
+	client := &http.Client{Timeout: DOMAINS_TIMEOUT}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	domains := make([]string, 0)
+	scanner := bufio.NewScanner(io.LimitReader(resp.Body, DOMAINS_MAX))
+	for scanner.Scan() {
+		domain := strings.ToLower(list_entry(scanner.Text()))
+		if blockDomainRegexp.MatchString(domain) {
+			domains = append(domains, domain)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(domains) == 0 {
+		return nil, fmt.Errorf("no domains found")
+	}
+	sort.Strings(domains)
+	return domains, nil
+}
+
+// domains_write replaces a domain list atomically.
+func domains_write(pathname string, url string, domains []string) error {
+	if err := os.MkdirAll(filepath.Dir(pathname), 0700); err != nil {
+		return err
+	}
+	var data strings.Builder
+	fmt.Fprintf(&data, "# fetched from %s on %s\n", url, time.Now().Format("2006-01-02"))
+	for _, domain := range domains {
+		data.WriteString(domain + "\n")
+	}
+	tmpname := fmt.Sprintf("%s.%d", pathname, os.Getpid())
+	if err := os.WriteFile(tmpname, []byte(data.String()), 0600); err != nil {
+		os.Remove(tmpname)
+		return err
+	}
+	if err := os.Rename(tmpname, pathname); err != nil {
+		os.Remove(tmpname)
+		return err
+	}
+	return nil
+}
+
+var updateDomainsFlags = flag.NewFlagSet("update-domains", flag.ExitOnError)
+
+// update_domains_main implements "mail.pmda update-domains", which
+// refreshes the domain lists from their configured URLs, for use from
+// cron. A list that cannot be fetched is left as it was.
+func update_domains_main(args []string) int {
+	updateDomainsFlags.Parse(args)
+
+	homedir := os.Getenv("HOME")
+	cfg, err := config_read(filepath.Join(homedir, ".pmda.conf"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading configuration: %s\n", err)
+		return 1
+	}
+	if len(cfg.Domains) == 0 {
+		fmt.Fprintf(os.Stderr, "Error: no domain list url in %s\n", filepath.Join(homedir, ".pmda.conf"))
+		return 1
+	}
+
+	names := make([]string, 0, len(cfg.Domains))
+	for name := range cfg.Domains {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	status := 0
+	for _, name := range names {
+		url := cfg.Domains[name]
+		domains, err := domains_fetch(url)
+		if err == nil {
+			err = domains_write(domains_path(homedir, name), url, domains)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error updating %s domains from %s: %s\n", name, url, err)
+			status = 1
+			continue
+		}
+		fmt.Printf("%s: %d domains\n", name, len(domains))
+	}
+	return status
+}
@@ -0,0 +1,150 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var dryRun bool
+
+func init() {
+	help := "print where the message would be delivered and why, without delivering it"
+	flag.BoolVar(&dryRun, "n", false, help)
+	flag.BoolVar(&dryRun, "dry-run", false, help)
+}
+
+// dryrun_message establishes the facts the delivery would about a message,
+// those of reclassify and those only known at delivery time.
+func dryrun_message(cfg *Config, env *Envelope, maildir string, pathname string, hdr *Header) *Message {
+	violation := ""
+	if limits := &cfg.Structure; limits.Headers != 0 && len(hdr.Fields) > limits.Headers {
+		violation = fmt.Sprintf("more than %d header fields", limits.Headers)
+	} else if limits.mime() {
+		if err := mime_scan_file(pathname, hdr.Get("Content-Type"), limits); err != nil {
+			violation = err.Error()
+		}
+	}
+
+	msg := reclassify_message(cfg, env, maildir, pathname, hdr)
+	msg.Violation = violation
+	id := message_id(hdr.Get("Message-ID"))
+	msg.Bypass = bypass_check(cfg, env, bypass_strip(cfg, hdr), id, pathname)
+	if cfg.Blocklist != nil {
+		msg.Blocked = blocklist_check(cfg, env, hdr)
+	}
+	if cfg.Mute != nil {
+		msg.Muted = mute_check(cfg, env, hdr)
+	}
+	scan := cfg.ScanEncrypted || !msg.Encrypted
+	if len(cfg.Reports) != 0 && scan {
+		msg.Report = reports_detect(cfg, pathname)
+	}
+	if cfg.Importance != nil {
+		msg.Scores["importance"] = importance_score(cfg, env, msg)
+	}
+	if script, err := sieve_load(env.Home); err != nil {
+		log_info("error loading sieve script, using the built-in classification: %s", err)
+	} else if script != nil && violation == "" {
+		msg.Sieve = sieve_evaluate(script, hdr, env, message_size(pathname))
+	}
+	return msg
+}
+
+// dryrun_main implements -n, which runs the classification over the
+// message read from stdin, as the external filters left it, and prints
+// the decision, leaving the maildir untouched:
+//
+//	folder:   .Lists.Debian
+//	verdict:  rule at line 12
+//	trace:    line 10: no match
+//	          line 12: matched, folder .Lists.Debian
+func dryrun_main(cfg *Config, env *Envelope, maildir string) int {
+	// classifiers read the message from a file, one out of the maildir
+	spool, err := os.CreateTemp("", "pmda-dryrun-*")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error spooling message: %s\n", err)
+		return EX_TEMPFAIL
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	reader := bufio.NewReader(os.Stdin)
+	if peek, _ := reader.Peek(5); string(peek) == "From " {
+		line_read(reader, LINE_READ_MAX)
+	}
+	if _, err := io.Copy(spool, reader); err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading from stdin: %s\n", err)
+		return EX_TEMPFAIL
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		fmt.Fprintf(os.Stderr, "Error spooling message: %s\n", err)
+		return EX_TEMPFAIL
+	}
+	hdr, err := header_read(spool)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading header: %s\n", err)
+		return EX_TEMPFAIL
+	}
+
+	now := time.Now()
+	msg := dryrun_message(cfg, env, maildir, spool.Name(), hdr)
+	decision := Classify(cfg, msg, now)
+	folder := decision.Folder
+	if cfg.Overflow != 0 {
+		folder = folder_overflow(cfg, maildir, folder, now)
+	}
+
+	switch {
+	case decision.Reason == "sieve" && msg.Sieve.Reject != "":
+		fmt.Printf("reject:   %s\n", msg.Sieve.Reject)
+	case decision.Reason == "sieve" && len(msg.Sieve.Deliveries) == 0:
+		fmt.Printf("discard\n")
+	case decision.Discard:
+		fmt.Printf("redirect: %s\n", strings.Join(decision.Reinject, ", "))
+	default:
+		created := ""
+		if _, err := os.Stat(filepath.Join(maildir, folder)); err != nil && folder != "" {
+			created = " (created on delivery)"
+		}
+		fmt.Printf("folder:   %s%s\n", folder_name(folder), created)
+		if decision.Reason == "sieve" {
+			for _, delivery := range msg.Sieve.Deliveries[1:] {
+				fmt.Printf("copy:     %s\n", folder_name(delivery.Folder))
+			}
+		}
+		for _, address := range decision.Reinject {
+			fmt.Printf("copy-to:  %s\n", address)
+		}
+	}
+	fmt.Printf("verdict:  %s\n", decision.Reason)
+	for i, line := range decision.Trace {
+		if i == 0 {
+			fmt.Printf("trace:    %s\n", line)
+		} else {
+			fmt.Printf("          %s\n", line)
+		}
+	}
+	return 0
+}
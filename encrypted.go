@@ -0,0 +1,56 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"fmt"
+	"mime"
+	"strings"
+)
+
+// encrypted_detect reports whether a message is encrypted as a whole,
+// PGP/MIME or S/MIME, from its Content-Type alone. Parts encrypted inside
+// an otherwise readable message are not looked for.
+//
+// Content scanners only see ciphertext in such messages, so they can be
+// skipped for them:
+//
+//	encrypted scan off
+func encrypted_detect(hdr *Header) bool {
+	mediaType, params, err := mime.ParseMediaType(hdr.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	switch mediaType {
+	case "multipart/encrypted", "application/pgp-encrypted":
+		return true
+	case "application/pkcs7-mime", "application/x-pkcs7-mime":
+		// smime-type is optional, and most agents omitting it encrypt
+		switch strings.ToLower(params["smime-type"]) {
+		case "", "enveloped-data", "authenveloped-data":
+			return true
+		}
+	}
+	return false
+}
+
+func encrypted_parse(args []string) (bool, error) {
+	if len(args) != 2 || args[0] != "scan" || (args[1] != "on" && args[1] != "off") {
+		return false, fmt.Errorf("usage: encrypted scan on|off")
+	}
+	return args[1] == "on", nil
+}
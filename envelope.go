@@ -0,0 +1,43 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"os"
+)
+
+// Envelope holds what the MTA told us about the delivery, OpenSMTPD and
+// most other MTAs export it in the environment of the MDA.
+type Envelope struct {
+	Sender            string `json:"sender"`
+	Recipient         string `json:"recipient"`
+	OriginalRecipient string `json:"original_recipient"`
+	User              string `json:"user"`
+	Home              string `json:"-"`
+	Extension         string `json:"extension"`
+}
+
+func envelope_from_environ() *Envelope {
+	return &Envelope{
+		Sender:            os.Getenv("SENDER"),
+		Recipient:         os.Getenv("RECIPIENT"),
+		OriginalRecipient: os.Getenv("ORIGINAL_RECIPIENT"),
+		User:              os.Getenv("USER"),
+		Home:              os.Getenv("HOME"),
+		Extension:         os.Getenv("EXTENSION"),
+	}
+}
@@ -0,0 +1,150 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// EventLogConfig is where delivery events go, a file of JSON lines under
+// the home directory unless absolute, or a descriptor set up by the
+// caller:
+//
+//	events file ".pmda/events.json"
+//	events fd 3
+type EventLogConfig struct {
+	File string
+	Fd   int
+}
+
+func events_parse(args []string) (*EventLogConfig, error) {
+	if len(args) != 2 {
+		return nil, fmt.Errorf("usage: events file pathname|fd descriptor")
+	}
+	switch args[0] {
+	case "file":
+		return &EventLogConfig{File: args[1], Fd: -1}, nil
+	case "fd":
+		fd, err := strconv.Atoi(args[1])
+		if err != nil || fd < 0 {
+			return nil, fmt.Errorf("invalid descriptor: %s", args[1])
+		}
+		return &EventLogConfig{Fd: fd}, nil
+	}
+	return nil, fmt.Errorf("usage: events file pathname|fd descriptor")
+}
+
+// the event log of the delivery, nil unless configured
+var eventWriter *os.File
+
+// EventRule is the match rule that decided, Line being 0 for the
+// built-in ones.
+type EventRule struct {
+	Line   int      `json:"line"`
+	Action string   `json:"action"`
+	Args   []string `json:"args,omitempty"`
+}
+
+// DeliveryLogEvent is the object logged for every delivery, whatever its
+// outcome, fields not known by then being left out.
+type DeliveryLogEvent struct {
+	Time      time.Time  `json:"time"`
+	Start     time.Time  `json:"start"`
+	Duration  float64    `json:"duration"`
+	Outcome   string     `json:"outcome"`
+	Sender    string     `json:"sender"`
+	Recipient string     `json:"recipient"`
+	MessageId string     `json:"message_id,omitempty"`
+	Size      int64      `json:"size"`
+	Verdict   string     `json:"verdict,omitempty"`
+	Rule      *EventRule `json:"rule,omitempty"`
+	Trace     []string   `json:"trace,omitempty"`
+	Folder    string     `json:"folder,omitempty"`
+	Filename  string     `json:"filename,omitempty"`
+}
+
+// events_open opens the event log if the configuration asks for it, the
+// delivery proceeds without should that fail.
+func events_open(cfg *Config, env *Envelope) {
+	if cfg.EventLog == nil {
+		return
+	}
+	if cfg.EventLog.File == "" {
+		if eventWriter = os.NewFile(uintptr(cfg.EventLog.Fd), "events"); eventWriter == nil {
+			log_error("Error opening event log: invalid descriptor %d", cfg.EventLog.Fd)
+		}
+		return
+	}
+	pathname := cfg.EventLog.File
+	if !filepath.IsAbs(pathname) {
+		pathname = filepath.Join(env.Home, pathname)
+	}
+	if err := os.MkdirAll(filepath.Dir(pathname), 0700); err != nil {
+		log_error("Error opening event log: %s", err)
+		return
+	}
+	file, err := os.OpenFile(pathname, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		log_error("Error opening event log: %s", err)
+		return
+	}
+	eventWriter = file
+}
+
+// events_delivery logs the outcome of a delivery as a JSON object on a
+// line of its own, written at once so that concurrent deliveries do not
+// interleave.
+func events_delivery(outcome string) {
+	if eventWriter == nil {
+		return
+	}
+	now := time.Now()
+	event := &DeliveryLogEvent{
+		Time:      now,
+		Start:     deliveryLog.Start,
+		Duration:  now.Sub(deliveryLog.Start).Seconds(),
+		Outcome:   outcome,
+		Sender:    deliveryLog.Sender,
+		Recipient: deliveryLog.Recipient,
+		MessageId: deliveryLog.MessageId,
+		Size:      usage.Bytes,
+		Verdict:   deliveryLog.Verdict,
+		Trace:     deliveryLog.Trace,
+		Folder:    usage.Folder,
+		Filename:  deliveryLog.Filename,
+	}
+	if rule := deliveryLog.Rule; rule != nil {
+		event.Rule = &EventRule{Line: rule.Line, Action: rule.Action, Args: rule.Args}
+	}
+	// Message-IDs and addresses read better with their <> left alone
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	err := encoder.Encode(event)
+	if err == nil {
+		_, err = eventWriter.Write(buf.Bytes())
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error logging event: %s\n", err)
+	}
+}
@@ -0,0 +1,226 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const EXPIRE_NS = "expire"
+
+// the junk folders are only swept once a day from deliveries
+const EXPIRE_INTERVAL = 24 * time.Hour
+
+// JunkExpiry is the two-stage junk flow:
+//
+//	expire junk probation 14 trash 30
+//
+// Junk left unread for probation days moves to .Junk.Trash, the Trash
+// subfolder of the junk folder, where it is deleted trash days later.
+// Junk that was read stays where the user left it, ages are counted
+// from delivery.
+type JunkExpiry struct {
+	Probation int
+	Trash     int
+}
+
+func expire_parse(args []string) (*JunkExpiry, error) {
+	if len(args) != 5 || args[0] != "junk" || args[1] != "probation" || args[3] != "trash" {
+		return nil, fmt.Errorf("usage: expire junk probation days trash days")
+	}
+	probation, err := strconv.Atoi(args[2])
+	if err != nil || probation < 1 {
+		return nil, fmt.Errorf("invalid probation: %s", args[2])
+	}
+	trash, err := strconv.Atoi(args[4])
+	if err != nil || trash < 1 {
+		return nil, fmt.Errorf("invalid trash retention: %s", args[4])
+	}
+	return &JunkExpiry{Probation: probation, Trash: trash}, nil
+}
+
+// message_delivered returns when a message was delivered, as recorded at
+// the start of its filename, or its mtime for filenames not made so.
+func message_delivered(pathname string, entry fs.DirEntry) time.Time {
+	prefix, _, _ := strings.Cut(entry.Name(), ".")
+	if seconds, err := strconv.ParseInt(prefix, 10, 64); err == nil && seconds > 0 {
+		return time.Unix(seconds, 0)
+	}
+	if info, err := entry.Info(); err == nil {
+		return info.ModTime()
+	}
+	return time.Now()
+}
+
+// message_seen reports whether a message of a cur subdirectory carries
+// the seen flag, those still in new never do.
+func message_seen(filename string) bool {
+	_, info, found := strings.Cut(filename, ":2,")
+	return found && strings.ContainsRune(info, 'S')
+}
+
+// junk_expire runs both stages of the junk flow over a maildir and
+// returns how many messages were moved and deleted, to the trash unless
+// it is off.
+func junk_expire(cfg *Config, homedir string, maildir string, now time.Time) (int, int, error) {
+	expiry := cfg.JunkExpiry
+	if special_folder(cfg, "junk") == "" {
+		return 0, 0, nil
+	}
+	junk := filepath.Join(maildir, special_folder(cfg, "junk"))
+	trash := junk + ".Trash"
+	depth := shard_depth(maildir)
+
+	moved := 0
+	probation := now.AddDate(0, 0, -expiry.Probation)
+	for _, subdir := range []string{"new", "cur"} {
+		err := maildir_walk(filepath.Join(junk, subdir), func(pathname string, entry fs.DirEntry) error {
+			if message_seen(entry.Name()) || !message_delivered(pathname, entry).Before(probation) {
+				return nil
+			}
+			if moved == 0 {
+				maildir_mkdirs(trash)
+			}
+			target, err := maildir_path(filepath.Join(trash, subdir), entry.Name(), depth)
+			if err != nil {
+				return err
+			}
+			if err := os.Rename(pathname, target); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			moved++
+			return nil
+		})
+		if err != nil && !os.IsNotExist(err) {
+			return moved, 0, err
+		}
+	}
+
+	deleted := 0
+	limit := probation.AddDate(0, 0, -expiry.Trash)
+	for _, subdir := range []string{"new", "cur"} {
+		err := maildir_walk(filepath.Join(trash, subdir), func(pathname string, entry fs.DirEntry) error {
+			if !message_delivered(pathname, entry).Before(limit) {
+				return nil
+			}
+			if err := trash_remove(cfg, homedir, maildir, pathname, special_folder(cfg, "junk")+".Trash", "expire"); err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			deleted++
+			return nil
+		})
+		if err != nil && !os.IsNotExist(err) {
+			return moved, deleted, err
+		}
+	}
+	return moved, deleted, nil
+}
+
+// expire_run is the expire subsystem as run after a delivery: role
+// account folders every time, the junk flow, auto-created folders and
+// the trash once a day at most.
+func expire_run(cfg *Config, env *Envelope, maildir string, now time.Time) {
+	if cfg.RoleAccount {
+		role_expire(cfg, env.Home, maildir, now)
+	}
+	store := &LocalStore{directory: filepath.Join(env.Home, ".pmda", "state")}
+	if cfg.AutoFolders != nil {
+		if due, err := store.SetNX(EXPIRE_NS, "autofolders:"+maildir, "1", EXPIRE_INTERVAL); err == nil && due {
+			if _, _, err := autofolders_expire(cfg, maildir, now); err != nil {
+				fmt.Fprintf(os.Stderr, "Error expiring folders: %s\n", err)
+			}
+		}
+	}
+	trash_expire(cfg, env, now)
+	if cfg.JunkExpiry == nil {
+		return
+	}
+
+	if due, err := store.SetNX(EXPIRE_NS, maildir, "1", EXPIRE_INTERVAL); err != nil || !due {
+		return
+	}
+	moved, deleted, err := junk_expire(cfg, env.Home, maildir, now)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error expiring junk: %s\n", err)
+		return
+	}
+	if moved != 0 || deleted != 0 {
+		log_info("junk expiry: %d moved to %s.Trash, %d deleted", moved, special_folder(cfg, "junk"), deleted)
+	}
+}
+
+var expireFlags = flag.NewFlagSet("expire", flag.ExitOnError)
+
+// expire_main implements "mail.pmda expire", which runs the expire
+// subsystem right away, for use from cron.
+func expire_main(args []string) int {
+	expireFlags.Parse(args)
+
+	homedir := os.Getenv("HOME")
+	cfg, err := config_read(filepath.Join(homedir, ".pmda.conf"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading configuration: %s\n", err)
+		return 1
+	}
+	maildir := maildir_resolve(cfg, homedir)
+	if expireFlags.NArg() == 1 {
+		maildir = expireFlags.Arg(0)
+	} else if expireFlags.NArg() > 1 {
+		fmt.Fprintf(os.Stderr, "Usage: %s expire [maildir]\n", os.Args[0])
+		return 1
+	}
+
+	now := time.Now()
+	if cfg.RoleAccount {
+		role_expire(cfg, homedir, maildir, now)
+	}
+	if cfg.JunkExpiry != nil {
+		moved, deleted, err := junk_expire(cfg, homedir, maildir, now)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error expiring junk: %s\n", err)
+			return 1
+		}
+		fmt.Printf("%d moved to %s.Trash, %d deleted\n", moved, special_folder(cfg, "junk"), deleted)
+	}
+	if cfg.AutoFolders != nil {
+		removed, archived, err := autofolders_expire(cfg, maildir, now)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error expiring folders: %s\n", err)
+			return 1
+		}
+		fmt.Printf("%d folders removed, %d of them archived\n", removed, archived)
+	}
+	if cfg.Trash != nil {
+		purged, err := trash_purge(cfg, homedir, now.AddDate(0, 0, -cfg.Trash.Days))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error purging trash: %s\n", err)
+			return 1
+		}
+		fmt.Printf("%d purged from the trash\n", purged)
+	}
+	return 0
+}
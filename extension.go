@@ -0,0 +1,121 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ExtensionConfig creates the folder of an address extension on first
+// use, instead of only filing to those that exist:
+//
+//	extensions create depth 2 allow "lists.*" allow "newproject"
+//
+// The extension is lowercased, runs of characters other than letters,
+// digits, - and _ turned into a -, and its dots taken as the hierarchy
+// separator: user+Lists.Go@ is filed to .lists.go. Extensions deeper
+// than depth, one by default, or not matching an allow pattern when
+// some are given, go to the inbox. New folders are subscribed to.
+type ExtensionConfig struct {
+	Depth int
+	Allow []string
+}
+
+func extensions_parse(args []string) (*ExtensionConfig, error) {
+	if len(args) == 0 || args[0] != "create" {
+		return nil, fmt.Errorf("usage: extensions create [depth n] [allow pattern ...]")
+	}
+	extensions := &ExtensionConfig{Depth: 1}
+	for i := 1; i < len(args); i++ {
+		switch {
+		case args[i] == "depth" && i+1 < len(args):
+			depth, err := strconv.Atoi(args[i+1])
+			if err != nil || depth < 1 {
+				return nil, fmt.Errorf("invalid depth: %s", args[i+1])
+			}
+			extensions.Depth = depth
+			i++
+		case args[i] == "allow" && i+1 < len(args):
+			pattern := strings.ToLower(args[i+1])
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("bad pattern: %s", args[i+1])
+			}
+			extensions.Allow = append(extensions.Allow, pattern)
+			i++
+		default:
+			return nil, fmt.Errorf("usage: extensions create [depth n] [allow pattern ...]")
+		}
+	}
+	return extensions, nil
+}
+
+// extension_sanitize returns the name an extension is filed under, its
+// components separated by dots.
+func extension_sanitize(extension string) string {
+	components := make([]string, 0)
+	for _, component := range strings.Split(strings.ToLower(extension), ".") {
+		var name strings.Builder
+		dash := false
+		for _, c := range component {
+			if c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_' {
+				name.WriteRune(c)
+				dash = false
+			} else if !dash {
+				name.WriteRune('-')
+				dash = true
+			}
+		}
+		if value := strings.Trim(name.String(), "-"); value != "" {
+			components = append(components, value)
+		}
+	}
+	return strings.Join(components, ".")
+}
+
+// extension_folder returns the folder of an extension, empty when it may
+// not have one.
+func extension_folder(extensions *ExtensionConfig, extension string) string {
+	name := extension_sanitize(extension)
+	if name == "" || strings.Count(name, ".")+1 > extensions.Depth {
+		return ""
+	}
+	if len(extensions.Allow) != 0 {
+		allowed := false
+		for _, pattern := range extensions.Allow {
+			if ok, _ := path.Match(pattern, name); ok {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return ""
+		}
+	}
+	return "." + name
+}
+
+// folder_subscribe adds a folder to the subscriptions file IMAP servers
+// keep at the root of a maildir, one name per line.
+func folder_subscribe(maildir string, folder string) {
+	if _, err := list_edit(filepath.Join(maildir, "subscriptions"), []string{strings.TrimPrefix(folder, ".")}, false, ""); err != nil {
+		log_info("error subscribing to %s: %s", folder, err)
+	}
+}
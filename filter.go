@@ -0,0 +1,175 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const FILTER_TIMEOUT = 30 * time.Second
+
+// filter messages are kept to this much on errors
+const FILTER_STDERR_MAX = 4096
+
+// FilterConfig is an external filter the message is piped through before
+// it is classified and stored, its output replacing the message as with
+// procmail recipes flagged fw. Filters run in the order of the
+// configuration, through the shell so that they can take arguments:
+//
+//	filter "rspamc --mime" timeout 10s
+//	filter "bogofilter -p -e" on-error tempfail
+//
+// A filter fails when it exits non-zero, runs past its timeout or outputs
+// nothing, and the message then goes on unchanged to the next one unless
+// on-error asks for the delivery to be retried later or rejected, the
+// latter suiting scanners that exit non-zero on what they catch.
+type FilterConfig struct {
+	Command string
+	Timeout time.Duration
+	OnError string
+}
+
+var filterPolicies = map[string]bool{"pass": true, "tempfail": true, "reject": true}
+
+func filter_parse(args []string) (*FilterConfig, error) {
+	if len(args) == 0 || len(args)%2 != 1 || args[0] == "" {
+		return nil, fmt.Errorf("usage: filter command [timeout duration] [on-error pass|tempfail|reject]")
+	}
+	filter := &FilterConfig{Command: args[0], Timeout: FILTER_TIMEOUT, OnError: "pass"}
+	for i := 1; i < len(args); i += 2 {
+		switch args[i] {
+		case "timeout":
+			timeout, err := time.ParseDuration(args[i+1])
+			if err != nil || timeout <= 0 {
+				return nil, fmt.Errorf("invalid duration: %s", args[i+1])
+			}
+			filter.Timeout = timeout
+		case "on-error":
+			if !filterPolicies[args[i+1]] {
+				return nil, fmt.Errorf("invalid policy: %s", args[i+1])
+			}
+			filter.OnError = args[i+1]
+		default:
+			return nil, fmt.Errorf("unknown filter option: %s", args[i])
+		}
+	}
+	return filter, nil
+}
+
+// filter_spool returns an anonymous file to hold a message, removed
+// right away so that nothing is left behind whatever the outcome.
+func filter_spool() (*os.File, error) {
+	file, err := os.CreateTemp("", "pmda-filter-*")
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(file.Name())
+	return file, nil
+}
+
+// filter_run pipes the message through a filter and returns its output.
+func filter_run(filter *FilterConfig, message *os.File) (*os.File, error) {
+	if _, err := message.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	output, err := filter_spool()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), filter.Timeout)
+	defer cancel()
+	defer usage_exec(time.Now())
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", filter.Command)
+	cmd.Stdin = message
+	cmd.Stdout = output
+	cmd.Stderr = &stderr
+	cmd.WaitDelay = time.Second
+	err = cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("timed out after %s", filter.Timeout)
+	} else if err != nil {
+		if text := strings.TrimSpace(string(stderr.Bytes()[:min(stderr.Len(), FILTER_STDERR_MAX)])); text != "" {
+			err = fmt.Errorf("%s: %s", err, text)
+		}
+	} else if st, serr := output.Stat(); serr != nil {
+		err = serr
+	} else if st.Size() == 0 {
+		err = fmt.Errorf("no output")
+	}
+	if err != nil {
+		output.Close()
+		return nil, err
+	}
+	return output, nil
+}
+
+// filter_pipeline runs the message read on stdin through the filters
+// and has the engine read what comes out of the last one instead.
+func filter_pipeline(cfg *Config, env *Envelope) {
+	if len(cfg.Filters) == 0 {
+		return
+	}
+	message, err := filter_spool()
+	if err != nil {
+		log_error("Error spooling message: %s", err)
+		tempfail()
+	}
+	if _, err := io.Copy(message, os.Stdin); err != nil {
+		log_error("Error reading from stdin: %s", err)
+		tempfail()
+	}
+
+	for _, filter := range cfg.Filters {
+		output, err := filter_run(filter, message)
+		if err == nil {
+			message.Close()
+			message = output
+			continue
+		}
+		switch filter.OnError {
+		case "tempfail":
+			log_error("Error running filter %s: %s", filter.Command, err)
+			tempfail()
+		case "reject":
+			if dryRun {
+				fmt.Printf("reject:   by filter %s: %s\n", filter.Command, err)
+				fmt.Printf("verdict:  filter\n")
+				os.Exit(0)
+			}
+			usage_record(env.Home, "rejected")
+			log_info("rejected by filter %s: %s", filter.Command, err)
+			fmt.Fprintf(os.Stderr, "rejected by filter\n")
+			os.Exit(EX_UNAVAILABLE)
+		}
+		log_info("filter %s failed, passing the message unchanged: %s", filter.Command, err)
+	}
+
+	if _, err := message.Seek(0, io.SeekStart); err != nil {
+		log_error("Error reading filtered message: %s", err)
+		tempfail()
+	}
+	os.Stdin = message
+}
@@ -0,0 +1,165 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const FORWARD_TIMEOUT = 5 * time.Minute
+
+// Forward is a ~/.forward file, as sendmail and mail.local read it:
+// addresses to forward to, commands to pipe into, mbox files to append
+// to and, with \user, whether a copy is filed here too:
+//
+//	\me, me@example.org
+//	"|/usr/local/bin/archive --user me"
+//	/home/me/mail/everything
+//
+// Entries are separated by commas or newlines. A file group or world
+// writable, or not owned by the user, is ignored. It is honoured unless
+// turned off:
+//
+//	forward off
+type Forward struct {
+	Addresses []string
+	Commands  []string
+	Files     []string
+	Keep      bool
+}
+
+// forward_entries splits the content of a .forward file, quotes keeping
+// the commas and spaces of commands.
+func forward_entries(data string) []string {
+	entries := make([]string, 0)
+	for _, line := range strings.Split(data, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		var entry strings.Builder
+		quoted := false
+		for _, c := range line + "," {
+			switch {
+			case c == '"':
+				quoted = !quoted
+			case c == ',' && !quoted:
+				if value := strings.TrimSpace(entry.String()); value != "" {
+					entries = append(entries, value)
+				}
+				entry.Reset()
+			default:
+				entry.WriteRune(c)
+			}
+		}
+	}
+	return entries
+}
+
+// forward_read returns the .forward file of the user, nil if there is
+// none or it holds no entry.
+func forward_read(homedir string) (*Forward, error) {
+	pathname := filepath.Join(homedir, ".forward")
+	st, err := os.Stat(pathname)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if sys, ok := st.Sys().(*syscall.Stat_t); st.Mode().Perm()&0022 != 0 || (ok && int(sys.Uid) != os.Getuid()) {
+		log_info("ignoring %s, writable by others or not owned by the user", pathname)
+		return nil, nil
+	}
+	data, err := os.ReadFile(pathname)
+	if err != nil {
+		return nil, err
+	}
+
+	forward := &Forward{}
+	for _, entry := range forward_entries(string(data)) {
+		switch {
+		case strings.HasPrefix(entry, "\\"):
+			forward.Keep = true
+		case strings.HasPrefix(entry, "|"):
+			forward.Commands = append(forward.Commands, strings.TrimSpace(entry[1:]))
+		case strings.HasPrefix(entry, "/"):
+			forward.Files = append(forward.Files, entry)
+		default:
+			forward.Addresses = append(forward.Addresses, entry)
+		}
+	}
+	if !forward.Keep && len(forward.Addresses) == 0 && len(forward.Commands) == 0 && len(forward.Files) == 0 {
+		return nil, nil
+	}
+	return forward, nil
+}
+
+func forward_pipe(command string, pathname string) error {
+	file, err := os.Open(pathname)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), FORWARD_TIMEOUT)
+	defer cancel()
+	defer usage_exec(time.Now())
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", command)
+	cmd.Stdin = file
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// forward_deliver forwards, pipes and appends the message at pathname
+// as the .forward file says. The delivery is retried if any of them
+// fails, which may duplicate those that succeeded but loses nothing.
+func forward_deliver(env *Envelope, forward *Forward, pathname string) error {
+	for _, address := range forward.Addresses {
+		file, err := os.Open(pathname)
+		if err != nil {
+			return err
+		}
+		err = sieve_sendmail(file, env.Sender, address)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("forwarding to %s: %s", address, err)
+		}
+		log_info("forwarded to %s", address)
+	}
+	for _, command := range forward.Commands {
+		if err := forward_pipe(command, pathname); err != nil {
+			return fmt.Errorf("piping to %s: %s", command, err)
+		}
+		log_info("piped to %s", command)
+	}
+	for _, mbox := range forward.Files {
+		if err := mbox_append(mbox, env.Sender, pathname); err != nil {
+			return fmt.Errorf("appending to %s: %s", mbox, err)
+		}
+		log_info("appended to %s", mbox)
+	}
+	return nil
+}
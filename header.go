@@ -0,0 +1,209 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/mail"
+	"regexp"
+	"strings"
+)
+
+const HEADER_READ_MAX = 1024 * 1024
+
+// lines read from messages are cut at this length, far beyond the 998
+// characters RFC 5322 allows
+const LINE_READ_MAX = 64 * 1024
+
+var addressRegexp = regexp.MustCompile(`[^\s<>,;:()"]+@[^\s<>,;:()"]+`)
+
+// HeaderField is a single header field, Value is unfolded but otherwise
+// left as found in the message while Raw keeps the original lines.
+type HeaderField struct {
+	Name  string
+	Value string
+	Raw   []string
+}
+
+// Header is the ordered list of fields of a message header.
+type Header struct {
+	Fields []HeaderField
+	edited bool
+}
+
+// add_line feeds a raw header line, continuation lines are folded into
+// the previous field.
+func (h *Header) add_line(line string) {
+	if line != "" && (line[0] == ' ' || line[0] == '\t') {
+		if len(h.Fields) != 0 {
+			field := &h.Fields[len(h.Fields)-1]
+			field.Value += line
+			field.Raw = append(field.Raw, line)
+		}
+		return
+	}
+
+	// garbage lines are kept nameless so they survive a rewrite
+	name, value, found := strings.Cut(line, ":")
+	if !found {
+		h.Fields = append(h.Fields, HeaderField{Raw: []string{line}})
+		return
+	}
+	h.Fields = append(h.Fields, HeaderField{
+		Name:  strings.TrimSpace(name),
+		Value: strings.TrimSpace(value),
+		Raw:   []string{line},
+	})
+}
+
+// line_read returns the next line of a message without its ending and
+// the number of bytes it took. Lines of any length are read through but
+// only the first max bytes are kept, memory use is bounded whatever the
+// message holds.
+func line_read(reader *bufio.Reader, max int) (string, int, error) {
+	line := make([]byte, 0, 128)
+	size := 0
+	for {
+		data, err := reader.ReadSlice('\n')
+		size += len(data)
+		if room := max - len(line); room > 0 {
+			line = append(line, data[:min(len(data), room)]...)
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		return strings.TrimRight(string(line), "\r\n"), size, err
+	}
+}
+
+// header_read parses the header of a stored message, it stops at the
+// empty line and refuses headers that are unreasonably large.
+func header_read(r io.Reader) (*Header, error) {
+	reader := bufio.NewReader(io.LimitReader(r, HEADER_READ_MAX))
+	hdr := &Header{}
+	for {
+		line, _, err := line_read(reader, LINE_READ_MAX)
+		if line != "" {
+			hdr.add_line(line)
+		}
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if line == "" || err == io.EOF {
+			return hdr, nil
+		}
+	}
+}
+
+// Set replaces the first field called name, or appends one if missing.
+func (h *Header) Set(name string, value string) {
+	for i := range h.Fields {
+		if strings.EqualFold(h.Fields[i].Name, name) {
+			h.Fields[i].Value = value
+			h.Fields[i].Raw = []string{h.Fields[i].Name + ": " + value}
+			h.edited = true
+			return
+		}
+	}
+	h.add_line(name + ": " + value)
+}
+
+// Del removes all fields called name.
+func (h *Header) Del(name string) {
+	fields := h.Fields[:0]
+	for _, field := range h.Fields {
+		if !strings.EqualFold(field.Name, name) {
+			fields = append(fields, field)
+		}
+	}
+	h.edited = h.edited || len(fields) != len(h.Fields)
+	h.Fields = fields
+}
+
+// write outputs the header fields as they were read, modified fields
+// excepted, without the separating empty line. Lines end in eol.
+func (h *Header) write(w io.Writer, eol string) {
+	for _, field := range h.Fields {
+		for _, line := range field.Raw {
+			fmt.Fprintf(w, "%s%s", line, eol)
+		}
+	}
+}
+
+// Get returns the value of the first field called name, or an empty string.
+func (h *Header) Get(name string) string {
+	for _, field := range h.Fields {
+		if strings.EqualFold(field.Name, name) {
+			return field.Value
+		}
+	}
+	return ""
+}
+
+// Values returns the values of all fields called name, in order.
+func (h *Header) Values(name string) []string {
+	values := make([]string, 0)
+	for _, field := range h.Fields {
+		if strings.EqualFold(field.Name, name) {
+			values = append(values, field.Value)
+		}
+	}
+	return values
+}
+
+// Addresses returns the lowercased addresses found in the fields called
+// name, group syntax and lists are flattened. Fields that do not parse
+// are scavenged for anything looking like an address.
+func (h *Header) Addresses(name string) []string {
+	addresses := make([]string, 0)
+	for _, value := range h.Values(name) {
+		if list, err := mail.ParseAddressList(value); err == nil {
+			for _, address := range list {
+				addresses = append(addresses, strings.ToLower(address.Address))
+			}
+			continue
+		}
+		for _, address := range addressRegexp.FindAllString(value, -1) {
+			addresses = append(addresses, strings.ToLower(address))
+		}
+	}
+	return addresses
+}
+
+var messageIdRegexp = regexp.MustCompile(`<[^<>\s]+>`)
+
+// message_ids returns the message identifiers of a Message-ID, In-Reply-To
+// or References value, brackets included.
+func message_ids(value string) []string {
+	return messageIdRegexp.FindAllString(value, -1)
+}
+
+// message_id returns the first message identifier of a value, if any.
+func message_id(value string) string {
+	if ids := message_ids(value); len(ids) != 0 {
+		return ids[0]
+	}
+	return ""
+}
+
+// header_oneline collapses the whitespace of a value, line breaks
+// included, so that it fits a header field of its own.
+func header_oneline(value string) string {
+	return strings.Join(strings.Fields(value), " ")
+}
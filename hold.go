@@ -0,0 +1,154 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// HoldConfig puts deliveries on hold, every one of them being tempfailed
+// so the MTA queues them until it is lifted, for storage maintenance:
+//
+//	hold "storage migration until 02:00"
+//	hold file "/var/run/mail.pmda.hold"
+//
+// The hold file, ~/.pmda/hold by default, holds deliveries as long as it
+// exists and is what "mail.pmda hold on|off" manages. Pointing it at a
+// shared path from /etc/mail.pmda.conf holds all accounts at once.
+type HoldConfig struct {
+	Reason string
+	File   string
+}
+
+func hold_default() *HoldConfig {
+	return &HoldConfig{File: filepath.Join(".pmda", "hold")}
+}
+
+func hold_parse(hold *HoldConfig, args []string) error {
+	switch {
+	case len(args) == 2 && args[0] == "file":
+		hold.File = args[1]
+	case len(args) == 1 && args[0] != "":
+		hold.Reason = args[0]
+	default:
+		return fmt.Errorf("usage: hold reason | hold file path")
+	}
+	return nil
+}
+
+func hold_file(cfg *Config, homedir string) string {
+	if filepath.IsAbs(cfg.Hold.File) {
+		return cfg.Hold.File
+	}
+	return filepath.Join(homedir, cfg.Hold.File)
+}
+
+// hold_status reports whether deliveries are on hold and why, along with
+// when the hold file was created.
+func hold_status(cfg *Config, homedir string) (bool, string, time.Time) {
+	if cfg.Hold.Reason != "" {
+		return true, cfg.Hold.Reason, time.Time{}
+	}
+	pathname := hold_file(cfg, homedir)
+	st, err := os.Stat(pathname)
+	if err != nil {
+		return false, "", time.Time{}
+	}
+	reason := "deliveries on hold"
+	if data, err := os.ReadFile(pathname); err == nil {
+		if line, _, _ := strings.Cut(string(data), "\n"); strings.TrimSpace(line) != "" {
+			reason = strings.TrimSpace(line)
+		}
+	}
+	return true, reason, st.ModTime()
+}
+
+// hold_check tempfails the delivery if deliveries are on hold, before
+// anything is read or written.
+func hold_check(cfg *Config, homedir string) {
+	held, reason, _ := hold_status(cfg, homedir)
+	if !held {
+		return
+	}
+	log_info("delivery held: %s", reason)
+	fmt.Fprintf(os.Stderr, "Delivery held: %s\n", reason)
+	tempfail()
+}
+
+var holdFlags = flag.NewFlagSet("hold", flag.ExitOnError)
+
+// hold_main implements "mail.pmda hold", which puts deliveries on hold,
+// lifts the hold or tells whether they are held.
+func hold_main(args []string) int {
+	holdFlags.Parse(args)
+	if holdFlags.NArg() < 1 || (holdFlags.Arg(0) != "on" && holdFlags.NArg() != 1) {
+		fmt.Fprintf(os.Stderr, "Usage: %s hold on [reason] | off | status\n", os.Args[0])
+		return 1
+	}
+
+	homedir := os.Getenv("HOME")
+	cfg, err := config_read(filepath.Join(homedir, ".pmda.conf"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading configuration: %s\n", err)
+		return 1
+	}
+	pathname := hold_file(cfg, homedir)
+
+	switch holdFlags.Arg(0) {
+	case "on":
+		reason := strings.Join(holdFlags.Args()[1:], " ")
+		if err := os.MkdirAll(filepath.Dir(pathname), 0700); err != nil {
+			fmt.Fprintf(os.Stderr, "Error creating %s: %s\n", filepath.Dir(pathname), err)
+			return 1
+		}
+		if err := os.WriteFile(pathname, []byte(header_oneline(reason)+"\n"), 0600); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing %s: %s\n", pathname, err)
+			return 1
+		}
+
+	case "off":
+		if err := os.Remove(pathname); err != nil && !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "Error removing %s: %s\n", pathname, err)
+			return 1
+		}
+		if cfg.Hold.Reason != "" {
+			fmt.Fprintf(os.Stderr, "Deliveries remain held by the configuration: %s\n", cfg.Hold.Reason)
+			return 1
+		}
+
+	case "status":
+		held, reason, since := hold_status(cfg, homedir)
+		switch {
+		case !held:
+			fmt.Printf("off\n")
+		case since.IsZero():
+			fmt.Printf("on: %s (configured)\n", reason)
+		default:
+			fmt.Printf("on since %s: %s\n", since.Format(time.RFC3339), reason)
+		}
+
+	default:
+		fmt.Fprintf(os.Stderr, "Usage: %s hold on [reason] | off | status\n", os.Args[0])
+		return 1
+	}
+	return 0
+}
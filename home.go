@@ -0,0 +1,122 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Servers running as root act on behalf of users in their home directory,
+// which the users control: a symbolic link planted in place of ~/.pmda or
+// of a file would have them read or write anywhere. Paths under a home are
+// reached through these instead, relative to it, without following links
+// along the way. Files not owned by the account are refused too, a hard
+// link being another way in.
+func home_components(name string) ([]string, error) {
+	name = filepath.Clean(name)
+	if name == "." {
+		return nil, nil
+	}
+	components := strings.Split(name, string(filepath.Separator))
+	for _, component := range components {
+		if component == "" || component == ".." {
+			return nil, fmt.Errorf("%s: invalid path", name)
+		}
+	}
+	return components, nil
+}
+
+// home_dir opens a directory under the home of an account, creating the
+// missing ones on the way when asked to.
+func home_dir(account *user.User, name string, create bool) (*os.File, error) {
+	components, err := home_components(name)
+	if err != nil {
+		return nil, err
+	}
+	return home_walk(account, components, create)
+}
+
+// home_open opens a regular file under the home of an account. A file
+// created exclusively is handed over to the account, any other must
+// already belong to it.
+func home_open(account *user.User, name string, flag int, perm os.FileMode) (*os.File, error) {
+	dir, err := home_dir(account, filepath.Dir(name), flag&os.O_CREATE != 0)
+	if err != nil {
+		return nil, err
+	}
+	defer dir.Close()
+	file, err := home_openat(dir, filepath.Base(name), flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	if err := home_owned(account, file, flag&os.O_EXCL != 0); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+func home_owned(account *user.User, file *os.File, created bool) error {
+	st, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if !st.Mode().IsRegular() {
+		return fmt.Errorf("%s: not a regular file", file.Name())
+	}
+	if os.Getuid() != 0 {
+		return nil
+	}
+	if created {
+		return account_fchown(account, file)
+	}
+	if sys, ok := st.Sys().(*syscall.Stat_t); !ok || strconv.FormatUint(uint64(sys.Uid), 10) != account.Uid {
+		return fmt.Errorf("%s: not owned by %s", file.Name(), account.Username)
+	}
+	return nil
+}
+
+// home_rename renames a file under the home of an account.
+func home_rename(account *user.User, oldname string, newname string) error {
+	olddir, err := home_dir(account, filepath.Dir(oldname), false)
+	if err != nil {
+		return err
+	}
+	defer olddir.Close()
+	newdir, err := home_dir(account, filepath.Dir(newname), false)
+	if err != nil {
+		return err
+	}
+	defer newdir.Close()
+	return home_renameat(olddir, filepath.Base(oldname), newdir, filepath.Base(newname))
+}
+
+// home_remove removes a file under the home of an account.
+func home_remove(account *user.User, name string) error {
+	dir, err := home_dir(account, filepath.Dir(name), false)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return home_unlinkat(dir, filepath.Base(name))
+}
@@ -0,0 +1,80 @@
+//go:build linux
+
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// home_walk opens each component relative to the previous one with
+// O_NOFOLLOW, a link anywhere fails the walk.
+func home_walk(account *user.User, components []string, create bool) (*os.File, error) {
+	fd, err := syscall.Open(account.HomeDir, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: account.HomeDir, Err: err}
+	}
+	pathname := account.HomeDir
+	for _, component := range components {
+		pathname = filepath.Join(pathname, component)
+		flags := syscall.O_RDONLY | syscall.O_DIRECTORY | syscall.O_NOFOLLOW | syscall.O_CLOEXEC
+		next, err := syscall.Openat(fd, component, flags, 0)
+		if err == syscall.ENOENT && create {
+			created := syscall.Mkdirat(fd, component, 0700) == nil
+			if next, err = syscall.Openat(fd, component, flags, 0); err == nil && created && os.Getuid() == 0 {
+				uid, _ := strconv.Atoi(account.Uid)
+				gid, _ := strconv.Atoi(account.Gid)
+				syscall.Fchown(next, uid, gid)
+			}
+		}
+		syscall.Close(fd)
+		if err != nil {
+			return nil, &os.PathError{Op: "open", Path: pathname, Err: err}
+		}
+		fd = next
+	}
+	return os.NewFile(uintptr(fd), pathname), nil
+}
+
+func home_openat(dir *os.File, name string, flag int, perm os.FileMode) (*os.File, error) {
+	pathname := filepath.Join(dir.Name(), name)
+	// O_NONBLOCK keeps a FIFO from blocking the open, it is refused after
+	fd, err := syscall.Openat(int(dir.Fd()), name, flag|syscall.O_NOFOLLOW|syscall.O_NONBLOCK|syscall.O_CLOEXEC, uint32(perm.Perm()))
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: pathname, Err: err}
+	}
+	return os.NewFile(uintptr(fd), pathname), nil
+}
+
+func home_renameat(olddir *os.File, oldname string, newdir *os.File, newname string) error {
+	if err := syscall.Renameat(int(olddir.Fd()), oldname, int(newdir.Fd()), newname); err != nil {
+		return &os.LinkError{Op: "rename", Old: filepath.Join(olddir.Name(), oldname), New: filepath.Join(newdir.Name(), newname), Err: err}
+	}
+	return nil
+}
+
+func home_unlinkat(dir *os.File, name string) error {
+	if err := syscall.Unlinkat(int(dir.Fd()), name); err != nil {
+		return &os.PathError{Op: "remove", Path: filepath.Join(dir.Name(), name), Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+//go:build !linux
+
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"os"
+	"os/user"
+	"path/filepath"
+	"syscall"
+)
+
+// home_walk checks that each component is a directory and not a link
+// before going on. Without openat(2) this narrows the window between the
+// check and the use, it does not close it.
+func home_walk(account *user.User, components []string, create bool) (*os.File, error) {
+	pathname := account.HomeDir
+	for _, component := range components {
+		pathname = filepath.Join(pathname, component)
+		st, err := os.Lstat(pathname)
+		if os.IsNotExist(err) && create {
+			if err = os.Mkdir(pathname, 0700); err == nil {
+				account_chown(account, pathname)
+			}
+			st, err = os.Lstat(pathname)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !st.IsDir() {
+			return nil, &os.PathError{Op: "open", Path: pathname, Err: syscall.ENOTDIR}
+		}
+	}
+	return os.Open(pathname)
+}
+
+func home_openat(dir *os.File, name string, flag int, perm os.FileMode) (*os.File, error) {
+	return os.OpenFile(filepath.Join(dir.Name(), name), flag|syscall.O_NOFOLLOW|syscall.O_NONBLOCK, perm)
+}
+
+func home_renameat(olddir *os.File, oldname string, newdir *os.File, newname string) error {
+	return os.Rename(filepath.Join(olddir.Name(), oldname), filepath.Join(newdir.Name(), newname))
+}
+
+func home_unlinkat(dir *os.File, name string) error {
+	return os.Remove(filepath.Join(dir.Name(), name))
+}
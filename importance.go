@@ -0,0 +1,165 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+const REPUTATION_NS = "reputation"
+
+// personal messages of a sender are counted over a year
+const REPUTATION_TTL = 365 * 24 * time.Hour
+
+// signals saturate at this many messages
+const (
+	IMPORTANCE_THREAD_MAX     = 5
+	IMPORTANCE_REPUTATION_MAX = 10
+)
+
+// ImportanceConfig scores how much a message matters to the user from
+// 0 to 100, independently of whether it is spam:
+//
+//	importance threshold 50 folder ".Priority" tag
+//	importance weight reply-to-me 50 weight thread 10
+//
+// The signals are the sender being a known correspondent, the message
+// replying to one the user sent, the activity of its thread and the
+// reputation of the sender, the number of personal messages received
+// from them. Inbox messages scoring above the threshold are filed to the
+// folder if one is set, tag records the score of every message in an
+// X-PMDA-Importance header field, and score conditions can test it:
+//
+//	match score importance >= 80 folder ".Urgent"
+type ImportanceConfig struct {
+	Threshold float64
+	Folder    string
+	Tag       bool
+	Weights   map[string]float64
+}
+
+var importanceSignals = []string{"known-correspondent", "reply-to-me", "thread", "reputation"}
+
+func importance_default() *ImportanceConfig {
+	return &ImportanceConfig{
+		Threshold: 50,
+		Weights: map[string]float64{
+			"known-correspondent": 30,
+			"reply-to-me":         40,
+			"thread":              15,
+			"reputation":          15,
+		},
+	}
+}
+
+// importance_parse applies an importance directive, several of them add
+// up to one configuration.
+func importance_parse(importance *ImportanceConfig, args []string) error {
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == "threshold" && i+1 < len(args):
+			threshold, err := strconv.ParseFloat(args[i+1], 64)
+			if err != nil || threshold < 0 || threshold > 100 {
+				return fmt.Errorf("invalid threshold: %s", args[i+1])
+			}
+			importance.Threshold = threshold
+			i++
+		case args[i] == "folder" && i+1 < len(args):
+			importance.Folder = args[i+1]
+			i++
+		case args[i] == "tag":
+			importance.Tag = true
+		case args[i] == "weight" && i+2 < len(args):
+			if _, exists := importance.Weights[args[i+1]]; !exists {
+				return fmt.Errorf("unknown importance signal: %s", args[i+1])
+			}
+			weight, err := strconv.ParseFloat(args[i+2], 64)
+			if err != nil || weight < 0 {
+				return fmt.Errorf("invalid weight: %s", args[i+2])
+			}
+			importance.Weights[args[i+1]] = weight
+			i += 2
+		default:
+			return fmt.Errorf("usage: importance [threshold n] [folder name] [tag] [weight signal n]")
+		}
+	}
+	return nil
+}
+
+// importance_score combines the signals of a message, each contributing
+// up to its weight, into a score out of 100.
+func importance_score(cfg *Config, env *Envelope, msg *Message) float64 {
+	signals := map[string]float64{}
+	if msg.KnownCorrespondent {
+		signals["known-correspondent"] = 1
+	}
+	if msg.ReplyToMe {
+		signals["reply-to-me"] = 1
+	}
+
+	store, err := state_open(cfg, env.Home)
+	if err != nil {
+		log_info("error opening state: %s", err)
+	} else {
+		defer store.Close()
+		activity := thread_activity(store, msg.Header)
+		signals["thread"] = float64(min(activity, IMPORTANCE_THREAD_MAX)) / IMPORTANCE_THREAD_MAX
+		if sender := importance_sender(msg); sender != "" {
+			value, _, _ := store.Get(REPUTATION_NS, sender)
+			count, _ := strconv.ParseInt(value, 10, 64)
+			signals["reputation"] = float64(min(count, IMPORTANCE_REPUTATION_MAX)) / IMPORTANCE_REPUTATION_MAX
+		}
+	}
+
+	total, score := 0.0, 0.0
+	for _, signal := range importanceSignals {
+		total += cfg.Importance.Weights[signal]
+		score += cfg.Importance.Weights[signal] * signals[signal]
+	}
+	if total == 0 {
+		return 0
+	}
+	return score * 100 / total
+}
+
+func importance_sender(msg *Message) string {
+	if addresses := msg.Header.Addresses("From"); len(addresses) != 0 {
+		return addresses[0]
+	}
+	return ""
+}
+
+// threads_record feeds the thread index and, for personal messages filed
+// to the inbox or by importance, the reputation of the sender.
+func threads_record(cfg *Config, env *Envelope, msg *Message, personal bool) {
+	store, err := state_open(cfg, env.Home)
+	if err != nil {
+		log_info("error opening state: %s", err)
+		return
+	}
+	defer store.Close()
+	if err := thread_record(store, msg.Header); err != nil {
+		log_info("error recording thread: %s", err)
+	}
+	if sender := importance_sender(msg); cfg.Importance != nil && personal && sender != "" {
+		if _, err := store.Incr(REPUTATION_NS, sender, REPUTATION_TTL); err != nil {
+			log_info("error recording reputation: %s", err)
+		}
+	}
+}
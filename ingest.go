@@ -0,0 +1,326 @@
+//go:build !noingest && !tiny
+
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const INGEST_TIMEOUT = 5 * time.Minute
+
+var ingestFlags = flag.NewFlagSet("ingest", flag.ExitOnError)
+var ingestListen = ingestFlags.String("listen", "127.0.0.1:8191", "address to listen on")
+var ingestCert = ingestFlags.String("cert", "", "TLS certificate, serves HTTPS")
+var ingestKey = ingestFlags.String("key", "", "TLS private key")
+var ingestCheckpassword = ingestFlags.String("checkpassword", "", "checkpassword program used to authenticate users")
+var ingestMaxSize = ingestFlags.String("max-size", "50m", "largest message accepted")
+var ingestMailgunKey = ingestFlags.String("mailgun-key", "", "Mailgun webhook signing key")
+var ingestS3Region = ingestFlags.String("s3-region", os.Getenv("AWS_REGION"), "region of the S3 buckets SES stores messages in")
+var ingestMetrics = ingestFlags.String("metrics", "", "address to serve Prometheus metrics on, at /metrics")
+
+// the counters of the deliveries made, served when -metrics is set
+var ingestCounters struct {
+	sync.Mutex
+	metrics *Metrics
+}
+
+func init() {
+	feature_register("ingest")
+	command_register(&Command{Name: "ingest", Synopsis: "accept messages over HTTP and deliver them",
+		Flags: ingestFlags, Main: ingest_main})
+}
+
+// IngestRequest is the JSON form of a submission, for providers that post
+// messages as JSON documents rather than as is.
+type IngestRequest struct {
+	Sender    string `json:"sender"`
+	Recipient string `json:"recipient"`
+	Extension string `json:"extension"`
+	Raw       string `json:"raw"`
+}
+
+// ingest_main implements "mail.pmda ingest", an HTTP endpoint delivering
+// messages to the maildir of the authenticated user:
+//
+//	POST /messages?sender=...&recipient=...   body is message/rfc822
+//	POST /messages                            body is an IngestRequest
+//	POST /ses                                 Amazon SES through SNS
+//	POST /mailgun/mime                        Mailgun route forwarding
+//
+// Each message goes through the regular MDA run as the user, so it gets
+// exactly the processing of a message handed over by the MTA. A temporary
+// failure is reported as 503 for the caller to retry.
+func ingest_main(args []string) int {
+	ingestFlags.Parse(args)
+	maxSize, err := config_size(*ingestMaxSize)
+	if ingestFlags.NArg() != 0 || *ingestCheckpassword == "" || err != nil {
+		fmt.Fprintf(os.Stderr, "Usage: %s ingest -checkpassword program [-listen address] [-cert file -key file] [-max-size size] [-metrics address]\n", os.Args[0])
+		return 1
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/messages", http_authenticated("ingest", *ingestCheckpassword,
+		func(w http.ResponseWriter, r *http.Request, account *user.User) {
+			ingest_message(w, r, account, maxSize)
+		}))
+	mux.HandleFunc("/ses", http_authenticated("ingest", *ingestCheckpassword,
+		func(w http.ResponseWriter, r *http.Request, account *user.User) {
+			ingest_ses(w, r, account, maxSize)
+		}))
+	mux.HandleFunc("/mailgun/mime", http_authenticated("ingest", *ingestCheckpassword,
+		func(w http.ResponseWriter, r *http.Request, account *user.User) {
+			ingest_mailgun(w, r, account, maxSize)
+		}))
+	server := &http.Server{
+		Addr:         *ingestListen,
+		Handler:      mux,
+		ReadTimeout:  INGEST_TIMEOUT,
+		WriteTimeout: INGEST_TIMEOUT,
+	}
+
+	if *ingestMetrics != "" {
+		ingestCounters.metrics = metrics_new()
+		go ingest_metrics_serve(*ingestMetrics)
+	}
+
+	log_info("ingest listening on %s", *ingestListen)
+	if *ingestCert != "" {
+		err = server.ListenAndServeTLS(*ingestCert, *ingestKey)
+	} else {
+		err = server.ListenAndServe()
+	}
+	fmt.Fprintf(os.Stderr, "Error serving ingest: %s\n", err)
+	return 1
+}
+
+func ingest_message(w http.ResponseWriter, r *http.Request, account *user.User, maxSize int64) {
+	if r.Method != http.MethodPost {
+		http_error(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+		return
+	}
+
+	body := http.MaxBytesReader(w, r.Body, maxSize*4/3+4096)
+	query := r.URL.Query()
+	env := &Envelope{
+		Sender:    query.Get("sender"),
+		Recipient: query.Get("recipient"),
+		Extension: query.Get("extension"),
+	}
+
+	var message io.Reader = body
+	mediatype, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediatype {
+	case "message/rfc822", "text/plain", "application/octet-stream", "":
+	case "application/json":
+		var request IngestRequest
+		if err := json.NewDecoder(body).Decode(&request); err != nil {
+			http_error(w, http.StatusBadRequest, err)
+			return
+		}
+		raw, err := base64.StdEncoding.DecodeString(request.Raw)
+		if err != nil {
+			http_error(w, http.StatusBadRequest, fmt.Errorf("raw: %s", err))
+			return
+		}
+		env.Sender, env.Recipient, env.Extension = request.Sender, request.Recipient, request.Extension
+		message = bytes.NewReader(raw)
+	default:
+		http_error(w, http.StatusUnsupportedMediaType, fmt.Errorf("unsupported content type: %s", mediatype))
+		return
+	}
+
+	ingest_spool(w, r.Context(), account, env, message, maxSize)
+}
+
+// ingest_spool delivers a message read from a request or fetched from a
+// provider, the recipient defaulting to the authenticated user.
+func ingest_spool(w http.ResponseWriter, ctx context.Context, account *user.User, env *Envelope, message io.Reader, maxSize int64) {
+	if env.Recipient == "" {
+		env.Recipient = account.Username
+	}
+
+	// spooled first so that an oversized message is refused rather than
+	// delivered truncated.
+	spool, err := os.CreateTemp("", "pmda-ingest-*")
+	if err != nil {
+		http_error(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer spool.Close()
+	os.Remove(spool.Name())
+
+	size, err := io.Copy(spool, io.LimitReader(message, maxSize+1))
+	if err != nil {
+		http_error(w, http.StatusBadRequest, err)
+		return
+	}
+	if size > maxSize {
+		http_error(w, http.StatusRequestEntityTooLarge, fmt.Errorf("message exceeds %d bytes", maxSize))
+		return
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		http_error(w, http.StatusInternalServerError, err)
+		return
+	}
+	ingest_deliver(w, ctx, account, env, spool, size)
+}
+
+// ingest_deliver runs the MDA as the user and maps its exit status to an
+// HTTP status.
+func ingest_deliver(w http.ResponseWriter, ctx context.Context, account *user.User, env *Envelope, message *os.File, size int64) {
+	executable, err := os.Executable()
+	if err != nil {
+		http_error(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, executable)
+	cmd.Stdin = message
+	cmd.Stderr = &stderr
+
+	// the result tells the metrics where the message went
+	var results, writer *os.File
+	if ingestCounters.metrics != nil {
+		results, writer, err = os.Pipe()
+		if err != nil {
+			http_error(w, http.StatusInternalServerError, err)
+			return
+		}
+		defer results.Close()
+		cmd.Args = append(cmd.Args, "-result-fd", "3")
+		cmd.ExtraFiles = []*os.File{writer}
+	}
+	cmd.Env = []string{
+		"PATH=" + os.Getenv("PATH"),
+		"HOME=" + account.HomeDir,
+		"USER=" + account.Username,
+		"SENDER=" + env.Sender,
+		"RECIPIENT=" + env.Recipient,
+		"ORIGINAL_RECIPIENT=" + env.Recipient,
+		"EXTENSION=" + env.Extension,
+	}
+	if os.Getuid() == 0 {
+		uid, _ := strconv.ParseUint(account.Uid, 10, 32)
+		gid, _ := strconv.ParseUint(account.Gid, 10, 32)
+		cmd.SysProcAttr = &syscall.SysProcAttr{Credential: &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}}
+		cmd.Dir = account.HomeDir
+	}
+
+	start := time.Now()
+	err = cmd.Start()
+	if writer != nil {
+		writer.Close()
+	}
+	if err == nil {
+		var result *DeliveryResult
+		if results != nil {
+			result = ingest_result(results)
+		}
+		err = cmd.Wait()
+		ingest_account(account, result, err, time.Since(start))
+	}
+
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]any{"delivered": true, "size": size})
+	case errors.As(err, &exitErr) && exitErr.ExitCode() == EX_TEMPFAIL:
+		w.Header().Set("Retry-After", "300")
+		http_error(w, http.StatusServiceUnavailable, fmt.Errorf("%s", strings.TrimSpace(stderr.String())))
+	default:
+		log_info("ingest: delivery for %s failed: %s: %s", account.Username, err, strings.TrimSpace(stderr.String()))
+		http_error(w, http.StatusInternalServerError, fmt.Errorf("delivery failed"))
+	}
+}
+
+// ingest_result reads back the result of a delivery, nil if the message
+// was not stored.
+func ingest_result(reader io.Reader) *DeliveryResult {
+	data, err := io.ReadAll(io.LimitReader(reader, 64*1024))
+	if err != nil || len(data) == 0 {
+		return nil
+	}
+	result := &DeliveryResult{}
+	if json.Unmarshal(data, result) != nil {
+		return nil
+	}
+	return result
+}
+
+// ingest_account counts a delivery made by the MDA run for a user.
+func ingest_account(account *user.User, result *DeliveryResult, err error, duration time.Duration) {
+	if ingestCounters.metrics == nil {
+		return
+	}
+	ingestCounters.Lock()
+	defer ingestCounters.Unlock()
+
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil && result != nil:
+		ingestCounters.metrics.account(account.Username, "delivered", result.Folder, result.Verdict, result.Size, duration)
+	case err == nil:
+		ingestCounters.metrics.account(account.Username, "accepted", "", "", 0, duration)
+	case errors.As(err, &exitErr) && exitErr.ExitCode() == EX_TEMPFAIL:
+		ingestCounters.metrics.add(metrics_series("mail_pmda_tempfails_total", "user", account.Username), 1)
+	default:
+		ingestCounters.metrics.account(account.Username, "failed", "", "", 0, duration)
+	}
+}
+
+// ingest_metrics_serve serves the counters for Prometheus to scrape, on
+// an address of its own as they are not behind authentication.
+func ingest_metrics_serve(address string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		ingestCounters.Lock()
+		defer ingestCounters.Unlock()
+		ingestCounters.metrics.write(w)
+	})
+	server := &http.Server{
+		Addr:         address,
+		Handler:      mux,
+		ReadTimeout:  time.Minute,
+		WriteTimeout: time.Minute,
+	}
+	log_info("ingest metrics on %s", address)
+	if err := server.ListenAndServe(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error serving metrics: %s\n", err)
+	}
+}
@@ -0,0 +1,362 @@
+//go:build !noingest && !tiny
+
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"os/user"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const PROVIDER_TIMEOUT = time.Minute
+
+var providerClient = &http.Client{Timeout: PROVIDER_TIMEOUT}
+
+// SNS only ever serves certificates and confirmation links from its own
+// regional endpoints, anything else is a forgery.
+var snsHostRegexp = regexp.MustCompile(`^sns\.[a-z0-9-]+\.amazonaws\.com(\.cn)?$`)
+
+// SNSMessage is the envelope of an SNS HTTP notification.
+type SNSMessage struct {
+	Type             string
+	MessageId        string
+	Token            string
+	TopicArn         string
+	Subject          string
+	Message          string
+	Timestamp        string
+	SignatureVersion string
+	Signature        string
+	SigningCertURL   string
+	SubscribeURL     string
+}
+
+// SESNotification is the part of an SES receipt notification we use, the
+// message is either inline or stored in S3 depending on the rule action.
+type SESNotification struct {
+	NotificationType string
+	Mail             struct {
+		Source      string   `json:"source"`
+		Destination []string `json:"destination"`
+	} `json:"mail"`
+	Receipt struct {
+		Recipients []string `json:"recipients"`
+		Action     struct {
+			Type       string `json:"type"`
+			Encoding   string `json:"encoding"`
+			BucketName string `json:"bucketName"`
+			ObjectKey  string `json:"objectKey"`
+		} `json:"action"`
+	} `json:"receipt"`
+	Content string `json:"content"`
+}
+
+var snsCertificates sync.Map
+
+func sns_certificate(rawurl string) (*x509.Certificate, error) {
+	if certificate, cached := snsCertificates.Load(rawurl); cached {
+		return certificate.(*x509.Certificate), nil
+	}
+	u, err := url.Parse(rawurl)
+	if err != nil || u.Scheme != "https" || !snsHostRegexp.MatchString(u.Host) {
+		return nil, fmt.Errorf("untrusted signing certificate: %s", rawurl)
+	}
+
+	response, err := providerClient.Get(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(response.Body, 64*1024))
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("invalid signing certificate")
+	}
+	certificate, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	snsCertificates.Store(rawurl, certificate)
+	return certificate, nil
+}
+
+// sns_verify checks the signature of an SNS message, computed over some
+// of its fields in a fixed order depending on the message type.
+func sns_verify(message *SNSMessage) error {
+	fields := [][2]string{{"Message", message.Message}, {"MessageId", message.MessageId}}
+	if message.Type == "Notification" {
+		if message.Subject != "" {
+			fields = append(fields, [2]string{"Subject", message.Subject})
+		}
+		fields = append(fields, [2]string{"Timestamp", message.Timestamp}, [2]string{"TopicArn", message.TopicArn})
+	} else {
+		fields = append(fields, [2]string{"SubscribeURL", message.SubscribeURL},
+			[2]string{"Timestamp", message.Timestamp}, [2]string{"Token", message.Token},
+			[2]string{"TopicArn", message.TopicArn})
+	}
+	fields = append(fields, [2]string{"Type", message.Type})
+
+	var signed strings.Builder
+	for _, field := range fields {
+		signed.WriteString(field[0] + "\n" + field[1] + "\n")
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(message.Signature)
+	if err != nil {
+		return err
+	}
+	certificate, err := sns_certificate(message.SigningCertURL)
+	if err != nil {
+		return err
+	}
+	key, ok := certificate.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("unexpected signing key")
+	}
+
+	switch message.SignatureVersion {
+	case "1":
+		sum := sha1.Sum([]byte(signed.String()))
+		return rsa.VerifyPKCS1v15(key, crypto.SHA1, sum[:], signature)
+	case "2":
+		sum := sha256.Sum256([]byte(signed.String()))
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], signature)
+	}
+	return fmt.Errorf("unsupported signature version: %s", message.SignatureVersion)
+}
+
+// ingest_ses handles SES receipt notifications delivered through an SNS
+// HTTP subscription, which it confirms on first contact.
+func ingest_ses(w http.ResponseWriter, r *http.Request, account *user.User, maxSize int64) {
+	if r.Method != http.MethodPost {
+		http_error(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+		return
+	}
+
+	var message SNSMessage
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxSize*4/3+64*1024)).Decode(&message); err != nil {
+		http_error(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := sns_verify(&message); err != nil {
+		log_info("ingest: rejecting SNS message: %s", err)
+		http_error(w, http.StatusForbidden, fmt.Errorf("invalid signature"))
+		return
+	}
+
+	switch message.Type {
+	case "SubscriptionConfirmation":
+		u, err := url.Parse(message.SubscribeURL)
+		if err != nil || u.Scheme != "https" || !snsHostRegexp.MatchString(u.Host) {
+			http_error(w, http.StatusBadRequest, fmt.Errorf("untrusted subscription URL"))
+			return
+		}
+		response, err := providerClient.Get(message.SubscribeURL)
+		if err != nil {
+			http_error(w, http.StatusBadGateway, err)
+			return
+		}
+		response.Body.Close()
+		log_info("ingest: confirmed SNS subscription to %s for %s", message.TopicArn, account.Username)
+		w.WriteHeader(http.StatusOK)
+		return
+	case "Notification":
+	default:
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	var notification SESNotification
+	if err := json.Unmarshal([]byte(message.Message), &notification); err != nil {
+		http_error(w, http.StatusBadRequest, err)
+		return
+	}
+	if notification.NotificationType != "Received" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	env := &Envelope{Sender: notification.Mail.Source}
+	if len(notification.Receipt.Recipients) != 0 {
+		env.Recipient = notification.Receipt.Recipients[0]
+	} else if len(notification.Mail.Destination) != 0 {
+		env.Recipient = notification.Mail.Destination[0]
+	}
+
+	action := notification.Receipt.Action
+	switch action.Type {
+	case "SNS":
+		content := notification.Content
+		if action.Encoding == "BASE64" {
+			data, err := base64.StdEncoding.DecodeString(content)
+			if err != nil {
+				http_error(w, http.StatusBadRequest, err)
+				return
+			}
+			content = string(data)
+		}
+		ingest_spool(w, r.Context(), account, env, strings.NewReader(content), maxSize)
+
+	case "S3":
+		body, err := s3_get(r, action.BucketName, action.ObjectKey)
+		if err != nil {
+			log_info("ingest: fetching s3://%s/%s: %s", action.BucketName, action.ObjectKey, err)
+			w.Header().Set("Retry-After", "300")
+			http_error(w, http.StatusServiceUnavailable, err)
+			return
+		}
+		defer body.Close()
+		ingest_spool(w, r.Context(), account, env, body, maxSize)
+
+	default:
+		http_error(w, http.StatusUnprocessableEntity, fmt.Errorf("unsupported SES action: %s", action.Type))
+	}
+}
+
+func s3_escape(key string) string {
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = strings.ReplaceAll(url.PathEscape(segment), "+", "%2B")
+	}
+	return "/" + strings.Join(segments, "/")
+}
+
+func hmac_sha256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3_get fetches an object with a SigV4-signed request, credentials come
+// from the usual AWS environment variables.
+func s3_get(r *http.Request, bucket string, key string) (io.ReadCloser, error) {
+	accessKey, secretKey := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+	region := *ingestS3Region
+	if accessKey == "" || secretKey == "" || region == "" {
+		return nil, fmt.Errorf("AWS credentials or region not configured")
+	}
+
+	host := bucket + ".s3." + region + ".amazonaws.com"
+	path := s3_escape(key)
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	headers := [][2]string{{"host", host}, {"x-amz-content-sha256", "UNSIGNED-PAYLOAD"}, {"x-amz-date", amzDate}}
+	if token := os.Getenv("AWS_SESSION_TOKEN"); token != "" {
+		headers = append(headers, [2]string{"x-amz-security-token", token})
+	}
+	var canonicalHeaders strings.Builder
+	signedHeaders := make([]string, 0, len(headers))
+	for _, header := range headers {
+		canonicalHeaders.WriteString(header[0] + ":" + header[1] + "\n")
+		signedHeaders = append(signedHeaders, header[0])
+	}
+
+	canonical := strings.Join([]string{"GET", path, "", canonicalHeaders.String(),
+		strings.Join(signedHeaders, ";"), "UNSIGNED-PAYLOAD"}, "\n")
+	canonicalSum := sha256.Sum256([]byte(canonical))
+	scope := date + "/" + region + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalSum[:])
+
+	signing := hmac_sha256([]byte("AWS4"+secretKey), date)
+	signing = hmac_sha256(signing, region)
+	signing = hmac_sha256(signing, "s3")
+	signing = hmac_sha256(signing, "aws4_request")
+	signature := hex.EncodeToString(hmac_sha256(signing, toSign))
+
+	request, err := http.NewRequestWithContext(r.Context(), http.MethodGet, "https://"+host+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, header := range headers[1:] {
+		request.Header.Set(header[0], header[1])
+	}
+	request.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, strings.Join(signedHeaders, ";"), signature))
+
+	response, err := providerClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		response.Body.Close()
+		return nil, fmt.Errorf("s3: %s", response.Status)
+	}
+	return response.Body, nil
+}
+
+// ingest_mailgun handles Mailgun routes forwarding to a URL ending in
+// /mime, which posts the untouched message in the body-mime field. The
+// webhook signature is checked when a signing key is configured.
+func ingest_mailgun(w http.ResponseWriter, r *http.Request, account *user.User, maxSize int64) {
+	if r.Method != http.MethodPost {
+		http_error(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxSize+64*1024)
+	if err := r.ParseMultipartForm(32 * 1024 * 1024); err != nil && err != http.ErrNotMultipart {
+		http_error(w, http.StatusBadRequest, err)
+		return
+	}
+	if r.MultipartForm != nil {
+		defer r.MultipartForm.RemoveAll()
+	}
+
+	if *ingestMailgunKey != "" {
+		timestamp, token := r.FormValue("timestamp"), r.FormValue("token")
+		expected := hex.EncodeToString(hmac_sha256([]byte(*ingestMailgunKey), timestamp+token))
+		seconds, _ := strconv.ParseInt(timestamp, 10, 64)
+		if !hmac.Equal([]byte(expected), []byte(r.FormValue("signature"))) ||
+			math.Abs(float64(time.Now().Unix()-seconds)) > 15*60 {
+			http_error(w, http.StatusForbidden, fmt.Errorf("invalid signature"))
+			return
+		}
+	}
+
+	raw := r.FormValue("body-mime")
+	if raw == "" {
+		http_error(w, http.StatusUnprocessableEntity, fmt.Errorf("no body-mime field, route must forward to a /mime URL"))
+		return
+	}
+	env := &Envelope{Sender: r.FormValue("sender"), Recipient: r.FormValue("recipient")}
+	ingest_spool(w, r.Context(), account, env, strings.NewReader(raw), maxSize)
+}
@@ -0,0 +1,170 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// INIT_CONFIG is the starter configuration, rules are match directives in
+// the same file and are given commented out as a starting point.
+const INIT_CONFIG = `# mail.pmda configuration, see the Config documentation for the full list
+# of directives.
+
+maildir %s
+notify %s
+
+# checksums
+# xattr
+# repair message-id
+# repair date
+
+# Rules are evaluated in order, the first match decides the folder. They
+# take precedence over the built-in classification.
+#
+# match header "List-Id" "golang-nuts" folder ".Lists.golang-nuts"
+# match header "From" "@github\\.com" folder ".GitHub"
+# match to "invoices+*@example.org" folder ".Invoices"
+# match all file-by-date ".Archive"
+`
+
+var initFlags = flag.NewFlagSet("init", flag.ExitOnError)
+var initMaildir = initFlags.String("maildir", "Maildir", "maildir location, relative to the home directory")
+var initNotify = initFlags.String("notify", "none", "desktop notification level: none, minimal, sender or full")
+var initSpecialUse = initFlags.Bool("special-use", false, "declare the category folders in the dovecot snippet")
+var initForce = initFlags.Bool("force", false, "overwrite an existing configuration file")
+var initBatch = initFlags.Bool("y", false, "do not ask questions, use flags and defaults")
+
+// init_main implements "mail.pmda init", which prepares an account for
+// delivery and prints the MTA and IMAP server snippets to go with it.
+// Questions are only asked on a terminal for options not given as flags.
+func init_main(args []string) int {
+	initFlags.Parse(args)
+	if initFlags.NArg() != 0 {
+		fmt.Fprintf(os.Stderr, "Usage: %s init [-y] [-force] [-special-use] [-maildir path] [-notify level]\n", os.Args[0])
+		return 1
+	}
+
+	homedir := os.Getenv("HOME")
+	if homedir == "" {
+		fmt.Fprintf(os.Stderr, "HOME environment variable not set\n")
+		return 1
+	}
+
+	explicit := make(map[string]bool)
+	initFlags.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	if st, err := os.Stdin.Stat(); err == nil && st.Mode()&os.ModeCharDevice != 0 && !*initBatch {
+		prompt := bufio.NewReader(os.Stdin)
+		if !explicit["maildir"] {
+			*initMaildir = init_ask(prompt, "Maildir location", *initMaildir)
+		}
+		if !explicit["notify"] {
+			*initNotify = init_ask(prompt, "Notify level (none, minimal, sender, full)", *initNotify)
+		}
+		if !explicit["special-use"] {
+			*initSpecialUse = strings.HasPrefix(strings.ToLower(init_ask(prompt, "Declare folders in dovecot (yes/no)", "no")), "y")
+		}
+	}
+
+	switch *initNotify {
+	case "none", "minimal", "sender", "full":
+	default:
+		fmt.Fprintf(os.Stderr, "unknown notify level: %s\n", *initNotify)
+		return 1
+	}
+
+	pathname := filepath.Join(homedir, ".pmda.conf")
+	content := fmt.Sprintf(INIT_CONFIG, config_quote(*initMaildir), *initNotify)
+	if _, err := os.Stat(pathname); err == nil && !*initForce {
+		fmt.Printf("%s exists, leaving it untouched (use -force to overwrite)\n", pathname)
+	} else {
+		if err := os.WriteFile(pathname, []byte(content), 0600); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing %s: %s\n", pathname, err)
+			return 1
+		}
+		fmt.Printf("wrote %s\n", pathname)
+	}
+
+	// the snippets must match what deliveries will use, which is whatever
+	// configuration ends up in place, not necessarily what was asked.
+	cfg, err := config_read(pathname)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading configuration: %s\n", err)
+		return 1
+	}
+	maildir := maildir_resolve(cfg, homedir)
+	maildir_mkdirs(maildir)
+	for _, fallback := range cfg.Fallbacks {
+		maildir_mkdirs(backend_resolve(homedir, fallback))
+	}
+	for _, category := range SPECIAL_FOLDERS {
+		if folder := special_folder(cfg, category); folder != "" {
+			maildir_folder(cfg, maildir, folder)
+		}
+	}
+	fmt.Printf("created %s\n", maildir)
+
+	binary, err := os.Executable()
+	if err != nil {
+		binary = "/usr/local/bin/mail.pmda"
+	}
+	location := maildir
+	if rel, err := filepath.Rel(homedir, maildir); err == nil && !strings.HasPrefix(rel, "..") {
+		location = "~/" + rel
+	}
+
+	fmt.Printf("\n# smtpd.conf\n")
+	fmt.Printf("action \"local_mail\" mda \"%s\"\n", binary)
+	fmt.Printf("match from local for local action \"local_mail\"\n")
+	fmt.Printf("\n# smtpd.conf, letting smtpd resolve users through mail.pmda\n")
+	fmt.Printf("table pmda proc-exec:\"%s table\"\n", binary)
+	fmt.Printf("action \"local_mail\" mda \"%s\" userbase <pmda>\n", binary)
+
+	fmt.Printf("\n# dovecot.conf\n")
+	fmt.Printf("mail_location = maildir:%s\n", location)
+	if *initSpecialUse {
+		fmt.Printf("namespace inbox {\n")
+		fmt.Printf("  inbox = yes\n")
+		for _, category := range SPECIAL_FOLDERS {
+			if special_folder(cfg, category) == "" {
+				continue
+			}
+			fmt.Printf("  mailbox %s {\n", strings.TrimPrefix(special_folder(cfg, category), "."))
+			if category == "junk" {
+				fmt.Printf("    special_use = \\Junk\n")
+			}
+			fmt.Printf("    auto = subscribe\n")
+			fmt.Printf("  }\n")
+		}
+		fmt.Printf("}\n")
+	}
+	return 0
+}
+
+// init_ask prompts for a value, an empty answer keeps the default.
+func init_ask(prompt *bufio.Reader, question string, value string) string {
+	fmt.Printf("%s [%s]: ", question, value)
+	answer, _ := prompt.ReadString('\n')
+	if answer = strings.TrimSpace(answer); answer != "" {
+		return answer
+	}
+	return value
+}
@@ -0,0 +1,166 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const TRAINER_TIMEOUT = 30 * time.Second
+
+// trainers are the commands a filter learns from, fed a message on stdin,
+// run through the shell so that they can take arguments:
+//
+//	trainer junk "rspamc learn_spam"
+//	trainer junk "sa-learn --spam"
+var trainerKinds = map[string]bool{"junk": true}
+
+func trainer_parse(args []string) (string, string, error) {
+	if len(args) != 2 || !trainerKinds[args[0]] {
+		return "", "", fmt.Errorf("usage: trainer junk command")
+	}
+	return args[0], args[1], nil
+}
+
+// trainer_run feeds a stored message to the trainer of a kind, if any.
+func trainer_run(cfg *Config, kind string, pathname string) error {
+	command, exists := cfg.Trainers[kind]
+	if !exists {
+		return nil
+	}
+	file, err := os.Open(pathname)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), TRAINER_TIMEOUT)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", command)
+	cmd.Stdin = file
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %s: %s", command, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// message_move moves a stored message to a folder of the maildir,
+// keeping its name and whether it was seen by the MUA.
+func message_move(cfg *Config, maildir string, pathname string, folder string) (string, error) {
+	subdir := "new"
+	if strings.Contains(filepath.Base(pathname), ":2,") {
+		subdir = "cur"
+	}
+	maildir_folder(cfg, maildir, folder)
+	target, err := maildir_path(filepath.Join(maildir, folder, subdir), filepath.Base(pathname), shard_depth(maildir))
+	if err != nil {
+		return "", err
+	}
+	if target == pathname {
+		return target, nil
+	}
+	if err := os.Rename(pathname, target); err != nil {
+		return "", err
+	}
+	return target, nil
+}
+
+var junkFlags = flag.NewFlagSet("junk", flag.ExitOnError)
+var junkBlock = junkFlags.Bool("block", false, "also add the senders to the blocklist")
+
+// junk_main implements "mail.pmda junk", the report-as-spam action for
+// MUA macros: messages move to .Junk, the configured trainer learns from
+// them and their senders lose the reputation the importance scorer gave.
+func junk_main(args []string) int {
+	junkFlags.Parse(args)
+	if junkFlags.NArg() == 0 {
+		fmt.Fprintf(os.Stderr, "Usage: %s junk [-block] message ...\n", os.Args[0])
+		return 1
+	}
+
+	homedir := os.Getenv("HOME")
+	cfg, err := config_read(filepath.Join(homedir, ".pmda.conf"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading configuration: %s\n", err)
+		return 1
+	}
+	maildir := maildir_resolve(cfg, homedir)
+	if special_folder(cfg, "junk") == "" {
+		fmt.Fprintf(os.Stderr, "Error: the junk category is off\n")
+		return 1
+	}
+
+	store, err := state_open(cfg, homedir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error opening state: %s\n", err)
+		return 1
+	}
+	defer store.Close()
+
+	status := 0
+	senders := make([]string, 0)
+	for _, pathname := range junkFlags.Args() {
+		file, err := os.Open(pathname)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading %s: %s\n", pathname, err)
+			status = 1
+			continue
+		}
+		hdr, err := header_read(file)
+		file.Close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading %s: %s\n", pathname, err)
+			status = 1
+			continue
+		}
+
+		target, err := message_move(cfg, maildir, pathname, special_folder(cfg, "junk"))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error moving %s: %s\n", pathname, err)
+			status = 1
+			continue
+		}
+		if err := trainer_run(cfg, "junk", target); err != nil {
+			fmt.Fprintf(os.Stderr, "Error training: %s\n", err)
+			status = 1
+		}
+		for _, sender := range hdr.Addresses("From") {
+			store.Delete(REPUTATION_NS, sender)
+			senders = append(senders, sender)
+		}
+		fmt.Println(target)
+	}
+
+	if *junkBlock && len(senders) != 0 {
+		blocklist := cfg.Blocklist
+		if blocklist == nil {
+			blocklist = blocklist_default()
+		}
+		if _, err := list_edit(blocklist_path(blocklist, homedir), senders, false, "junk "+time.Now().Format("2006-01-02")); err != nil {
+			fmt.Fprintf(os.Stderr, "Error updating blocklist: %s\n", err)
+			status = 1
+		}
+	}
+	return status
+}
@@ -0,0 +1,150 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// IMAP keywords are stored as lowercase flag letters by Dovecot, each
+// folder mapping its letters to keywords in a dovecot-keywords file:
+//
+//	0 $Forwarded
+//	1 $Label1
+//
+// makes letter a stand for $Forwarded and b for $Label1 in that folder
+// only, so moving a message between folders translates its letters.
+const KEYWORDS_MAX = 26
+
+func keywords_read(folder string) ([]string, error) {
+	keywords := make([]string, KEYWORDS_MAX)
+	file, err := os.Open(filepath.Join(folder, "dovecot-keywords"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return keywords, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		index, name, found := strings.Cut(strings.TrimSpace(scanner.Text()), " ")
+		if !found {
+			continue
+		}
+		if n, err := strconv.Atoi(index); err == nil && n >= 0 && n < KEYWORDS_MAX {
+			keywords[n] = name
+		}
+	}
+	return keywords, scanner.Err()
+}
+
+func keywords_write(folder string, keywords []string) error {
+	var data strings.Builder
+	for index, name := range keywords {
+		if name != "" {
+			fmt.Fprintf(&data, "%d %s\n", index, name)
+		}
+	}
+	pathname := filepath.Join(folder, "dovecot-keywords")
+	tmpname := fmt.Sprintf("%s.%d", filepath.Join(folder, "tmp", "dovecot-keywords"), os.Getpid())
+	if err := os.WriteFile(tmpname, []byte(data.String()), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpname, pathname)
+}
+
+// keywords_translate rewrites the keyword letters of maildir flags from
+// the letters of one folder to those of another, registering keywords
+// the target folder does not know yet. Keywords beyond the 26 letters of
+// the target folder are lost, as with Dovecot itself.
+func keywords_translate(flags string, source string, target string) (string, error) {
+	if strings.IndexFunc(flags, func(r rune) bool { return r >= 'a' && r <= 'z' }) < 0 {
+		return flags, nil
+	}
+	from, err := keywords_read(source)
+	if err != nil {
+		return "", err
+	}
+
+	names := make([]string, 0)
+	translated := make([]rune, 0, len(flags))
+	for _, flag := range flags {
+		if flag < 'a' || flag > 'z' {
+			translated = append(translated, flag)
+		} else if name := from[flag-'a']; name != "" {
+			names = append(names, name)
+		}
+	}
+	letters, err := keywords_letters(target, names)
+	if err != nil {
+		return "", err
+	}
+	translated = append(translated, []rune(letters)...)
+
+	// flags stay in ASCII order
+	sort.Slice(translated, func(i, j int) bool { return translated[i] < translated[j] })
+	return string(translated), nil
+}
+
+// keywords_letters returns the letters standing for keywords in a
+// folder, registering those it does not know yet.
+func keywords_letters(folder string, names []string) (string, error) {
+	if len(names) == 0 {
+		return "", nil
+	}
+	to, err := keywords_read(folder)
+	if err != nil {
+		return "", err
+	}
+
+	changed := false
+	letters := make([]rune, 0, len(names))
+	for _, name := range names {
+		index := -1
+		for i, known := range to {
+			if known == name {
+				index = i
+				break
+			}
+		}
+		if index < 0 {
+			for i, known := range to {
+				if known == "" {
+					to[i], index, changed = name, i, true
+					break
+				}
+			}
+		}
+		if index >= 0 {
+			letters = append(letters, 'a'+rune(index))
+		}
+	}
+	if changed {
+		if err := keywords_write(folder, to); err != nil {
+			return "", err
+		}
+	}
+	return string(letters), nil
+}
@@ -0,0 +1,83 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// Messages are stored byte for byte as the MTA handed them over: bare CRs,
+// NULs and a missing final newline included, the header only being
+// rewritten when a field was changed, in the line ending of the message.
+// Mailstores that want LF only may have CRLF normalized as it is copied:
+//
+//	line-endings lf
+//
+// The W= attribute of the filename is the size with CRLF endings either
+// way, as IMAP servers count it.
+func line_endings_parse(args []string) (bool, error) {
+	if len(args) != 1 || (args[0] != "keep" && args[0] != "lf") {
+		return false, fmt.Errorf("usage: line-endings keep|lf")
+	}
+	return args[0] == "lf", nil
+}
+
+// line_ending returns the ending of the first line of data, LF unless
+// that line ends in CRLF.
+func line_ending(data []byte) string {
+	if i := bytes.IndexByte(data, '\n'); i > 0 && data[i-1] == '\r' {
+		return "\r\n"
+	}
+	return "\n"
+}
+
+// LFWriter turns CRLF into LF on its way to w, bare CRs are left alone.
+// A CR ending a write is held until the next one tells what follows it,
+// Close writes it out if nothing does.
+type LFWriter struct {
+	w   io.Writer
+	cr  bool
+	buf []byte
+}
+
+func (lf *LFWriter) Write(p []byte) (int, error) {
+	lf.buf = lf.buf[:0]
+	for _, c := range p {
+		if lf.cr && c != '\n' {
+			lf.buf = append(lf.buf, '\r')
+		}
+		lf.cr = c == '\r'
+		if !lf.cr {
+			lf.buf = append(lf.buf, c)
+		}
+	}
+	if _, err := lf.w.Write(lf.buf); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (lf *LFWriter) Close() error {
+	if !lf.cr {
+		return nil
+	}
+	lf.cr = false
+	_, err := lf.w.Write([]byte{'\r'})
+	return err
+}
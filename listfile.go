@@ -0,0 +1,136 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// A list file holds one entry per line. Blank lines and comments, on a
+// line of their own or after an entry, are kept as the user left them:
+//
+//	# mailing list noise
+//	<20240301.abcd@example.org>  # muted 2024-03-04
+
+// list_entry returns the entry of a line, if it has one.
+func list_entry(line string) string {
+	entry, _, _ := strings.Cut(line, "#")
+	return strings.TrimSpace(entry)
+}
+
+// list_read returns the entries of a list file, a missing file is an
+// empty list.
+func list_read(pathname string) (map[string]bool, error) {
+	file, err := os.Open(pathname)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return map[string]bool{}, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	entries := make(map[string]bool)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if entry := list_entry(scanner.Text()); entry != "" {
+			entries[entry] = true
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// list_edit adds entries missing from a list file, or removes them, and
+// returns how many lines it changed. The file is rewritten atomically
+// under a lock of its own, so that concurrent edits do not lose any.
+func list_edit(pathname string, entries []string, remove bool, comment string) (int, error) {
+	if err := os.MkdirAll(filepath.Dir(pathname), 0700); err != nil {
+		return 0, err
+	}
+	lock, err := os.OpenFile(pathname+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return 0, err
+	}
+	defer lock.Close()
+	if err := lock_file(lock, LOCK_TIMEOUT); err != nil {
+		return 0, err
+	}
+
+	lines := make([]string, 0)
+	if data, err := os.ReadFile(pathname); err == nil {
+		lines = strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+		if len(lines) == 1 && lines[0] == "" {
+			lines = lines[:0]
+		}
+	} else if !os.IsNotExist(err) {
+		return 0, err
+	}
+
+	wanted := make(map[string]bool)
+	for _, entry := range entries {
+		wanted[entry] = true
+	}
+	changed := 0
+	kept := make([]string, 0, len(lines)+len(entries))
+	for _, line := range lines {
+		entry := list_entry(line)
+		if wanted[entry] {
+			if remove {
+				changed++
+				continue
+			}
+			// already listed, only the first occurrence counts
+			delete(wanted, entry)
+		}
+		kept = append(kept, line)
+	}
+	if !remove {
+		for _, entry := range entries {
+			if !wanted[entry] {
+				continue
+			}
+			delete(wanted, entry)
+			if comment != "" {
+				entry += "  # " + comment
+			}
+			kept = append(kept, entry)
+			changed++
+		}
+	}
+	if changed == 0 {
+		return 0, nil
+	}
+
+	data := strings.Join(kept, "\n")
+	if len(kept) != 0 {
+		data += "\n"
+	}
+	tmpname := fmt.Sprintf("%s.%d", pathname, os.Getpid())
+	if err := os.WriteFile(tmpname, []byte(data), 0600); err != nil {
+		os.Remove(tmpname)
+		return 0, err
+	}
+	if err := os.Rename(tmpname, pathname); err != nil {
+		os.Remove(tmpname)
+		return 0, err
+	}
+	return changed, nil
+}
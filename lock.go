@@ -0,0 +1,85 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"syscall"
+	"time"
+)
+
+const (
+	LOCK_TIMEOUT     = 30 * time.Second
+	LOCK_BACKOFF_MIN = 5 * time.Millisecond
+	LOCK_BACKOFF_MAX = 500 * time.Millisecond
+
+	// waits longer than this are worth a log line
+	LOCK_CONTENDED = 1 * time.Second
+)
+
+// LockStats accounts for the contention met by this process.
+type LockStats struct {
+	Acquired  int64
+	Contended int64
+	Attempts  int64
+	Waited    time.Duration
+}
+
+var lockStats LockStats
+
+// lock_file takes an exclusive flock on an open file. Rather than blocking
+// in the kernel, which lets a burst of deliveries to the same mailbox wake
+// up all at once, it polls with an exponential backoff and full jitter.
+func lock_file(file *os.File, timeout time.Duration) error {
+	start := time.Now()
+	backoff := LOCK_BACKOFF_MIN
+	attempts := int64(0)
+
+	for {
+		attempts++
+		err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if err != syscall.EWOULDBLOCK && err != syscall.EINTR {
+			return err
+		}
+		if time.Since(start) > timeout {
+			lockStats.Contended++
+			lockStats.Attempts += attempts
+			lockStats.Waited += time.Since(start)
+			return fmt.Errorf("timeout locking %s after %d attempts", file.Name(), attempts)
+		}
+
+		time.Sleep(time.Duration(rand.Int63n(int64(backoff))) + time.Millisecond)
+		backoff = min(backoff*2, LOCK_BACKOFF_MAX)
+	}
+
+	waited := time.Since(start)
+	lockStats.Acquired++
+	lockStats.Attempts += attempts
+	lockStats.Waited += waited
+	if attempts > 1 {
+		lockStats.Contended++
+	}
+	if waited > LOCK_CONTENDED {
+		log_info("lock on %s contended: %d attempts, waited %s", file.Name(), attempts, waited.Round(time.Millisecond))
+	}
+	return nil
+}
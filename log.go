@@ -0,0 +1,43 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// log_info reports a noteworthy but non-fatal event of the delivery, to
+// syslog as well when in use, and only there with -q.
+func log_info(format string, a ...any) {
+	if syslogWriter != nil {
+		syslogWriter.Info(fmt.Sprintf(format, a...))
+		if *quiet {
+			return
+		}
+	}
+	fmt.Fprintf(os.Stderr, "mail.pmda: "+format+"\n", a...)
+}
+
+// log_error reports why a delivery failed, on stderr where the MTA picks
+// it up for its logs and bounces, and to syslog when in use.
+func log_error(format string, a ...any) {
+	if syslogWriter != nil {
+		syslogWriter.Err(fmt.Sprintf(format, a...))
+	}
+	fmt.Fprintf(os.Stderr, format+"\n", a...)
+}
@@ -0,0 +1,80 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// delivered_to looks for the Delivered-To fields naming recipient. The
+// MTA may have prepended one for this very delivery, above the Received
+// field it added on receipt, in which case present is set and no other
+// is needed. One found below a Received field means the message was
+// delivered here before and came back: it is a forwarding loop.
+func delivered_to(hdr *Header, recipient string) (bool, bool) {
+	recipient = correspondent_address(recipient)
+	if recipient == "" {
+		return false, false
+	}
+	present, received := false, false
+	for _, field := range hdr.Fields {
+		if strings.EqualFold(field.Name, "Received") {
+			received = true
+			continue
+		}
+		if !strings.EqualFold(field.Name, "Delivered-To") || correspondent_address(field.Value) != recipient {
+			continue
+		}
+		if received {
+			return present, true
+		}
+		present = true
+	}
+	return present, false
+}
+
+// delivery_fields returns the values of the fields called name that the
+// MTA prepended for this delivery, those above the first Received field.
+func delivery_fields(hdr *Header, name string) []string {
+	values := make([]string, 0)
+	for _, field := range hdr.Fields {
+		if strings.EqualFold(field.Name, "Received") {
+			break
+		}
+		if strings.EqualFold(field.Name, name) {
+			values = append(values, field.Value)
+		}
+	}
+	return values
+}
+
+// delivery_stamp is the value of the X-PMDA-Delivery field recording a
+// delivery, written under Return-Path once the folder is known:
+//
+//	X-PMDA-Delivery: by mx.example.org (mail.pmda 1.2.0) for <me@example.org>; Tue, 5 Mar 2024 09:12:44 +0100 (into .Junk)
+func delivery_stamp(cfg *Config, env *Envelope, hostname string, folder string, now time.Time) string {
+	stamp := fmt.Sprintf("by %s (mail.pmda %s)", hostname, version)
+	if env.Recipient != "" {
+		stamp += " for <" + header_oneline(env.Recipient) + ">"
+	}
+	if folder == "" {
+		folder = "INBOX"
+	}
+	return fmt.Sprintf("%s; %s (into %s)", stamp, now.In(cfg.Timezone).Format(time.RFC1123Z), header_oneline(folder))
+}
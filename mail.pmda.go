@@ -19,43 +19,146 @@ package main
 import (
 	"bufio"
 	"crypto/rand"
+	"encoding/hex"
 	"flag"
 	"fmt"
-	"math/big"
+	"io"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 )
 
 const (
-	EX_TEMPFAIL = 75
+	EX_UNAVAILABLE = 69
+	EX_TEMPFAIL    = 75
 )
 
-func maildir_mkdirs(maildir string) {
+// tempfail ends a delivery for the MTA to retry it later.
+func tempfail() {
+	metrics_tempfail()
+	os.Exit(EX_TEMPFAIL)
+}
+
+// maildir_mkdirs creates the new, cur and tmp subdirectories of maildir
+// and reports whether any of them had to be created.
+func maildir_mkdirs(maildir string) bool {
+	created := false
 	for _, subdir := range []string{"new", "cur", "tmp"} {
 		path := filepath.Join(maildir, subdir)
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			created = true
+		}
 		if err := os.MkdirAll(path, 0700); err != nil {
-			fmt.Fprintf(os.Stderr, "Error creating %s: %s\n", path, err)
-			os.Exit(EX_TEMPFAIL)
+			log_error("Error creating %s: %s", path, err)
+			tempfail()
+		}
+	}
+	return created
+}
+
+// maildir_resolve returns the maildir of a user, as configured or in the
+// default location. Relative paths are relative to the home directory.
+func maildir_resolve(cfg *Config, homedir string) string {
+	if cfg.Maildir == "" {
+		return filepath.Join(homedir, "Maildir")
+	}
+	if filepath.IsAbs(cfg.Maildir) {
+		return cfg.Maildir
+	}
+	return filepath.Join(homedir, cfg.Maildir)
+}
+
+// maildir_flags validates and normalizes the flags of a maildir info
+// part, which must be listed in ASCII order.
+func maildir_flags(flags string) (string, error) {
+	seen := make(map[rune]bool)
+	for _, flag := range flags {
+		if !strings.ContainsRune("DFPRST", flag) && (flag < 'a' || flag > 'z') {
+			return "", fmt.Errorf("invalid maildir flag: %c", flag)
 		}
+		seen[flag] = true
 	}
+	sorted := make([]byte, 0, len(seen))
+	for c := byte('A'); c <= 'z'; c++ {
+		if seen[rune(c)] {
+			sorted = append(sorted, c)
+		}
+	}
+	return string(sorted), nil
 }
 
-func maildir_engine(maildir string) {
+// maildir_folder creates a Maildir++ folder and, on first creation,
+// writes its configured metadata.
+func maildir_folder(cfg *Config, maildir string, folder string) {
+	if maildir_mkdirs(filepath.Join(maildir, folder)) {
+		folder_metadata(cfg, folder)
+	}
+}
+
+// attempts at creating a message file before giving up on collisions
+const MAILDIR_CREATE_ATTEMPTS = 16
+
+// deliveries made by the process, the Q part of filenames
+var maildirDeliveries = 0
+
+// maildir_hostname escapes a hostname for use in filenames, as the
+// maildir specification asks for / and :, and for the , that separates
+// the Maildir++ attributes.
+func maildir_hostname(hostname string) string {
+	return strings.NewReplacer("/", "\\057", ":", "\\072", ",", "\\054").Replace(hostname)
+}
+
+// maildir_filename returns a unique name in the modern convention: the
+// time in seconds, then microseconds, process ID, delivery counter and
+// random bits, then the host.
+//
+//	1709251200.M482133P4211Q1R5f0c1a2b.mx1
+func maildir_filename(hostname string, now time.Time) (string, error) {
+	random := make([]byte, 4)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	maildirDeliveries++
+	return fmt.Sprintf("%d.M%dP%dQ%dR%s.%s", now.Unix(), now.Nanosecond()/1000, os.Getpid(),
+		maildirDeliveries, hex.EncodeToString(random), maildir_hostname(hostname)), nil
+}
+
+// maildir_create creates a message file in a tmp directory under a new
+// unique name, never over an existing file.
+func maildir_create(tmp string, hostname string) (*os.File, string, error) {
+	for attempt := 0; ; attempt++ {
+		filename, err := maildir_filename(hostname, time.Now())
+		if err != nil {
+			return nil, "", err
+		}
+		file, err := os.OpenFile(filepath.Join(tmp, filename), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			return file, filename, nil
+		}
+		if !os.IsExist(err) || attempt+1 == MAILDIR_CREATE_ATTEMPTS {
+			return nil, "", err
+		}
+	}
+}
+
+func maildir_engine(cfg *Config, env *Envelope, maildir string) {
+	root := maildir
 	maildir_mkdirs(maildir)
-	maildir_mkdirs(filepath.Join(maildir, ".Error"))
-	maildir_mkdirs(filepath.Join(maildir, ".Junk"))
-	maildir_mkdirs(filepath.Join(maildir, ".List"))
-	maildir_mkdirs(filepath.Join(maildir, ".Marketing"))
-	maildir_mkdirs(filepath.Join(maildir, ".Social"))
-	maildir_mkdirs(filepath.Join(maildir, ".Transactional"))
-
-	if extension := os.Getenv("EXTENSION"); extension != "" {
+
+	if extension := env.Extension; extension != "" && *mboxPath == "" {
 		subdir := filepath.Join(maildir, extension)
 		if _, err := os.Stat(subdir); err == nil {
-			maildir_mkdirs(subdir)
+			maildir_folder(cfg, maildir, extension)
 			maildir = subdir
+		} else if cfg.Extensions != nil {
+			if folder := extension_folder(cfg.Extensions, extension); folder != "" {
+				if autofolder_create(cfg, maildir, folder) {
+					log_info("created folder %s for extension %s", folder, extension)
+				}
+				maildir = filepath.Join(maildir, folder)
+			}
 		}
 	}
 
@@ -67,118 +170,693 @@ func maildir_engine(maildir string) {
 		}
 	}
 
-	nBig, err := rand.Int(rand.Reader, big.NewInt(0xffffffff))
+	file, filename, err := maildir_create(filepath.Join(maildir, "tmp"), hostname)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error generating random number: %s\n", err)
-		os.Exit(EX_TEMPFAIL)
-	}
-	filename := fmt.Sprintf("%d.%08x.%s", time.Now().Unix(), uint32(nBig.Uint64()), hostname)
-
-	pathname := filepath.Join(maildir, "tmp", filename)
-	file, err := os.Create(pathname)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error creating %s: %s\n", pathname, err)
-		os.Exit(EX_TEMPFAIL)
+		log_error("Error creating message in %s: %s", filepath.Join(maildir, "tmp"), err)
+		tempfail()
 	}
+	pathname := file.Name()
 	defer file.Close()
 
-	scanner := bufio.NewScanner(os.Stdin)
-	writer := bufio.NewWriter(file)
+	// memory use is bounded by the buffer size whatever the message size,
+	// the header is held in memory up to that size and passed through as
+	// is beyond, only what was read until then is classified.
+	reader := bufio.NewReaderSize(os.Stdin, cfg.BufferSize)
+	writer := bufio.NewWriterSize(file, cfg.BufferSize)
+	headerSize := 0
+	var raw, overflow []byte
 
-	hasReturnPath := false
-	listId := ""
+	// MTAs piping messages in mbox framing, Postfix among them, start
+	// them with a From_ line which has no place in a maildir
+	if peek, _ := reader.Peek(5); string(peek) == "From " {
+		if _, _, err := line_read(reader, LINE_READ_MAX); err != nil && err != io.EOF {
+			log_error("Error reading from stdin: %s", err)
+			tempfail()
+		}
+	}
 
-	isMarketing := false
-	isSocial := false
-	isError := false
-	isJunk := false
-	isList := false
+	hdr := Header{}
 	isHdr := true
-	for scanner.Scan() {
-		line := scanner.Text()
-		fmt.Println(line)
+	violation := ""
+	limits := &cfg.Structure
+	for isHdr {
+		data, err := reader.ReadSlice('\n')
+		if err == bufio.ErrBufferFull || headerSize+len(data) > cfg.BufferSize {
+			log_info("header exceeds %d bytes, passing the remainder through", cfg.BufferSize)
+			overflow = append(overflow, data...)
+			break
+		}
+
+		// beyond the structure limits the header is not parsed any further
+		// and the message will not be classified
+		if limits.HeaderSize != 0 && headerSize+len(data) > limits.HeaderSize {
+			violation = fmt.Sprintf("header exceeds %d bytes", limits.HeaderSize)
+		} else if limits.Headers != 0 && len(hdr.Fields) >= limits.Headers && len(data) > 0 &&
+			data[0] != ' ' && data[0] != '\t' && data[0] != '\n' && data[0] != '\r' {
+			violation = fmt.Sprintf("more than %d header fields", limits.Headers)
+		}
+		if violation != "" {
+			overflow = append(overflow, data...)
+			break
+		}
+		if err != nil && err != io.EOF {
+			log_error("Error reading from stdin: %s", err)
+			tempfail()
+		}
+		if len(data) == 0 && err == io.EOF {
+			break
+		}
+		headerSize += len(data)
+		raw = append(raw, data...)
+		line := strings.TrimSuffix(strings.TrimSuffix(string(data), "\n"), "\r")
 
-		if isHdr && line == "" {
+		if line == "" {
 			isHdr = false
-		} else if isHdr {
-			if strings.ToLower(line) == "x-spam: yes" ||
-				strings.ToLower(line) == "x-spam-flag: yes" {
-				isJunk = true
-			} else if strings.ToLower(line) == "precedence: bulk" {
-				isMarketing = true
-			} else if strings.HasPrefix(strings.ToLower(line), "feedback-id: ") {
-				isMarketing = true
-			} else if strings.ToLower(line) == "precedence: list" {
-				isList = true
-			} else if strings.HasPrefix(strings.ToLower(line), "list-id: ") {
-				isList = true
-				listId = line[9:]
-				if listId != "" {
-					if listId[0] == '<' && listId[len(listId)-1] == '>' {
-						listId = listId[1 : len(listId)-1]
-						_ = listId
-					}
-				}
-			} else if strings.ToLower(line) == "return-path: <>" {
-				isError = true
-			} else if strings.HasPrefix(strings.ToLower(line), "return-path: ") {
-				hasReturnPath = true
-			}
+		} else {
+			hdr.add_line(line)
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+
+	deliveryLog.MessageId = hdr.Get("Message-ID")
+	delivered, looping := delivered_to(&hdr, env.Recipient)
+	if looping {
+		os.Remove(pathname)
+		usage_record(env.Home, "rejected")
+		log_info("mail forwarding loop for %s", env.Recipient)
+		fmt.Fprintf(os.Stderr, "mail forwarding loop for %s\n", env.Recipient)
+		os.Exit(EX_UNAVAILABLE)
+	}
+
+	parsed := len(hdr.Fields)
+	dedupKey := ""
+	if cfg.Dedup != nil {
+		// before repairs, a generated Message-ID is new every time
+		dedupKey = dedup_key(&hdr, env)
+	}
+	// before repairs too, the signature covers the Message-ID as received
+	bypassId := message_id(hdr.Get("Message-ID"))
+	bypassField := bypass_strip(cfg, &hdr)
+	header_repair(cfg, &hdr, hostname, time.Now())
+	if cfg.SMIME != nil {
+		// only the verdict of this delivery may be trusted
+		hdr.Del("X-PMDA-SMIME")
+	}
+	if cfg.PGP != nil {
+		hdr.Del("X-PMDA-PGP")
+	}
+	if cfg.AuthResults != nil {
+		authresults_strip(&hdr, authresults_servid(cfg, hostname))
+	}
+
+	// the trace fields of the delivery go atop the header unless the MTA
+	// added them already, the envelope sender it exported replacing any
+	// Return-Path the message claimed
+	trace := &Header{}
+	if _, exported := os.LookupEnv("SENDER"); exported {
+		hdr.Del("Return-Path")
+		trace.add_line("Return-Path: <" + header_oneline(env.Sender) + ">")
+	}
+	original := env.OriginalRecipient
+	if original == "" {
+		original = env.Recipient
+	}
+	if original != "" && len(delivery_fields(&hdr, "X-Original-To")) == 0 {
+		trace.add_line("X-Original-To: " + header_oneline(original))
+	}
+	if !delivered && env.Recipient != "" {
+		trace.add_line("Delivered-To: " + header_oneline(env.Recipient))
+	}
+
+	var out io.Writer = writer
+	var lf *LFWriter
+	if cfg.LineEndingsLF {
+		lf = &LFWriter{w: writer}
+		out = lf
+	}
+	eol := line_ending(raw)
+	trace.write(out, eol)
+	if !hdr.edited && len(hdr.Fields) == parsed {
+		out.Write(raw)
+	} else {
+		hdr.write(out, eol)
+		if overflow == nil && !isHdr {
+			io.WriteString(out, eol)
 		}
-		fmt.Fprintf(writer, "%s\n", line)
-	}
-	writer.Flush()
-
-	if err := scanner.Err(); err != nil {
-		fmt.Fprintf(os.Stderr, "Error reading from stdin: %s\n", err)
-		os.Exit(EX_TEMPFAIL)
-	}
-
-	if isError || !hasReturnPath {
-		os.Rename(pathname, filepath.Join(maildir, ".Error", "new", filename))
-	} else if isJunk {
-		os.Rename(pathname, filepath.Join(maildir, ".Junk", "new", filename))
-	} else if isSocial {
-		os.Rename(pathname, filepath.Join(maildir, ".Social", "new", filename))
-	} else if isList {
-		// XXX - not that simple, depends on maildir layout,
-		// will give it a bit more thinking
-		/*
-			subdir := filepath.Join(maildir, ".List", "."+listId)
-			if _, err := os.Stat(subdir); err == nil {
-				maildir_mkdirs(subdir)
-				os.Rename(pathname, filepath.Join(subdir, "new", filename))
+	}
+	hdr.Fields = append(trace.Fields, hdr.Fields...)
+	if overflow != nil {
+		out.Write(overflow)
+	}
+
+	// the body is copied as is: what the reader already buffered first,
+	// then straight from stdin which allows zero-copy where supported,
+	// the normalization of line endings needing it to cross userland.
+	if _, err := io.CopyN(out, reader, int64(reader.Buffered())); err != nil {
+		log_error("Error writing %s: %s", pathname, err)
+		tempfail()
+	}
+	if lf != nil {
+		if _, err := io.Copy(lf, os.Stdin); err != nil {
+			log_error("Error reading from stdin: %s", err)
+			tempfail()
+		}
+		lf.Close()
+	}
+	if err := writer.Flush(); err != nil {
+		log_error("Error writing %s: %s", pathname, err)
+		tempfail()
+	}
+	if lf == nil {
+		if _, err := body_copy(file, os.Stdin); err != nil {
+			log_error("Error reading from stdin: %s", err)
+			tempfail()
+		}
+	}
+	if st, err := file.Stat(); err == nil {
+		usage.Bytes = st.Size()
+	}
+	// the signature covers the body, known only now
+	bypass := bypassField != "" && bypass_check(cfg, env, bypassField, bypassId, pathname)
+
+	if dedupKey != "" && dedup_seen(cfg, env, dedupKey) {
+		if cfg.Trash != nil && *mboxPath == "" {
+			// kept in the trash should the key have collided
+			size := message_size(pathname)
+			folder := strings.TrimPrefix(strings.TrimPrefix(maildir, root), string(filepath.Separator))
+			if err := trash_move(cfg, env.Home, root, pathname, folder, "duplicate"); err != nil {
+				log_error("Error trashing duplicate: %s", err)
 			} else {
-				os.Rename(pathname, filepath.Join(maildir, ".List", "new", filename))
+				quota_add(cfg, root, size, 1)
+				usage_record(env.Home, "duplicate")
+				log_info("duplicate of %s, moved to %s", dedupKey, cfg.Trash.Folder)
+				return
+			}
+		}
+		os.Remove(pathname)
+		usage_record(env.Home, "duplicate")
+		log_info("duplicate of %s, discarded", dedupKey)
+		return
+	}
+
+	if cfg.Forward {
+		forward, err := forward_read(env.Home)
+		if err == nil && forward != nil {
+			err = forward_deliver(env, forward, pathname)
+		}
+		if err != nil {
+			os.Remove(pathname)
+			log_error("Error processing .forward: %s", err)
+			tempfail()
+		}
+		if forward != nil && !forward.Keep {
+			os.Remove(pathname)
+			if dedupKey != "" {
+				dedup_record(cfg, env, dedupKey)
 			}
-		*/
-		os.Rename(pathname, filepath.Join(maildir, ".List", "new", filename))
-	} else if isMarketing {
-		os.Rename(pathname, filepath.Join(maildir, ".Marketing", "new", filename))
+			usage_record(env.Home, "forwarded")
+			return
+		}
+	}
+
+	budget := budget_start(cfg.Budget)
+	if violation == "" && overflow == nil && limits.mime() {
+		var scanErr error
+		if budget.stage("mime", func() { scanErr = mime_scan_file(pathname, hdr.Get("Content-Type"), limits) }) && scanErr != nil {
+			violation = scanErr.Error()
+		}
+	}
+	if violation != "" {
+		log_info("message beyond limits: %s", violation)
+		if limits.Tempfail {
+			os.Remove(pathname)
+			usage_record(env.Home, "limited")
+			log_error("Error delivering: %s", violation)
+			tempfail()
+		}
+	}
+
+	msg := &Message{Header: &hdr, Envelope: env, Encrypted: encrypted_detect(&hdr), Violation: violation, Bypass: bypass}
+
+	// content scanners would only see ciphertext
+	scan := cfg.ScanEncrypted || !msg.Encrypted
+	if !scan {
+		log_info("encrypted message, content scanners skipped")
+	}
+	if cfg.Correspondents != nil && violation == "" {
+		known := false
+		if budget.stage("correspondents", func() { known = correspondents_check(cfg, env, root, &hdr) }) {
+			msg.KnownCorrespondent = known
+		}
+	}
+	if (cfg.Importance != nil || cfg.rules_use("is-reply-to-me")) && violation == "" {
+		reply := false
+		if budget.stage("replies", func() { reply = correspondents_reply(cfg, env, root, &hdr) }) {
+			msg.ReplyToMe = reply
+		}
+	}
+	if cfg.Blocklist != nil && violation == "" {
+		var found bool
+		if budget.stage("blocklist", func() { found = blocklist_check(cfg, env, &hdr) }) {
+			msg.Blocked = found
+		}
+	}
+	if cfg.Mute != nil && violation == "" {
+		var found bool
+		if budget.stage("mute", func() { found = mute_check(cfg, env, &hdr) }) {
+			msg.Muted = found
+		}
+	}
+	if (cfg.Calendar || cfg.rules_use("calendar")) && scan && violation == "" {
+		var calendar *Calendar
+		if budget.stage("calendar", func() { calendar = calendar_detect(cfg, env, pathname) }) {
+			msg.Calendar = calendar
+		}
+	}
+	// the fields decided on the way are written with the delivery stamp
+	// once the folder is known, the message copied a single time
+	fields := &Header{}
+	if (cfg.SMIME != nil || cfg.rules_use("smime")) && violation == "" {
+		var status, detail string
+		if budget.stage("smime", func() { status, detail = smime_check(cfg, env, &hdr, pathname) }) {
+			msg.SMIME = status
+			if status != "none" && cfg.SMIME != nil {
+				fields.add_line("X-PMDA-SMIME: " + status + "; " + header_oneline(detail))
+			}
+		}
+	}
+	if cfg.PGP != nil && violation == "" {
+		var status, detail string
+		signer := false
+		if budget.stage("pgp", func() {
+			status, detail = pgp_check(cfg, env, &hdr, pathname)
+			if authors := hdr.Addresses("From"); cfg.rules_use("pgp-signer") && len(authors) != 0 {
+				signer = pgp_signer(pgp_keyring(cfg, env.Home), authors[0])
+			}
+		}) {
+			msg.PGP, msg.PGPSigner = status, signer
+			if status != "none" {
+				fields.add_line("X-PMDA-PGP: " + status + "; " + header_oneline(detail))
+			}
+		}
+	}
+	if cfg.AuthResults != nil && violation == "" {
+		var value string
+		if budget.stage("dkim", func() { value = authresults_check(cfg, &hdr, pathname, hostname) }) {
+			fields.add_line("Authentication-Results: " + value)
+		}
+	}
+	if cfg.Classifier != nil && scan && violation == "" {
+		var result map[string]any
+		if budget.stage("classifier", func() { result = classifier_check(cfg, env, &hdr, pathname) }) {
+			msg.Classifier = result
+		}
+	}
+	if len(cfg.Models) != 0 && scan && violation == "" {
+		var scores map[string]float64
+		if budget.stage("models", func() { scores = models_score(cfg, env, pathname) }) {
+			msg.Scores = scores
+		}
+	}
+	if len(cfg.Reports) != 0 && scan && violation == "" {
+		var found *Report
+		if budget.stage("reports", func() { found = reports_detect(cfg, pathname) }) {
+			msg.Report = found
+		}
+	}
+	if cfg.rules_use("sender-is-freemail") && violation == "" {
+		msg.Freemail = sender_in_domains(env, &hdr, "freemail")
+	}
+	if cfg.rules_use("sender-is-disposable") && violation == "" {
+		msg.Disposable = sender_in_domains(env, &hdr, "disposable")
+	}
+	if violation == "" {
+		msg.SenderMismatch = sender_mismatch(env, &hdr)
+		if msg.Scores == nil {
+			msg.Scores = make(map[string]float64)
+		}
+		msg.Scores["phishing"] = phishing_score(msg)
+	}
+	if cfg.Marketing != nil && scan && violation == "" {
+		var score float64
+		if budget.stage("marketing", func() { score = marketing_score(cfg, pathname, &hdr) }) {
+			msg.Scores["marketing"] = score
+			msg.Marketing = score >= cfg.Marketing.Threshold
+		}
+	}
+	if cfg.Importance != nil && violation == "" {
+		var score float64
+		if budget.stage("importance", func() { score = importance_score(cfg, env, msg) }) {
+			msg.Scores["importance"] = score
+		}
+	}
+
+	// a script of the user replaces the built-in classification
+	if script, err := sieve_load(env.Home); err != nil {
+		log_info("error loading sieve script, using the built-in classification: %s", err)
+	} else if script != nil && violation == "" {
+		var result *SieveResult
+		if budget.stage("sieve", func() { result = sieve_evaluate(script, &hdr, env, message_size(pathname)) }) {
+			msg.Sieve = result
+		}
+	}
+	decision := Decision{Reason: "default"}
+	var classified Decision
+	if budget.stage("rules", func() { classified = Classify(cfg, msg, time.Now()) }) {
+		decision = classified
+	}
+	if budget.Degraded != "" {
+		fields.add_line("X-PMDA-Degraded: " + budget.Degraded)
+		decision = Decision{Reason: "degraded: " + budget.Degraded}
+	}
+	folder, reason, sieve, report := decision.Folder, decision.Reason, msg.Sieve, msg.Report
+	deliveryLog.Verdict, deliveryLog.Rule, deliveryLog.Trace = reason, decision.Rule, decision.Trace
+	if score, scored := msg.Scores["importance"]; scored && cfg.Importance.Tag {
+		fields.add_line("X-PMDA-Importance: " + strconv.FormatFloat(score, 'f', 0, 64))
+	}
+	if reason == "sieve" && sieve.Reject != "" {
+		os.Remove(pathname)
+		usage_record(env.Home, "rejected")
+		log_info("rejected by sieve script: %s", sieve.Reject)
+		fmt.Fprintf(os.Stderr, "%s\n", header_oneline(sieve.Reject))
+		os.Exit(EX_UNAVAILABLE)
+	}
+	if reason == "sieve" && len(sieve.Deliveries) == 0 {
+		sieve_actions(cfg, env, &hdr, sieve, pathname)
+		os.Remove(pathname)
+		usage_record(env.Home, "discarded")
+		log_info("discarded by sieve script")
+		return
+	}
+	if decision.Discard {
+		sent, err := reinject_deliver(env, &hdr, pathname, decision.Reinject)
+		if err != nil {
+			os.Remove(pathname)
+			log_error("Error redirecting: %s", err)
+			tempfail()
+		}
+		if sent != 0 {
+			os.Remove(pathname)
+			if dedupKey != "" {
+				dedup_record(cfg, env, dedupKey)
+			}
+			usage_record(env.Home, "redirected")
+			return
+		}
+		// a redirect that would loop delivers here rather than lose the message
+		decision.Reinject = nil
+	}
+	if special_folder_is(cfg, folder, "error") {
+		bounce_annotate(cfg, env, root, pathname, fields)
+	}
+	if cfg.Overflow != 0 && *mboxPath == "" {
+		folder = folder_overflow(cfg, maildir, folder, time.Now())
+	}
+	usage.Folder = folder
+	if usage.Folder == "" {
+		usage.Folder = "INBOX"
+	}
+	stamp := &Header{}
+	stamp.add_line("X-PMDA-Delivery: " + delivery_stamp(cfg, env, hostname, folder, time.Now()))
+	stamp.Fields = append(stamp.Fields, fields.Fields...)
+	if err := message_prepend(pathname, stamp); err != nil {
+		log_error("Error writing %s: %s", pathname, err)
+		tempfail()
+	}
+	if *mboxPath != "" {
+		if reason == "sieve" {
+			sieve_actions(cfg, env, &hdr, sieve, pathname)
+		}
+		if reason != "sieve" || sieve.Vacation == nil {
+			vacation_respond(cfg, env, &hdr, folder)
+		}
+		if _, err := reinject_deliver(env, &hdr, pathname, decision.Reinject); err != nil {
+			log_error("Error: %s", err)
+		}
+		mbox_deliver(cfg, env, &hdr, pathname, folder, reason)
+		if dedupKey != "" {
+			dedup_record(cfg, env, dedupKey)
+		}
+		return
+	}
+	if folder != "" && decision.Auto {
+		if autofolder_create(cfg, maildir, folder) {
+			log_info("created folder %s for list %s", folder, header_oneline(hdr.Get("List-Id")))
+		}
+	} else if folder != "" {
+		maildir_folder(cfg, maildir, folder)
+	}
+
+	if err := usage_check(cfg, pathname); err != nil {
+		os.Remove(pathname)
+		usage_record(env.Home, "limited")
+		log_error("Error delivering: %s", err)
+		tempfail()
+	}
+
+	// the sizes are those of the message as stored, header fields added
+	// since the copy included
+	filename, err = maildir_sized(filename, pathname)
+	if err != nil {
+		os.Remove(pathname)
+		log_error("Error sizing %s: %s", pathname, err)
+		tempfail()
+	}
+
+	var tx *PostgresTx
+	if cfg.Postgres != nil {
+		tx, err = postgres_begin(cfg, env, &hdr, folder, filename, pathname)
+		if err != nil {
+			os.Remove(pathname)
+			log_error("Error inserting into PostgreSQL: %s", err)
+			tempfail()
+		}
+	}
+
+	subdir, target := "new", filename
+	if folderCfg := cfg.folder_config(folder); folderCfg != nil && folderCfg.DeliverCur {
+		subdir, target = "cur", filename+":2,"+folderCfg.Flags
+	}
+	if reason == "sieve" && len(sieve.Deliveries[0].Flags) != 0 {
+		flags, err := sieve_maildir_flags(filepath.Join(maildir, folder), sieve.Deliveries[0].Flags)
+		if err != nil {
+			log_info("error setting flags: %s", err)
+		}
+		subdir, target = "cur", filename+":2,"+flags
+	}
+	destination, err := maildir_path(filepath.Join(maildir, folder, subdir), target, maildir_layout(cfg, root))
+	if err != nil {
+		if tx != nil {
+			tx.rollback()
+		}
+		os.Remove(pathname)
+		log_error("Error creating shard: %s", err)
+		tempfail()
+	}
+	if cfg.Postgres != nil && cfg.Postgres.Exclusive {
+		destination = pathname
 	} else {
-		os.Rename(pathname, filepath.Join(maildir, "new", filename))
+		err := file_sync(pathname)
+		if err == nil {
+			err = os.Rename(pathname, destination)
+		}
+		if err == nil {
+			err = dir_sync(filepath.Dir(destination), filepath.Join(maildir, folder, subdir))
+		}
+		if err == nil {
+			err = dir_sync(filepath.Join(maildir, "tmp"), filepath.Join(maildir, "tmp"))
+		}
+		if err != nil {
+			if tx != nil {
+				tx.rollback()
+			}
+			os.Remove(pathname)
+			os.Remove(destination)
+			log_error("Error storing %s: %s", destination, err)
+			tempfail()
+		}
+	}
+
+	if cfg.Postgres == nil || !cfg.Postgres.Exclusive {
+		quota_add(cfg, root, message_size(destination), 1)
+	}
+	deliveryLog.Filename = filepath.Base(destination)
+	if env.Extension != "" {
+		autofolder_touch(maildir, time.Now())
+	}
+	autofolder_touch(filepath.Join(maildir, folder), time.Now())
+
+	if cfg.Xattr {
+		metadata_store(maildir, folder, destination, []MetadataField{
+			{"sender", env.Sender},
+			{"recipient", env.Recipient},
+			{"folder", folder},
+			{"verdict", reason},
+			{"delivered", time.Now().Format(time.RFC3339)},
+		})
+	}
+
+	if cfg.Provenance {
+		provenance_store(maildir, folder, destination, &Provenance{
+			Envelope:              env,
+			Received:              hdr.Values("Received"),
+			RelayAddress:          provenance_relay(&hdr),
+			AuthenticationResults: hdr.Values("Authentication-Results"),
+			MessageId:             hdr.Get("Message-ID"),
+			Folder:                folder,
+			Verdict:               reason,
+			RuleTrace:             decision.Trace,
+			Delivered:             time.Now(),
+		})
+	}
+
+	if cfg.Checksums {
+		if err := checksum_record(env.Home, destination); err != nil {
+			log_error("Error recording checksum: %s", err)
+		}
+	}
+	if cfg.AttachmentIndex {
+		if relative, err := filepath.Rel(root, filepath.Join(maildir, folder)); err == nil {
+			attachments_record(env.Home, root, relative, destination, &hdr)
+		}
+	}
+
+	if tx != nil {
+		if err := tx.commit(); err != nil {
+			size := message_size(destination)
+			os.Remove(destination)
+			if !cfg.Postgres.Exclusive {
+				quota_add(cfg, root, -size, -1)
+			}
+			log_error("Error committing to PostgreSQL: %s", err)
+			tempfail()
+		}
+		if cfg.Postgres.Exclusive {
+			os.Remove(pathname)
+		}
+	}
+
+	if dedupKey != "" {
+		dedup_record(cfg, env, dedupKey)
 	}
+	if reason == "sieve" {
+		for _, delivery := range sieve.Deliveries[1:] {
+			if err := sieve_copy(cfg, root, maildir, destination, delivery); err != nil {
+				log_error("Error filing a copy into %s: %s", folder_name(delivery.Folder), err)
+			}
+		}
+		sieve_actions(cfg, env, &hdr, sieve, destination)
+	}
+	if _, err := reinject_deliver(env, &hdr, destination, decision.Reinject); err != nil {
+		log_error("Error: %s", err)
+	}
+	if reason != "sieve" || sieve.Vacation == nil {
+		// a script answering the message takes precedence
+		vacation_respond(cfg, env, &hdr, folder)
+	}
+	if report != nil {
+		reports_record(env.Home, report)
+	}
+	if cfg.Calendar && msg.Calendar != nil {
+		calendar_record(cfg, env, msg.Calendar, folder)
+	}
+	if cfg.Importance != nil || cfg.Mute != nil {
+		threads_record(cfg, env, msg, folder == "" || reason == "importance")
+	}
+
+	if *resultFd >= 0 {
+		result := &DeliveryResult{
+			Path:     destination,
+			Maildir:  maildir,
+			Folder:   folder,
+			Filename: filepath.Base(destination),
+			Verdict:  reason,
+			Size:     usage.Bytes,
+		}
+		if cfg.Postgres != nil && cfg.Postgres.Exclusive {
+			result.Path = ""
+		}
+		result_write(result)
+	}
+
+	if folderCfg := cfg.folder_config(folder); folder == "" || (folderCfg != nil && folderCfg.Notify) {
+		notify_delivery(cfg, hdr.Get("From"), hdr.Get("Subject"))
+	}
+	if len(cfg.Publishers) != 0 {
+		event := &DeliveryEvent{
+			Time:      time.Now(),
+			Sender:    env.Sender,
+			Recipient: env.Recipient,
+			MessageId: hdr.Get("Message-ID"),
+			From:      hdr.Get("From"),
+			Subject:   hdr.Get("Subject"),
+			Folder:    folder,
+			Filename:  filename,
+		}
+		if st, err := os.Stat(destination); err == nil {
+			event.Size = st.Size()
+		}
+		publish_event(cfg, env, event, destination)
+	}
+	expire_run(cfg, env, root, time.Now())
+	usage_record(env.Home, "delivered")
 }
 
 // main is the entry point of the maildir delivery agent
 func main() {
+	if len(os.Args) > 1 {
+		if command := command_lookup(os.Args[1]); command != nil {
+			os.Exit(command.Main(os.Args[2:]))
+		}
+	}
+
 	flag.Parse()
+	if *describeCli {
+		os.Exit(describe_main())
+	}
 
 	homedir := os.Getenv("HOME")
 	if homedir == "" {
 		fmt.Fprintf(os.Stderr, "HOME environment variable not set\n")
-		os.Exit(EX_TEMPFAIL)
+		tempfail()
+	}
+
+	env := envelope_from_environ()
+	cfg := profile_load(homedir, env)
+	special_folder_flags(cfg)
+	if dryRun {
+		maildir := maildir_resolve(cfg, homedir)
+		if flag.NArg() == 1 {
+			maildir = flag.Arg(0)
+		}
+		filter_pipeline(cfg, env)
+		os.Exit(dryrun_main(cfg, env, maildir))
 	}
+	syslog_open(cfg, env)
+	chaos_enable(cfg)
+	events_open(cfg, env)
+	metrics_open(cfg, env)
+	hold_check(cfg, homedir)
 
-	maildir := filepath.Join(homedir, "/Maildir")
-	if flag.NArg() == 1 {
+	maildir := maildir_resolve(cfg, homedir)
+	if *mboxPath != "" {
+		maildir = mbox_staging(homedir)
+	}
+	if flag.NArg() == 1 && *mboxPath == "" {
 		maildir = flag.Arg(0)
-	} else if flag.NArg() > 1 {
-		fmt.Fprintf(os.Stderr, "Usage: %s [maildir]\n", os.Args[0])
-		os.Exit(EX_TEMPFAIL)
+	} else if flag.NArg() != 0 {
+		fmt.Fprintf(os.Stderr, "Usage: %s [-n] [-profile name] [-special-folder category=folder] [maildir]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s [-profile name] -mbox path [-mbox-dir directory]\n", os.Args[0])
+		tempfail()
+	}
+	if flag.NArg() == 0 && *mboxPath == "" {
+		maildir = backend_select(cfg, homedir, maildir)
 	}
 
-	maildir_engine(maildir)
+	filter_pipeline(cfg, env)
+	maildir_engine(cfg, env, maildir)
 
 	os.Exit(0)
 }
@@ -0,0 +1,137 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// TestMain lets the test binary stand in for mail.pmda, so that tests
+// deliver through the real entry point, exit codes included.
+func TestMain(m *testing.M) {
+	if os.Getenv("PMDA_TEST_MAIN") == "1" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// pmda_command returns a mail.pmda run for a user whose home directory is
+// home, configured with the given lines.
+func pmda_command(t *testing.T, home string, config string, args ...string) *exec.Cmd {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(home, ".pmda.conf"), []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), "PMDA_TEST_MAIN=1", "HOME="+home,
+		"SENDER=sender@example.org", "RECIPIENT=user@example.org")
+	return cmd
+}
+
+// pmda_messages returns the messages of a folder of the maildir of home.
+func pmda_messages(t *testing.T, home string, folder string) []string {
+	t.Helper()
+	messages, err := filepath.Glob(filepath.Join(home, "Maildir", folder, "new", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return messages
+}
+
+// syntheticBody produces size bytes of message body without holding them.
+type syntheticBody struct {
+	size int64
+	line []byte
+	off  int
+}
+
+func (body *syntheticBody) Read(p []byte) (int, error) {
+	if body.size == 0 {
+		return 0, io.EOF
+	}
+	n := 0
+	for n < len(p) && body.size > 0 {
+		chunk := body.line[body.off:]
+		if int64(len(chunk)) > body.size {
+			chunk = chunk[:body.size]
+		}
+		c := copy(p[n:], chunk)
+		n += c
+		body.size -= int64(c)
+		body.off = (body.off + c) % len(body.line)
+	}
+	return n, nil
+}
+
+// TestDeliveryMemoryBound delivers a 2GB message and checks that peak
+// memory stays bounded by the buffers, not by the size of the message.
+func TestDeliveryMemoryBound(t *testing.T) {
+	if testing.Short() {
+		t.Skip("writes 2GB")
+	}
+	if runtime.GOOS != "linux" {
+		t.Skip("ru_maxrss is in kilobytes on linux only")
+	}
+	const bodySize = 2 << 30
+	const ceiling = 64 << 20
+
+	home := t.TempDir()
+	cmd := pmda_command(t, home, "buffer-size 256k\n")
+	header := "From: sender@example.org\nTo: user@example.org\nSubject: large\nMessage-ID: <large@example.org>\n\n"
+	line := strings.Repeat("0123456789abcdefghijklmnopqrstuvwxyz", 2)[:71] + "\n"
+	cmd.Stdin = io.MultiReader(strings.NewReader(header), &syntheticBody{size: bodySize, line: []byte(line)})
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("delivery failed: %s: %s", err, output)
+	}
+
+	messages := pmda_messages(t, home, "")
+	if len(messages) != 1 {
+		t.Fatalf("expected one message in the inbox, found %d", len(messages))
+	}
+	file, err := os.Open(messages[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	st, err := file.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the trace fields of the delivery come on top of the message
+	start := make([]byte, 4096)
+	n, _ := io.ReadFull(file, start)
+	offset := strings.Index(string(start[:n]), header)
+	if offset == -1 {
+		t.Fatalf("header of the message not found")
+	}
+	if got := st.Size() - int64(offset); got != int64(len(header))+bodySize {
+		t.Errorf("stored %d bytes of message, expected %d", got, int64(len(header))+bodySize)
+	}
+	if rss := cmd.ProcessState.SysUsage().(*syscall.Rusage).Maxrss * 1024; rss > ceiling {
+		t.Errorf("peak RSS of %d bytes exceeds %d", rss, ceiling)
+	} else {
+		t.Logf("peak RSS of %d bytes for a %d bytes message", rss, st.Size())
+	}
+}
@@ -0,0 +1,755 @@
+//go:build !nomanagesieve && !tiny
+
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const MANAGESIEVE_TIMEOUT = 10 * time.Minute
+const MANAGESIEVE_MAX_SCRIPT = 1024 * 1024
+const MANAGESIEVE_MAX_SCRIPTS = 32
+
+// a command line is no longer than this, literals aside, nor is a command
+// sent before logging in, literals included
+const MANAGESIEVE_MAX_LINE = 8192
+
+// sieveExtensions lists the Sieve extensions advertised to clients, those
+// the interpreter supports.
+var sieveExtensions = sieve_extensions()
+
+var managesieveFlags = flag.NewFlagSet("managesieve", flag.ExitOnError)
+var managesieveListen = managesieveFlags.String("listen", "127.0.0.1:4190", "address to listen on")
+var managesieveCert = managesieveFlags.String("cert", "", "TLS certificate, enables STARTTLS")
+var managesieveKey = managesieveFlags.String("key", "", "TLS private key")
+var managesieveCheckpassword = managesieveFlags.String("checkpassword", "", "checkpassword program used to authenticate users")
+
+func init() {
+	feature_register("managesieve")
+	command_register(&Command{Name: "managesieve", Synopsis: "run a ManageSieve server for remote script editing",
+		Flags: managesieveFlags, Main: managesieve_main})
+}
+
+// managesieve_main implements "mail.pmda managesieve", an RFC 5804 server
+// letting users manage their Sieve scripts with standard clients. Scripts
+// are stored in ~/.pmda/sieve/ and the active one is linked as
+// ~/.pmda.sieve. Credentials are checked by a checkpassword program:
+//
+//	mail.pmda managesieve -checkpassword /usr/local/bin/checkpassword-pam
+//
+// When not running as root, only the invoking user may log in. PLAIN
+// authentication is refused over cleartext on anything but loopback.
+func managesieve_main(args []string) int {
+	managesieveFlags.Parse(args)
+	if managesieveFlags.NArg() != 0 || *managesieveCheckpassword == "" {
+		fmt.Fprintf(os.Stderr, "Usage: %s managesieve -checkpassword program [-listen address] [-cert file -key file]\n", os.Args[0])
+		return 1
+	}
+
+	var tlsConfig *tls.Config
+	if *managesieveCert != "" {
+		certificate, err := tls.LoadX509KeyPair(*managesieveCert, *managesieveKey)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading certificate: %s\n", err)
+			return 1
+		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{certificate}, MinVersion: tls.VersionTLS12}
+	}
+
+	listener, err := net.Listen("tcp", *managesieveListen)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error listening on %s: %s\n", *managesieveListen, err)
+		return 1
+	}
+	log_info("managesieve listening on %s", listener.Addr())
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error accepting connection: %s\n", err)
+			continue
+		}
+		session := &SieveSession{conn: conn, tlsConfig: tlsConfig}
+		go session.serve()
+	}
+}
+
+// SieveSession is a ManageSieve client connection.
+type SieveSession struct {
+	conn      net.Conn
+	reader    *bufio.Reader
+	writer    *bufio.Writer
+	tlsConfig *tls.Config
+	secure    bool
+	account   *user.User
+}
+
+func (session *SieveSession) respond(status string, code string, text string) {
+	line := status
+	if code != "" {
+		line += " (" + code + ")"
+	}
+	if text != "" {
+		line += " " + config_quote(text)
+	}
+	fmt.Fprintf(session.writer, "%s\r\n", line)
+}
+
+func (session *SieveSession) capabilities() {
+	fmt.Fprintf(session.writer, "\"IMPLEMENTATION\" \"mail.pmda %s\"\r\n", version)
+	if session.account == nil {
+		fmt.Fprintf(session.writer, "\"SASL\" \"PLAIN\"\r\n")
+	}
+	fmt.Fprintf(session.writer, "\"SIEVE\" %s\r\n", config_quote(strings.Join(sieveExtensions, " ")))
+	if session.tlsConfig != nil {
+		fmt.Fprintf(session.writer, "\"STARTTLS\"\r\n")
+	}
+	if session.account != nil {
+		fmt.Fprintf(session.writer, "\"OWNER\" %s\r\n", config_quote(session.account.Username))
+	}
+	fmt.Fprintf(session.writer, "\"VERSION\" \"1.0\"\r\n")
+}
+
+func (session *SieveSession) serve() {
+	defer session.conn.Close()
+	session.reader = bufio.NewReader(session.conn)
+	session.writer = bufio.NewWriter(session.conn)
+	if host, _, err := net.SplitHostPort(session.conn.LocalAddr().String()); err == nil {
+		session.secure = net.ParseIP(host).IsLoopback()
+	}
+
+	session.capabilities()
+	session.respond("OK", "", "mail.pmda ManageSieve ready")
+	for {
+		session.writer.Flush()
+		session.conn.SetDeadline(time.Now().Add(MANAGESIEVE_TIMEOUT))
+		args, err := sieve_read_command(session.reader, session.limit())
+		if err != nil {
+			if err != io.EOF {
+				session.respond("BYE", "", err.Error())
+				session.writer.Flush()
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		if !session.dispatch(strings.ToUpper(args[0]), args[1:]) {
+			session.writer.Flush()
+			return
+		}
+	}
+}
+
+// dispatch runs a command and reports whether the session goes on.
+func (session *SieveSession) dispatch(command string, args []string) bool {
+	switch command {
+	case "LOGOUT":
+		session.respond("OK", "", "bye")
+		return false
+
+	case "NOOP":
+		session.respond("OK", "", "")
+		return true
+
+	case "CAPABILITY":
+		session.capabilities()
+		session.respond("OK", "", "")
+		return true
+
+	case "STARTTLS":
+		if session.tlsConfig == nil {
+			session.respond("NO", "", "STARTTLS not available")
+			return true
+		}
+		session.respond("OK", "", "begin TLS negotiation")
+		session.writer.Flush()
+		conn := tls.Server(session.conn, session.tlsConfig)
+		if err := conn.Handshake(); err != nil {
+			return false
+		}
+		session.conn = conn
+		session.reader = bufio.NewReader(conn)
+		session.writer = bufio.NewWriter(conn)
+		session.tlsConfig = nil
+		session.secure = true
+		session.capabilities()
+		session.respond("OK", "", "")
+		return true
+
+	case "AUTHENTICATE":
+		return session.authenticate(args)
+	}
+
+	if session.account == nil {
+		session.respond("NO", "", "authenticate first")
+		return true
+	}
+	store := &SieveStore{account: session.account}
+
+	switch command {
+	case "UNAUTHENTICATE":
+		session.account = nil
+		session.respond("OK", "", "")
+
+	case "LISTSCRIPTS":
+		names, active, err := store.list()
+		if err != nil {
+			session.respond("NO", "", err.Error())
+			break
+		}
+		for _, name := range names {
+			if name == active {
+				fmt.Fprintf(session.writer, "%s ACTIVE\r\n", config_quote(name))
+			} else {
+				fmt.Fprintf(session.writer, "%s\r\n", config_quote(name))
+			}
+		}
+		session.respond("OK", "", "")
+
+	case "HAVESPACE":
+		if len(args) != 2 {
+			session.respond("NO", "", "usage: HAVESPACE name size")
+			break
+		}
+		size, err := strconv.Atoi(args[1])
+		if err != nil || size > MANAGESIEVE_MAX_SCRIPT {
+			session.respond("NO", "QUOTA/MAXSIZE", "script too large")
+			break
+		}
+		session.respond("OK", "", "")
+
+	case "PUTSCRIPT", "CHECKSCRIPT":
+		if len(args) != 2 && !(command == "CHECKSCRIPT" && len(args) == 1) {
+			session.respond("NO", "", "usage: "+command+" [name] script")
+			break
+		}
+		script := args[len(args)-1]
+		if len(script) > MANAGESIEVE_MAX_SCRIPT {
+			session.respond("NO", "QUOTA/MAXSIZE", "script too large")
+			break
+		}
+		if err := sieve_check(script); err != nil {
+			session.respond("NO", "", err.Error())
+			break
+		}
+		if command == "PUTSCRIPT" {
+			if err := store.put(args[0], script); err != nil {
+				session.respond("NO", sieve_code(err), err.Error())
+				break
+			}
+		}
+		session.respond("OK", "", "")
+
+	case "GETSCRIPT":
+		if len(args) != 1 {
+			session.respond("NO", "", "usage: GETSCRIPT name")
+			break
+		}
+		script, err := store.get(args[0])
+		if err != nil {
+			session.respond("NO", sieve_code(err), err.Error())
+			break
+		}
+		fmt.Fprintf(session.writer, "{%d}\r\n%s\r\n", len(script), script)
+		session.respond("OK", "", "")
+
+	case "SETACTIVE":
+		if len(args) != 1 {
+			session.respond("NO", "", "usage: SETACTIVE name")
+			break
+		}
+		if err := store.activate(args[0]); err != nil {
+			session.respond("NO", sieve_code(err), err.Error())
+			break
+		}
+		session.respond("OK", "", "")
+
+	case "DELETESCRIPT":
+		if len(args) != 1 {
+			session.respond("NO", "", "usage: DELETESCRIPT name")
+			break
+		}
+		if err := store.delete(args[0]); err != nil {
+			session.respond("NO", sieve_code(err), err.Error())
+			break
+		}
+		session.respond("OK", "", "")
+
+	case "RENAMESCRIPT":
+		if len(args) != 2 {
+			session.respond("NO", "", "usage: RENAMESCRIPT old new")
+			break
+		}
+		if err := store.rename(args[0], args[1]); err != nil {
+			session.respond("NO", sieve_code(err), err.Error())
+			break
+		}
+		session.respond("OK", "", "")
+
+	default:
+		session.respond("NO", "", "unknown command")
+	}
+	return true
+}
+
+func (session *SieveSession) authenticate(args []string) bool {
+	if session.account != nil {
+		session.respond("NO", "", "already authenticated")
+		return true
+	}
+	if len(args) == 0 || strings.ToUpper(args[0]) != "PLAIN" {
+		session.respond("NO", "", "unsupported mechanism")
+		return true
+	}
+	if !session.secure {
+		session.respond("NO", "ENCRYPT-NEEDED", "use STARTTLS first")
+		return true
+	}
+
+	response := ""
+	if len(args) > 1 {
+		response = args[1]
+	} else {
+		fmt.Fprintf(session.writer, "\"\"\r\n")
+		session.writer.Flush()
+		continuation, err := sieve_read_command(session.reader, session.limit())
+		if err != nil {
+			session.respond("BYE", "", err.Error())
+			return false
+		}
+		if len(continuation) != 1 {
+			session.respond("NO", "", "authentication aborted")
+			return true
+		}
+		response = continuation[0]
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(response)
+	fields := strings.Split(string(decoded), "\x00")
+	if err != nil || len(fields) != 3 || (fields[0] != "" && fields[0] != fields[1]) {
+		session.respond("NO", "", "invalid credentials")
+		return true
+	}
+
+	account, err := auth_checkpassword(*managesieveCheckpassword, fields[1], fields[2])
+	if err != nil {
+		log_info("managesieve authentication failed for %s from %s: %s", fields[1], session.conn.RemoteAddr(), err)
+		time.Sleep(time.Second)
+		session.respond("NO", "", "authentication failed")
+		return true
+	}
+	session.account = account
+	session.respond("OK", "", "logged in")
+	return true
+}
+
+// limit is the most a command may take, little until the client logged
+// in and a script with its command line after.
+func (session *SieveSession) limit() int {
+	if session.account == nil {
+		return MANAGESIEVE_MAX_LINE
+	}
+	return MANAGESIEVE_MAX_SCRIPT + MANAGESIEVE_MAX_LINE
+}
+
+// sieve_read_line reads a line of at most MANAGESIEVE_MAX_LINE bytes.
+func sieve_read_line(reader *bufio.Reader) (string, error) {
+	var line []byte
+	for {
+		data, err := reader.ReadSlice('\n')
+		if len(line)+len(data) > MANAGESIEVE_MAX_LINE {
+			return "", fmt.Errorf("line too long")
+		}
+		line = append(line, data...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		return string(line), err
+	}
+}
+
+// sieve_read_command reads a command line made of atoms, quoted strings
+// and literals, the latter possibly spanning several lines. Commands
+// larger than max are refused before they are read through, the client
+// is then to be disconnected.
+func sieve_read_command(reader *bufio.Reader, max int) ([]string, error) {
+	args := make([]string, 0)
+	var token bytes.Buffer
+	total := 0
+	for {
+		line, err := sieve_read_line(reader)
+		if err != nil {
+			return nil, err
+		}
+		if total += len(line); total > max {
+			return nil, fmt.Errorf("command too long")
+		}
+		line = strings.TrimRight(line, "\r\n")
+
+		for i := 0; i < len(line); i++ {
+			switch c := line[i]; {
+			case c == ' ':
+				continue
+
+			case c == '"':
+				token.Reset()
+				for i++; i < len(line) && line[i] != '"'; i++ {
+					if line[i] == '\\' && i+1 < len(line) {
+						i++
+					}
+					token.WriteByte(line[i])
+				}
+				if i == len(line) {
+					return nil, fmt.Errorf("unterminated string")
+				}
+				args = append(args, token.String())
+
+			case c == '{':
+				end := strings.IndexByte(line[i:], '}')
+				if end == -1 || i+end != len(line)-1 {
+					return nil, fmt.Errorf("invalid literal")
+				}
+				size, err := strconv.Atoi(strings.TrimSuffix(line[i+1:i+end], "+"))
+				if err != nil || size < 0 {
+					return nil, fmt.Errorf("invalid literal size")
+				}
+				if total += size; total > max {
+					return nil, fmt.Errorf("command too long")
+				}
+				data := make([]byte, size)
+				if _, err := io.ReadFull(reader, data); err != nil {
+					return nil, err
+				}
+				args = append(args, string(data))
+				i = len(line)
+
+			default:
+				end := strings.IndexByte(line[i:], ' ')
+				if end == -1 {
+					end = len(line) - i
+				}
+				args = append(args, line[i:i+end])
+				i += end
+			}
+		}
+
+		// a literal ends the line, the command goes on after its data
+		if strings.HasSuffix(line, "}") {
+			continue
+		}
+		return args, nil
+	}
+}
+
+// sieve_check parses a script when the interpreter is compiled in, and
+// falls back to a lexical check otherwise: strings, multi-line texts and
+// comments must be terminated and brackets balanced.
+func sieve_check(script string) error {
+	if features["sieve"] {
+		_, err := sieve_parse(script)
+		return err
+	}
+
+	stack := make([]byte, 0)
+	lineno := 1
+	for i := 0; i < len(script); i++ {
+		switch c := script[i]; c {
+		case '\n':
+			lineno++
+		case '#':
+			for i < len(script) && script[i] != '\n' {
+				i++
+			}
+			lineno++
+		case '/':
+			if i+1 < len(script) && script[i+1] == '*' {
+				end := strings.Index(script[i+2:], "*/")
+				if end == -1 {
+					return fmt.Errorf("line %d: unterminated comment", lineno)
+				}
+				lineno += strings.Count(script[i:i+2+end], "\n")
+				i += end + 3
+			}
+		case '"':
+			start := lineno
+			for i++; i < len(script) && script[i] != '"'; i++ {
+				if script[i] == '\\' {
+					i++
+				} else if script[i] == '\n' {
+					lineno++
+				}
+			}
+			if i >= len(script) {
+				return fmt.Errorf("line %d: unterminated string", start)
+			}
+		case 't':
+			if strings.HasPrefix(script[i:], "text:") && (i == 0 || !sieve_identifier(script[i-1])) {
+				end := strings.Index(script[i:], "\n.\n")
+				if end == -1 && strings.HasSuffix(script, "\n.") {
+					end = len(script) - i - 2
+				}
+				if end == -1 {
+					end = strings.Index(script[i:], "\n.\r\n")
+				}
+				if end == -1 {
+					return fmt.Errorf("line %d: unterminated text", lineno)
+				}
+				lineno += strings.Count(script[i:i+end+2], "\n")
+				i += end + 2
+			}
+		case '{', '(', '[':
+			stack = append(stack, c)
+		case '}', ')', ']':
+			open := map[byte]byte{'}': '{', ')': '(', ']': '['}[c]
+			if len(stack) == 0 || stack[len(stack)-1] != open {
+				return fmt.Errorf("line %d: unexpected %c", lineno, c)
+			}
+			stack = stack[:len(stack)-1]
+		}
+	}
+	if len(stack) != 0 {
+		return fmt.Errorf("line %d: unclosed %c", lineno, stack[len(stack)-1])
+	}
+	return nil
+}
+
+var errSieveNonexistent = errors.New("no such script")
+var errSieveExists = errors.New("script already exists")
+var errSieveActive = errors.New("script is active")
+var errSieveQuota = errors.New("too many scripts")
+
+func sieve_code(err error) string {
+	switch err {
+	case errSieveNonexistent:
+		return "NONEXISTENT"
+	case errSieveExists:
+		return "ALREADYEXISTS"
+	case errSieveActive:
+		return "ACTIVE"
+	case errSieveQuota:
+		return "QUOTA/MAXSCRIPTS"
+	}
+	return ""
+}
+
+// SieveStore is the script directory of a user, files created on behalf
+// of another user by a root server are handed over to them. Scripts are
+// reached through home_open and friends, a root server must not follow
+// the links a user plants in their home.
+type SieveStore struct {
+	account *user.User
+}
+
+const SIEVE_DIRECTORY = ".pmda/sieve"
+
+func (store *SieveStore) active() string {
+	return filepath.Join(store.account.HomeDir, ".pmda.sieve")
+}
+
+// path returns the name of a script relative to the home directory.
+func (store *SieveStore) path(name string) (string, error) {
+	if name == "" || len(name) > 128 || strings.ContainsAny(name, "/\x00") || name[0] == '.' {
+		return "", fmt.Errorf("invalid script name")
+	}
+	for _, c := range name {
+		if c < 0x20 || c == 0x7f {
+			return "", fmt.Errorf("invalid script name")
+		}
+	}
+	return filepath.Join(SIEVE_DIRECTORY, name+".sieve"), nil
+}
+
+func (store *SieveStore) chown(pathname string) {
+	account_chown(store.account, pathname)
+}
+
+// exists reports whether a script is there, and a regular file of the user.
+func (store *SieveStore) exists(pathname string) bool {
+	file, err := home_open(store.account, pathname, os.O_RDONLY, 0)
+	if err != nil {
+		return false
+	}
+	file.Close()
+	return true
+}
+
+func (store *SieveStore) list() ([]string, string, error) {
+	names := make([]string, 0)
+	dir, err := home_dir(store.account, SIEVE_DIRECTORY, false)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, "", err
+	}
+	if err == nil {
+		entries, err := dir.ReadDir(-1)
+		dir.Close()
+		if err != nil {
+			return nil, "", err
+		}
+		for _, entry := range entries {
+			if name, found := strings.CutSuffix(entry.Name(), ".sieve"); found && entry.Type().IsRegular() {
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+
+	active := ""
+	if target, err := os.Readlink(store.active()); err == nil {
+		active = strings.TrimSuffix(filepath.Base(target), ".sieve")
+	}
+	return names, active, nil
+}
+
+func (store *SieveStore) get(name string) (string, error) {
+	pathname, err := store.path(name)
+	if err != nil {
+		return "", err
+	}
+	file, err := home_open(store.account, pathname, os.O_RDONLY, 0)
+	if os.IsNotExist(err) {
+		return "", errSieveNonexistent
+	} else if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	data, err := io.ReadAll(io.LimitReader(file, MANAGESIEVE_MAX_SCRIPT))
+	return string(data), err
+}
+
+// sieve_tmpname returns a name to stage pathname under, unique to the
+// call as sessions of the same user run in the same process.
+func sieve_tmpname(pathname string) string {
+	suffix := make([]byte, 8)
+	rand.Read(suffix)
+	return pathname + "." + hex.EncodeToString(suffix) + ".tmp"
+}
+
+func (store *SieveStore) put(name string, script string) error {
+	pathname, err := store.path(name)
+	if err != nil {
+		return err
+	}
+	if !store.exists(pathname) {
+		if names, _, err := store.list(); err != nil {
+			return err
+		} else if len(names) >= MANAGESIEVE_MAX_SCRIPTS {
+			return errSieveQuota
+		}
+	}
+
+	tmpname := sieve_tmpname(pathname)
+	file, err := home_open(store.account, tmpname, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = file.WriteString(script)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		home_remove(store.account, tmpname)
+		return err
+	}
+	return home_rename(store.account, tmpname, pathname)
+}
+
+// activate points ~/.pmda.sieve at a script, an empty name deactivates.
+func (store *SieveStore) activate(name string) error {
+	tmpname := sieve_tmpname(store.active())
+	if name == "" {
+		if err := os.Remove(store.active()); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	pathname, err := store.path(name)
+	if err != nil {
+		return err
+	}
+	if !store.exists(pathname) {
+		return errSieveNonexistent
+	}
+	if err := os.Symlink(pathname, tmpname); err != nil {
+		return err
+	}
+	store.chown(tmpname)
+	if err := os.Rename(tmpname, store.active()); err != nil {
+		os.Remove(tmpname)
+		return err
+	}
+	return nil
+}
+
+func (store *SieveStore) delete(name string) error {
+	pathname, err := store.path(name)
+	if err != nil {
+		return err
+	}
+	if _, active, _ := store.list(); active == name {
+		return errSieveActive
+	}
+	if err := home_remove(store.account, pathname); os.IsNotExist(err) {
+		return errSieveNonexistent
+	} else {
+		return err
+	}
+}
+
+func (store *SieveStore) rename(oldname string, newname string) error {
+	oldpath, err := store.path(oldname)
+	if err != nil {
+		return err
+	}
+	newpath, err := store.path(newname)
+	if err != nil {
+		return err
+	}
+	if !store.exists(oldpath) {
+		return errSieveNonexistent
+	}
+	if store.exists(newpath) {
+		return errSieveExists
+	}
+	_, active, _ := store.list()
+	if err := home_rename(store.account, oldpath, newpath); err != nil {
+		return err
+	}
+	if active == oldname {
+		return store.activate(newname)
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// only the start of a part is measured, past it HTML has made its point
+const MARKETING_PART_MAX = 1024 * 1024
+
+// MarketingConfig scores how much a message looks like a newsletter or
+// a promotion from 0 to 100, for those not telling so with Precedence:
+//
+//	marketing threshold 60 weight campaign 50 ratio 20
+//	marketing off
+//
+// The signals are a List-Unsubscribe field, the fields an emailing
+// service tags its campaigns with, and HTML dwarfing the text of the
+// message, ratio times larger or alone. It is on by default, messages
+// scoring at least the threshold being filed to .Marketing by the
+// built-in rules, and score conditions can test it:
+//
+//	match score marketing >= 80 folder ".Promotions"
+type MarketingConfig struct {
+	Threshold float64
+	Ratio     float64
+	Weights   map[string]float64
+}
+
+var marketingSignals = []string{"list-unsubscribe", "campaign", "html"}
+
+// the field prefixes of the campaigns of emailing services
+var marketingCampaignFields = []string{"X-Mailgun", "X-SES", "X-Campaign"}
+
+func marketing_default() *MarketingConfig {
+	return &MarketingConfig{
+		Threshold: 60,
+		Ratio:     10,
+		Weights: map[string]float64{
+			"list-unsubscribe": 40,
+			"campaign":         40,
+			"html":             20,
+		},
+	}
+}
+
+// marketing_parse applies a marketing directive, several of them add up
+// to one configuration.
+func marketing_parse(cfg *Config, args []string) error {
+	if len(args) == 1 && (args[0] == "on" || args[0] == "off") {
+		cfg.Marketing = nil
+		if args[0] == "on" {
+			cfg.Marketing = marketing_default()
+		}
+		return nil
+	}
+	if cfg.Marketing == nil {
+		cfg.Marketing = marketing_default()
+	}
+	marketing := cfg.Marketing
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == "threshold" && i+1 < len(args):
+			threshold, err := strconv.ParseFloat(args[i+1], 64)
+			if err != nil || threshold < 0 || threshold > 100 {
+				return fmt.Errorf("invalid threshold: %s", args[i+1])
+			}
+			marketing.Threshold = threshold
+			i++
+		case args[i] == "ratio" && i+1 < len(args):
+			ratio, err := strconv.ParseFloat(args[i+1], 64)
+			if err != nil || ratio < 1 {
+				return fmt.Errorf("invalid ratio: %s", args[i+1])
+			}
+			marketing.Ratio = ratio
+			i++
+		case args[i] == "weight" && i+2 < len(args):
+			if _, exists := marketing.Weights[args[i+1]]; !exists {
+				return fmt.Errorf("unknown marketing signal: %s", args[i+1])
+			}
+			weight, err := strconv.ParseFloat(args[i+2], 64)
+			if err != nil || weight < 0 {
+				return fmt.Errorf("invalid weight: %s", args[i+2])
+			}
+			marketing.Weights[args[i+1]] = weight
+			i += 2
+		default:
+			return fmt.Errorf("usage: marketing on|off | [threshold n] [ratio n] [weight signal n]")
+		}
+	}
+	return nil
+}
+
+func marketing_campaign(hdr *Header) bool {
+	for _, field := range hdr.Fields {
+		for _, prefix := range marketingCampaignFields {
+			if len(field.Name) >= len(prefix) && strings.EqualFold(field.Name[:len(prefix)], prefix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// marketing_html reports whether the HTML of a message dwarfs its text,
+// attachments aside.
+func marketing_html(cfg *Config, pathname string) bool {
+	html, text := int64(0), int64(0)
+	err := mime_walk_file(pathname, func(part *MimePart) error {
+		if part.Disposition == "attachment" {
+			return nil
+		}
+		switch part.MediaType {
+		case "text/html":
+			n, err := io.Copy(io.Discard, io.LimitReader(part.Body, MARKETING_PART_MAX))
+			html += n
+			return err
+		case "text/plain":
+			n, err := io.Copy(io.Discard, io.LimitReader(part.Body, MARKETING_PART_MAX))
+			text += n
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		log_info("error measuring HTML: %s", err)
+	}
+	return html != 0 && float64(html) >= cfg.Marketing.Ratio*float64(text)
+}
+
+// marketing_score combines the signals of a message, each contributing
+// its weight, into a score out of 100.
+func marketing_score(cfg *Config, pathname string, hdr *Header) float64 {
+	signals := map[string]bool{
+		"list-unsubscribe": hdr.Get("List-Unsubscribe") != "",
+		"campaign":         marketing_campaign(hdr),
+	}
+	if cfg.Marketing.Weights["html"] != 0 {
+		signals["html"] = marketing_html(cfg, pathname)
+	}
+
+	total, score := 0.0, 0.0
+	for _, signal := range marketingSignals {
+		total += cfg.Marketing.Weights[signal]
+		if signals[signal] {
+			score += cfg.Marketing.Weights[signal]
+		}
+	}
+	if total == 0 {
+		return 0
+	}
+	return score * 100 / total
+}
@@ -0,0 +1,232 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var mboxPath = flag.String("mbox", "", "append to this mbox file instead of delivering to a maildir")
+var mboxDir = flag.String("mbox-dir", "", "directory of the mbox folders, ~/Mail by default")
+
+// dotlocks older than this are left over by a crashed agent
+const MBOX_DOTLOCK_STALE = 5 * time.Minute
+
+// In mbox mode messages are classified as usual, then appended to the
+// mbox given with -mbox or, when filed to a folder, to the mbox of that
+// folder under -mbox-dir, Maildir++ names mapping to paths:
+//
+//	.Lists.golang-nuts -> ~/Mail/Lists/golang-nuts
+//
+// Messages are staged in ~/.pmda/mbox, which is the maildir the rest of
+// the agent sees, so that features reading folders of the maildir find
+// nothing there.
+func mbox_staging(homedir string) string {
+	return filepath.Join(homedir, ".pmda", "mbox")
+}
+
+func mbox_folder_path(homedir string, folder string) string {
+	if folder == "" {
+		return *mboxPath
+	}
+	dir := *mboxDir
+	if dir == "" {
+		dir = filepath.Join(homedir, "Mail")
+	}
+	return filepath.Join(dir, filepath.FromSlash(strings.ReplaceAll(strings.TrimPrefix(folder, "."), ".", "/")))
+}
+
+// mbox_from_line returns the From_ line separating messages, in the
+// asctime format readers expect.
+func mbox_from_line(sender string, now time.Time) string {
+	if sender == "" {
+		sender = "MAILER-DAEMON"
+	}
+	return fmt.Sprintf("From %s %s\n", strings.ReplaceAll(sender, " ", "_"), now.UTC().Format("Mon Jan _2 15:04:05 2006"))
+}
+
+// mbox_escape quotes a body line that would read as a From_ line, the
+// mboxrd way, which readers undo by removing one '>' from such lines.
+func mbox_escape(line []byte) []byte {
+	unquoted := line
+	for len(unquoted) != 0 && unquoted[0] == '>' {
+		unquoted = unquoted[1:]
+	}
+	if strings.HasPrefix(string(unquoted), "From ") {
+		return append([]byte{'>'}, line...)
+	}
+	return line
+}
+
+// mbox_dotlock takes the traditional pathname.lock lock, returning the
+// function to release it. Spools where the agent may not create files
+// are locked with fcntl only, as other agents do.
+func mbox_dotlock(pathname string) (func(), error) {
+	lockname := pathname + ".lock"
+	deadline := time.Now().Add(LOCK_TIMEOUT)
+	backoff := LOCK_BACKOFF_MIN
+	for {
+		file, err := os.OpenFile(lockname, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			fmt.Fprintf(file, "%d\n", os.Getpid())
+			file.Close()
+			return func() { os.Remove(lockname) }, nil
+		}
+		if errors.Is(err, os.ErrPermission) {
+			log_info("cannot create %s, relying on fcntl locking", lockname)
+			return func() {}, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		if st, err := os.Stat(lockname); err == nil && time.Since(st.ModTime()) > MBOX_DOTLOCK_STALE {
+			log_info("removing stale %s", lockname)
+			os.Remove(lockname)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("timed out waiting for %s", lockname)
+		}
+		time.Sleep(backoff)
+		backoff = min(backoff*2, LOCK_BACKOFF_MAX)
+	}
+}
+
+// mbox_append appends a message to an mbox under both dotlock and fcntl
+// locks. A failed append is truncated away, leaving the mbox as found.
+func mbox_append(mbox string, sender string, pathname string) error {
+	src, err := os.Open(pathname)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	if err := os.MkdirAll(filepath.Dir(mbox), 0700); err != nil {
+		return err
+	}
+	unlock, err := mbox_dotlock(mbox)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	file, err := os.OpenFile(mbox, os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	lock := syscall.Flock_t{Type: syscall.F_WRLCK, Whence: io.SeekStart}
+	if err := syscall.FcntlFlock(file.Fd(), syscall.F_SETLKW, &lock); err != nil {
+		return err
+	}
+
+	offset, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if err := mbox_write(file, sender, src); err != nil {
+		file.Truncate(offset)
+		return err
+	}
+	if *noSync {
+		return nil
+	}
+	if err := file.Sync(); err != nil {
+		file.Truncate(offset)
+		return err
+	}
+	return nil
+}
+
+func mbox_write(file *os.File, sender string, src io.Reader) error {
+	writer := bufio.NewWriter(file)
+	if _, err := writer.WriteString(mbox_from_line(sender, time.Now())); err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(src)
+	inHeader, startOfLine := true, true
+	last := byte('\n')
+	for {
+		line, err := reader.ReadSlice('\n')
+		if err != nil && err != bufio.ErrBufferFull && err != io.EOF {
+			return err
+		}
+		if len(line) != 0 {
+			// continuations of long lines are never From_ lines
+			if startOfLine && inHeader && (line[0] == '\n' || string(line) == "\r\n") {
+				inHeader = false
+			} else if startOfLine && !inHeader {
+				line = mbox_escape(line)
+			}
+			if _, err := writer.Write(line); err != nil {
+				return err
+			}
+			last = line[len(line)-1]
+		}
+		if err == io.EOF {
+			break
+		}
+		startOfLine = err == nil
+	}
+
+	// messages end with a newline and are separated by an empty line
+	if last != '\n' {
+		writer.WriteByte('\n')
+	}
+	writer.WriteByte('\n')
+	return writer.Flush()
+}
+
+// mbox_deliver stores a classified message in mbox mode, it stands for
+// the maildir steps of the engine.
+func mbox_deliver(cfg *Config, env *Envelope, hdr *Header, pathname string, folder string, reason string) {
+	if err := usage_check(cfg, pathname); err != nil {
+		os.Remove(pathname)
+		usage_record(env.Home, "limited")
+		fmt.Fprintf(os.Stderr, "Error delivering: %s\n", err)
+		tempfail()
+	}
+
+	mbox := mbox_folder_path(env.Home, folder)
+	err := mbox_append(mbox, env.Sender, pathname)
+	os.Remove(pathname)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error appending to %s: %s\n", mbox, err)
+		tempfail()
+	}
+
+	result_write(&DeliveryResult{
+		Path:    mbox,
+		Folder:  folder,
+		Verdict: reason,
+		Size:    usage.Bytes,
+	})
+	if folderCfg := cfg.folder_config(folder); folder == "" || (folderCfg != nil && folderCfg.Notify) {
+		notify_delivery(cfg, hdr.Get("From"), hdr.Get("Subject"))
+	}
+	usage_record(env.Home, "delivered")
+}
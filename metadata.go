@@ -0,0 +1,69 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const METADATA_TIMEOUT = 10 * time.Second
+
+// RFC 5464 entries for the folder options, display-name has no registered
+// entry so it goes under our vendor tree.
+var metadataEntries = map[string]string{
+	"color":        "/private/color",
+	"comment":      "/private/comment",
+	"display-name": "/private/vendor/vendor.pmda/display-name",
+}
+
+// folder_metadata writes the configured METADATA entries of a freshly
+// created Maildir++ folder through doveadm, so that IMAP clients which
+// support annotations can display it nicely. This is best effort.
+func folder_metadata(cfg *Config, folder string) {
+	folderCfg, exists := cfg.Folders[folder]
+	if !exists || len(folderCfg.Metadata) == 0 {
+		return
+	}
+
+	mailbox := strings.TrimPrefix(folder, ".")
+	if mailbox == "" {
+		mailbox = "INBOX"
+	}
+
+	for option, value := range folderCfg.Metadata {
+		args := []string{"mailbox", "metadata", "set"}
+		if user := os.Getenv("USER"); user != "" {
+			args = append(args, "-u", user)
+		}
+		args = append(args, mailbox, metadataEntries[option], value)
+
+		ctx, cancel := context.WithTimeout(context.Background(), METADATA_TIMEOUT)
+		cmd := exec.CommandContext(ctx, "doveadm", args...)
+		started := time.Now()
+		if output, err := cmd.CombinedOutput(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error setting %s on %s: %s: %s\n", option, mailbox, err,
+				strings.TrimSpace(string(output)))
+		}
+		usage_exec(started)
+		cancel()
+	}
+}
@@ -0,0 +1,262 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the delivery latency histogram buckets, in seconds
+var metricsBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// metricFamilies are the metrics exported, in the order they are written.
+var metricFamilies = []struct {
+	Name string
+	Type string
+	Help string
+}{
+	{"mail_pmda_deliveries_total", "counter", "Deliveries by outcome."},
+	{"mail_pmda_folder_deliveries_total", "counter", "Messages stored by folder."},
+	{"mail_pmda_classifications_total", "counter", "Classification decisions by verdict."},
+	{"mail_pmda_bytes_written_total", "counter", "Bytes of messages stored."},
+	{"mail_pmda_tempfails_total", "counter", "Deliveries left for the MTA to retry."},
+	{"mail_pmda_delivery_duration_seconds", "histogram", "Time taken by deliveries."},
+}
+
+// MetricsConfig is the Prometheus textfile-collector file the one-shot
+// MDA keeps its counters in, relative to the home directory unless
+// absolute, {user} expanding to the user so a system-wide configuration
+// gives every user a file of their own:
+//
+//	metrics textfile "/var/lib/node_exporter/mail.pmda.{user}.prom"
+type MetricsConfig struct {
+	Textfile string
+}
+
+func metrics_parse(args []string) (*MetricsConfig, error) {
+	if len(args) != 2 || args[0] != "textfile" {
+		return nil, fmt.Errorf("usage: metrics textfile pathname")
+	}
+	return &MetricsConfig{Textfile: args[1]}, nil
+}
+
+// Metrics are series keyed by name and labels, as they appear in the
+// text exposition format.
+type Metrics struct {
+	series map[string]float64
+}
+
+func metrics_new() *Metrics {
+	return &Metrics{series: make(map[string]float64)}
+}
+
+// metrics_series returns the key of a series from its name and label
+// pairs.
+func metrics_series(name string, labels ...string) string {
+	if len(labels) == 0 {
+		return name
+	}
+	escape := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, labels[i]+`="`+escape.Replace(labels[i+1])+`"`)
+	}
+	return name + "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (metrics *Metrics) add(series string, value float64) {
+	metrics.series[series] += value
+}
+
+// observe accounts for a value in a histogram, the le label going last.
+func (metrics *Metrics) observe(name string, value float64, labels ...string) {
+	labels = labels[:len(labels):len(labels)]
+	for _, bucket := range metricsBuckets {
+		count := 0.0
+		if value <= bucket {
+			count = 1
+		}
+		metrics.add(metrics_series(name+"_bucket", append(labels, "le", strconv.FormatFloat(bucket, 'g', -1, 64))...), count)
+	}
+	metrics.add(metrics_series(name+"_bucket", append(labels, "le", "+Inf")...), 1)
+	metrics.add(metrics_series(name+"_sum", labels...), value)
+	metrics.add(metrics_series(name+"_count", labels...), 1)
+}
+
+// account counts a delivery, folder, verdict and size being
+// those of the message stored if it was.
+func (metrics *Metrics) account(user string, outcome string, folder string, verdict string, size int64, duration time.Duration) {
+	metrics.add(metrics_series("mail_pmda_deliveries_total", "user", user, "outcome", outcome), 1)
+	if verdict != "" {
+		metrics.add(metrics_series("mail_pmda_classifications_total", "user", user, "verdict", verdict), 1)
+	}
+	if outcome == "delivered" {
+		metrics.add(metrics_series("mail_pmda_folder_deliveries_total", "user", user, "folder", folder_name(folder)), 1)
+		metrics.add(metrics_series("mail_pmda_bytes_written_total", "user", user), float64(size))
+	}
+	metrics.observe("mail_pmda_delivery_duration_seconds", duration.Seconds(), "user", user)
+}
+
+// metrics_read parses what write produced, comments and lines it does
+// not understand being skipped.
+func metrics_read(r io.Reader) (*Metrics, error) {
+	metrics := metrics_new()
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		space := strings.LastIndexByte(line, ' ')
+		if line == "" || line[0] == '#' || space == -1 {
+			continue
+		}
+		if value, err := strconv.ParseFloat(line[space+1:], 64); err == nil {
+			metrics.series[line[:space]] = value
+		}
+	}
+	return metrics, scanner.Err()
+}
+
+// write outputs the metrics in the Prometheus text exposition format.
+func (metrics *Metrics) write(w io.Writer) error {
+	keys := make([]string, 0, len(metrics.series))
+	for key := range metrics.series {
+		keys = append(keys, key)
+	}
+	// buckets in the order of their bounds, which go last
+	bucket := func(key string) (string, float64) {
+		if at := strings.LastIndex(key, `le="`); at != -1 {
+			if le, err := strconv.ParseFloat(strings.TrimSuffix(key[at+4:], `"}`), 64); err == nil {
+				return key[:at], le
+			}
+		}
+		return key, 0
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		iseries, ile := bucket(keys[i])
+		jseries, jle := bucket(keys[j])
+		if iseries != jseries {
+			return iseries < jseries
+		}
+		return ile < jle
+	})
+
+	buf := bufio.NewWriter(w)
+	for _, family := range metricFamilies {
+		fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", family.Name, family.Help, family.Name, family.Type)
+		for _, key := range keys {
+			name, _, _ := strings.Cut(key, "{")
+			if family.Type == "histogram" {
+				for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+					if base, found := strings.CutSuffix(name, suffix); found {
+						name = base
+						break
+					}
+				}
+			}
+			if name == family.Name {
+				fmt.Fprintf(buf, "%s %s\n", key, strconv.FormatFloat(metrics.series[key], 'f', -1, 64))
+			}
+		}
+	}
+	return buf.Flush()
+}
+
+// the textfile of the delivery and the user it accounts for, empty
+// unless configured
+var metricsTextfile, metricsUser string
+
+// metrics_open remembers where the counters of the delivery go.
+func metrics_open(cfg *Config, env *Envelope) {
+	if cfg.Metrics == nil {
+		return
+	}
+	metricsUser = env.User
+	pathname := strings.ReplaceAll(cfg.Metrics.Textfile, "{user}", strings.ReplaceAll(env.User, "/", "_"))
+	if !filepath.IsAbs(pathname) {
+		pathname = filepath.Join(env.Home, pathname)
+	}
+	metricsTextfile = pathname
+}
+
+// metrics_update applies fn to the counters of the textfile, under a
+// lock as deliveries run concurrently, and replaces the file at once
+// for the collector never to read half of it.
+func metrics_update(fn func(metrics *Metrics)) {
+	if metricsTextfile == "" {
+		return
+	}
+	lock, err := os.OpenFile(metricsTextfile+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error updating metrics: %s\n", err)
+		return
+	}
+	defer lock.Close()
+	if err := lock_file(lock, LOCK_TIMEOUT); err != nil {
+		fmt.Fprintf(os.Stderr, "Error updating metrics: %s\n", err)
+		return
+	}
+
+	metrics := metrics_new()
+	if file, err := os.Open(metricsTextfile); err == nil {
+		metrics, err = metrics_read(file)
+		file.Close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading metrics: %s\n", err)
+			return
+		}
+	}
+	fn(metrics)
+
+	tmpname := fmt.Sprintf("%s.%d", metricsTextfile, os.Getpid())
+	file, err := os.OpenFile(tmpname, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error updating metrics: %s\n", err)
+		return
+	}
+	err = metrics.write(file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpname, metricsTextfile)
+	}
+	if err != nil {
+		os.Remove(tmpname)
+		fmt.Fprintf(os.Stderr, "Error updating metrics: %s\n", err)
+	}
+}
+
+// metrics_delivery counts the outcome of the delivery.
+func metrics_delivery(outcome string) {
+	metrics_update(func(metrics *Metrics) {
+		metrics.account(metricsUser, outcome, usage.Folder, deliveryLog.Verdict, usage.Bytes, time.Since(deliveryLog.Start))
+	})
+}
+
+// metrics_tempfail counts a delivery given back to the MTA.
+func metrics_tempfail() {
+	metrics_update(func(metrics *Metrics) {
+		metrics.add(metrics_series("mail_pmda_tempfails_total", "user", metricsUser), 1)
+	})
+}
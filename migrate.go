@@ -0,0 +1,227 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// A migration moves an account to another maildir or layout without a
+// flag day. New mail is delivered to the configured maildir and layout
+// right away, while "mail.pmda migrate" moves the old messages over in
+// batches:
+//
+//	maildir "/srv/mail/alice"
+//	layout sharded depth 1
+//	migrate from "Maildir"
+//
+// Lookups of earlier messages made during deliveries, such as the sent
+// folder for correspondents and bounces, read through to the maildir
+// migrated from until the directive is removed. Messages in a plain
+// layout where the configuration asks for sharding, or the other way
+// round, are moved to their place as well.
+//
+// Migrating is resumable: moved messages are no longer where they are
+// looked for, a run interrupted carries on from where it stopped.
+func maildir_roots(cfg *Config, homedir string, maildir string) []string {
+	if cfg.MigrateFrom == "" {
+		return []string{maildir}
+	}
+	return []string{maildir, backend_resolve(homedir, cfg.MigrateFrom)}
+}
+
+// Migration paces the moves, pausing after each batch to leave the disks
+// to deliveries and readers.
+type Migration struct {
+	Batch int
+	Pause time.Duration
+	Total int
+	Moved int
+}
+
+func (migration *Migration) step() {
+	migration.Moved++
+	if migration.Moved%migration.Batch != 0 {
+		return
+	}
+	migration.progress()
+	time.Sleep(migration.Pause)
+}
+
+func (migration *Migration) progress() {
+	percent := 100
+	if migration.Total != 0 {
+		percent = migration.Moved * 100 / migration.Total
+	}
+	fmt.Printf("%d/%d messages migrated (%d%%)\n", migration.Moved, migration.Total, percent)
+}
+
+// migrate_misplaced calls fn for the messages of a maildir a depth does
+// not put where they are.
+func migrate_misplaced(maildir string, depth int, fn func(directory string, pathname string, target string) error) error {
+	folders, err := maildir_folders(maildir)
+	if err != nil {
+		return err
+	}
+	for _, folder := range folders {
+		for _, subdir := range []string{"new", "cur"} {
+			directory := filepath.Join(maildir, folder, subdir)
+			err := maildir_walk(directory, func(pathname string, entry fs.DirEntry) error {
+				target := filepath.Join(directory, entry.Name())
+				if depth != 0 {
+					target = filepath.Join(directory, shard_dir(entry.Name(), depth), entry.Name())
+				}
+				if target == pathname {
+					return nil
+				}
+				return fn(directory, pathname, target)
+			})
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// migrate_count returns how many messages are left to migrate.
+func migrate_count(maildir string, source string, depth int) (int, error) {
+	total := 0
+	if source != "" {
+		folders, err := maildir_folders(source)
+		if err != nil && !os.IsNotExist(err) {
+			return 0, err
+		}
+		for _, folder := range folders {
+			_, count := folder_size(filepath.Join(source, folder))
+			total += int(count)
+		}
+	}
+	err := migrate_misplaced(maildir, depth, func(directory string, pathname string, target string) error {
+		total++
+		return nil
+	})
+	return total, err
+}
+
+// migrate_run moves the messages of the maildir migrated from, then
+// those of the maildir not in its layout.
+func migrate_run(cfg *Config, maildir string, source string, migration *Migration) error {
+	if source != "" {
+		folders, err := maildir_folders(source)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		for _, folder := range folders {
+			for _, subdir := range []string{"new", "cur"} {
+				err := maildir_walk(filepath.Join(source, folder, subdir), func(pathname string, entry fs.DirEntry) error {
+					if err := drain_message(cfg, maildir, source, folder, subdir, pathname); err != nil && !os.IsNotExist(err) {
+						return err
+					}
+					migration.step()
+					return nil
+				})
+				if err != nil && !os.IsNotExist(err) {
+					return err
+				}
+			}
+		}
+	}
+
+	depth := maildir_layout(cfg, maildir)
+	directories := make(map[string]bool)
+	err := migrate_misplaced(maildir, depth, func(directory string, pathname string, target string) error {
+		if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+			return err
+		}
+		if err := os.Rename(pathname, target); err != nil {
+			if os.IsNotExist(err) {
+				// flagged or expunged by a reader meanwhile
+				return nil
+			}
+			return err
+		}
+		directories[directory] = true
+		migration.step()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for directory := range directories {
+		entries, err := os.ReadDir(directory)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			if entry.IsDir() && shard_name(entry.Name()) {
+				shard_prune(filepath.Join(directory, entry.Name()))
+			}
+		}
+	}
+	return nil
+}
+
+var migrateFlags = flag.NewFlagSet("migrate", flag.ExitOnError)
+var migrateBatch = migrateFlags.Int("batch", 1000, "messages moved between pauses")
+var migratePause = migrateFlags.Duration("pause", time.Second, "pause between batches")
+
+// migrate_main implements "mail.pmda migrate", which moves the messages
+// left behind by a change of maildir or layout.
+func migrate_main(args []string) int {
+	migrateFlags.Parse(args)
+	if migrateFlags.NArg() != 0 || *migrateBatch < 1 {
+		fmt.Fprintf(os.Stderr, "Usage: %s migrate [-batch n] [-pause duration]\n", os.Args[0])
+		return 1
+	}
+
+	homedir := os.Getenv("HOME")
+	cfg, err := config_read(filepath.Join(homedir, ".pmda.conf"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading configuration: %s\n", err)
+		return 1
+	}
+	maildir := maildir_resolve(cfg, homedir)
+	maildir_mkdirs(maildir)
+	source := ""
+	if cfg.MigrateFrom != "" {
+		source = backend_resolve(homedir, cfg.MigrateFrom)
+	}
+
+	migration := &Migration{Batch: *migrateBatch, Pause: *migratePause}
+	if migration.Total, err = migrate_count(maildir, source, maildir_layout(cfg, maildir)); err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading %s: %s\n", maildir, err)
+		return 1
+	}
+	if err := migrate_run(cfg, maildir, source, migration); err != nil {
+		migration.progress()
+		fmt.Fprintf(os.Stderr, "Error migrating: %s\n", err)
+		return 1
+	}
+	if migration.Moved == 0 || migration.Moved%migration.Batch != 0 {
+		migration.progress()
+	}
+	if source != "" {
+		fmt.Printf("migration complete, the migrate directive can be removed\n")
+	}
+	return 0
+}
@@ -0,0 +1,338 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"os"
+	"strings"
+)
+
+// StructureLimits bound the work spent parsing a message, so that crafted
+// messages cannot stall delivery. Beyond them the message is delivered to
+// the inbox without classification, or tempfailed if so configured.
+type StructureLimits struct {
+	Headers    int
+	HeaderSize int
+	MimeDepth  int
+	MimeParts  int
+	Tempfail   bool
+}
+
+func (limits *StructureLimits) mime() bool {
+	return limits.MimeDepth != 0 || limits.MimeParts != 0 || limits.Headers != 0 || limits.HeaderSize != 0
+}
+
+// mime_boundary returns the boundary of a multipart content type, or an
+// empty string for anything else.
+func mime_boundary(contentType string) string {
+	mediatype, params, err := mime.ParseMediaType(contentType)
+	if err != nil || !strings.HasPrefix(mediatype, "multipart/") {
+		return ""
+	}
+	return params["boundary"]
+}
+
+func mime_embedded(contentType string) bool {
+	mediatype, _, err := mime.ParseMediaType(contentType)
+	return err == nil && mediatype == "message/rfc822"
+}
+
+// mime_scan walks the MIME structure of a message body line by line,
+// without holding it in memory, and reports the first limit exceeded.
+// Boundaries in use are kept on a stack, an embedded message pushes an
+// empty entry that only counts towards the depth.
+func mime_scan(r io.Reader, contentType string, limits *StructureLimits) error {
+	boundary, embedded := mime_boundary(contentType), mime_embedded(contentType)
+	if boundary == "" && !embedded {
+		return nil
+	}
+
+	stack := []string{boundary}
+	parts := 0
+	inHeader := embedded
+	partType, fields, headerSize := "", 0, 0
+	inContentType := false
+
+	reader := bufio.NewReaderSize(r, 64*1024)
+	truncated := false
+	for {
+		data, err := reader.ReadSlice('\n')
+		if err != nil && err != bufio.ErrBufferFull && err != io.EOF {
+			return err
+		}
+		// the tail of an overlong line is never a boundary nor a field
+		continuation := truncated
+		truncated = err == bufio.ErrBufferFull
+		line := strings.TrimRight(string(data), "\r\n")
+
+		if inHeader {
+			headerSize += len(data)
+			if limits.HeaderSize != 0 && headerSize > limits.HeaderSize {
+				return fmt.Errorf("part header exceeds %d bytes", limits.HeaderSize)
+			}
+			switch {
+			case continuation:
+			case line == "":
+				inHeader = false
+				if nested := mime_boundary(partType); nested != "" {
+					stack = append(stack, nested)
+				} else if mime_embedded(partType) {
+					stack = append(stack, "")
+					inHeader = true
+				}
+				if limits.MimeDepth != 0 && len(stack) > limits.MimeDepth {
+					return fmt.Errorf("MIME nesting deeper than %d", limits.MimeDepth)
+				}
+				partType, fields, headerSize, inContentType = "", 0, 0, false
+			case line[0] == ' ' || line[0] == '\t':
+				if inContentType {
+					partType += line
+				}
+			default:
+				fields++
+				if limits.Headers != 0 && fields > limits.Headers {
+					return fmt.Errorf("more than %d part header fields", limits.Headers)
+				}
+				name, value, _ := strings.Cut(line, ":")
+				inContentType = strings.EqualFold(strings.TrimSpace(name), "Content-Type")
+				if inContentType {
+					partType = strings.TrimSpace(value)
+				}
+			}
+		} else if !continuation && strings.HasPrefix(line, "--") {
+			line = strings.TrimRight(line, " \t")
+			for i := len(stack) - 1; i >= 0; i-- {
+				if stack[i] == "" {
+					continue
+				}
+				if line == "--"+stack[i] {
+					stack = stack[:i+1]
+					parts++
+					if limits.MimeParts != 0 && parts > limits.MimeParts {
+						return fmt.Errorf("more than %d MIME parts", limits.MimeParts)
+					}
+					inHeader = true
+					break
+				}
+				if line == "--"+stack[i]+"--" {
+					stack = stack[:i]
+					break
+				}
+			}
+		}
+
+		if err == io.EOF || len(stack) == 0 {
+			return nil
+		}
+	}
+}
+
+// mime_scan_file runs mime_scan on the body of a stored message.
+func mime_scan_file(pathname string, contentType string, limits *StructureLimits) error {
+	file, err := os.Open(pathname)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReaderSize(file, 64*1024)
+	for {
+		line, err := reader.ReadSlice('\n')
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil && err != bufio.ErrBufferFull {
+			return err
+		}
+		if err == nil && strings.TrimRight(string(line), "\r\n") == "" {
+			break
+		}
+	}
+	return mime_scan(reader, contentType, limits)
+}
+
+const MIME_WALK_DEPTH = 10
+
+// MimePart is a leaf part of a message, Body is its decoded content.
+type MimePart struct {
+	MediaType   string
+	Params      map[string]string
+	Disposition string
+	Filename    string
+	Body        io.Reader
+}
+
+// mime_walk calls fn for every leaf part of a body, descending into
+// multiparts but not into embedded messages. Parts are streamed, fn must
+// consume Body before returning if it needs it.
+func mime_walk(r io.Reader, contentType string, encoding string, disposition string, fn func(part *MimePart) error) error {
+	return mime_walk_depth(r, contentType, encoding, disposition, 0, fn)
+}
+
+func mime_walk_depth(r io.Reader, contentType string, encoding string, disposition string, depth int, fn func(part *MimePart) error) error {
+	if contentType == "" {
+		contentType = "text/plain"
+	}
+	mediatype, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediatype, params = "application/octet-stream", map[string]string{}
+	}
+
+	if strings.HasPrefix(mediatype, "multipart/") && params["boundary"] != "" {
+		if depth >= MIME_WALK_DEPTH {
+			return fmt.Errorf("MIME nesting deeper than %d", MIME_WALK_DEPTH)
+		}
+		reader := multipart.NewReader(r, params["boundary"])
+		for {
+			part, err := reader.NextRawPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			err = mime_walk_depth(part, part.Header.Get("Content-Type"), part.Header.Get("Content-Transfer-Encoding"),
+				part.Header.Get("Content-Disposition"), depth+1, fn)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	part := &MimePart{MediaType: mediatype, Params: params, Body: r}
+	if value, dparams, err := mime.ParseMediaType(disposition); err == nil {
+		part.Disposition = value
+		part.Filename = dparams["filename"]
+	}
+	if part.Filename == "" {
+		part.Filename = params["name"]
+	}
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		part.Body = base64.NewDecoder(base64.StdEncoding, r)
+	case "quoted-printable":
+		part.Body = quotedprintable.NewReader(r)
+	}
+	return fn(part)
+}
+
+// mime_walk_file runs mime_walk on a stored message.
+func mime_walk_file(pathname string, fn func(part *MimePart) error) error {
+	file, err := os.Open(pathname)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// header_read buffers past the header, which is read here instead
+	reader := bufio.NewReaderSize(file, 64*1024)
+	hdr := &Header{}
+	for size := 0; size < HEADER_READ_MAX; {
+		line, n, err := line_read(reader, LINE_READ_MAX)
+		size += n
+		if line == "" {
+			break
+		}
+		hdr.add_line(line)
+		if err != nil {
+			return nil
+		}
+	}
+	return mime_walk(reader, hdr.Get("Content-Type"), hdr.Get("Content-Transfer-Encoding"), hdr.Get("Content-Disposition"), fn)
+}
+
+// signed messages are only verified up to this size
+const MIME_SIGNED_MAX = 32 * 1024 * 1024
+
+// mime_read_body returns the body of a stored message.
+func mime_read_body(pathname string) ([]byte, error) {
+	file, err := os.Open(pathname)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	message, err := mail.ReadMessage(io.LimitReader(file, MIME_SIGNED_MAX))
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(message.Body)
+}
+
+// mime_signed_parts splits the body of a multipart/signed message into
+// the signed part, as the exact bytes canonicalized to CRLF which is what
+// signatures are computed over, and the header and decoded body of the
+// signature part.
+func mime_signed_parts(body []byte, boundary string) ([]byte, *Header, []byte, error) {
+	delimiter := "--" + boundary
+	parts := make([][]string, 0, 2)
+	var current []string
+	for _, line := range strings.Split(string(body), "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		trimmed := strings.TrimRight(line, " \t")
+		if trimmed == delimiter || trimmed == delimiter+"--" {
+			if current != nil {
+				parts = append(parts, current)
+			}
+			if trimmed == delimiter+"--" {
+				current = nil
+				break
+			}
+			current = make([]string, 0)
+			continue
+		}
+		if current != nil {
+			current = append(current, line)
+		}
+	}
+	if current != nil || len(parts) != 2 {
+		return nil, nil, nil, fmt.Errorf("malformed multipart/signed")
+	}
+
+	part := []byte(strings.Join(parts[1], "\n"))
+	hdr, err := header_read(bytes.NewReader(part))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	_, partBody, _ := bytes.Cut(part, []byte("\n\n"))
+	signature, err := mime_decode_body(hdr, partBody)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return []byte(strings.Join(parts[0], "\r\n")), hdr, signature, nil
+}
+
+// mime_decode_body undoes the base64 transfer encoding of a body, others
+// are left as is.
+func mime_decode_body(hdr *Header, body []byte) ([]byte, error) {
+	if strings.EqualFold(strings.TrimSpace(hdr.Get("Content-Transfer-Encoding")), "base64") {
+		return io.ReadAll(base64.NewDecoder(base64.StdEncoding, bytes.NewReader(bytes.Map(func(r rune) rune {
+			if r == '\r' || r == '\n' || r == ' ' || r == '\t' {
+				return -1
+			}
+			return r
+		}, body))))
+	}
+	return body, nil
+}
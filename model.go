@@ -0,0 +1,306 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// only the start of the text of a message is looked at by models
+const MODEL_TEXT_MAX = 64 * 1024
+
+// ModelConfig is a local ONNX model scoring messages, spam or importance
+// say, with the vocabulary its bag-of-words input was built from:
+//
+//	model spam "models/spam.onnx" vocabulary "models/spam.vocab"
+//
+// The model takes a 1xN float input, N being the size of the vocabulary,
+// holding 1 for every word of the vocabulary found in the subject or text
+// of the message. Its output is either a single score or the probability
+// of two classes, in which case the score is that of the second. Paths
+// are relative to the home directory.
+type ModelConfig struct {
+	Name       string
+	Path       string
+	Vocabulary string
+}
+
+var modelNameRegexp = regexp.MustCompile(`^[a-z0-9_-]+$`)
+
+var modelTokenRegexp = regexp.MustCompile(`[\p{L}\p{N}]+`)
+
+func model_parse(args []string) (*ModelConfig, error) {
+	if len(args) != 4 || args[2] != "vocabulary" {
+		return nil, fmt.Errorf("usage: model name path vocabulary path")
+	}
+	if !modelNameRegexp.MatchString(args[0]) {
+		return nil, fmt.Errorf("invalid model name: %s", args[0])
+	}
+	return &ModelConfig{Name: args[0], Path: args[1], Vocabulary: args[3]}, nil
+}
+
+func model_path(homedir string, pathname string) string {
+	if filepath.IsAbs(pathname) {
+		return pathname
+	}
+	return filepath.Join(homedir, pathname)
+}
+
+// model_tokens returns the words of the subject and text parts of a
+// stored message, lowercased and without the very short or long ones.
+func model_tokens(pathname string) (map[string]bool, error) {
+	tokens := make(map[string]bool)
+	add := func(text string) {
+		for _, token := range modelTokenRegexp.FindAllString(strings.ToLower(text), -1) {
+			if length := utf8.RuneCountInString(token); length >= 2 && length <= 32 {
+				tokens[token] = true
+			}
+		}
+	}
+
+	file, err := os.Open(pathname)
+	if err != nil {
+		return nil, err
+	}
+	hdr, err := header_read(file)
+	file.Close()
+	if err != nil {
+		return nil, err
+	}
+	add(header_oneline(hdr.Get("Subject")))
+
+	remaining := int64(MODEL_TEXT_MAX)
+	err = mime_walk_file(pathname, func(part *MimePart) error {
+		if !strings.HasPrefix(part.MediaType, "text/") || part.Disposition == "attachment" || remaining <= 0 {
+			return nil
+		}
+		text, err := io.ReadAll(io.LimitReader(part.Body, remaining))
+		if err != nil {
+			return err
+		}
+		remaining -= int64(len(text))
+		add(string(text))
+		return nil
+	})
+	return tokens, err
+}
+
+// vocabulary_read reads a vocabulary, one word per line, the line number
+// being the index of the word in the input of the model.
+func vocabulary_read(pathname string) (map[string]int, error) {
+	file, err := os.Open(pathname)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	vocabulary := make(map[string]int)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		vocabulary[strings.TrimSpace(scanner.Text())] = len(vocabulary)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return vocabulary, nil
+}
+
+// model_run scores a message with a model.
+func model_run(homedir string, model *ModelConfig, tokens map[string]bool) (float64, error) {
+	onnx, err := onnx_load(model_path(homedir, model.Path))
+	if err != nil {
+		return 0, err
+	}
+	vocabulary, err := vocabulary_read(model_path(homedir, model.Vocabulary))
+	if err != nil {
+		return 0, err
+	}
+
+	input := &Tensor{Dims: []int{1, len(vocabulary)}, Data: make([]float64, len(vocabulary))}
+	for token := range tokens {
+		if index, exists := vocabulary[token]; exists {
+			input.Data[index] = 1
+		}
+	}
+	output, err := onnx.run(input)
+	if err != nil {
+		return 0, err
+	}
+	switch len(output.Data) {
+	case 1:
+		return output.Data[0], nil
+	case 2:
+		return output.Data[1], nil
+	}
+	return 0, fmt.Errorf("output of shape %v is not a score", output.Dims)
+}
+
+// models_score runs every configured model over a stored message, models
+// that fail leave no score and conditions on it do not match.
+func models_score(cfg *Config, env *Envelope, pathname string) map[string]float64 {
+	tokens, err := model_tokens(pathname)
+	if err != nil {
+		log_info("error reading text for models: %s", err)
+		return nil
+	}
+	scores := make(map[string]float64)
+	for _, model := range cfg.Models {
+		score, err := model_run(env.Home, model, tokens)
+		if err != nil {
+			log_info("error running model %s: %s", model.Name, err)
+			continue
+		}
+		scores[model.Name] = score
+	}
+	return scores
+}
+
+// model_messages calls fn for every message of every folder of a maildir.
+func model_messages(maildir string, fn func(folder string, pathname string)) error {
+	folders, err := maildir_folders(maildir)
+	if err != nil {
+		return err
+	}
+	for _, folder := range folders {
+		for _, subdir := range []string{"new", "cur"} {
+			err := maildir_walk(filepath.Join(maildir, folder, subdir), func(pathname string, entry fs.DirEntry) error {
+				fn(folder, pathname)
+				return nil
+			})
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+var trainFlags = flag.NewFlagSet("train", flag.ExitOnError)
+var trainSize = trainFlags.Int("size", 5000, "keep at most this many words")
+var trainMin = trainFlags.Int("min", 3, "ignore words found in fewer messages")
+var trainDataset = trainFlags.String("dataset", "", "also write the features of every message to this file")
+
+// train_main implements "mail.pmda train", which builds the vocabulary of
+// a model from the words most messages of the maildir use. With -dataset
+// it also writes, one JSON object per line, the folder and the vocabulary
+// indices of every message, to train the model itself from.
+func train_main(args []string) int {
+	trainFlags.Parse(args)
+	if trainFlags.NArg() < 1 || trainFlags.NArg() > 2 {
+		fmt.Fprintf(os.Stderr, "Usage: %s train [-size n] [-min n] [-dataset file] vocabulary [maildir]\n", os.Args[0])
+		return 1
+	}
+
+	homedir := os.Getenv("HOME")
+	cfg := config_load(filepath.Join(homedir, ".pmda.conf"))
+	maildir := maildir_resolve(cfg, homedir)
+	if trainFlags.NArg() == 2 {
+		maildir = trainFlags.Arg(1)
+	}
+
+	frequencies := make(map[string]int)
+	messages := 0
+	err := model_messages(maildir, func(folder string, pathname string) {
+		tokens, err := model_tokens(pathname)
+		if err != nil {
+			return
+		}
+		for token := range tokens {
+			frequencies[token]++
+		}
+		messages++
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading %s: %s\n", maildir, err)
+		return 1
+	}
+
+	words := make([]string, 0, len(frequencies))
+	for token, count := range frequencies {
+		if count >= *trainMin {
+			words = append(words, token)
+		}
+	}
+	sort.Slice(words, func(i, j int) bool {
+		if frequencies[words[i]] != frequencies[words[j]] {
+			return frequencies[words[i]] > frequencies[words[j]]
+		}
+		return words[i] < words[j]
+	})
+	if len(words) > *trainSize {
+		words = words[:*trainSize]
+	}
+	if err := os.WriteFile(trainFlags.Arg(0), []byte(strings.Join(words, "\n")+"\n"), 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing vocabulary: %s\n", err)
+		return 1
+	}
+	fmt.Printf("%d words kept from %d messages\n", len(words), messages)
+
+	if *trainDataset == "" {
+		return 0
+	}
+	vocabulary := make(map[string]int, len(words))
+	for i, word := range words {
+		vocabulary[word] = i
+	}
+	file, err := os.Create(*trainDataset)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing dataset: %s\n", err)
+		return 1
+	}
+	writer := bufio.NewWriter(file)
+	encoder := json.NewEncoder(writer)
+	err = model_messages(maildir, func(folder string, pathname string) {
+		tokens, err := model_tokens(pathname)
+		if err != nil {
+			return
+		}
+		features := make([]int, 0, len(tokens))
+		for token := range tokens {
+			if index, exists := vocabulary[token]; exists {
+				features = append(features, index)
+			}
+		}
+		sort.Ints(features)
+		if folder == "" {
+			folder = "INBOX"
+		}
+		encoder.Encode(map[string]any{"folder": folder, "features": features})
+	})
+	if err == nil {
+		err = writer.Flush()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing dataset: %s\n", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,165 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// MuteConfig files the messages of muted threads away from the inbox:
+//
+//	mute folder ".Archive" list ".pmda/muted"
+//
+// The list holds Message-IDs, one per line, and a message is muted when
+// its thread, as found in the thread index, or any of the messages it
+// references is listed. Paths are relative to the home directory.
+type MuteConfig struct {
+	Folder string
+	List   string
+}
+
+func mute_default() *MuteConfig {
+	return &MuteConfig{Folder: ".Archive", List: filepath.Join(".pmda", "muted")}
+}
+
+func mute_parse(args []string) (*MuteConfig, error) {
+	mute := mute_default()
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == "folder" && i+1 < len(args):
+			mute.Folder = args[i+1]
+			i++
+		case args[i] == "list" && i+1 < len(args):
+			mute.List = args[i+1]
+			i++
+		default:
+			return nil, fmt.Errorf("usage: mute [folder name] [list path]")
+		}
+	}
+	return mute, nil
+}
+
+func mute_list_path(mute *MuteConfig, homedir string) string {
+	if filepath.IsAbs(mute.List) {
+		return mute.List
+	}
+	return filepath.Join(homedir, mute.List)
+}
+
+// mute_check reports whether a message belongs to a muted thread.
+func mute_check(cfg *Config, env *Envelope, hdr *Header) bool {
+	muted, err := list_read(mute_list_path(cfg.Mute, env.Home))
+	if err != nil {
+		log_info("error reading muted threads: %s", err)
+		return false
+	}
+	if len(muted) == 0 {
+		return false
+	}
+
+	ids := message_ids(hdr.Get("In-Reply-To"))
+	for _, references := range hdr.Values("References") {
+		ids = append(ids, message_ids(references)...)
+	}
+	store, err := state_open(cfg, env.Home)
+	if err != nil {
+		log_info("error opening state: %s", err)
+	} else {
+		ids = append(ids, thread_root(store, hdr))
+		store.Close()
+	}
+	for _, id := range ids {
+		if muted[id] {
+			return true
+		}
+	}
+	return false
+}
+
+var muteFlags = flag.NewFlagSet("mute", flag.ExitOnError)
+var muteUndo = muteFlags.Bool("undo", false, "unmute the threads instead")
+
+// mute_main implements "mail.pmda mute", which adds threads to the muted
+// list given a Message-ID or a stored message of the thread, for MUAs to
+// bind to a key.
+func mute_main(args []string) int {
+	muteFlags.Parse(args)
+	if muteFlags.NArg() == 0 {
+		fmt.Fprintf(os.Stderr, "Usage: %s mute [-undo] message-id|message ...\n", os.Args[0])
+		return 1
+	}
+
+	homedir := os.Getenv("HOME")
+	cfg, err := config_read(filepath.Join(homedir, ".pmda.conf"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading configuration: %s\n", err)
+		return 1
+	}
+	mute := cfg.Mute
+	if mute == nil {
+		fmt.Fprintf(os.Stderr, "Warning: mute is not enabled in %s, deliveries ignore the list\n", filepath.Join(homedir, ".pmda.conf"))
+		mute = mute_default()
+	}
+	store, err := state_open(cfg, homedir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error opening state: %s\n", err)
+		return 1
+	}
+	defer store.Close()
+
+	ids := make([]string, 0, muteFlags.NArg())
+	for _, arg := range muteFlags.Args() {
+		if id := message_id(arg); id != "" && strings.HasPrefix(arg, "<") {
+			ids = append(ids, id)
+			continue
+		}
+		file, err := os.Open(arg)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading %s: %s\n", arg, err)
+			return 1
+		}
+		hdr, err := header_read(file)
+		file.Close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading %s: %s\n", arg, err)
+			return 1
+		}
+		root := thread_root(store, hdr)
+		if root == "" {
+			fmt.Fprintf(os.Stderr, "Error: %s has no Message-ID\n", arg)
+			return 1
+		}
+		ids = append(ids, root)
+	}
+
+	changed, err := list_edit(mute_list_path(mute, homedir), ids, *muteUndo, "muted "+time.Now().Format("2006-01-02"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error updating muted threads: %s\n", err)
+		return 1
+	}
+	if *muteUndo {
+		fmt.Printf("%d threads unmuted\n", changed)
+	} else {
+		fmt.Printf("%d threads muted\n", changed)
+	}
+	return 0
+}
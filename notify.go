@@ -0,0 +1,105 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"mime"
+	"net/mail"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+)
+
+const NOTIFY_TIMEOUT = 5 * time.Second
+
+// notify_session_bus returns the address of the user session bus, or an
+// empty string if there is none we can talk to.
+func notify_session_bus() string {
+	if address := os.Getenv("DBUS_SESSION_BUS_ADDRESS"); address != "" {
+		return address
+	}
+
+	// fetchmail run from cron or a systemd user unit may not inherit the
+	// variable, but the bus socket lives at a well-known location.
+	if runtimeDir := os.Getenv("XDG_RUNTIME_DIR"); runtimeDir != "" {
+		socket := filepath.Join(runtimeDir, "bus")
+		if st, err := os.Stat(socket); err == nil && st.Mode()&os.ModeSocket != 0 {
+			return "unix:path=" + socket
+		}
+	}
+	return ""
+}
+
+func notify_decode(value string) string {
+	decoder := new(mime.WordDecoder)
+	if decoded, err := decoder.DecodeHeader(value); err == nil {
+		return decoded
+	}
+	return value
+}
+
+func notify_sender(from string) string {
+	from = notify_decode(from)
+	if address, err := mail.ParseAddress(from); err == nil {
+		if address.Name != "" {
+			return address.Name
+		}
+		return address.Address
+	}
+	return from
+}
+
+// notify_delivery emits a desktop notification for a delivery to the inbox
+// or to a folder with notify on, the amount of information disclosed
+// depends on the configured privacy level.
+// Failures are silently ignored, a notification is never worth a tempfail.
+func notify_delivery(cfg *Config, from string, subject string) {
+	if cfg.Notify == "none" {
+		return
+	}
+
+	bus := notify_session_bus()
+	if bus == "" {
+		return
+	}
+
+	summary := "New mail"
+	body := ""
+	switch cfg.Notify {
+	case "sender":
+		summary = fmt.Sprintf("New mail from %s", notify_sender(from))
+	case "full":
+		summary = fmt.Sprintf("New mail from %s", notify_sender(from))
+		body = notify_decode(subject)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), NOTIFY_TIMEOUT)
+	defer cancel()
+
+	args := []string{"--app-name=mail.pmda", "--icon=mail-unread", "--", summary}
+	if body != "" {
+		args = append(args, body)
+	}
+	cmd := exec.CommandContext(ctx, "notify-send", args...)
+	cmd.Env = append(os.Environ(), "DBUS_SESSION_BUS_ADDRESS="+bus)
+	started := time.Now()
+	cmd.Run()
+	usage_exec(started)
+}
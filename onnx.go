@@ -0,0 +1,623 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+)
+
+// This is the subset of ONNX needed to run the small models a mailbox
+// can use: float tensors and the core operators of linear models and
+// multilayer perceptrons, as exported by most training frameworks. The
+// protobuf encoding is decoded by hand to keep the build dependency free.
+
+// ONNX tensor element types
+const (
+	ONNX_FLOAT  = 1
+	ONNX_INT64  = 7
+	ONNX_DOUBLE = 11
+)
+
+// Tensor holds the values of an ONNX tensor in row-major order, whatever
+// their element type in the model.
+type Tensor struct {
+	Dims []int
+	Data []float64
+}
+
+type OnnxAttribute struct {
+	Name string
+	F    float64
+	I    int64
+}
+
+type OnnxNode struct {
+	OpType     string
+	Inputs     []string
+	Outputs    []string
+	Attributes map[string]*OnnxAttribute
+}
+
+// OnnxModel is the graph of a model, its nodes being in topological
+// order as the format requires.
+type OnnxModel struct {
+	Nodes        []*OnnxNode
+	Initializers map[string]*Tensor
+	Input        string
+	Output       string
+}
+
+var onnxOperators = map[string]bool{
+	"Add": true, "Sub": true, "Mul": true, "Div": true,
+	"MatMul": true, "Gemm": true,
+	"Relu": true, "Sigmoid": true, "Tanh": true, "Softmax": true,
+	"Identity": true, "Flatten": true, "Reshape": true,
+}
+
+// protobuf is a cursor over an encoded protobuf message.
+type protobuf struct {
+	data []byte
+}
+
+func (pb *protobuf) varint() (uint64, error) {
+	value, n := binary.Uvarint(pb.data)
+	if n <= 0 {
+		return 0, fmt.Errorf("truncated varint")
+	}
+	pb.data = pb.data[n:]
+	return value, nil
+}
+
+// next returns the number and wire type of the next field along with
+// its payload: the value of varints, the bytes of everything else.
+func (pb *protobuf) next() (int, int, uint64, []byte, error) {
+	key, err := pb.varint()
+	if err != nil {
+		return 0, 0, 0, nil, err
+	}
+	field, wire := int(key>>3), int(key&7)
+	switch wire {
+	case 0:
+		value, err := pb.varint()
+		return field, wire, value, nil, err
+	case 1, 5:
+		size := 8
+		if wire == 5 {
+			size = 4
+		}
+		if len(pb.data) < size {
+			return 0, 0, 0, nil, fmt.Errorf("truncated field")
+		}
+		payload := pb.data[:size]
+		pb.data = pb.data[size:]
+		return field, wire, 0, payload, nil
+	case 2:
+		size, err := pb.varint()
+		if err != nil {
+			return 0, 0, 0, nil, err
+		}
+		if uint64(len(pb.data)) < size {
+			return 0, 0, 0, nil, fmt.Errorf("truncated field")
+		}
+		payload := pb.data[:size]
+		pb.data = pb.data[size:]
+		return field, wire, 0, payload, nil
+	}
+	return 0, 0, 0, nil, fmt.Errorf("unsupported wire type %d", wire)
+}
+
+// protobuf_int64s decodes a repeated integer field, packed or not.
+func protobuf_int64s(wire int, value uint64, payload []byte) ([]int64, error) {
+	if wire == 0 {
+		return []int64{int64(value)}, nil
+	}
+	values := make([]int64, 0)
+	pb := &protobuf{data: payload}
+	for len(pb.data) != 0 {
+		value, err := pb.varint()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, int64(value))
+	}
+	return values, nil
+}
+
+func protobuf_floats(payload []byte) []float64 {
+	values := make([]float64, 0, len(payload)/4)
+	for i := 0; i+4 <= len(payload); i += 4 {
+		values = append(values, float64(math.Float32frombits(binary.LittleEndian.Uint32(payload[i:]))))
+	}
+	return values
+}
+
+func protobuf_doubles(payload []byte) []float64 {
+	values := make([]float64, 0, len(payload)/8)
+	for i := 0; i+8 <= len(payload); i += 8 {
+		values = append(values, math.Float64frombits(binary.LittleEndian.Uint64(payload[i:])))
+	}
+	return values
+}
+
+func onnx_tensor(data []byte) (string, *Tensor, error) {
+	name := ""
+	tensor := &Tensor{}
+	dataType := 0
+	var raw []byte
+	pb := &protobuf{data: data}
+	for len(pb.data) != 0 {
+		field, wire, value, payload, err := pb.next()
+		if err != nil {
+			return "", nil, err
+		}
+		switch field {
+		case 1:
+			dims, err := protobuf_int64s(wire, value, payload)
+			if err != nil {
+				return "", nil, err
+			}
+			for _, dim := range dims {
+				tensor.Dims = append(tensor.Dims, int(dim))
+			}
+		case 2:
+			dataType = int(value)
+		case 4:
+			tensor.Data = append(tensor.Data, protobuf_floats(payload)...)
+		case 7:
+			values, err := protobuf_int64s(wire, value, payload)
+			if err != nil {
+				return "", nil, err
+			}
+			for _, value := range values {
+				tensor.Data = append(tensor.Data, float64(value))
+			}
+		case 8:
+			name = string(payload)
+		case 9:
+			raw = payload
+		case 10:
+			tensor.Data = append(tensor.Data, protobuf_doubles(payload)...)
+		}
+	}
+
+	if raw != nil {
+		switch dataType {
+		case ONNX_FLOAT:
+			tensor.Data = protobuf_floats(raw)
+		case ONNX_DOUBLE:
+			tensor.Data = protobuf_doubles(raw)
+		case ONNX_INT64:
+			for i := 0; i+8 <= len(raw); i += 8 {
+				tensor.Data = append(tensor.Data, float64(int64(binary.LittleEndian.Uint64(raw[i:]))))
+			}
+		default:
+			return "", nil, fmt.Errorf("tensor %s: unsupported element type %d", name, dataType)
+		}
+	}
+	if len(tensor.Data) != tensor_size(tensor.Dims) {
+		return "", nil, fmt.Errorf("tensor %s: %d values for shape %v", name, len(tensor.Data), tensor.Dims)
+	}
+	return name, tensor, nil
+}
+
+func onnx_attribute(data []byte) (*OnnxAttribute, error) {
+	attribute := &OnnxAttribute{}
+	pb := &protobuf{data: data}
+	for len(pb.data) != 0 {
+		field, _, value, payload, err := pb.next()
+		if err != nil {
+			return nil, err
+		}
+		switch field {
+		case 1:
+			attribute.Name = string(payload)
+		case 2:
+			if len(payload) == 4 {
+				attribute.F = float64(math.Float32frombits(binary.LittleEndian.Uint32(payload)))
+			}
+		case 3:
+			attribute.I = int64(value)
+		}
+	}
+	return attribute, nil
+}
+
+func onnx_node(data []byte) (*OnnxNode, error) {
+	node := &OnnxNode{Attributes: make(map[string]*OnnxAttribute)}
+	pb := &protobuf{data: data}
+	for len(pb.data) != 0 {
+		field, _, _, payload, err := pb.next()
+		if err != nil {
+			return nil, err
+		}
+		switch field {
+		case 1:
+			node.Inputs = append(node.Inputs, string(payload))
+		case 2:
+			node.Outputs = append(node.Outputs, string(payload))
+		case 4:
+			node.OpType = string(payload)
+		case 5:
+			attribute, err := onnx_attribute(payload)
+			if err != nil {
+				return nil, err
+			}
+			node.Attributes[attribute.Name] = attribute
+		case 7:
+			if domain := string(payload); domain != "" && domain != "ai.onnx" {
+				return nil, fmt.Errorf("unsupported operator domain: %s", domain)
+			}
+		}
+	}
+	if !onnxOperators[node.OpType] {
+		return nil, fmt.Errorf("unsupported operator: %s", node.OpType)
+	}
+	return node, nil
+}
+
+// onnx_value_name returns the name of a ValueInfoProto.
+func onnx_value_name(data []byte) (string, error) {
+	pb := &protobuf{data: data}
+	for len(pb.data) != 0 {
+		field, _, _, payload, err := pb.next()
+		if err != nil {
+			return "", err
+		}
+		if field == 1 {
+			return string(payload), nil
+		}
+	}
+	return "", fmt.Errorf("unnamed value")
+}
+
+func onnx_graph(data []byte) (*OnnxModel, error) {
+	model := &OnnxModel{Initializers: make(map[string]*Tensor)}
+	inputs := make([]string, 0)
+	pb := &protobuf{data: data}
+	for len(pb.data) != 0 {
+		field, _, _, payload, err := pb.next()
+		if err != nil {
+			return nil, err
+		}
+		switch field {
+		case 1:
+			node, err := onnx_node(payload)
+			if err != nil {
+				return nil, err
+			}
+			model.Nodes = append(model.Nodes, node)
+		case 5:
+			name, tensor, err := onnx_tensor(payload)
+			if err != nil {
+				return nil, err
+			}
+			model.Initializers[name] = tensor
+		case 11:
+			name, err := onnx_value_name(payload)
+			if err != nil {
+				return nil, err
+			}
+			inputs = append(inputs, name)
+		case 12:
+			if model.Output != "" {
+				continue
+			}
+			if model.Output, err = onnx_value_name(payload); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// older exporters list initializers among the inputs
+	for _, name := range inputs {
+		if _, exists := model.Initializers[name]; !exists {
+			if model.Input != "" {
+				return nil, fmt.Errorf("models must have a single input")
+			}
+			model.Input = name
+		}
+	}
+	if model.Input == "" || model.Output == "" {
+		return nil, fmt.Errorf("model has no input or output")
+	}
+	return model, nil
+}
+
+// onnx_load reads an ONNX model file.
+func onnx_load(pathname string) (*OnnxModel, error) {
+	data, err := os.ReadFile(pathname)
+	if err != nil {
+		return nil, err
+	}
+	pb := &protobuf{data: data}
+	for len(pb.data) != 0 {
+		field, _, _, payload, err := pb.next()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", pathname, err)
+		}
+		if field == 7 {
+			model, err := onnx_graph(payload)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", pathname, err)
+			}
+			return model, nil
+		}
+	}
+	return nil, fmt.Errorf("%s: no graph in model", pathname)
+}
+
+func tensor_size(dims []int) int {
+	size := 1
+	for _, dim := range dims {
+		size *= dim
+	}
+	return size
+}
+
+// tensor_broadcast applies op elementwise with numpy broadcasting.
+func tensor_broadcast(a *Tensor, b *Tensor, op func(float64, float64) float64) (*Tensor, error) {
+	rank := max(len(a.Dims), len(b.Dims))
+	pad := func(dims []int) []int {
+		padded := make([]int, rank)
+		for i := range padded {
+			padded[i] = 1
+		}
+		copy(padded[rank-len(dims):], dims)
+		return padded
+	}
+	adims, bdims := pad(a.Dims), pad(b.Dims)
+	dims := make([]int, rank)
+	for i := range dims {
+		switch {
+		case adims[i] == bdims[i], bdims[i] == 1:
+			dims[i] = adims[i]
+		case adims[i] == 1:
+			dims[i] = bdims[i]
+		default:
+			return nil, fmt.Errorf("shapes %v and %v do not broadcast", a.Dims, b.Dims)
+		}
+	}
+
+	result := &Tensor{Dims: dims, Data: make([]float64, tensor_size(dims))}
+	index := make([]int, rank)
+	for n := range result.Data {
+		ai, bi := 0, 0
+		for i := 0; i < rank; i++ {
+			ai = ai*adims[i] + index[i]%adims[i]
+			bi = bi*bdims[i] + index[i]%bdims[i]
+		}
+		result.Data[n] = op(a.Data[ai], b.Data[bi])
+		for i := rank - 1; i >= 0; i-- {
+			if index[i]++; index[i] < dims[i] {
+				break
+			}
+			index[i] = 0
+		}
+	}
+	return result, nil
+}
+
+// tensor_matmul multiplies two matrices, optionally transposed.
+func tensor_matmul(a *Tensor, b *Tensor, transA bool, transB bool) (*Tensor, error) {
+	if len(a.Dims) == 1 {
+		a = &Tensor{Dims: []int{1, a.Dims[0]}, Data: a.Data}
+	}
+	if len(a.Dims) != 2 || len(b.Dims) != 2 {
+		return nil, fmt.Errorf("only matrices can be multiplied")
+	}
+	m, k := a.Dims[0], a.Dims[1]
+	if transA {
+		m, k = k, m
+	}
+	kb, n := b.Dims[0], b.Dims[1]
+	if transB {
+		kb, n = n, kb
+	}
+	if k != kb {
+		return nil, fmt.Errorf("shapes %v and %v do not multiply", a.Dims, b.Dims)
+	}
+
+	at := func(i, j int) float64 {
+		if transA {
+			return a.Data[j*a.Dims[1]+i]
+		}
+		return a.Data[i*a.Dims[1]+j]
+	}
+	bt := func(i, j int) float64 {
+		if transB {
+			return b.Data[j*b.Dims[1]+i]
+		}
+		return b.Data[i*b.Dims[1]+j]
+	}
+	result := &Tensor{Dims: []int{m, n}, Data: make([]float64, m*n)}
+	for i := 0; i < m; i++ {
+		for l := 0; l < k; l++ {
+			// bag-of-words inputs are mostly zeroes
+			if x := at(i, l); x != 0 {
+				for j := 0; j < n; j++ {
+					result.Data[i*n+j] += x * bt(l, j)
+				}
+			}
+		}
+	}
+	return result, nil
+}
+
+func tensor_map(a *Tensor, fn func(float64) float64) *Tensor {
+	result := &Tensor{Dims: a.Dims, Data: make([]float64, len(a.Data))}
+	for i, value := range a.Data {
+		result.Data[i] = fn(value)
+	}
+	return result
+}
+
+// tensor_softmax normalizes the last axis, the only one models score on.
+func tensor_softmax(a *Tensor) *Tensor {
+	result := &Tensor{Dims: a.Dims, Data: make([]float64, len(a.Data))}
+	width := 1
+	if len(a.Dims) != 0 {
+		width = a.Dims[len(a.Dims)-1]
+	}
+	for start := 0; start+width <= len(a.Data); start += width {
+		row := a.Data[start : start+width]
+		highest := math.Inf(-1)
+		for _, value := range row {
+			highest = math.Max(highest, value)
+		}
+		total := 0.0
+		for i, value := range row {
+			result.Data[start+i] = math.Exp(value - highest)
+			total += result.Data[start+i]
+		}
+		for i := range row {
+			result.Data[start+i] /= total
+		}
+	}
+	return result
+}
+
+func (node *OnnxNode) attribute_int(name string, value int64) int64 {
+	if attribute, exists := node.Attributes[name]; exists {
+		return attribute.I
+	}
+	return value
+}
+
+func (node *OnnxNode) attribute_float(name string, value float64) float64 {
+	if attribute, exists := node.Attributes[name]; exists {
+		return attribute.F
+	}
+	return value
+}
+
+func (node *OnnxNode) eval(inputs []*Tensor) (*Tensor, error) {
+	arity := map[string]int{"Add": 2, "Sub": 2, "Mul": 2, "Div": 2, "MatMul": 2, "Gemm": 2, "Reshape": 2}[node.OpType]
+	if arity == 0 {
+		arity = 1
+	}
+	for i := 0; i < arity; i++ {
+		if i >= len(inputs) || inputs[i] == nil {
+			return nil, fmt.Errorf("%s: missing input", node.OpType)
+		}
+	}
+
+	switch node.OpType {
+	case "Add":
+		return tensor_broadcast(inputs[0], inputs[1], func(a, b float64) float64 { return a + b })
+	case "Sub":
+		return tensor_broadcast(inputs[0], inputs[1], func(a, b float64) float64 { return a - b })
+	case "Mul":
+		return tensor_broadcast(inputs[0], inputs[1], func(a, b float64) float64 { return a * b })
+	case "Div":
+		return tensor_broadcast(inputs[0], inputs[1], func(a, b float64) float64 { return a / b })
+	case "MatMul":
+		return tensor_matmul(inputs[0], inputs[1], false, false)
+	case "Gemm":
+		product, err := tensor_matmul(inputs[0], inputs[1], node.attribute_int("transA", 0) != 0, node.attribute_int("transB", 0) != 0)
+		if err != nil {
+			return nil, err
+		}
+		alpha, beta := node.attribute_float("alpha", 1), node.attribute_float("beta", 1)
+		product = tensor_map(product, func(x float64) float64 { return alpha * x })
+		if len(inputs) < 3 || inputs[2] == nil {
+			return product, nil
+		}
+		return tensor_broadcast(product, inputs[2], func(a, c float64) float64 { return a + beta*c })
+	case "Relu":
+		return tensor_map(inputs[0], func(x float64) float64 { return math.Max(x, 0) }), nil
+	case "Sigmoid":
+		return tensor_map(inputs[0], func(x float64) float64 { return 1 / (1 + math.Exp(-x)) }), nil
+	case "Tanh":
+		return tensor_map(inputs[0], math.Tanh), nil
+	case "Softmax":
+		return tensor_softmax(inputs[0]), nil
+	case "Identity":
+		return inputs[0], nil
+	case "Flatten":
+		axis := int(node.attribute_int("axis", 1))
+		if axis < 0 {
+			axis += len(inputs[0].Dims)
+		}
+		if axis < 0 || axis > len(inputs[0].Dims) {
+			return nil, fmt.Errorf("Flatten: invalid axis %d", axis)
+		}
+		outer := tensor_size(inputs[0].Dims[:axis])
+		return &Tensor{Dims: []int{outer, len(inputs[0].Data) / max(outer, 1)}, Data: inputs[0].Data}, nil
+	case "Reshape":
+		dims := make([]int, len(inputs[1].Data))
+		inferred, known := -1, 1
+		for i, value := range inputs[1].Data {
+			dims[i] = int(value)
+			switch {
+			case dims[i] == 0 && i < len(inputs[0].Dims):
+				dims[i] = inputs[0].Dims[i]
+			case dims[i] == -1:
+				inferred = i
+				continue
+			}
+			known *= dims[i]
+		}
+		if inferred != -1 && known != 0 {
+			dims[inferred] = len(inputs[0].Data) / known
+		}
+		if tensor_size(dims) != len(inputs[0].Data) {
+			return nil, fmt.Errorf("Reshape: cannot reshape %v to %v", inputs[0].Dims, dims)
+		}
+		return &Tensor{Dims: dims, Data: inputs[0].Data}, nil
+	}
+	return nil, fmt.Errorf("unsupported operator: %s", node.OpType)
+}
+
+// run evaluates the model on an input tensor and returns its output.
+func (model *OnnxModel) run(input *Tensor) (*Tensor, error) {
+	values := make(map[string]*Tensor, len(model.Initializers)+len(model.Nodes)+1)
+	for name, tensor := range model.Initializers {
+		values[name] = tensor
+	}
+	values[model.Input] = input
+
+	for _, node := range model.Nodes {
+		inputs := make([]*Tensor, len(node.Inputs))
+		for i, name := range node.Inputs {
+			// optional inputs are left out with an empty name
+			if name == "" {
+				continue
+			}
+			tensor, exists := values[name]
+			if !exists {
+				return nil, fmt.Errorf("%s: unknown input %s", node.OpType, name)
+			}
+			inputs[i] = tensor
+		}
+		output, err := node.eval(inputs)
+		if err != nil {
+			return nil, err
+		}
+		if len(node.Outputs) != 0 {
+			values[node.Outputs[0]] = output
+		}
+	}
+
+	output, exists := values[model.Output]
+	if !exists {
+		return nil, fmt.Errorf("output %s is never computed", model.Output)
+	}
+	return output, nil
+}
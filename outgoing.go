@@ -0,0 +1,148 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+var learnOutgoingFlags = flag.NewFlagSet("learn-outgoing", flag.ExitOnError)
+var learnOutgoingSendmail = learnOutgoingFlags.String("sendmail", "", "pass the message on to this program, the arguments being its own")
+
+// learn_outgoing_main implements "mail.pmda learn-outgoing", which makes
+// known correspondents of the recipients of a message as it is sent. It
+// reads the messages given, for Sent folder watchers, or stdin. It can
+// also stand in for sendmail in the MUA, passing the message on:
+//
+//	set sendmail="mail.pmda learn-outgoing -sendmail /usr/sbin/sendmail -- -oi -t"
+//
+// Learning is best effort then, the exit status being that of sendmail.
+func learn_outgoing_main(args []string) int {
+	learnOutgoingFlags.Parse(args)
+
+	homedir := os.Getenv("HOME")
+	cfg, err := config_read(filepath.Join(homedir, ".pmda.conf"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading configuration: %s\n", err)
+		if *learnOutgoingSendmail == "" {
+			return 1
+		}
+		cfg = config_default()
+	}
+
+	if *learnOutgoingSendmail != "" {
+		return learn_outgoing_sendmail(cfg, homedir, learnOutgoingFlags.Args())
+	}
+
+	store, err := state_open(cfg, homedir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error opening state: %s\n", err)
+		return 1
+	}
+	defer store.Close()
+
+	if learnOutgoingFlags.NArg() == 0 {
+		hdr, err := header_read(os.Stdin)
+		if err == nil {
+			err = correspondents_learn_header(store, hdr)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error learning from stdin: %s\n", err)
+			return 1
+		}
+		return 0
+	}
+
+	status := 0
+	for _, pathname := range learnOutgoingFlags.Args() {
+		file, err := os.Open(pathname)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading %s: %s\n", pathname, err)
+			status = 1
+			continue
+		}
+		hdr, err := header_read(file)
+		file.Close()
+		if err == nil {
+			err = correspondents_learn_header(store, hdr)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error learning from %s: %s\n", pathname, err)
+			status = 1
+		}
+	}
+	return status
+}
+
+// learn_outgoing_sendmail streams stdin to sendmail, learning from the
+// header on the way and from the recipients given as arguments.
+func learn_outgoing_sendmail(cfg *Config, homedir string, args []string) int {
+	cmd := exec.Command(*learnOutgoingSendmail, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	pipe, err := cmd.StdinPipe()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error running %s: %s\n", *learnOutgoingSendmail, err)
+		return EX_TEMPFAIL
+	}
+	if err := cmd.Start(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error running %s: %s\n", *learnOutgoingSendmail, err)
+		return EX_TEMPFAIL
+	}
+
+	// whatever the header parser reads ahead is passed on too
+	hdr, hdrErr := header_read(io.TeeReader(os.Stdin, pipe))
+	_, copyErr := io.Copy(pipe, os.Stdin)
+	pipe.Close()
+	err = cmd.Wait()
+	if copyErr != nil {
+		fmt.Fprintf(os.Stderr, "Error passing the message on: %s\n", copyErr)
+	}
+
+	if hdrErr == nil {
+		if store, err := state_open(cfg, homedir); err != nil {
+			fmt.Fprintf(os.Stderr, "Error opening state: %s\n", err)
+		} else {
+			if err := correspondents_learn_header(store, hdr); err != nil {
+				fmt.Fprintf(os.Stderr, "Error learning correspondents: %s\n", err)
+			}
+			for _, arg := range args {
+				if !strings.HasPrefix(arg, "-") && strings.Contains(arg, "@") {
+					store.Set(CORRESPONDENTS_NS, correspondent_address(arg), "1", 0)
+				}
+			}
+			store.Close()
+		}
+	}
+
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return exitErr.ExitCode()
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "Error running %s: %s\n", *learnOutgoingSendmail, err)
+		return EX_TEMPFAIL
+	}
+	if copyErr != nil {
+		return EX_TEMPFAIL
+	}
+	return 0
+}
@@ -0,0 +1,68 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"time"
+)
+
+// folder_count counts the messages of a folder, giving up past limit so
+// that a huge folder is never listed in full.
+func folder_count(folder string, limit int) int {
+	count := 0
+	for _, subdir := range []string{"new", "cur"} {
+		maildir_walk(filepath.Join(folder, subdir), func(pathname string, entry fs.DirEntry) error {
+			count++
+			if count > limit {
+				return errWalkStop
+			}
+			return nil
+		})
+	}
+	return count
+}
+
+// folder_overflow returns the folder to deliver to once the one chosen
+// holds more messages than allowed: a dated subfolder of it, suffixed
+// with a counter should a single day overflow as well.
+//
+//	.Junk -> .Junk.Overflow.2024-03-01 -> .Junk.Overflow.2024-03-01-2
+func folder_overflow(cfg *Config, maildir string, folder string, now time.Time) string {
+	if folder_count(filepath.Join(maildir, folder), cfg.Overflow) < cfg.Overflow {
+		return folder
+	}
+
+	base := folder + ".Overflow." + now.In(cfg.Timezone).Format("2006-01-02")
+	candidate := base
+	for i := 2; folder_count(filepath.Join(maildir, candidate), cfg.Overflow) >= cfg.Overflow; i++ {
+		candidate = fmt.Sprintf("%s-%d", base, i)
+	}
+	if candidate == base {
+		log_info("folder %s holds %d messages or more, delivering to %s", folder_name(folder), cfg.Overflow, candidate)
+	}
+	return candidate
+}
+
+// folder_name is the name of a folder for humans, the inbox has none.
+func folder_name(folder string) string {
+	if folder == "" {
+		return "INBOX"
+	}
+	return folder
+}
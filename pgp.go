@@ -0,0 +1,135 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"path/filepath"
+	"strings"
+)
+
+// inline signatures are only looked for in the first text parts
+const PGP_INLINE_MAX = 1024 * 1024
+
+const PGP_CLEARSIGN = "-----BEGIN PGP SIGNED MESSAGE-----"
+
+// PGPConfig enables the verification of OpenPGP signatures, PGP/MIME or
+// inline, against the keyring of the user:
+//
+//	pgp keyring ".gnupg"
+//
+// The status of every message, valid, invalid or none, is available to
+// the pgp condition of rules, and pgp-signer holds when the author of a
+// message has a key in the keyring, so that unsigned mail claiming to be
+// from someone who signs can be singled out:
+//
+//	match pgp none pgp-signer folder ".Review"
+//
+// Signed messages get an X-PMDA-PGP header. Of an inline signature, only
+// the signed block is vouched for.
+type PGPConfig struct {
+	Keyring string
+}
+
+var errPGPFound = errors.New("signature found")
+
+func pgp_default() *PGPConfig {
+	return &PGPConfig{Keyring: ".gnupg"}
+}
+
+func pgp_parse(args []string) (*PGPConfig, error) {
+	pgp := pgp_default()
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == "keyring" && i+1 < len(args):
+			pgp.Keyring = args[i+1]
+			i++
+		default:
+			return nil, fmt.Errorf("usage: pgp [keyring path]")
+		}
+	}
+	return pgp, nil
+}
+
+func pgp_keyring(cfg *Config, homedir string) string {
+	if filepath.IsAbs(cfg.PGP.Keyring) {
+		return cfg.PGP.Keyring
+	}
+	return filepath.Join(homedir, cfg.PGP.Keyring)
+}
+
+// pgp_check verifies the signature of a stored message, that of a
+// multipart/signed or the first inline signature of its text parts, and
+// returns its status along with the signer or what is wrong with it. A
+// valid signature must be made by a key of the author.
+func pgp_check(cfg *Config, env *Envelope, hdr *Header, pathname string) (string, string) {
+	keyring := pgp_keyring(cfg, env.Home)
+	var addresses []string
+	var err error
+
+	mediaType, params, _ := mime.ParseMediaType(hdr.Get("Content-Type"))
+	if mediaType == "multipart/signed" && strings.EqualFold(params["protocol"], "application/pgp-signature") {
+		body, err := mime_read_body(pathname)
+		if err != nil {
+			return "invalid", err.Error()
+		}
+		content, partHeader, signature, err := mime_signed_parts(body, params["boundary"])
+		if err != nil {
+			return "invalid", err.Error()
+		}
+		if partType, _, _ := mime.ParseMediaType(partHeader.Get("Content-Type")); partType != "application/pgp-signature" {
+			return "invalid", "no signature part"
+		}
+		if addresses, err = pgp_verify(keyring, content, signature); err != nil {
+			return "invalid", err.Error()
+		}
+	} else {
+		var signed []byte
+		walkErr := mime_walk_file(pathname, func(part *MimePart) error {
+			if part.MediaType != "text/plain" {
+				return nil
+			}
+			text, err := io.ReadAll(io.LimitReader(part.Body, PGP_INLINE_MAX))
+			if err != nil || !strings.Contains(string(text), PGP_CLEARSIGN) {
+				return nil
+			}
+			signed = text
+			return errPGPFound
+		})
+		if walkErr != nil && walkErr != errPGPFound {
+			log_info("error looking for signature: %s", walkErr)
+		}
+		if signed == nil {
+			return "none", ""
+		}
+		if addresses, err = pgp_verify(keyring, signed, nil); err != nil {
+			return "invalid", err.Error()
+		}
+	}
+
+	for _, author := range hdr.Addresses("From") {
+		for _, address := range addresses {
+			if address == author {
+				return "valid", author
+			}
+		}
+	}
+	return "invalid", "signer is not the author"
+}
@@ -0,0 +1,147 @@
+//go:build !nopgp && !tiny
+
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const PGP_TIMEOUT = 10 * time.Second
+
+func init() {
+	feature_register("pgp")
+}
+
+// pgp_gpg runs gpg over the keyring, the status lines are returned and
+// data, if any, is made available to gpg as file descriptor 3.
+func pgp_gpg(keyring string, stdin []byte, data []byte, args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), PGP_TIMEOUT)
+	defer cancel()
+	defer usage_exec(time.Now())
+
+	args = append([]string{"--homedir", keyring, "--batch", "--no-tty", "--no-auto-key-retrieve", "--status-fd", "1"}, args...)
+	cmd := exec.CommandContext(ctx, "gpg", args...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if data != nil {
+		reader, writer, err := os.Pipe()
+		if err != nil {
+			return "", err
+		}
+		defer reader.Close()
+		cmd.ExtraFiles = []*os.File{reader}
+		go func() {
+			writer.Write(data)
+			writer.Close()
+		}()
+	}
+	err := cmd.Run()
+	if err != nil && stdout.Len() == 0 {
+		return "", fmt.Errorf("gpg: %s: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
+
+// pgp_verify checks a detached signature over content, or the cleartext
+// signature content holds when signature is nil, and returns the
+// addresses of the key that made it.
+func pgp_verify(keyring string, content []byte, signature []byte) ([]string, error) {
+	var status string
+	var err error
+	if signature != nil {
+		status, err = pgp_gpg(keyring, content, signature, "--enable-special-filenames", "--verify", "--", "-&3", "-")
+	} else {
+		status, err = pgp_gpg(keyring, content, nil, "--verify", "-")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	fingerprint := ""
+	good := false
+	var problem error
+	for _, line := range strings.Split(status, "\n") {
+		fields := strings.Fields(strings.TrimPrefix(line, "[GNUPG:] "))
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "GOODSIG":
+			good = true
+		case "VALIDSIG":
+			// the primary key comes last, subkeys sign
+			fingerprint = fields[len(fields)-1]
+		case "BADSIG":
+			problem = fmt.Errorf("bad signature")
+		case "EXPSIG":
+			problem = fmt.Errorf("expired signature")
+		case "EXPKEYSIG":
+			problem = fmt.Errorf("signed with an expired key")
+		case "REVKEYSIG":
+			problem = fmt.Errorf("signed with a revoked key")
+		case "NO_PUBKEY":
+			problem = fmt.Errorf("no public key %s", fields[len(fields)-1])
+		case "ERRSIG":
+			if problem == nil {
+				problem = fmt.Errorf("signature could not be checked")
+			}
+		}
+	}
+	if problem != nil {
+		return nil, problem
+	}
+	if !good || fingerprint == "" {
+		return nil, fmt.Errorf("no valid signature")
+	}
+	return pgp_addresses(keyring, fingerprint)
+}
+
+// pgp_addresses returns the addresses of the user IDs of a key that are
+// not revoked.
+func pgp_addresses(keyring string, query string) ([]string, error) {
+	listing, err := pgp_gpg(keyring, nil, nil, "--with-colons", "--list-keys", query)
+	if err != nil {
+		return nil, err
+	}
+	addresses := make([]string, 0)
+	for _, line := range strings.Split(listing, "\n") {
+		fields := strings.Split(line, ":")
+		if len(fields) < 10 || fields[0] != "uid" || fields[1] == "r" {
+			continue
+		}
+		userId := strings.ReplaceAll(fields[9], `\x3a`, ":")
+		for _, address := range addressRegexp.FindAllString(userId, -1) {
+			addresses = append(addresses, strings.ToLower(address))
+		}
+	}
+	return addresses, nil
+}
+
+// pgp_signer reports whether the author has a key in the keyring.
+func pgp_signer(keyring string, author string) bool {
+	addresses, err := pgp_addresses(keyring, "<"+author+">")
+	return err == nil && len(addresses) != 0
+}
@@ -0,0 +1,102 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"net/mail"
+	"strings"
+)
+
+// The phishing score is the share of the tell-tale signs of phishing a
+// message shows, from 0 to 1, for rules to act upon:
+//
+//	match sender-mismatch ! known-correspondent folder ".Review"
+//	match score phishing >= 0.6 folder ".Junk"
+//
+// The signs are an envelope sender unrelated to the author, a Reply-To
+// taking answers elsewhere and an address in the display name of the
+// author that is not theirs.
+var phishingSigns = []func(msg *Message) bool{
+	func(msg *Message) bool { return msg.SenderMismatch },
+	phishing_reply_to,
+	phishing_display_name,
+}
+
+func address_domain(address string) string {
+	_, domain, _ := strings.Cut(address, "@")
+	return strings.TrimSuffix(strings.ToLower(domain), ".")
+}
+
+// domains_related reports whether two domains belong to the same party,
+// one being a subdomain of the other or both sharing their last two
+// labels, as bounce and tracking subdomains of a sender do.
+func domains_related(a string, b string) bool {
+	if a == b || strings.HasSuffix(a, "."+b) || strings.HasSuffix(b, "."+a) {
+		return true
+	}
+	base := func(domain string) string {
+		labels := strings.Split(domain, ".")
+		if len(labels) < 2 {
+			return domain
+		}
+		return strings.Join(labels[len(labels)-2:], ".")
+	}
+	return base(a) == base(b)
+}
+
+// sender_mismatch reports whether the envelope sender and the author of
+// a message are in unrelated domains. Bounces, without a sender, and
+// messages without an author do not count.
+func sender_mismatch(env *Envelope, hdr *Header) bool {
+	authors := hdr.Addresses("From")
+	if env.Sender == "" || len(authors) == 0 {
+		return false
+	}
+	sender, author := address_domain(correspondent_address(env.Sender)), address_domain(authors[0])
+	return sender != "" && author != "" && !domains_related(sender, author)
+}
+
+func phishing_reply_to(msg *Message) bool {
+	authors, replies := msg.Header.Addresses("From"), msg.Header.Addresses("Reply-To")
+	if len(authors) == 0 || len(replies) == 0 {
+		return false
+	}
+	return !domains_related(address_domain(authors[0]), address_domain(replies[0]))
+}
+
+func phishing_display_name(msg *Message) bool {
+	author, err := mail.ParseAddress(msg.Header.Get("From"))
+	if err != nil {
+		return false
+	}
+	for _, address := range addressRegexp.FindAllString(author.Name, -1) {
+		if !strings.EqualFold(address, author.Address) {
+			return true
+		}
+	}
+	return false
+}
+
+func phishing_score(msg *Message) float64 {
+	signs := 0
+	for _, sign := range phishingSigns {
+		if sign(msg) {
+			signs++
+		}
+	}
+	return float64(signs) / float64(len(phishingSigns))
+}
@@ -0,0 +1,180 @@
+//go:build !nopostgresql && !tiny
+
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const POSTGRES_TIMEOUT = 60 * time.Second
+
+// PostgresConfig describes the PostgreSQL archival backend. The table is
+// expected to look like:
+//
+//	CREATE TABLE messages (
+//		id             bigserial PRIMARY KEY,
+//		delivered_at   timestamptz NOT NULL DEFAULT now(),
+//		envelope_from  text,
+//		envelope_to    text,
+//		message_id     text,
+//		header_from    text,
+//		header_subject text,
+//		header_date    text,
+//		folder         text,
+//		filename       text,
+//		size           bigint,
+//		raw            oid
+//	);
+//
+// The message is stored as a large object, which psql streams from the
+// file whatever its size, the raw column referencing it. Rows deleted
+// leave their large object behind unless a lo_manage trigger or a
+// periodic vacuumlo removes it.
+type PostgresConfig struct {
+	Conninfo  string
+	Table     string
+	Exclusive bool
+}
+
+// PostgresTx is a transaction held open in a psql process, so that the
+// insert only commits once the maildir copy is in place.
+type PostgresTx struct {
+	cancel context.CancelFunc
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+	stderr bytes.Buffer
+}
+
+func init() {
+	feature_register("postgresql")
+}
+
+func postgres_quote(value string) string {
+	value = strings.ReplaceAll(value, "\x00", "")
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+}
+
+// postgres_quote_meta quotes an argument of a psql meta-command, which
+// knows backslash escapes where SQL strings do not.
+func postgres_quote_meta(value string) string {
+	value = strings.ReplaceAll(value, "\\", "\\\\")
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+}
+
+// wait_marker reads psql output until the marker line shows up, which
+// means every statement sent before it succeeded.
+func (tx *PostgresTx) wait_marker(marker string) error {
+	for {
+		line, err := tx.stdout.ReadString('\n')
+		if strings.TrimSpace(line) == marker {
+			return nil
+		}
+		if err != nil {
+			tx.cmd.Wait()
+			tx.cancel()
+			return fmt.Errorf("psql: %s", strings.TrimSpace(tx.stderr.String()))
+		}
+	}
+}
+
+func postgres_begin(cfg *Config, env *Envelope, hdr *Header, folder string, filename string, pathname string) (*PostgresTx, error) {
+	defer usage_exec(time.Now())
+
+	if strings.ContainsAny(pathname, "\r\n") {
+		return nil, fmt.Errorf("%q: unsupported pathname", pathname)
+	}
+	st, err := os.Stat(pathname)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), POSTGRES_TIMEOUT)
+	tx := &PostgresTx{cancel: cancel}
+	tx.cmd = exec.CommandContext(ctx, "psql", "-X", "-q", "-v", "ON_ERROR_STOP=1", "-d", cfg.Postgres.Conninfo)
+	tx.cmd.Stderr = &tx.stderr
+	if tx.stdin, err = tx.cmd.StdinPipe(); err != nil {
+		cancel()
+		return nil, err
+	}
+	stdout, err := tx.cmd.StdoutPipe()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	tx.stdout = bufio.NewReader(stdout)
+	if err := tx.cmd.Start(); err != nil {
+		cancel()
+		return nil, err
+	}
+
+	if folder == "" {
+		folder = "INBOX"
+	}
+	// postgres_quote only holds with standard conforming strings, which
+	// the server configuration could turn off
+	fmt.Fprintf(tx.stdin, "SET standard_conforming_strings = on;\n")
+	fmt.Fprintf(tx.stdin, "BEGIN;\n")
+
+	// psql streams the message into a large object of the transaction,
+	// neither it nor the server hold it in memory. A read error stops
+	// psql, the missing marker reporting it.
+	fmt.Fprintf(tx.stdin, "\\lo_import %s\n", postgres_quote_meta(pathname))
+	fmt.Fprintf(tx.stdin, "INSERT INTO %s (envelope_from, envelope_to, message_id, header_from, header_subject, header_date, folder, filename, size, raw) ", cfg.Postgres.Table)
+	fmt.Fprintf(tx.stdin, "VALUES (%s, %s, %s, %s, %s, %s, %s, %s, %d, :LASTOID);\n",
+		postgres_quote(env.Sender), postgres_quote(env.Recipient),
+		postgres_quote(hdr.Get("Message-ID")), postgres_quote(hdr.Get("From")),
+		postgres_quote(hdr.Get("Subject")), postgres_quote(hdr.Get("Date")),
+		postgres_quote(folder), postgres_quote(filename), st.Size())
+	fmt.Fprintf(tx.stdin, "\\echo PMDA-INSERTED\n")
+
+	if err := tx.wait_marker("PMDA-INSERTED"); err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
+
+func (tx *PostgresTx) commit() error {
+	defer tx.cancel()
+	defer usage_exec(time.Now())
+
+	fmt.Fprintf(tx.stdin, "COMMIT;\n\\echo PMDA-COMMITTED\n")
+	tx.stdin.Close()
+	if err := tx.wait_marker("PMDA-COMMITTED"); err != nil {
+		return err
+	}
+	return tx.cmd.Wait()
+}
+
+func (tx *PostgresTx) rollback() {
+	defer tx.cancel()
+	defer usage_exec(time.Now())
+
+	fmt.Fprintf(tx.stdin, "ROLLBACK;\n")
+	tx.stdin.Close()
+	tx.cmd.Wait()
+}
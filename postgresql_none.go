@@ -0,0 +1,42 @@
+//go:build nopostgresql || tiny
+
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"fmt"
+)
+
+type PostgresConfig struct {
+	Conninfo  string
+	Table     string
+	Exclusive bool
+}
+
+type PostgresTx struct{}
+
+func postgres_begin(cfg *Config, env *Envelope, hdr *Header, folder string, filename string, pathname string) (*PostgresTx, error) {
+	return nil, fmt.Errorf("postgresql support not compiled in")
+}
+
+func (tx *PostgresTx) commit() error {
+	return nil
+}
+
+func (tx *PostgresTx) rollback() {
+}
@@ -0,0 +1,87 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var profileName = flag.String("profile", "", "use the configuration of this profile instead of ~/.pmda.conf")
+
+var profileRegexp = regexp.MustCompile(`^[a-z0-9_-]+$`)
+
+// A profile is a configuration of its own, ~/.pmda.NAME.conf, with its
+// own maildir and rules, for users who run several accounts into one
+// system account. It is selected with -profile or, failing that, by
+// the first profile with a recipient pattern matching RECIPIENT:
+//
+//	recipient "*@work.example.org"
+//	maildir "Maildir-work"
+func profile_path(homedir string, name string) string {
+	return filepath.Join(homedir, ".pmda."+name+".conf")
+}
+
+// profile_match reports whether a recipient is one of the profile.
+func profile_match(cfg *Config, recipient string) bool {
+	recipient = strings.ToLower(recipient)
+	for _, pattern := range cfg.Recipients {
+		if ok, _ := path.Match(pattern, recipient); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// profile_load returns the configuration of the MDA: that of the profile
+// asked for, of the profile the recipient belongs to, or the default.
+func profile_load(homedir string, env *Envelope) *Config {
+	if *profileName != "" {
+		if !profileRegexp.MatchString(*profileName) {
+			fmt.Fprintf(os.Stderr, "Error: invalid profile name: %s\n", *profileName)
+			os.Exit(EX_TEMPFAIL)
+		}
+		pathname := profile_path(homedir, *profileName)
+		if _, err := os.Stat(pathname); err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading profile %s: %s\n", *profileName, err)
+			os.Exit(EX_TEMPFAIL)
+		}
+		return config_load(pathname)
+	}
+
+	if env.Recipient != "" {
+		profiles, _ := filepath.Glob(profile_path(homedir, "*"))
+		sort.Strings(profiles)
+		for _, pathname := range profiles {
+			name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(pathname), ".pmda."), ".conf")
+			if !profileRegexp.MatchString(name) {
+				continue
+			}
+			if cfg := config_load(pathname); profile_match(cfg, env.Recipient) {
+				log_info("recipient %s selects profile %s", env.Recipient, name)
+				return cfg
+			}
+		}
+	}
+	return config_load(filepath.Join(homedir, ".pmda.conf"))
+}
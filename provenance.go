@@ -0,0 +1,72 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+var receivedAddressRegexp = regexp.MustCompile(`\[(?:IPv6:)?([0-9A-Fa-f:.]+)\]`)
+
+// Provenance records how and why a message was handled, for users who
+// may have to prove it later on.
+type Provenance struct {
+	Envelope              *Envelope `json:"envelope"`
+	Received              []string  `json:"received"`
+	RelayAddress          string    `json:"relay_address"`
+	AuthenticationResults []string  `json:"authentication_results"`
+	MessageId             string    `json:"message_id"`
+	Folder                string    `json:"folder"`
+	Verdict               string    `json:"verdict"`
+	RuleTrace             []string  `json:"rule_trace"`
+	Delivered             time.Time `json:"delivered"`
+}
+
+// provenance_relay returns the address of the host that relayed the
+// message to us, as recorded by our MTA in the topmost Received field.
+func provenance_relay(hdr *Header) string {
+	received := hdr.Values("Received")
+	if len(received) == 0 {
+		return ""
+	}
+	if match := receivedAddressRegexp.FindStringSubmatch(received[0]); match != nil {
+		return match[1]
+	}
+	return ""
+}
+
+// provenance_store writes the provenance bundle of a message as a JSON
+// sidecar, next to the delivery metadata.
+func provenance_store(maildir string, folder string, pathname string, provenance *Provenance) {
+	data, err := json.MarshalIndent(provenance, "", "  ")
+	if err != nil {
+		return
+	}
+
+	sidecar := filepath.Join(maildir, folder, "pmda-meta", maildir_unique(filepath.Base(pathname))+".meta.json")
+	if err := os.MkdirAll(filepath.Dir(sidecar), 0700); err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating %s: %s\n", filepath.Dir(sidecar), err)
+		return
+	}
+	if err := os.WriteFile(sidecar, append(data, '\n'), 0600); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing %s: %s\n", sidecar, err)
+	}
+}
@@ -0,0 +1,208 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+const PUBLISH_TIMEOUT = 10 * time.Second
+const PUBLISH_RETRIES = 3
+
+// PublishConfig describes a broker to publish delivery events to:
+//
+//	publish nats "nats://localhost:4222" subject "mail.{user}.{folder}" guarantee ack
+//	publish kafka "broker:9092" topic "mail" guarantee all raw
+type PublishConfig struct {
+	Kind      string
+	URL       string
+	Template  string
+	Guarantee string
+	Raw       bool
+}
+
+// DeliveryEvent describes a completed delivery.
+type DeliveryEvent struct {
+	Time      time.Time `json:"time"`
+	Sender    string    `json:"sender"`
+	Recipient string    `json:"recipient"`
+	MessageId string    `json:"message_id"`
+	From      string    `json:"from"`
+	Subject   string    `json:"subject"`
+	Folder    string    `json:"folder"`
+	Filename  string    `json:"filename"`
+	Size      int64     `json:"size"`
+}
+
+// EventPayload is the JSON encoding of an event, optionally carrying the
+// raw message base64-encoded in a "raw" field. The message is streamed
+// from disk each time the payload is read so it is never held in memory.
+type EventPayload struct {
+	json     []byte
+	pathname string
+	size     int64
+}
+
+func event_payload(event *DeliveryEvent, pathname string, withRaw bool) (*EventPayload, error) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+	payload := &EventPayload{json: data}
+	if withRaw {
+		st, err := os.Stat(pathname)
+		if err != nil {
+			return nil, err
+		}
+		payload.json = append(data[:len(data)-1], []byte(`,"raw":"`)...)
+		payload.pathname = pathname
+		payload.size = st.Size()
+	}
+	return payload, nil
+}
+
+func (payload *EventPayload) Len() int64 {
+	if payload.pathname == "" {
+		return int64(len(payload.json))
+	}
+	return int64(len(payload.json)) + int64(base64.StdEncoding.EncodedLen(int(payload.size))) + 2
+}
+
+func (payload *EventPayload) Reader() (io.ReadCloser, error) {
+	if payload.pathname == "" {
+		return io.NopCloser(bytes.NewReader(payload.json)), nil
+	}
+
+	file, err := os.Open(payload.pathname)
+	if err != nil {
+		return nil, err
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		encoder := base64.NewEncoder(base64.StdEncoding, pw)
+		_, err := io.Copy(encoder, io.LimitReader(file, payload.size))
+		if err == nil {
+			err = encoder.Close()
+		}
+		file.Close()
+		pw.CloseWithError(err)
+	}()
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(payload.json), pr, strings.NewReader(`"}`)), pr}, nil
+}
+
+func publish_parse(args []string) (*PublishConfig, error) {
+	if len(args) < 2 || (args[0] != "nats" && args[0] != "kafka") {
+		return nil, fmt.Errorf("usage: publish nats|kafka url [subject|topic template] [guarantee level] [raw]")
+	}
+	if !features[args[0]] {
+		return nil, fmt.Errorf("%s support not compiled in", args[0])
+	}
+
+	pub := &PublishConfig{Kind: args[0], URL: args[1], Template: "mail.{user}", Guarantee: "none"}
+	for i := 2; i < len(args); i++ {
+		switch {
+		case (args[i] == "subject" || args[i] == "topic") && i+1 < len(args):
+			pub.Template = args[i+1]
+			i++
+		case args[i] == "guarantee" && i+1 < len(args):
+			pub.Guarantee = args[i+1]
+			i++
+		case args[i] == "raw":
+			pub.Raw = true
+		default:
+			return nil, fmt.Errorf("unknown publish option: %s", args[i])
+		}
+	}
+
+	valid := map[string][]string{
+		"nats":  {"none", "ack", "jetstream"},
+		"kafka": {"none", "leader", "all"},
+	}
+	for _, level := range valid[pub.Kind] {
+		if level == pub.Guarantee {
+			return pub, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid %s guarantee: %s", pub.Kind, pub.Guarantee)
+}
+
+// publish_subject expands the {user}, {recipient}, {domain} and {folder}
+// placeholders of a subject or topic template, dots and spaces in values
+// would split NATS subject tokens so they are replaced.
+func publish_subject(template string, event *DeliveryEvent, env *Envelope) string {
+	folder := strings.TrimPrefix(event.Folder, ".")
+	if folder == "" {
+		folder = "INBOX"
+	}
+	domain := ""
+	if at := strings.LastIndex(env.Recipient, "@"); at != -1 {
+		domain = env.Recipient[at+1:]
+	}
+
+	sanitize := strings.NewReplacer(".", "_", " ", "_", "*", "_", ">", "_")
+	replacer := strings.NewReplacer(
+		"{user}", sanitize.Replace(env.User),
+		"{recipient}", sanitize.Replace(env.Recipient),
+		"{domain}", sanitize.Replace(domain),
+		"{folder}", sanitize.Replace(folder),
+	)
+	return replacer.Replace(template)
+}
+
+// publish_event sends the delivery event to every configured broker,
+// mail is already safely stored by then so failures are only logged.
+func publish_event(cfg *Config, env *Envelope, event *DeliveryEvent, pathname string) {
+	for _, pub := range cfg.Publishers {
+		payload, err := event_payload(event, pathname, pub.Raw)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error preparing event: %s\n", err)
+			continue
+		}
+
+		breaker := "publish:" + pub.URL
+		if !breaker_allow(cfg, env.Home, breaker) {
+			continue
+		}
+		subject := publish_subject(pub.Template, event, env)
+		for attempt := 1; attempt <= PUBLISH_RETRIES; attempt++ {
+			err = chaos_inject("publish", PUBLISH_TIMEOUT)
+			if err == nil && pub.Kind == "nats" {
+				err = publish_nats(pub, subject, payload)
+			} else if err == nil {
+				err = publish_kafka(pub, subject, payload)
+			}
+			if err == nil {
+				break
+			}
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+		breaker_result(cfg, env.Home, breaker, err)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error publishing to %s: %s\n", pub.URL, err)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+//go:build !nokafka && !tiny
+
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+func init() {
+	feature_register("kafka")
+}
+
+// publish_kafka hands the event over to kcat, the Kafka protocol is too
+// much of a beast to be reimplemented here.
+func publish_kafka(pub *PublishConfig, topic string, payload *EventPayload) error {
+	acks := map[string]string{"none": "0", "leader": "1", "all": "all"}[pub.Guarantee]
+
+	ctx, cancel := context.WithTimeout(context.Background(), PUBLISH_TIMEOUT)
+	defer cancel()
+
+	body, err := payload.Reader()
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "kcat", "-P", "-b", pub.URL, "-t", topic, "-X", "acks="+acks, "-c", "1")
+	cmd.Stdin = io.MultiReader(body, strings.NewReader("\n"))
+	cmd.Stderr = &stderr
+	defer usage_exec(time.Now())
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("kcat: %s: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+//go:build !nonats && !tiny
+
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+func init() {
+	feature_register("nats")
+}
+
+func publish_nats(pub *PublishConfig, subject string, payload *EventPayload) error {
+	u, err := url.Parse(pub.URL)
+	if err != nil {
+		return err
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "4222")
+	}
+
+	var conn net.Conn
+	dialer := &net.Dialer{Timeout: PUBLISH_TIMEOUT}
+	if u.Scheme == "tls" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", host, &tls.Config{ServerName: u.Hostname()})
+	} else {
+		conn, err = dialer.Dial("tcp", host)
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(PUBLISH_TIMEOUT))
+
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		return fmt.Errorf("unexpected greeting: %s", strings.TrimSpace(line))
+	}
+
+	connect := map[string]any{"verbose": false, "pedantic": false, "name": "mail.pmda", "lang": "go"}
+	if u.User != nil {
+		if password, ok := u.User.Password(); ok {
+			connect["user"] = u.User.Username()
+			connect["pass"] = password
+		} else {
+			connect["auth_token"] = u.User.Username()
+		}
+	}
+	connectJson, _ := json.Marshal(connect)
+	fmt.Fprintf(conn, "CONNECT %s\r\n", connectJson)
+
+	inbox := ""
+	if pub.Guarantee == "jetstream" {
+		nonce := make([]byte, 8)
+		rand.Read(nonce)
+		inbox = "_INBOX.pmda." + hex.EncodeToString(nonce)
+		fmt.Fprintf(conn, "SUB %s 1\r\n", inbox)
+		fmt.Fprintf(conn, "PUB %s %s %d\r\n", subject, inbox, payload.Len())
+	} else {
+		fmt.Fprintf(conn, "PUB %s %d\r\n", subject, payload.Len())
+	}
+	body, err := payload.Reader()
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	if _, err := io.Copy(conn, body); err != nil {
+		return err
+	}
+	fmt.Fprintf(conn, "\r\n")
+	if pub.Guarantee == "none" {
+		return nil
+	}
+
+	// a PONG means the server processed everything sent before the PING,
+	// a JetStream publish is only safe once the stream acked it.
+	fmt.Fprintf(conn, "PING\r\n")
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "-ERR"):
+			return fmt.Errorf("nats: %s", line)
+		case line == "PING":
+			fmt.Fprintf(conn, "PONG\r\n")
+		case line == "PONG" && pub.Guarantee == "ack":
+			return nil
+		case strings.HasPrefix(line, "MSG "):
+			var size int
+			fields := strings.Fields(line)
+			fmt.Sscanf(fields[len(fields)-1], "%d", &size)
+			body := make([]byte, size+2)
+			if _, err := io.ReadFull(reader, body); err != nil {
+				return err
+			}
+			var ack struct {
+				Error *struct {
+					Description string `json:"description"`
+				} `json:"error"`
+			}
+			if err := json.Unmarshal(body[:size], &ack); err != nil {
+				return err
+			}
+			if ack.Error != nil {
+				return fmt.Errorf("jetstream: %s", ack.Error.Description)
+			}
+			return nil
+		}
+	}
+}
@@ -0,0 +1,202 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Maildir++ readers recalculate a maildirsize file past this size
+const MAILDIRSIZE_MAX = 5120
+
+// QuotaConfig is the quota definition written to a new maildirsize:
+//
+//	quota 1g 100000
+type QuotaConfig struct {
+	Size  int64
+	Count int64
+}
+
+func (quota *QuotaConfig) definition() string {
+	definition := make([]string, 0, 2)
+	if quota.Size != 0 {
+		definition = append(definition, fmt.Sprintf("%dS", quota.Size))
+	}
+	if quota.Count != 0 {
+		definition = append(definition, fmt.Sprintf("%dC", quota.Count))
+	}
+	return strings.Join(definition, ",")
+}
+
+// The quota accounting of a maildir is kept in its Maildir++ maildirsize
+// file, so that IMAP servers enforcing quotas agree with what we did.
+// Every write path that adds or removes messages goes through quota_add,
+// moves between folders of a maildir leave the totals unchanged.
+//
+// A maildir without maildirsize is not accounted for, unless a quota is
+// configured in which case the file is created from a full count.
+func quota_add(cfg *Config, maildir string, bytes int64, count int64) {
+	pathname := filepath.Join(maildir, "maildirsize")
+	st, err := os.Stat(pathname)
+	if os.IsNotExist(err) {
+		if cfg.Quota == nil {
+			return
+		}
+		if err := quota_recalculate(maildir, cfg.Quota.definition()); err != nil {
+			log_error("Error creating %s: %s", pathname, err)
+		}
+		return
+	}
+	if err != nil {
+		log_error("Error accounting quota: %s", err)
+		return
+	}
+
+	if st.Size() > MAILDIRSIZE_MAX {
+		if definition, err := quota_definition(pathname); err == nil {
+			if err := quota_recalculate(maildir, definition); err != nil {
+				log_error("Error recalculating %s: %s", pathname, err)
+			}
+			return
+		}
+	}
+
+	// lines are short enough for O_APPEND writes not to interleave
+	file, err := os.OpenFile(pathname, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		log_error("Error accounting quota: %s", err)
+		return
+	}
+	defer file.Close()
+	if _, err := fmt.Fprintf(file, "%d %d\n", bytes, count); err != nil {
+		log_error("Error accounting quota: %s", err)
+	}
+}
+
+func quota_definition(pathname string) (string, error) {
+	file, err := os.Open(pathname)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	if !scanner.Scan() {
+		return "", fmt.Errorf("empty maildirsize")
+	}
+	return strings.TrimSpace(scanner.Text()), nil
+}
+
+// message_size returns the size of a message, from the S= attribute of
+// its filename when present as Maildir++ readers do.
+func message_size(pathname string) int64 {
+	for _, attribute := range strings.Split(maildir_unique(filepath.Base(pathname)), ",")[1:] {
+		if value, found := strings.CutPrefix(attribute, "S="); found {
+			if size, err := strconv.ParseInt(value, 10, 64); err == nil {
+				return size
+			}
+		}
+	}
+	if st, err := os.Stat(pathname); err == nil {
+		return st.Size()
+	}
+	return 0
+}
+
+// message_sizes returns the size of a stored message and its virtual
+// size, that of the message with LF line endings turned into CRLF as an
+// IMAP server would count it.
+func message_sizes(pathname string) (int64, int64, error) {
+	file, err := os.Open(pathname)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+
+	size, vsize := int64(0), int64(0)
+	buf := make([]byte, 64*1024)
+	cr := false
+	for {
+		n, err := file.Read(buf)
+		for _, c := range buf[:n] {
+			if c == '\n' && !cr {
+				vsize++
+			}
+			cr = c == '\r'
+		}
+		size += int64(n)
+		vsize += int64(n)
+		if err == io.EOF {
+			return size, vsize, nil
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+}
+
+// maildir_sized appends the S= and W= attributes Dovecot and Courier
+// read sizes from to a maildir filename, saving them a stat or a parse.
+func maildir_sized(filename string, pathname string) (string, error) {
+	size, vsize, err := message_sizes(pathname)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s,S=%d,W=%d", filename, size, vsize), nil
+}
+
+// folder_size totals the messages of a folder.
+func folder_size(folder string) (int64, int64) {
+	bytes, count := int64(0), int64(0)
+	for _, subdir := range []string{"new", "cur"} {
+		maildir_walk(filepath.Join(folder, subdir), func(pathname string, entry fs.DirEntry) error {
+			bytes += message_size(pathname)
+			count++
+			return nil
+		})
+	}
+	return bytes, count
+}
+
+// quota_recalculate rewrites maildirsize from a full count of the maildir.
+func quota_recalculate(maildir string, definition string) error {
+	folders, err := maildir_folders(maildir)
+	if err != nil {
+		return err
+	}
+	bytes, count := int64(0), int64(0)
+	for _, folder := range folders {
+		folderBytes, folderCount := folder_size(filepath.Join(maildir, folder))
+		bytes += folderBytes
+		count += folderCount
+	}
+
+	pathname := filepath.Join(maildir, "maildirsize")
+	tmpname := fmt.Sprintf("%s.%d", filepath.Join(maildir, "tmp", "maildirsize"), os.Getpid())
+	data := fmt.Sprintf("%s\n%d %d\n", definition, bytes, count)
+	if err := os.WriteFile(tmpname, []byte(data), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpname, pathname)
+}
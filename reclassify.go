@@ -0,0 +1,189 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var reclassifyFlags = flag.NewFlagSet("reclassify", flag.ExitOnError)
+var reclassifyFolder = reclassifyFlags.String("folder", "INBOX", "folder to reclassify")
+var reclassifySince = reclassifyFlags.String("since", "", "only reclassify messages delivered this recently, as in 7d")
+var reclassifyDryRun = reclassifyFlags.Bool("n", false, "only print where messages would move")
+
+// reclassify_message establishes the facts the rules need about a stored
+// message, as the delivery would have.
+func reclassify_message(cfg *Config, env *Envelope, maildir string, pathname string, hdr *Header) *Message {
+	msg := &Message{Header: hdr, Envelope: env, Encrypted: encrypted_detect(hdr)}
+	scan := cfg.ScanEncrypted || !msg.Encrypted
+	if cfg.Correspondents != nil && cfg.rules_use("known-correspondent") {
+		msg.KnownCorrespondent = correspondents_check(cfg, env, maildir, hdr)
+	}
+	if cfg.rules_use("is-reply-to-me") {
+		msg.ReplyToMe = correspondents_reply(cfg, env, maildir, hdr)
+	}
+	if cfg.rules_use("calendar") && scan {
+		msg.Calendar = calendar_detect(cfg, env, pathname)
+	}
+	if cfg.Classifier != nil && cfg.rules_use("classifier") && scan {
+		msg.Classifier = classifier_check(cfg, env, hdr, pathname)
+	}
+	if len(cfg.Models) != 0 && cfg.rules_use("score") && scan {
+		msg.Scores = models_score(cfg, env, pathname)
+	}
+	if cfg.rules_use("sender-is-freemail") {
+		msg.Freemail = sender_in_domains(env, hdr, "freemail")
+	}
+	if cfg.rules_use("sender-is-disposable") {
+		msg.Disposable = sender_in_domains(env, hdr, "disposable")
+	}
+	msg.SenderMismatch = sender_mismatch(env, hdr)
+	if msg.Scores == nil {
+		msg.Scores = make(map[string]float64)
+	}
+	msg.Scores["phishing"] = phishing_score(msg)
+	if cfg.Marketing != nil && scan {
+		msg.Scores["marketing"] = marketing_score(cfg, pathname, hdr)
+		msg.Marketing = msg.Scores["marketing"] >= cfg.Marketing.Threshold
+	}
+	return msg
+}
+
+// reclassify_move moves a message to a folder keeping its flags, keyword
+// letters being translated to those of the target folder.
+func reclassify_move(cfg *Config, maildir string, source string, pathname string, folder string) (string, error) {
+	maildir_folder(cfg, maildir, folder)
+	name := filepath.Base(pathname)
+	subdir := "new"
+	if unique, flags, found := strings.Cut(name, ":2,"); found {
+		translated, err := keywords_translate(flags, source, filepath.Join(maildir, folder))
+		if err != nil {
+			return "", err
+		}
+		subdir, name = "cur", unique+":2,"+translated
+	}
+	target, err := maildir_path(filepath.Join(maildir, folder, subdir), name, shard_depth(maildir))
+	if err != nil {
+		return "", err
+	}
+	if err := os.Rename(pathname, target); err != nil {
+		return "", err
+	}
+	return target, nil
+}
+
+// reclassify_main implements "mail.pmda reclassify", which runs the rules
+// as they are now over messages already delivered to a folder, moving
+// those that match elsewhere. Messages no rule matches stay where they
+// are, the built-in classification is not run again.
+func reclassify_main(args []string) int {
+	reclassifyFlags.Parse(args)
+	if reclassifyFlags.NArg() > 1 {
+		fmt.Fprintf(os.Stderr, "Usage: %s reclassify [-n] [-folder name] [-since duration] [maildir]\n", os.Args[0])
+		return 1
+	}
+
+	homedir := os.Getenv("HOME")
+	cfg, err := config_read(filepath.Join(homedir, ".pmda.conf"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading configuration: %s\n", err)
+		return 1
+	}
+	maildir := maildir_resolve(cfg, homedir)
+	if reclassifyFlags.NArg() == 1 {
+		maildir = reclassifyFlags.Arg(0)
+	}
+	folder := *reclassifyFolder
+	if folder == "INBOX" {
+		folder = ""
+	}
+	since := time.Time{}
+	if *reclassifySince != "" {
+		duration, err := config_duration(*reclassifySince)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			return 1
+		}
+		since = time.Now().Add(-duration)
+	}
+
+	env := &Envelope{Home: homedir, User: os.Getenv("USER")}
+	source := filepath.Join(maildir, folder)
+	moved, status := 0, 0
+	for _, subdir := range []string{"new", "cur"} {
+		err := maildir_walk(filepath.Join(source, subdir), func(pathname string, entry fs.DirEntry) error {
+			if message_delivered(pathname, entry).Before(since) {
+				return nil
+			}
+			file, err := os.Open(pathname)
+			if err != nil {
+				return nil
+			}
+			hdr, err := header_read(file)
+			file.Close()
+			if err != nil {
+				return nil
+			}
+
+			env.Sender = correspondent_address(strings.Trim(hdr.Get("Return-Path"), "<>"))
+			rule, _ := rules_evaluate(cfg.Rules, reclassify_message(cfg, env, maildir, pathname, hdr))
+			if rule == nil || rule.Action == "redirect" {
+				return nil
+			}
+			target := rule_folder(cfg, rule, hdr, message_delivered(pathname, entry))
+			if target == folder {
+				return nil
+			}
+			display := target
+			if display == "" {
+				display = "INBOX"
+			}
+			if *reclassifyDryRun {
+				fmt.Printf("%s -> %s (rule at line %d)\n", pathname, display, rule.Line)
+				moved++
+				return nil
+			}
+			if rule.Action == "file-by-list" && target != "" {
+				autofolder_create(cfg, maildir, target)
+			}
+			if _, err := reclassify_move(cfg, maildir, source, pathname, target); err != nil {
+				fmt.Fprintf(os.Stderr, "Error moving %s: %s\n", pathname, err)
+				status = 1
+				return nil
+			}
+			fmt.Printf("%s -> %s (rule at line %d)\n", pathname, display, rule.Line)
+			moved++
+			return nil
+		})
+		if err != nil && !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "Error reading %s: %s\n", source, err)
+			return 1
+		}
+	}
+	if *reclassifyDryRun {
+		fmt.Printf("%d messages would move\n", moved)
+	} else {
+		fmt.Printf("%d messages moved\n", moved)
+	}
+	return status
+}
@@ -0,0 +1,206 @@
+//go:build !noredis && !tiny
+
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RedisStore is a StateStore shared by all MDA hosts through Redis, keys
+// are prefixed with "pmda:<namespace>:" so the database can be shared.
+type RedisStore struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// redis_open connects to a redis:// or rediss:// URL, credentials and
+// database number are taken from the URL as usual.
+func redis_open(rawurl string) (*RedisStore, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "6379")
+	}
+
+	var conn net.Conn
+	dialer := &net.Dialer{Timeout: REDIS_TIMEOUT}
+	switch u.Scheme {
+	case "redis":
+		conn, err = dialer.Dial("tcp", host)
+	case "rediss":
+		conn, err = tls.DialWithDialer(dialer, "tcp", host, &tls.Config{ServerName: u.Hostname()})
+	default:
+		return nil, fmt.Errorf("unsupported scheme: %s", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	store := &RedisStore{conn: conn, reader: bufio.NewReader(conn)}
+	if u.User != nil {
+		password, hasPassword := u.User.Password()
+		if hasPassword && u.User.Username() != "" {
+			_, err = store.command("AUTH", u.User.Username(), password)
+		} else if hasPassword {
+			_, err = store.command("AUTH", password)
+		} else {
+			_, err = store.command("AUTH", u.User.Username())
+		}
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if db := strings.TrimPrefix(u.Path, "/"); db != "" {
+		if _, err := store.command("SELECT", db); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return store, nil
+}
+
+// command sends a RESP request and returns the decoded reply, a nil reply
+// is returned as a nil interface.
+func (store *RedisStore) command(args ...string) (any, error) {
+	store.conn.SetDeadline(time.Now().Add(REDIS_TIMEOUT))
+
+	request := fmt.Sprintf("*%d\r\n", len(args))
+	for _, arg := range args {
+		request += fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(store.conn, request); err != nil {
+		return nil, err
+	}
+	return store.reply()
+}
+
+func (store *RedisStore) reply() (any, error) {
+	line, err := store.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("redis: empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, fmt.Errorf("redis: %s", line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 {
+			return nil, err
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(store.reader, data); err != nil {
+			return nil, err
+		}
+		return string(data[:size]), nil
+	case '*':
+		count, err := strconv.Atoi(line[1:])
+		if err != nil || count < 0 {
+			return nil, err
+		}
+		items := make([]any, count)
+		for i := range items {
+			if items[i], err = store.reply(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply: %s", line)
+}
+
+func init() {
+	feature_register("redis")
+}
+
+func redis_key(namespace string, key string) string {
+	return "pmda:" + namespace + ":" + key
+}
+
+func (store *RedisStore) Get(namespace string, key string) (string, bool, error) {
+	reply, err := store.command("GET", redis_key(namespace, key))
+	if err != nil || reply == nil {
+		return "", false, err
+	}
+	return reply.(string), true, nil
+}
+
+func (store *RedisStore) Set(namespace string, key string, value string, ttl time.Duration) error {
+	args := []string{"SET", redis_key(namespace, key), value}
+	if ttl != 0 {
+		args = append(args, "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	}
+	_, err := store.command(args...)
+	return err
+}
+
+func (store *RedisStore) SetNX(namespace string, key string, value string, ttl time.Duration) (bool, error) {
+	args := []string{"SET", redis_key(namespace, key), value, "NX"}
+	if ttl != 0 {
+		args = append(args, "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	}
+	reply, err := store.command(args...)
+	if err != nil {
+		return false, err
+	}
+	return reply != nil, nil
+}
+
+func (store *RedisStore) Incr(namespace string, key string, ttl time.Duration) (int64, error) {
+	reply, err := store.command("INCR", redis_key(namespace, key))
+	if err != nil {
+		return 0, err
+	}
+	counter := reply.(int64)
+	if counter == 1 && ttl != 0 {
+		if _, err := store.command("PEXPIRE", redis_key(namespace, key), strconv.FormatInt(ttl.Milliseconds(), 10)); err != nil {
+			return 0, err
+		}
+	}
+	return counter, nil
+}
+
+func (store *RedisStore) Delete(namespace string, key string) error {
+	_, err := store.command("DEL", redis_key(namespace, key))
+	return err
+}
+
+func (store *RedisStore) Close() {
+	store.conn.Close()
+}
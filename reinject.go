@@ -0,0 +1,92 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// the field each re-injection adds, its hop count first
+const REINJECT_FIELD = "X-PMDA-Reinjected"
+
+// messages re-injected this many times are not re-injected again
+const REINJECT_HOPS_MAX = 5
+
+// reinject_trail returns the hop count of a message and the addresses it
+// was already re-injected to, from the fields earlier re-injections left:
+//
+//	X-PMDA-Reinjected: 1; from <me@example.org> to <books@example.org>
+func reinject_trail(hdr *Header) (int, map[string]bool) {
+	hops := 0
+	trail := make(map[string]bool)
+	for _, value := range hdr.Values(REINJECT_FIELD) {
+		count, rest, _ := strings.Cut(value, ";")
+		if n, err := strconv.Atoi(strings.TrimSpace(count)); err == nil {
+			hops = max(hops, n)
+		}
+		if _, to, found := strings.Cut(rest, " to "); found {
+			trail[correspondent_address(to)] = true
+		}
+	}
+	return hops, trail
+}
+
+// reinject_send hands the message at pathname to the local MTA for an
+// address, a field recording the hop on top.
+func reinject_send(env *Envelope, pathname string, hops int, address string) error {
+	file, err := os.Open(pathname)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReaderSize(file, LINE_READ_MAX)
+	first, _ := reader.Peek(LINE_READ_MAX)
+	field := fmt.Sprintf("%s: %d; from <%s> to <%s>%s", REINJECT_FIELD, hops+1,
+		header_oneline(env.Recipient), header_oneline(address), line_ending(first))
+	return sieve_sendmail(io.MultiReader(strings.NewReader(field), reader), env.Sender, address)
+}
+
+// reinject_deliver re-injects the message at pathname to the addresses
+// of a rule, unless it would loop: back to the recipient, to an address
+// it went through already, or past the hop limit. It returns how many
+// copies went out.
+func reinject_deliver(env *Envelope, hdr *Header, pathname string, addresses []string) (int, error) {
+	hops, trail := reinject_trail(hdr)
+	sent := 0
+	for _, address := range addresses {
+		switch target := correspondent_address(address); {
+		case target == correspondent_address(env.Recipient) || trail[target]:
+			log_info("not re-injecting to %s: mail loop", address)
+			continue
+		case hops >= REINJECT_HOPS_MAX:
+			log_info("not re-injecting to %s: %d hops already", address, hops)
+			continue
+		}
+		if err := reinject_send(env, pathname, hops, address); err != nil {
+			return sent, fmt.Errorf("re-injecting to %s: %s", address, err)
+		}
+		log_info("re-injected to %s", address)
+		sent++
+	}
+	return sent, nil
+}
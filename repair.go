@@ -0,0 +1,74 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"net/mail"
+	"time"
+)
+
+// dates further than this in the future are considered bogus
+const DATE_FUTURE_SKEW = 24 * time.Hour
+
+// repair_message_id synthesizes a Message-ID for messages lacking one.
+// The generated identifier carries a "pmda" marker and is paired with an
+// X-PMDA-Generated field so nobody mistakes it for the sender's.
+func repair_message_id(hdr *Header, hostname string, now time.Time) {
+	if hdr.Get("Message-ID") != "" {
+		return
+	}
+
+	nBig, err := rand.Int(rand.Reader, big.NewInt(0xffffffff))
+	if err != nil {
+		return
+	}
+	messageId := fmt.Sprintf("<%s.%08x.pmda@%s>", now.UTC().Format("20060102150405"),
+		uint32(nBig.Uint64()), hostname)
+	log_info("generated Message-ID %s", messageId)
+
+	hdr.Set("Message-ID", messageId)
+	hdr.add_line("X-PMDA-Generated: Message-ID")
+}
+
+// repair_date rewrites a missing, unparseable or far-fetched Date to the
+// delivery time, the original value is preserved in X-Original-Date.
+func repair_date(hdr *Header, now time.Time) {
+	value := hdr.Get("Date")
+	date, err := mail.ParseDate(value)
+	if err == nil && date.Unix() > 0 && date.Before(now.Add(DATE_FUTURE_SKEW)) {
+		return
+	}
+
+	if value != "" {
+		log_info("rewriting invalid Date: %s", value)
+		hdr.add_line("X-Original-Date: " + value)
+	}
+	hdr.Set("Date", now.Format(time.RFC1123Z))
+}
+
+// header_repair applies the repairs enabled in the configuration.
+func header_repair(cfg *Config, hdr *Header, hostname string, now time.Time) {
+	if cfg.RepairMessageId {
+		repair_message_id(hdr, hostname, now)
+	}
+	if cfg.RepairDate {
+		repair_date(hdr, now)
+	}
+}
@@ -0,0 +1,213 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var replayFlags = flag.NewFlagSet("replay", flag.ExitOnError)
+var replayFrom = replayFlags.String("from", "", "replay messages delivered since this time, as in 2024-03-01 or 2024-03-01T12:00:00Z")
+var replayTo = replayFlags.String("to", "", "replay messages delivered until this time")
+var replayDryRun = replayFlags.Bool("n", false, "only print the messages that would be replayed")
+
+// replay_time parses the bounds of a replay, dates being local midnight.
+func replay_time(value string, fallback time.Time) (time.Time, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04", "2006-01-02 15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time: %s", value)
+}
+
+// replay_present returns the checksums and Message-IDs of the messages
+// in a maildir. Checksums recorded at delivery are trusted, the other
+// messages are read.
+func replay_present(homedir string, maildir string) (map[string]bool, map[string]bool, error) {
+	index, err := checksum_index(homedir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+	folders, err := maildir_folders(maildir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sums, ids := make(map[string]bool), make(map[string]bool)
+	for _, folder := range folders {
+		for _, subdir := range []string{"new", "cur"} {
+			err := maildir_walk(filepath.Join(maildir, folder, subdir), func(pathname string, entry fs.DirEntry) error {
+				if recorded, found := index[maildir_unique(entry.Name())]; found {
+					sums[recorded.sum] = true
+				} else if sum, _, err := checksum_file(pathname); err == nil {
+					sums[sum] = true
+				}
+				if file, err := os.Open(pathname); err == nil {
+					if hdr, err := header_read(file); err == nil {
+						if id := message_id(hdr.Get("Message-ID")); id != "" {
+							ids[id] = true
+						}
+					}
+					file.Close()
+				}
+				return nil
+			})
+			if err != nil && !os.IsNotExist(err) {
+				return nil, nil, err
+			}
+		}
+	}
+	return sums, ids, nil
+}
+
+// replay_deliver runs the MDA over an archived message, the envelope
+// being recovered from the header the MTA added.
+func replay_deliver(pathname string, hdr *Header) error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(pathname)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	sender := strings.Trim(strings.TrimSpace(hdr.Get("Return-Path")), "<>")
+	recipient := os.Getenv("RECIPIENT")
+	if addresses := hdr.Addresses("Delivered-To"); len(addresses) != 0 {
+		recipient = addresses[0]
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.Command(executable)
+	cmd.Stdin = file
+	cmd.Stderr = &stderr
+	cmd.Env = append(os.Environ(), "SENDER="+sender, "RECIPIENT="+recipient, "ORIGINAL_RECIPIENT="+recipient)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// replay_main implements "mail.pmda replay", which delivers again the
+// messages of an archive that a storage incident lost. The archive is a
+// directory of raw messages, as kept by an MTA copying mail aside or as
+// restored from a backup, flat or laid out as a maildir. Messages are
+// picked by delivery time, from their filename or modification time, and
+// those still in the maildir are skipped: matched by the checksum the
+// delivery recorded, or by Message-ID for those annotated since.
+func replay_main(args []string) int {
+	replayFlags.Parse(args)
+	if replayFlags.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "Usage: %s replay [-n] [-from time] [-to time] archive\n", os.Args[0])
+		return 1
+	}
+	from, err := replay_time(*replayFrom, time.Time{})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return 1
+	}
+	to, err := replay_time(*replayTo, time.Now())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return 1
+	}
+
+	homedir := os.Getenv("HOME")
+	cfg, err := config_read(filepath.Join(homedir, ".pmda.conf"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading configuration: %s\n", err)
+		return 1
+	}
+	maildir := maildir_resolve(cfg, homedir)
+	sums, ids, err := replay_present(homedir, maildir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading %s: %s\n", maildir, err)
+		return 1
+	}
+
+	replayed, present, failed := 0, 0, 0
+	err = filepath.WalkDir(replayFlags.Arg(0), func(pathname string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() && entry.Name() == "tmp" {
+			return filepath.SkipDir
+		}
+		if !entry.Type().IsRegular() || strings.HasPrefix(entry.Name(), ".") {
+			return nil
+		}
+		if delivered := message_delivered(pathname, entry); delivered.Before(from) || delivered.After(to) {
+			return nil
+		}
+
+		sum, _, err := checksum_file(pathname)
+		if err != nil {
+			return err
+		}
+		file, err := os.Open(pathname)
+		if err != nil {
+			return err
+		}
+		hdr, err := header_read(file)
+		file.Close()
+		if err != nil {
+			return err
+		}
+		if sums[sum] || ids[message_id(hdr.Get("Message-ID"))] {
+			present++
+			return nil
+		}
+
+		if *replayDryRun {
+			fmt.Printf("%s\n", pathname)
+		} else if err := replay_deliver(pathname, hdr); err != nil {
+			fmt.Fprintf(os.Stderr, "Error replaying %s: %s\n", pathname, err)
+			failed++
+			return nil
+		}
+		sums[sum] = true
+		replayed++
+		return nil
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading archive: %s\n", err)
+		return 1
+	}
+	if *replayDryRun {
+		fmt.Printf("%d to replay, %d already present\n", replayed, present)
+		return 0
+	}
+	fmt.Printf("%d replayed, %d already present, %d failed\n", replayed, present, failed)
+	if failed != 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,260 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// reports are small, anything bigger is not one
+const REPORT_MAX_SIZE = 10 * 1024 * 1024
+
+// ReportConfig enables the recognition of a kind of postmaster report,
+// which is summarized and filed:
+//
+//	reports dmarc ".Reports.DMARC"
+//	reports tls ".Reports.TLS"
+type ReportConfig struct {
+	Kind   string
+	Folder string
+}
+
+// ReportKind is a kind of report: how to recognize one in a message part
+// and how to summarize those recorded. Kinds register from an init().
+type ReportKind struct {
+	Name      string
+	Folder    string
+	parse     func(part *MimePart) (any, error)
+	key       func(summary json.RawMessage) string
+	summarize func(summaries []json.RawMessage, asJson bool) error
+}
+
+var reportKinds = make(map[string]*ReportKind)
+
+func report_register(kind *ReportKind) {
+	reportKinds[kind.Name] = kind
+}
+
+// Report is a report found in a message, along with its summary.
+type Report struct {
+	Kind    string
+	Folder  string
+	Summary any
+}
+
+func reports_parse(args []string) (*ReportConfig, error) {
+	if len(args) < 1 || len(args) > 2 {
+		return nil, fmt.Errorf("usage: reports kind [folder]")
+	}
+	kind, exists := reportKinds[args[0]]
+	if !exists {
+		return nil, fmt.Errorf("unknown report kind: %s", args[0])
+	}
+	report := &ReportConfig{Kind: kind.Name, Folder: kind.Folder}
+	if len(args) == 2 {
+		report.Folder = args[1]
+	}
+	return report, nil
+}
+
+// report_payload returns the decompressed content of a part, which
+// reports send raw, gzipped or as the single file of a zip archive.
+func report_payload(part *MimePart) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(part.Body, REPORT_MAX_SIZE+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > REPORT_MAX_SIZE {
+		return nil, fmt.Errorf("report exceeds %d bytes", REPORT_MAX_SIZE)
+	}
+
+	switch {
+	case bytes.HasPrefix(data, []byte("\x1f\x8b")):
+		reader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		data, err = io.ReadAll(io.LimitReader(reader, REPORT_MAX_SIZE+1))
+		if err != nil {
+			return nil, err
+		}
+	case bytes.HasPrefix(data, []byte("PK\x03\x04")):
+		archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return nil, err
+		}
+		if len(archive.File) != 1 {
+			return nil, fmt.Errorf("report archive holds %d files", len(archive.File))
+		}
+		reader, err := archive.File[0].Open()
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		data, err = io.ReadAll(io.LimitReader(reader, REPORT_MAX_SIZE+1))
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return data, nil
+	}
+	if len(data) > REPORT_MAX_SIZE {
+		return nil, fmt.Errorf("report exceeds %d bytes", REPORT_MAX_SIZE)
+	}
+	return data, nil
+}
+
+var errReportFound = errors.New("report found")
+
+// reports_detect looks for a report of the configured kinds in a stored
+// message, returning nil if it holds none.
+func reports_detect(cfg *Config, pathname string) *Report {
+	var report *Report
+	err := mime_walk_file(pathname, func(part *MimePart) error {
+		for _, reportCfg := range cfg.Reports {
+			summary, err := reportKinds[reportCfg.Kind].parse(part)
+			if err != nil {
+				log_info("error parsing %s report: %s", reportCfg.Kind, err)
+				continue
+			}
+			if summary != nil {
+				report = &Report{Kind: reportCfg.Kind, Folder: reportCfg.Folder, Summary: summary}
+				return errReportFound
+			}
+		}
+		return nil
+	})
+	if err != nil && err != errReportFound {
+		log_info("error looking for reports: %s", err)
+	}
+	return report
+}
+
+func reports_path(homedir string, kind string) string {
+	return filepath.Join(homedir, ".pmda", "reports", kind+".json")
+}
+
+// reports_record appends the summary of a report to the store of its
+// kind, a file of JSON lines which the reports command reads back.
+func reports_record(homedir string, report *Report) {
+	data, err := json.Marshal(report.Summary)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error encoding report: %s\n", err)
+		return
+	}
+	pathname := reports_path(homedir, report.Kind)
+	if err := os.MkdirAll(filepath.Dir(pathname), 0700); err != nil {
+		fmt.Fprintf(os.Stderr, "Error recording report: %s\n", err)
+		return
+	}
+	file, err := os.OpenFile(pathname, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error recording report: %s\n", err)
+		return
+	}
+	defer file.Close()
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		fmt.Fprintf(os.Stderr, "Error recording report: %s\n", err)
+	}
+}
+
+// reports_load reads back the summaries of a kind newer than since, a
+// report sent twice is only returned once.
+func reports_load(homedir string, kind *ReportKind, since time.Time) ([]json.RawMessage, error) {
+	file, err := os.Open(reports_path(homedir, kind.Name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	summaries := make([]json.RawMessage, 0)
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), REPORT_MAX_SIZE)
+	for scanner.Scan() {
+		var envelope struct {
+			End time.Time `json:"end"`
+		}
+		line := json.RawMessage(append([]byte(nil), scanner.Bytes()...))
+		if json.Unmarshal(line, &envelope) != nil || envelope.End.Before(since) {
+			continue
+		}
+		if key := kind.key(line); key != "" {
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+		}
+		summaries = append(summaries, line)
+	}
+	return summaries, scanner.Err()
+}
+
+var reportsFlags = flag.NewFlagSet("reports", flag.ExitOnError)
+var reportsSince = reportsFlags.Duration("since", 0, "only account for reports covering this duration")
+var reportsJson = reportsFlags.Bool("json", false, "output the summary as JSON")
+
+// reports_main implements "mail.pmda reports", which summarizes the
+// reports recorded so far.
+func reports_main(args []string) int {
+	reportsFlags.Parse(args)
+	kind := reportKinds[reportsFlags.Arg(0)]
+	if reportsFlags.NArg() != 1 || kind == nil {
+		fmt.Fprintf(os.Stderr, "Usage: %s reports [-json] [-since duration] %s\n", os.Args[0], strings.Join(reports_kinds(), "|"))
+		return 1
+	}
+
+	since := time.Time{}
+	if *reportsSince != 0 {
+		since = time.Now().Add(-*reportsSince)
+	}
+	summaries, err := reports_load(os.Getenv("HOME"), kind, since)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading reports: %s\n", err)
+		return 1
+	}
+	if err := kind.summarize(summaries, *reportsJson); err != nil {
+		fmt.Fprintf(os.Stderr, "Error summarizing reports: %s\n", err)
+		return 1
+	}
+	return 0
+}
+
+func reports_kinds() []string {
+	kinds := make([]string, 0, len(reportKinds))
+	for name := range reportKinds {
+		kinds = append(kinds, name)
+	}
+	sort.Strings(kinds)
+	return kinds
+}
@@ -0,0 +1,58 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+)
+
+var resultFd = flag.Int("result-fd", -1, "write the delivery result as JSON to this file descriptor")
+
+// DeliveryResult tells the caller where a message was stored, the path is
+// empty when it went to PostgreSQL only.
+type DeliveryResult struct {
+	Path     string `json:"path"`
+	Maildir  string `json:"maildir"`
+	Folder   string `json:"folder"`
+	Filename string `json:"filename"`
+	Verdict  string `json:"verdict"`
+	Size     int64  `json:"size"`
+}
+
+// result_write hands the result to whoever set up -result-fd, a failure to
+// do so does not undo the delivery.
+func result_write(result *DeliveryResult) {
+	if *resultFd < 0 {
+		return
+	}
+	file := os.NewFile(uintptr(*resultFd), "result-fd")
+	if file == nil {
+		fmt.Fprintf(os.Stderr, "Error writing result: invalid descriptor %d\n", *resultFd)
+		return
+	}
+	defer file.Close()
+
+	data, err := json.Marshal(result)
+	if err == nil {
+		_, err = file.Write(append(data, '\n'))
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing result: %s\n", err)
+	}
+}
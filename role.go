@@ -0,0 +1,84 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const ROLE_FOLDER_FORMAT = ".2006-01-02"
+
+// role_folder returns the per-day folder a role account delivers into.
+func role_folder(cfg *Config, now time.Time) string {
+	return now.In(cfg.Timezone).Format(ROLE_FOLDER_FORMAT)
+}
+
+// role_expire removes the per-day folders older than the retention, a
+// retention of zero keeps everything. Their messages go to the trash
+// unless it is off.
+func role_expire(cfg *Config, homedir string, maildir string, now time.Time) {
+	if cfg.RoleRetention == 0 {
+		return
+	}
+
+	entries, err := os.ReadDir(maildir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading %s: %s\n", maildir, err)
+		return
+	}
+
+	today := now.In(cfg.Timezone)
+	limit := time.Date(today.Year(), today.Month(), today.Day()-cfg.RoleRetention, 0, 0, 0, 0, cfg.Timezone)
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		date, err := time.ParseInLocation(ROLE_FOLDER_FORMAT, entry.Name(), cfg.Timezone)
+		if err != nil || !date.Before(limit) {
+			continue
+		}
+		log_info("expiring role account folder %s", entry.Name())
+		if cfg.Trash != nil {
+			if err := role_trash(cfg, homedir, maildir, entry.Name()); err != nil {
+				fmt.Fprintf(os.Stderr, "Error trashing %s: %s\n", entry.Name(), err)
+				continue
+			}
+		}
+		bytes, count := folder_size(filepath.Join(maildir, entry.Name()))
+		if err := os.RemoveAll(filepath.Join(maildir, entry.Name())); err != nil {
+			fmt.Fprintf(os.Stderr, "Error removing %s: %s\n", entry.Name(), err)
+		}
+		quota_add(cfg, maildir, -bytes, -count)
+	}
+}
+
+// role_trash moves the messages of a per-day folder to the trash.
+func role_trash(cfg *Config, homedir string, maildir string, folder string) error {
+	for _, subdir := range []string{"new", "cur"} {
+		err := maildir_walk(filepath.Join(maildir, folder, subdir), func(pathname string, entry fs.DirEntry) error {
+			return trash_move(cfg, homedir, maildir, pathname, folder, "role")
+		})
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
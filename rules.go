@@ -0,0 +1,406 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net/mail"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Condition is a single test of a match rule.
+type Condition struct {
+	Kind    string
+	Name    string
+	Regexp  *regexp.Regexp
+	Pattern string
+	Value   string
+	Negate  bool
+}
+
+// header fields inspected by the address conditions
+var addressConditions = map[string][]string{
+	"to":           {"To"},
+	"cc":           {"Cc"},
+	"bcc":          {"Bcc"},
+	"delivered-to": {"Delivered-To"},
+	"recipient":    {"To", "Cc", "Bcc", "Delivered-To"},
+}
+
+// Message is what rules are evaluated against, the header along with the
+// facts established about the message beforehand.
+type Message struct {
+	Header             *Header
+	Envelope           *Envelope
+	KnownCorrespondent bool
+	Calendar           *Calendar
+	ReplyToMe          bool
+	Classifier         map[string]any
+	Scores             map[string]float64
+	SMIME              string
+	PGP                string
+	PGPSigner          bool
+	Encrypted          bool
+	SenderMismatch     bool
+	Freemail           bool
+	Disposable         bool
+	Marketing          bool
+	Violation          string
+	Bypass             bool
+	Blocked            bool
+	Muted              bool
+	Report             *Report
+	Sieve              *SieveResult
+}
+
+// Rule is a match directive from the configuration file, the action
+// applies when all of its conditions hold:
+//
+//	match header "List-Id" "golang-nuts" folder ".Lists.golang-nuts"
+//	match recipient "abuse@*" folder ".Abuse"
+//	match known-correspondent folder ".People"
+//	match calendar request folder ".Calendar"
+//	match is-reply-to-me folder ".Priority"
+//	match classifier "score" > 0.8 folder ".Junk"
+//	match score spam >= 0.9 folder ".Junk"
+//	match ! smime valid header "From" "@example.com" folder ".Unsigned"
+//	match pgp none pgp-signer folder ".Review"
+//	match is-encrypted folder ".Encrypted"
+//	match sender-mismatch score phishing >= 0.6 folder ".Junk"
+//	match sender-is-disposable folder ".Junk"
+//	match all file-by-date ".Archive"
+//	match header "List-Id" "" file-by-list ".Lists"
+//	match header "From" "@invoices.example.com" copy-to "books@example.org" folder ".Invoices"
+//	match recipient "old@*" redirect "new@example.org"
+//
+// Copies go to the addresses of copy-to through the local MTA, besides
+// the delivery. A redirect re-injects the message instead of delivering
+// it.
+type Rule struct {
+	Line       int
+	Conditions []Condition
+	Copies     []string
+	Action     string
+	Args       []string
+}
+
+func rule_parse(args []string, lineno int) (*Rule, error) {
+	rule := &Rule{Line: lineno}
+
+	negate := false
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "!":
+			negate = !negate
+			continue
+
+		case "all", "known-correspondent", "is-reply-to-me", "pgp-signer", "is-encrypted", "sender-mismatch",
+			"sender-is-freemail", "sender-is-disposable", "is-marketing":
+			rule.Conditions = append(rule.Conditions, Condition{Kind: args[i], Negate: negate})
+
+		case "header":
+			if i+2 >= len(args) {
+				return nil, fmt.Errorf("usage: header name regexp")
+			}
+			re, err := regexp.Compile("(?i)" + args[i+2])
+			if err != nil {
+				return nil, fmt.Errorf("bad regexp: %s", err)
+			}
+			rule.Conditions = append(rule.Conditions, Condition{Kind: "header", Name: args[i+1], Regexp: re, Negate: negate})
+			i += 2
+
+		case "to", "cc", "bcc", "delivered-to", "recipient":
+			if i+1 >= len(args) {
+				return nil, fmt.Errorf("usage: %s address-pattern", args[i])
+			}
+			pattern := strings.ToLower(args[i+1])
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("bad address pattern: %s", args[i+1])
+			}
+			rule.Conditions = append(rule.Conditions, Condition{Kind: args[i], Pattern: pattern, Negate: negate})
+			i += 1
+
+		case "calendar":
+			if i+1 >= len(args) {
+				return nil, fmt.Errorf("usage: calendar request|reply|cancel|update|any")
+			}
+			switch args[i+1] {
+			case "request", "reply", "cancel", "update", "any":
+			default:
+				return nil, fmt.Errorf("usage: calendar request|reply|cancel|update|any")
+			}
+			rule.Conditions = append(rule.Conditions, Condition{Kind: "calendar", Pattern: args[i+1], Negate: negate})
+			i += 1
+
+		case "smime", "pgp":
+			if i+1 >= len(args) {
+				return nil, fmt.Errorf("usage: %s valid|invalid|none", args[i])
+			}
+			switch args[i+1] {
+			case "valid", "invalid", "none":
+			default:
+				return nil, fmt.Errorf("usage: %s valid|invalid|none", args[i])
+			}
+			rule.Conditions = append(rule.Conditions, Condition{Kind: args[i], Pattern: args[i+1], Negate: negate})
+			i += 1
+
+		case "classifier":
+			cond, err := classifier_condition(args[i+1:], negate)
+			if err != nil {
+				return nil, err
+			}
+			rule.Conditions = append(rule.Conditions, *cond)
+			i += 3
+
+		case "score":
+			if i+3 >= len(args) {
+				return nil, fmt.Errorf("usage: score name <|<=|>|>= number")
+			}
+			switch args[i+2] {
+			case "<", "<=", ">", ">=":
+			default:
+				return nil, fmt.Errorf("usage: score name <|<=|>|>= number")
+			}
+			if _, err := strconv.ParseFloat(args[i+3], 64); err != nil {
+				return nil, fmt.Errorf("invalid number: %s", args[i+3])
+			}
+			rule.Conditions = append(rule.Conditions, Condition{Kind: "score", Name: args[i+1], Pattern: args[i+2], Value: args[i+3], Negate: negate})
+			i += 3
+
+		case "copy-to":
+			if i+1 >= len(args) || !strings.Contains(args[i+1], "@") {
+				return nil, fmt.Errorf("usage: copy-to address")
+			}
+			rule.Copies = append(rule.Copies, args[i+1])
+			i += 1
+
+		case "redirect":
+			if i+2 != len(args) || !strings.Contains(args[i+1], "@") {
+				return nil, fmt.Errorf("usage: redirect address")
+			}
+			rule.Action = args[i]
+			rule.Args = args[i+1:]
+			i = len(args)
+
+		case "folder":
+			if i+2 != len(args) {
+				return nil, fmt.Errorf("usage: folder name")
+			}
+			if err := folder_check(args[i+1]); err != nil {
+				return nil, err
+			}
+			rule.Action = args[i]
+			rule.Args = args[i+1:]
+			i = len(args)
+
+		case "file-by-date", "file-by-list":
+			if i+2 < len(args) {
+				return nil, fmt.Errorf("usage: %s [prefix]", args[i])
+			}
+			if i+1 < len(args) {
+				if err := folder_check(args[i+1]); err != nil {
+					return nil, err
+				}
+			}
+			rule.Action = args[i]
+			rule.Args = args[i+1:]
+			i = len(args)
+
+		default:
+			return nil, fmt.Errorf("unknown condition or action: %s", args[i])
+		}
+		negate = false
+	}
+
+	if len(rule.Conditions) == 0 {
+		return nil, fmt.Errorf("match rule has no condition")
+	}
+	if rule.Action == "" {
+		return nil, fmt.Errorf("match rule has no action")
+	}
+	return rule, nil
+}
+
+func (cond *Condition) match(msg *Message) bool {
+	hdr := msg.Header
+	matched := false
+	switch cond.Kind {
+	case "all":
+		matched = true
+	case "known-correspondent":
+		matched = msg.KnownCorrespondent
+	case "calendar":
+		matched = calendar_method(msg.Calendar, cond.Pattern)
+	case "is-reply-to-me":
+		matched = msg.ReplyToMe
+	case "smime":
+		matched = msg.SMIME == cond.Pattern
+	case "pgp":
+		matched = msg.PGP == cond.Pattern
+	case "pgp-signer":
+		matched = msg.PGPSigner
+	case "is-encrypted":
+		matched = msg.Encrypted
+	case "sender-mismatch":
+		matched = msg.SenderMismatch
+	case "sender-is-freemail":
+		matched = msg.Freemail
+	case "sender-is-disposable":
+		matched = msg.Disposable
+	case "is-marketing":
+		matched = msg.Marketing
+	case "classifier":
+		matched = classifier_match(cond, msg.Classifier)
+	case "score":
+		if score, scored := msg.Scores[cond.Name]; scored {
+			threshold, _ := strconv.ParseFloat(cond.Value, 64)
+			matched = condition_compare(cond.Pattern, score, threshold)
+		}
+	case "header":
+		for _, value := range hdr.Values(cond.Name) {
+			if cond.Regexp.MatchString(value) {
+				matched = true
+				break
+			}
+		}
+	case "to", "cc", "bcc", "delivered-to", "recipient":
+		for _, name := range addressConditions[cond.Kind] {
+			for _, address := range hdr.Addresses(name) {
+				if ok, _ := path.Match(cond.Pattern, address); ok {
+					matched = true
+				}
+			}
+		}
+	}
+	return matched != cond.Negate
+}
+
+func (rule *Rule) match(msg *Message) bool {
+	for i := range rule.Conditions {
+		if !rule.Conditions[i].match(msg) {
+			return false
+		}
+	}
+	return true
+}
+
+// condition_compare applies the ordered comparison operators of number
+// conditions.
+func condition_compare(op string, value float64, threshold float64) bool {
+	switch op {
+	case "<":
+		return value < threshold
+	case "<=":
+		return value <= threshold
+	case ">":
+		return value > threshold
+	}
+	return value >= threshold
+}
+
+// rules_use reports whether any rule has a condition of the given kind,
+// so that facts only they need are not established for nothing.
+func rules_use(rules []*Rule, kind string) bool {
+	for _, rule := range rules {
+		for _, cond := range rule.Conditions {
+			if cond.Kind == kind {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// rules_match returns the first rule matching the message, if any.
+func rules_match(rules []*Rule, msg *Message) *Rule {
+	rule, _ := rules_evaluate(rules, msg)
+	return rule
+}
+
+// rules_evaluate is rules_match but also returns a trace of the rules
+// evaluated and their outcome.
+func rules_evaluate(rules []*Rule, msg *Message) (*Rule, []string) {
+	trace := make([]string, 0)
+	for _, rule := range rules {
+		if rule.match(msg) {
+			trace = append(trace, fmt.Sprintf("line %d: matched, %s %s", rule.Line, rule.Action, strings.Join(rule.Args, " ")))
+			return rule, trace
+		}
+		trace = append(trace, fmt.Sprintf("line %d: no match", rule.Line))
+	}
+	return nil, trace
+}
+
+// rule_folder resolves the destination folder of a matched rule, the
+// inbox when what the message holds does not make a valid one.
+func rule_folder(cfg *Config, rule *Rule, hdr *Header, now time.Time) string {
+	folder := rule_expand(cfg, rule, hdr, now)
+	if folder == "" {
+		return ""
+	}
+	if err := folder_check(folder); err != nil {
+		log_info("rule at line %d: %s", rule.Line, err)
+		return ""
+	}
+	return folder
+}
+
+func rule_expand(cfg *Config, rule *Rule, hdr *Header, now time.Time) string {
+	switch rule.Action {
+	case "folder":
+		return rule.Args[0]
+
+	case "file-by-date":
+		prefix := ".Archive"
+		if len(rule.Args) == 1 {
+			prefix = rule.Args[0]
+		}
+		date, err := mail.ParseDate(hdr.Get("Date"))
+		if err != nil {
+			date = now
+		}
+		return prefix + date.In(cfg.Timezone).Format(".2006.01")
+
+	case "file-by-list":
+		prefix := ".Lists"
+		if len(rule.Args) == 1 {
+			prefix = rule.Args[0]
+		}
+		if name := list_name(hdr.Get("List-Id")); name != "" {
+			return prefix + "." + name
+		}
+	}
+	return ""
+}
+
+// list_name returns the folder name of a list, from the first label of
+// its List-Id, sanitized as extensions are:
+//
+//	List-Id: "OpenBSD tech" <tech.openbsd.org> -> tech
+//	List-Id: <openbsd-tech.lists.example.org> -> openbsd-tech
+func list_name(value string) string {
+	id := strings.TrimSpace(value)
+	if start := strings.LastIndexByte(id, '<'); start != -1 {
+		id, _, _ = strings.Cut(id[start+1:], ">")
+	}
+	label, _, _ := strings.Cut(strings.TrimSpace(id), ".")
+	return extension_sanitize(label)
+}
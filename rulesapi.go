@@ -0,0 +1,259 @@
+//go:build !norulesapi && !tiny
+
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const RULESAPI_MAX_BODY = 1024 * 1024
+
+var rulesapiFlags = flag.NewFlagSet("rules-api", flag.ExitOnError)
+var rulesapiListen = rulesapiFlags.String("listen", "127.0.0.1:8190", "address to listen on")
+var rulesapiCert = rulesapiFlags.String("cert", "", "TLS certificate, serves HTTPS")
+var rulesapiKey = rulesapiFlags.String("key", "", "TLS private key")
+var rulesapiCheckpassword = rulesapiFlags.String("checkpassword", "", "checkpassword program used to authenticate users")
+
+func init() {
+	feature_register("rules-api")
+	command_register(&Command{Name: "rules-api", Synopsis: "serve an HTTP API to edit rules remotely",
+		Flags: rulesapiFlags, Main: rulesapi_main})
+}
+
+// rulesapi_main implements "mail.pmda rules-api", a small HTTP API over
+// the rules in the configuration file of the authenticated user:
+//
+//	GET  /rules           the match and classify rules, with the ETag of the file
+//	POST /rules/validate  check rules without storing them
+//	PUT  /rules           validate and replace the rules, honoring If-Match
+//
+// Only rules are exchanged, the other directives of the file are left as
+// they are: some run commands, which a leaked mail password must not
+// give. Users authenticate with HTTP basic auth, checked by a
+// checkpassword program, which is refused in cleartext on anything but
+// loopback. Validation is done by the parser used at delivery time, over
+// the system configuration.
+func rulesapi_main(args []string) int {
+	rulesapiFlags.Parse(args)
+	if rulesapiFlags.NArg() != 0 || *rulesapiCheckpassword == "" {
+		fmt.Fprintf(os.Stderr, "Usage: %s rules-api -checkpassword program [-listen address] [-cert file -key file]\n", os.Args[0])
+		return 1
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/rules", http_authenticated("rules-api", *rulesapiCheckpassword, rulesapi_rules))
+	mux.HandleFunc("/rules/validate", http_authenticated("rules-api", *rulesapiCheckpassword, rulesapi_validate))
+	server := &http.Server{
+		Addr:         *rulesapiListen,
+		Handler:      mux,
+		ReadTimeout:  time.Minute,
+		WriteTimeout: time.Minute,
+	}
+
+	log_info("rules-api listening on %s", *rulesapiListen)
+	var err error
+	if *rulesapiCert != "" {
+		err = server.ListenAndServeTLS(*rulesapiCert, *rulesapiKey)
+	} else {
+		err = server.ListenAndServe()
+	}
+	fmt.Fprintf(os.Stderr, "Error serving rules-api: %s\n", err)
+	return 1
+}
+
+func rulesapi_error(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{"valid": false, "error": err.Error()})
+}
+
+func rulesapi_etag(data []byte) string {
+	sum := sha256.Sum256(data)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// the directives the API may change, none of them runs a command
+var rulesapiKeywords = map[string]bool{"match": true, "classify": true}
+
+// rulesapi_split separates the rule lines of a configuration from the
+// others, and returns where the first rule was among the latter.
+func rulesapi_split(data []byte) ([]string, []string, int) {
+	rules, others := make([]string, 0), make([]string, 0)
+	at := -1
+	for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		if tokens, err := config_tokenize(line); err == nil && len(tokens) != 0 && rulesapiKeywords[tokens[0]] {
+			if at == -1 {
+				at = len(others)
+			}
+			rules = append(rules, line)
+			continue
+		}
+		if line != "" || len(others) != 0 {
+			others = append(others, line)
+		}
+	}
+	if at == -1 {
+		at = len(others)
+	}
+	return rules, others, at
+}
+
+// rulesapi_merge replaces the rules of a configuration, the other lines
+// staying as they are.
+func rulesapi_merge(current []byte, rules []string) []byte {
+	_, others, at := rulesapi_split(current)
+	lines := append(append(append([]string{}, others[:at]...), rules...), others[at:]...)
+	if len(lines) == 0 {
+		return nil
+	}
+	return []byte(strings.Join(lines, "\n") + "\n")
+}
+
+// rulesapi_current reads the configuration of the account, as the account
+// would: a link in its place is not followed.
+func rulesapi_current(account *user.User) ([]byte, error) {
+	file, err := home_open(account, ".pmda.conf", os.O_RDONLY, 0)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(file)
+}
+
+// rulesapi_body reads the rules of the request and validates them merged
+// into the current configuration, over the system one as at delivery.
+func rulesapi_body(w http.ResponseWriter, r *http.Request, current []byte) ([]byte, *Config, bool) {
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, RULESAPI_MAX_BODY))
+	if err != nil {
+		rulesapi_error(w, http.StatusRequestEntityTooLarge, err)
+		return nil, nil, false
+	}
+	rules := make([]string, 0)
+	for lineno, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		tokens, err := config_tokenize(line)
+		if err != nil {
+			rulesapi_error(w, http.StatusUnprocessableEntity, fmt.Errorf("line %d: %s", lineno+1, err))
+			return nil, nil, false
+		}
+		if len(tokens) != 0 && !rulesapiKeywords[tokens[0]] {
+			rulesapi_error(w, http.StatusUnprocessableEntity, fmt.Errorf("line %d: only match and classify rules can be edited: %s", lineno+1, tokens[0]))
+			return nil, nil, false
+		}
+		if len(tokens) != 0 {
+			rules = append(rules, line)
+		}
+	}
+
+	merged := rulesapi_merge(current, rules)
+	cfg, err := config_system()
+	if err == nil {
+		cfg, err = config_merge(cfg, bytes.NewReader(merged), ".pmda.conf")
+	}
+	if err != nil {
+		rulesapi_error(w, http.StatusUnprocessableEntity, err)
+		return nil, nil, false
+	}
+	return merged, cfg, true
+}
+
+func rulesapi_validate(w http.ResponseWriter, r *http.Request, account *user.User) {
+	if r.Method != http.MethodPost {
+		rulesapi_error(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+		return
+	}
+	current, err := rulesapi_current(account)
+	if err != nil {
+		rulesapi_error(w, http.StatusInternalServerError, err)
+		return
+	}
+	_, cfg, ok := rulesapi_body(w, r, current)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"valid": true, "rules": len(cfg.Rules)})
+}
+
+func rulesapi_rules(w http.ResponseWriter, r *http.Request, account *user.User) {
+	current, err := rulesapi_current(account)
+	if err != nil {
+		rulesapi_error(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		rules, _, _ := rulesapi_split(current)
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("ETag", rulesapi_etag(current))
+		for _, rule := range rules {
+			fmt.Fprintf(w, "%s\n", rule)
+		}
+
+	case http.MethodPut:
+		if match := r.Header.Get("If-Match"); match != "" && match != rulesapi_etag(current) {
+			rulesapi_error(w, http.StatusPreconditionFailed, fmt.Errorf("configuration changed since it was fetched"))
+			return
+		}
+		data, _, ok := rulesapi_body(w, r, current)
+		if !ok {
+			return
+		}
+		suffix := make([]byte, 8)
+		rand.Read(suffix)
+		tmpname := ".pmda.conf." + hex.EncodeToString(suffix) + ".tmp"
+		file, err := home_open(account, tmpname, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			rulesapi_error(w, http.StatusInternalServerError, err)
+			return
+		}
+		_, err = file.Write(data)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = home_rename(account, tmpname, ".pmda.conf")
+		}
+		if err != nil {
+			home_remove(account, tmpname)
+			rulesapi_error(w, http.StatusInternalServerError, err)
+			return
+		}
+		log_info("rules-api: %s updated the rules of %s", account.Username, filepath.Join(account.HomeDir, ".pmda.conf"))
+		w.Header().Set("ETag", rulesapi_etag(data))
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		rulesapi_error(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+	}
+}
@@ -0,0 +1,134 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+var sentFlags = flag.NewFlagSet("sent", flag.ExitOnError)
+var sentSendmail = sentFlags.String("sendmail", SIEVE_SENDMAIL, "pass the message on to this program, the arguments being its own")
+
+// sent_folder is where copies of outgoing mail are kept, the first sent
+// folder correspondents are learnt from if any.
+func sent_folder(cfg *Config) string {
+	if cfg.Correspondents != nil && len(cfg.Correspondents.Sent) != 0 {
+		return cfg.Correspondents.Sent[0]
+	}
+	return ".Sent"
+}
+
+// sent_main implements "mail.pmda sent", which stands in for sendmail in
+// command line MUAs and keeps a copy of what they send in the sent
+// folder, flagged as seen:
+//
+//	set sendmail="mail.pmda sent -- -oi -t"
+//
+// The message is spooled in the maildir, passed on to sendmail and only
+// filed once sendmail accepted it, the exit status being that of
+// sendmail. Failing to file the copy is reported but does not fail the
+// submission.
+func sent_main(args []string) int {
+	sentFlags.Parse(args)
+
+	homedir := os.Getenv("HOME")
+	cfg, err := config_read(filepath.Join(homedir, ".pmda.conf"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading configuration: %s\n", err)
+		cfg = config_default()
+	}
+	maildir := maildir_resolve(cfg, homedir)
+	folder := sent_folder(cfg)
+	maildir_mkdirs(maildir)
+	maildir_folder(cfg, maildir, folder)
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	file, filename, err := maildir_create(filepath.Join(maildir, "tmp"), hostname)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating message in %s: %s\n", filepath.Join(maildir, "tmp"), err)
+		return EX_TEMPFAIL
+	}
+	pathname := file.Name()
+	_, err = io.Copy(file, os.Stdin)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(pathname)
+		fmt.Fprintf(os.Stderr, "Error spooling the message: %s\n", err)
+		return EX_TEMPFAIL
+	}
+
+	spool, err := os.Open(pathname)
+	if err != nil {
+		os.Remove(pathname)
+		fmt.Fprintf(os.Stderr, "Error spooling the message: %s\n", err)
+		return EX_TEMPFAIL
+	}
+	cmd := exec.Command(*sentSendmail, sentFlags.Args()...)
+	cmd.Stdin = spool
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	spool.Close()
+	if err != nil {
+		os.Remove(pathname)
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return exitErr.ExitCode()
+		}
+		fmt.Fprintf(os.Stderr, "Error running %s: %s\n", *sentSendmail, err)
+		return EX_TEMPFAIL
+	}
+
+	if err := sent_store(cfg, maildir, folder, filename, pathname); err != nil {
+		os.Remove(pathname)
+		fmt.Fprintf(os.Stderr, "Error filing a copy into %s: %s\n", folder, err)
+	}
+	return 0
+}
+
+// sent_store moves a spooled message to the cur subdirectory of a folder
+// with the seen flag, as a MUA saving it would.
+func sent_store(cfg *Config, maildir string, folder string, filename string, pathname string) error {
+	filename, err := maildir_sized(filename, pathname)
+	if err != nil {
+		return err
+	}
+	destination, err := maildir_path(filepath.Join(maildir, folder, "cur"), filename+":2,S", maildir_layout(cfg, maildir))
+	if err != nil {
+		return err
+	}
+	if err := file_sync(pathname); err != nil {
+		return err
+	}
+	if err := os.Rename(pathname, destination); err != nil {
+		return err
+	}
+	if err := dir_sync(filepath.Dir(destination), filepath.Join(maildir, folder, "cur")); err != nil {
+		return err
+	}
+	quota_add(cfg, maildir, message_size(destination), 1)
+	return nil
+}
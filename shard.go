@@ -0,0 +1,352 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A sharded maildir spreads the messages of new/ and cur/ over hashed
+// subdirectories, one or two levels of 256, so that no directory grows
+// to millions of entries:
+//
+//	.Archive/cur/3f/1709251200.0a1b2c3d.mx1:2,S
+//
+// The shard only depends on the unique part of the filename, a message
+// keeps it when moved from new/ to cur/ or when its flags change. Mail
+// readers know nothing of this layout, it is meant for archival accounts
+// and can be converted back to a plain maildir with "mail.pmda layout".
+//
+// The layout is recorded in a marker at the root of the maildir, which
+// is what deliveries and tools go by whatever the configuration says.
+const SHARD_MARKER = ".pmda-layout"
+
+// LayoutConfig selects the layout of new maildirs:
+//
+//	layout maildir
+//	layout sharded depth 2
+type LayoutConfig struct {
+	Sharded bool
+	Depth   int
+}
+
+func layout_parse(args []string) (*LayoutConfig, error) {
+	switch {
+	case len(args) == 1 && args[0] == "maildir":
+		return &LayoutConfig{}, nil
+	case len(args) == 1 && args[0] == "sharded":
+		return &LayoutConfig{Sharded: true, Depth: 1}, nil
+	case len(args) == 3 && args[0] == "sharded" && args[1] == "depth":
+		depth, err := strconv.Atoi(args[2])
+		if err != nil || depth < 1 || depth > 2 {
+			return nil, fmt.Errorf("sharding depth must be 1 or 2")
+		}
+		return &LayoutConfig{Sharded: true, Depth: depth}, nil
+	}
+	return nil, fmt.Errorf("usage: layout maildir | layout sharded [depth 1|2]")
+}
+
+// shard_depth returns the sharding depth of a maildir, zero if plain.
+func shard_depth(maildir string) int {
+	data, err := os.ReadFile(filepath.Join(maildir, SHARD_MARKER))
+	if err != nil {
+		return 0
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) != 2 || fields[0] != "sharded" {
+		return 0
+	}
+	depth, err := strconv.Atoi(fields[1])
+	if err != nil || depth < 1 || depth > 2 {
+		return 0
+	}
+	return depth
+}
+
+// shard_mark records the layout of a maildir, a depth of zero removes
+// the marker and makes it plain again.
+func shard_mark(maildir string, depth int) error {
+	marker := filepath.Join(maildir, SHARD_MARKER)
+	if depth == 0 {
+		if err := os.Remove(marker); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	tmpname := fmt.Sprintf("%s.%d", marker, os.Getpid())
+	if err := os.WriteFile(tmpname, []byte(fmt.Sprintf("sharded %d\n", depth)), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpname, marker)
+}
+
+// maildir_layout returns the sharding depth deliveries to a maildir use,
+// marking the maildir on first delivery when sharding is configured.
+func maildir_layout(cfg *Config, maildir string) int {
+	if depth := shard_depth(maildir); depth != 0 || cfg.Layout == nil || !cfg.Layout.Sharded {
+		return depth
+	}
+	if err := shard_mark(maildir, cfg.Layout.Depth); err != nil {
+		fmt.Fprintf(os.Stderr, "Error marking %s as sharded: %s\n", maildir, err)
+		tempfail()
+	}
+	return cfg.Layout.Depth
+}
+
+// shard_dir returns the shard subdirectory of a message filename.
+func shard_dir(filename string, depth int) string {
+	sum := sha256.Sum256([]byte(maildir_unique(filename)))
+	name := hex.EncodeToString(sum[:depth])
+	if depth == 2 {
+		return filepath.Join(name[:2], name[2:])
+	}
+	return name
+}
+
+// maildir_path returns where a message lives in the new or cur
+// subdirectory of a folder, creating its shard as needed.
+func maildir_path(directory string, filename string, depth int) (string, error) {
+	if depth == 0 {
+		return filepath.Join(directory, filename), nil
+	}
+	shard := filepath.Join(directory, shard_dir(filename, depth))
+	if err := os.MkdirAll(shard, 0700); err != nil {
+		return "", err
+	}
+	return filepath.Join(shard, filename), nil
+}
+
+// shard_name reports whether a directory entry is a shard, which no
+// message filename can be mistaken for.
+func shard_name(name string) bool {
+	if len(name) != 2 {
+		return false
+	}
+	_, err := hex.DecodeString(name)
+	return err == nil && strings.ToLower(name) == name
+}
+
+// errWalkStop stops maildir_walk without it reporting an error.
+var errWalkStop = errors.New("walk stopped")
+
+// maildir_walk calls fn for every message of a new or cur subdirectory,
+// plain or sharded alike so that a maildir half converted reads fine. It
+// stops early without error when fn returns errWalkStop.
+func maildir_walk(directory string, fn func(pathname string, entry fs.DirEntry) error) error {
+	err := maildir_walk_level(directory, 2, fn)
+	if err == errWalkStop {
+		return nil
+	}
+	return err
+}
+
+func maildir_walk_level(directory string, levels int, fn func(pathname string, entry fs.DirEntry) error) error {
+	dir, err := os.Open(directory)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	for {
+		entries, err := dir.ReadDir(1024)
+		for _, entry := range entries {
+			pathname := filepath.Join(directory, entry.Name())
+			if entry.IsDir() {
+				if levels > 0 && shard_name(entry.Name()) {
+					if err := maildir_walk_level(pathname, levels-1, fn); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			if err := fn(pathname, entry); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// maildir_mtime returns the last change to a new or cur subdirectory,
+// which for a sharded one is that of its most recently changed shard.
+func maildir_mtime(directory string, st fs.FileInfo) time.Time {
+	mtime := st.ModTime()
+	for _, pattern := range []string{"[0-9a-f][0-9a-f]", "[0-9a-f][0-9a-f]/[0-9a-f][0-9a-f]"} {
+		shards, _ := filepath.Glob(filepath.Join(directory, pattern))
+		for _, shard := range shards {
+			if st, err := os.Stat(shard); err == nil && st.ModTime().After(mtime) {
+				mtime = st.ModTime()
+			}
+		}
+	}
+	return mtime
+}
+
+// maildir_folders returns the folders of a maildir: the inbox, named "",
+// and every Maildir++ folder below it.
+func maildir_folders(maildir string) ([]string, error) {
+	entries, err := os.ReadDir(maildir)
+	if err != nil {
+		return nil, err
+	}
+	folders := []string{""}
+	for _, entry := range entries {
+		if entry.IsDir() && strings.HasPrefix(entry.Name(), ".") {
+			folders = append(folders, entry.Name())
+		}
+	}
+	return folders, nil
+}
+
+var layoutFlags = flag.NewFlagSet("layout", flag.ExitOnError)
+var layoutDepth = layoutFlags.Int("depth", 1, "sharding depth, 1 or 2 levels of 256 directories")
+
+// layout_main implements "mail.pmda layout", which converts a maildir
+// between the plain and sharded layouts. The marker is updated first so
+// that deliveries made during the conversion already use the new layout,
+// messages are then moved one rename at a time.
+func layout_main(args []string) int {
+	layoutFlags.Parse(args)
+
+	homedir := os.Getenv("HOME")
+	cfg, err := config_read(filepath.Join(homedir, ".pmda.conf"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading configuration: %s\n", err)
+		return 1
+	}
+	maildir := maildir_resolve(cfg, homedir)
+	switch layoutFlags.NArg() {
+	case 2:
+		maildir = layoutFlags.Arg(1)
+	case 1:
+	default:
+		fmt.Fprintf(os.Stderr, "Usage: %s layout [-depth n] maildir|sharded [maildir]\n", os.Args[0])
+		return 1
+	}
+
+	depth := 0
+	switch layoutFlags.Arg(0) {
+	case "maildir":
+		if cfg.Layout != nil && cfg.Layout.Sharded {
+			fmt.Fprintf(os.Stderr, "Warning: configuration still asks for a sharded layout\n")
+		}
+	case "sharded":
+		if *layoutDepth < 1 || *layoutDepth > 2 {
+			fmt.Fprintf(os.Stderr, "Error: sharding depth must be 1 or 2\n")
+			return 1
+		}
+		depth = *layoutDepth
+	default:
+		fmt.Fprintf(os.Stderr, "Usage: %s layout [-depth n] maildir|sharded [maildir]\n", os.Args[0])
+		return 1
+	}
+
+	if err := shard_mark(maildir, depth); err != nil {
+		fmt.Fprintf(os.Stderr, "Error marking %s: %s\n", maildir, err)
+		return 1
+	}
+
+	folders, err := maildir_folders(maildir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading %s: %s\n", maildir, err)
+		return 1
+	}
+	moved := 0
+	for _, folder := range folders {
+		for _, subdir := range []string{"new", "cur"} {
+			directory := filepath.Join(maildir, folder, subdir)
+			n, err := layout_convert(directory, depth)
+			moved += n
+			if err != nil && !os.IsNotExist(err) {
+				fmt.Fprintf(os.Stderr, "Error converting %s: %s\n", directory, err)
+				return 1
+			}
+		}
+	}
+	fmt.Printf("%d messages moved\n", moved)
+	return 0
+}
+
+// layout_convert moves the messages of a directory to where depth puts
+// them, then removes the shards left empty.
+func layout_convert(directory string, depth int) (int, error) {
+	moves := make(map[string]string)
+	err := maildir_walk(directory, func(pathname string, entry fs.DirEntry) error {
+		target, err := maildir_path(directory, entry.Name(), depth)
+		if err != nil {
+			return err
+		}
+		if target != pathname {
+			moves[pathname] = target
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	moved := 0
+	for pathname, target := range moves {
+		if err := os.Rename(pathname, target); err != nil {
+			if os.IsNotExist(err) {
+				// flagged or expunged by a reader meanwhile
+				continue
+			}
+			return moved, err
+		}
+		moved++
+	}
+
+	entries, err := os.ReadDir(directory)
+	if err != nil {
+		return moved, err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() && shard_name(entry.Name()) {
+			shard_prune(filepath.Join(directory, entry.Name()))
+		}
+	}
+	return moved, nil
+}
+
+// shard_prune removes a shard and its subshards if they are empty, a
+// message delivered meanwhile keeps them in place.
+func shard_prune(shard string) {
+	if entries, err := os.ReadDir(shard); err == nil {
+		for _, entry := range entries {
+			if entry.IsDir() && shard_name(entry.Name()) {
+				os.Remove(filepath.Join(shard, entry.Name()))
+			}
+		}
+	}
+	os.Remove(shard)
+}
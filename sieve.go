@@ -0,0 +1,1135 @@
+//go:build !nosieve
+
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"fmt"
+	"mime"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// the script of a user is a file and may get large, not unbounded
+const SIEVE_MAX_SCRIPT = 1024 * 1024
+
+// sieve nesting beyond this is refused when parsing
+const SIEVE_MAX_DEPTH = 32
+
+// a script may not forward a message to more addresses than this
+const SIEVE_MAX_REDIRECTS = 4
+
+func init() {
+	feature_register("sieve")
+}
+
+// sieve_extensions are the extensions a script may require, advertised
+// by the ManageSieve server too.
+func sieve_extensions() []string {
+	return []string{"fileinto", "envelope", "reject", "ereject", "vacation", "imap4flags", "variables", "copy",
+		"comparator-i;octet", "comparator-i;ascii-casemap"}
+}
+
+const (
+	SIEVE_IDENTIFIER = iota
+	SIEVE_TAG
+	SIEVE_NUMBER
+	SIEVE_STRING
+	SIEVE_SPECIAL
+	SIEVE_EOF
+)
+
+type sieveToken struct {
+	kind   int
+	text   string
+	number int64
+	line   int
+}
+
+// sieveLexer splits a script into tokens, as of RFC 5228 section 8.1.
+type sieveLexer struct {
+	script string
+	offset int
+	line   int
+}
+
+func (lexer *sieveLexer) errorf(format string, args ...any) error {
+	return fmt.Errorf("line %d: %s", lexer.line, fmt.Sprintf(format, args...))
+}
+
+func (lexer *sieveLexer) skip() error {
+	for lexer.offset < len(lexer.script) {
+		switch c := lexer.script[lexer.offset]; {
+		case c == '\n':
+			lexer.line++
+			lexer.offset++
+		case c == ' ' || c == '\t' || c == '\r':
+			lexer.offset++
+		case c == '#':
+			for lexer.offset < len(lexer.script) && lexer.script[lexer.offset] != '\n' {
+				lexer.offset++
+			}
+		case strings.HasPrefix(lexer.script[lexer.offset:], "/*"):
+			end := strings.Index(lexer.script[lexer.offset+2:], "*/")
+			if end == -1 {
+				return lexer.errorf("unterminated comment")
+			}
+			lexer.line += strings.Count(lexer.script[lexer.offset:lexer.offset+2+end], "\n")
+			lexer.offset += end + 4
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+func (lexer *sieveLexer) next() (*sieveToken, error) {
+	if err := lexer.skip(); err != nil {
+		return nil, err
+	}
+	token := &sieveToken{line: lexer.line}
+	if lexer.offset >= len(lexer.script) {
+		token.kind = SIEVE_EOF
+		return token, nil
+	}
+
+	script := lexer.script
+	start := lexer.offset
+	switch c := script[start]; {
+	case strings.ContainsRune(";{}()[],", rune(c)):
+		token.kind, token.text = SIEVE_SPECIAL, string(c)
+		lexer.offset++
+
+	case c == '"':
+		var value strings.Builder
+		for lexer.offset++; lexer.offset < len(script) && script[lexer.offset] != '"'; lexer.offset++ {
+			if script[lexer.offset] == '\\' && lexer.offset+1 < len(script) {
+				lexer.offset++
+			}
+			if script[lexer.offset] == '\n' {
+				lexer.line++
+			}
+			value.WriteByte(script[lexer.offset])
+		}
+		if lexer.offset >= len(script) {
+			return nil, fmt.Errorf("line %d: unterminated string", token.line)
+		}
+		lexer.offset++
+		token.kind, token.text = SIEVE_STRING, value.String()
+
+	case c == ':':
+		end := start + 1
+		for end < len(script) && sieve_identifier(script[end]) {
+			end++
+		}
+		if end == start+1 {
+			return nil, lexer.errorf("invalid tag")
+		}
+		token.kind, token.text = SIEVE_TAG, strings.ToLower(script[start:end])
+		lexer.offset = end
+
+	case c >= '0' && c <= '9':
+		end := start
+		for end < len(script) && script[end] >= '0' && script[end] <= '9' {
+			end++
+		}
+		number, err := strconv.ParseInt(script[start:end], 10, 64)
+		if err != nil {
+			return nil, lexer.errorf("invalid number")
+		}
+		if end < len(script) {
+			switch script[end] {
+			case 'K', 'k':
+				number, end = number*1024, end+1
+			case 'M', 'm':
+				number, end = number*1024*1024, end+1
+			case 'G', 'g':
+				number, end = number*1024*1024*1024, end+1
+			}
+		}
+		token.kind, token.number = SIEVE_NUMBER, number
+		lexer.offset = end
+
+	case sieve_identifier(c):
+		end := start
+		for end < len(script) && sieve_identifier(script[end]) {
+			end++
+		}
+		word := strings.ToLower(script[start:end])
+		lexer.offset = end
+		if word == "text" && end < len(script) && script[end] == ':' {
+			return lexer.text(token)
+		}
+		token.kind, token.text = SIEVE_IDENTIFIER, word
+
+	default:
+		return nil, lexer.errorf("unexpected character %q", c)
+	}
+	return token, nil
+}
+
+// text reads a multi-line string, up to a line holding a single dot,
+// lines starting with a dot having it doubled.
+func (lexer *sieveLexer) text(token *sieveToken) (*sieveToken, error) {
+	lexer.offset++
+	for lexer.offset < len(lexer.script) && (lexer.script[lexer.offset] == ' ' || lexer.script[lexer.offset] == '\t') {
+		lexer.offset++
+	}
+	if lexer.offset < len(lexer.script) && lexer.script[lexer.offset] == '#' {
+		for lexer.offset < len(lexer.script) && lexer.script[lexer.offset] != '\n' {
+			lexer.offset++
+		}
+	}
+	if lexer.offset < len(lexer.script) && lexer.script[lexer.offset] == '\r' {
+		lexer.offset++
+	}
+	if lexer.offset >= len(lexer.script) || lexer.script[lexer.offset] != '\n' {
+		return nil, lexer.errorf("text: must end its line")
+	}
+	lexer.offset++
+	lexer.line++
+
+	var value strings.Builder
+	for {
+		if lexer.offset >= len(lexer.script) {
+			return nil, fmt.Errorf("line %d: unterminated text", token.line)
+		}
+		end := strings.IndexByte(lexer.script[lexer.offset:], '\n')
+		line := ""
+		if end == -1 {
+			line = lexer.script[lexer.offset:]
+			lexer.offset = len(lexer.script)
+		} else {
+			line = lexer.script[lexer.offset : lexer.offset+end]
+			lexer.offset += end + 1
+		}
+		lexer.line++
+		line = strings.TrimSuffix(line, "\r")
+		if line == "." {
+			break
+		}
+		value.WriteString(strings.TrimPrefix(line, "."))
+		value.WriteString("\r\n")
+	}
+	token.kind, token.text = SIEVE_STRING, value.String()
+	return token, nil
+}
+
+// SieveArgument is a tag, a number or a string list, single strings
+// being lists of one.
+type SieveArgument struct {
+	Tag     string
+	Number  int64
+	Strings []string
+	IsList  bool
+	Kind    int
+}
+
+// SieveNode is a command or a test, arguments are bound to the tags and
+// positional arguments of its specification when the script is parsed.
+type SieveNode struct {
+	Name     string
+	Line     int
+	Args     []*SieveArgument
+	Tests    []*SieveNode
+	Block    []*SieveNode
+	Tags     map[string]*SieveArgument
+	Position []*SieveArgument
+}
+
+// SieveScript is a parsed script along with the extensions it requires.
+type SieveScript struct {
+	Commands   []*SieveNode
+	Extensions map[string]bool
+}
+
+type sieveParser struct {
+	lexer *sieveLexer
+	token *sieveToken
+}
+
+func (parser *sieveParser) advance() error {
+	token, err := parser.lexer.next()
+	if err != nil {
+		return err
+	}
+	parser.token = token
+	return nil
+}
+
+func (parser *sieveParser) special(text string) bool {
+	return parser.token.kind == SIEVE_SPECIAL && parser.token.text == text
+}
+
+func (parser *sieveParser) expect(text string) error {
+	if !parser.special(text) {
+		return fmt.Errorf("line %d: expected %s", parser.token.line, text)
+	}
+	return parser.advance()
+}
+
+func (parser *sieveParser) commands(depth int) ([]*SieveNode, error) {
+	if depth > SIEVE_MAX_DEPTH {
+		return nil, fmt.Errorf("line %d: blocks nested too deep", parser.token.line)
+	}
+	commands := make([]*SieveNode, 0)
+	for parser.token.kind != SIEVE_EOF && !parser.special("}") {
+		if parser.token.kind != SIEVE_IDENTIFIER {
+			return nil, fmt.Errorf("line %d: expected a command", parser.token.line)
+		}
+		command := &SieveNode{Name: parser.token.text, Line: parser.token.line}
+		if err := parser.advance(); err != nil {
+			return nil, err
+		}
+		if err := parser.arguments(command, depth); err != nil {
+			return nil, err
+		}
+		if parser.special("{") {
+			if err := parser.advance(); err != nil {
+				return nil, err
+			}
+			block, err := parser.commands(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			if err := parser.expect("}"); err != nil {
+				return nil, err
+			}
+			command.Block = block
+			if command.Block == nil {
+				command.Block = []*SieveNode{}
+			}
+		} else if err := parser.expect(";"); err != nil {
+			return nil, err
+		}
+		commands = append(commands, command)
+	}
+	return commands, nil
+}
+
+// arguments reads the arguments of a command or test, then its test or
+// list of tests if any.
+func (parser *sieveParser) arguments(node *SieveNode, depth int) error {
+	for {
+		token := parser.token
+		switch {
+		case token.kind == SIEVE_TAG:
+			node.Args = append(node.Args, &SieveArgument{Kind: SIEVE_TAG, Tag: token.text})
+		case token.kind == SIEVE_NUMBER:
+			node.Args = append(node.Args, &SieveArgument{Kind: SIEVE_NUMBER, Number: token.number})
+		case token.kind == SIEVE_STRING:
+			node.Args = append(node.Args, &SieveArgument{Kind: SIEVE_STRING, Strings: []string{token.text}})
+		case parser.special("["):
+			list := &SieveArgument{Kind: SIEVE_STRING, IsList: true}
+			for {
+				if err := parser.advance(); err != nil {
+					return err
+				}
+				if parser.token.kind != SIEVE_STRING {
+					return fmt.Errorf("line %d: expected a string", parser.token.line)
+				}
+				list.Strings = append(list.Strings, parser.token.text)
+				if err := parser.advance(); err != nil {
+					return err
+				}
+				if parser.special("]") {
+					break
+				}
+				if !parser.special(",") {
+					return fmt.Errorf("line %d: expected , or ]", parser.token.line)
+				}
+			}
+			node.Args = append(node.Args, list)
+		default:
+			return parser.tests(node, depth)
+		}
+		if err := parser.advance(); err != nil {
+			return err
+		}
+	}
+}
+
+func (parser *sieveParser) tests(node *SieveNode, depth int) error {
+	if depth > SIEVE_MAX_DEPTH {
+		return fmt.Errorf("line %d: tests nested too deep", parser.token.line)
+	}
+	if parser.special("(") {
+		for {
+			if err := parser.advance(); err != nil {
+				return err
+			}
+			test, err := parser.test(depth)
+			if err != nil {
+				return err
+			}
+			node.Tests = append(node.Tests, test)
+			if parser.special(")") {
+				return parser.advance()
+			}
+			if !parser.special(",") {
+				return fmt.Errorf("line %d: expected , or )", parser.token.line)
+			}
+		}
+	}
+	if parser.token.kind == SIEVE_IDENTIFIER {
+		test, err := parser.test(depth)
+		if err != nil {
+			return err
+		}
+		node.Tests = append(node.Tests, test)
+	}
+	return nil
+}
+
+func (parser *sieveParser) test(depth int) (*SieveNode, error) {
+	if parser.token.kind != SIEVE_IDENTIFIER {
+		return nil, fmt.Errorf("line %d: expected a test", parser.token.line)
+	}
+	test := &SieveNode{Name: parser.token.text, Line: parser.token.line}
+	if err := parser.advance(); err != nil {
+		return nil, err
+	}
+	if err := parser.arguments(test, depth+1); err != nil {
+		return nil, err
+	}
+	return test, nil
+}
+
+// sieveSpec describes the arguments of a command or test: its tags and
+// the kind of value they take, if any, and the positional arguments.
+// Variants list the positional arguments accepted, "string" being a
+// single string, "strings" a string list and "number" a number.
+type sieveSpec struct {
+	extension string
+	tags      map[string]string
+	exclusive [][]string
+	variants  [][]string
+	tests     int
+	block     bool
+}
+
+const SIEVE_TESTLIST = -1
+
+var sieveMatchTags = map[string]string{":is": "", ":contains": "", ":matches": "", ":comparator": "string"}
+
+func sieve_tags(groups ...map[string]string) map[string]string {
+	tags := make(map[string]string)
+	for _, group := range groups {
+		for tag, kind := range group {
+			tags[tag] = kind
+		}
+	}
+	return tags
+}
+
+var sieveMatchTypes = []string{":is", ":contains", ":matches"}
+var sieveAddressParts = []string{":all", ":localpart", ":domain"}
+var sieveAddressTags = sieve_tags(sieveMatchTags, map[string]string{":all": "", ":localpart": "", ":domain": ""})
+
+var sieveCommands = map[string]*sieveSpec{
+	"require":    {variants: [][]string{{"strings"}}},
+	"if":         {tests: 1, block: true},
+	"elsif":      {tests: 1, block: true},
+	"else":       {block: true},
+	"stop":       {},
+	"keep":       {tags: map[string]string{":flags": "strings"}},
+	"discard":    {},
+	"redirect":   {tags: map[string]string{":copy": ""}, variants: [][]string{{"string"}}},
+	"fileinto":   {extension: "fileinto", tags: map[string]string{":copy": "", ":flags": "strings"}, variants: [][]string{{"string"}}},
+	"reject":     {extension: "reject", variants: [][]string{{"string"}}},
+	"ereject":    {extension: "ereject", variants: [][]string{{"string"}}},
+	"setflag":    {extension: "imap4flags", variants: [][]string{{"strings"}, {"string", "strings"}}},
+	"addflag":    {extension: "imap4flags", variants: [][]string{{"strings"}, {"string", "strings"}}},
+	"removeflag": {extension: "imap4flags", variants: [][]string{{"strings"}, {"string", "strings"}}},
+	"set": {extension: "variables", variants: [][]string{{"string", "string"}},
+		tags:      map[string]string{":lower": "", ":upper": "", ":lowerfirst": "", ":upperfirst": "", ":quotewildcard": "", ":length": ""},
+		exclusive: [][]string{{":lower", ":upper"}, {":lowerfirst", ":upperfirst"}}},
+	"vacation": {extension: "vacation", variants: [][]string{{"string"}},
+		tags: map[string]string{":days": "number", ":subject": "string", ":from": "string", ":addresses": "strings", ":mime": "", ":handle": "string"}},
+}
+
+var sieveTests = map[string]*sieveSpec{
+	"address":  {tags: sieveAddressTags, exclusive: [][]string{sieveMatchTypes, sieveAddressParts}, variants: [][]string{{"strings", "strings"}}},
+	"envelope": {extension: "envelope", tags: sieveAddressTags, exclusive: [][]string{sieveMatchTypes, sieveAddressParts}, variants: [][]string{{"strings", "strings"}}},
+	"header":   {tags: sieveMatchTags, exclusive: [][]string{sieveMatchTypes}, variants: [][]string{{"strings", "strings"}}},
+	"string":   {extension: "variables", tags: sieveMatchTags, exclusive: [][]string{sieveMatchTypes}, variants: [][]string{{"strings", "strings"}}},
+	"hasflag":  {extension: "imap4flags", tags: sieveMatchTags, exclusive: [][]string{sieveMatchTypes}, variants: [][]string{{"strings"}, {"strings", "strings"}}},
+	"exists":   {variants: [][]string{{"strings"}}},
+	"size":     {tags: map[string]string{":over": "", ":under": ""}, exclusive: [][]string{{":over", ":under"}}, variants: [][]string{{"number"}}},
+	"not":      {tests: 1},
+	"allof":    {tests: SIEVE_TESTLIST},
+	"anyof":    {tests: SIEVE_TESTLIST},
+	"true":     {},
+	"false":    {},
+}
+
+// bind checks the arguments of a node against its specification and
+// sorts them into tags and positional arguments.
+func (node *SieveNode) bind(spec *sieveSpec, extensions map[string]bool) error {
+	if spec.extension != "" && !extensions[spec.extension] {
+		return fmt.Errorf("line %d: %s requires the %s extension", node.Line, node.Name, spec.extension)
+	}
+	node.Tags = make(map[string]*SieveArgument)
+	for i := 0; i < len(node.Args); i++ {
+		arg := node.Args[i]
+		if arg.Kind != SIEVE_TAG {
+			node.Position = append(node.Position, arg)
+			continue
+		}
+		if len(node.Position) != 0 {
+			return fmt.Errorf("line %d: %s must come before the arguments of %s", node.Line, arg.Tag, node.Name)
+		}
+		kind, known := spec.tags[arg.Tag]
+		if !known {
+			return fmt.Errorf("line %d: unknown tag %s for %s", node.Line, arg.Tag, node.Name)
+		}
+		if _, duplicate := node.Tags[arg.Tag]; duplicate {
+			return fmt.Errorf("line %d: duplicate tag %s", node.Line, arg.Tag)
+		}
+		if arg.Tag == ":copy" && !extensions["copy"] {
+			return fmt.Errorf("line %d: :copy requires the copy extension", node.Line)
+		}
+		if arg.Tag == ":flags" && !extensions["imap4flags"] {
+			return fmt.Errorf("line %d: :flags requires the imap4flags extension", node.Line)
+		}
+		node.Tags[arg.Tag] = arg
+		if kind == "" {
+			continue
+		}
+		if i+1 >= len(node.Args) || !sieve_kind(node.Args[i+1], kind) {
+			return fmt.Errorf("line %d: %s takes a %s", node.Line, arg.Tag, kind)
+		}
+		node.Tags[arg.Tag] = node.Args[i+1]
+		i++
+	}
+	for _, group := range spec.exclusive {
+		found := 0
+		for _, tag := range group {
+			if _, exists := node.Tags[tag]; exists {
+				found++
+			}
+		}
+		if found > 1 {
+			return fmt.Errorf("line %d: %s only takes one of %s", node.Line, node.Name, strings.Join(group, " "))
+		}
+	}
+	if comparator, exists := node.Tags[":comparator"]; exists {
+		if name := comparator.Strings[0]; name != "i;octet" && name != "i;ascii-casemap" {
+			return fmt.Errorf("line %d: unsupported comparator %s", node.Line, name)
+		}
+	}
+
+	if node.Name == "size" && len(node.Tags) == 0 {
+		return fmt.Errorf("line %d: size takes :over or :under", node.Line)
+	}
+
+	matched := len(spec.variants) == 0 && len(node.Position) == 0
+	for _, variant := range spec.variants {
+		if len(variant) != len(node.Position) {
+			continue
+		}
+		matched = true
+		for i, kind := range variant {
+			matched = matched && sieve_kind(node.Position[i], kind)
+		}
+		if matched {
+			break
+		}
+	}
+	if !matched {
+		return fmt.Errorf("line %d: invalid arguments for %s", node.Line, node.Name)
+	}
+
+	switch {
+	case spec.tests == 0 && len(node.Tests) != 0:
+		return fmt.Errorf("line %d: %s takes no test", node.Line, node.Name)
+	case spec.tests == 1 && len(node.Tests) != 1:
+		return fmt.Errorf("line %d: %s takes a single test", node.Line, node.Name)
+	case spec.tests == SIEVE_TESTLIST && len(node.Tests) == 0:
+		return fmt.Errorf("line %d: %s takes a list of tests", node.Line, node.Name)
+	case spec.block && node.Block == nil:
+		return fmt.Errorf("line %d: %s takes a block", node.Line, node.Name)
+	case !spec.block && node.Block != nil:
+		return fmt.Errorf("line %d: %s takes no block", node.Line, node.Name)
+	}
+	for _, test := range node.Tests {
+		testSpec, known := sieveTests[test.Name]
+		if !known {
+			return fmt.Errorf("line %d: unknown test %s", test.Line, test.Name)
+		}
+		if err := test.bind(testSpec, extensions); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sieve_kind(arg *SieveArgument, kind string) bool {
+	switch kind {
+	case "number":
+		return arg.Kind == SIEVE_NUMBER
+	case "string":
+		return arg.Kind == SIEVE_STRING && len(arg.Strings) == 1
+	case "strings":
+		return arg.Kind == SIEVE_STRING
+	}
+	return false
+}
+
+// sieve_compile checks the commands of a block, require only being
+// allowed at the start of the script.
+func sieve_compile(commands []*SieveNode, extensions map[string]bool, top bool) error {
+	supported := make(map[string]bool)
+	for _, extension := range sieve_extensions() {
+		supported[extension] = true
+	}
+
+	requires := top
+	previous := ""
+	for _, command := range commands {
+		spec, known := sieveCommands[command.Name]
+		if !known {
+			return fmt.Errorf("line %d: unknown command %s", command.Line, command.Name)
+		}
+		if command.Name == "require" {
+			if !requires {
+				return fmt.Errorf("line %d: require must come first", command.Line)
+			}
+		} else {
+			requires = false
+		}
+		if (command.Name == "elsif" || command.Name == "else") && previous != "if" && previous != "elsif" {
+			return fmt.Errorf("line %d: %s without if", command.Line, command.Name)
+		}
+		previous = command.Name
+
+		if err := command.bind(spec, extensions); err != nil {
+			return err
+		}
+		if command.Name == "set" && !sieve_variable(command.Position[0].Strings[0]) {
+			return fmt.Errorf("line %d: invalid variable name %s", command.Line, command.Position[0].Strings[0])
+		}
+		if command.Name == "require" {
+			for _, extension := range command.Position[0].Strings {
+				if !supported[extension] {
+					return fmt.Errorf("line %d: unsupported extension %s", command.Line, extension)
+				}
+				extensions[extension] = true
+			}
+		}
+		if command.Block != nil {
+			if err := sieve_compile(command.Block, extensions, false); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// sieve_parse parses and checks a script.
+func sieve_parse(script string) (*SieveScript, error) {
+	if len(script) > SIEVE_MAX_SCRIPT {
+		return nil, fmt.Errorf("script too large")
+	}
+	parser := &sieveParser{lexer: &sieveLexer{script: script, line: 1}}
+	if err := parser.advance(); err != nil {
+		return nil, err
+	}
+	commands, err := parser.commands(0)
+	if err != nil {
+		return nil, err
+	}
+	if parser.token.kind != SIEVE_EOF {
+		return nil, fmt.Errorf("line %d: unexpected }", parser.token.line)
+	}
+
+	parsed := &SieveScript{Commands: commands, Extensions: make(map[string]bool)}
+	if err := sieve_compile(commands, parsed.Extensions, true); err != nil {
+		return nil, err
+	}
+	return parsed, nil
+}
+
+// sieve_load reads the active script of a user, the ~/.pmda.sieve the
+// ManageSieve server links to, and returns nil when there is none. A
+// script replaces the built-in classification of junk, lists, marketing
+// and errors, what it files into the inbox going there whatever the
+// headers say:
+//
+//	require ["fileinto", "imap4flags"];
+//	if header :contains "List-Id" "golang-nuts" {
+//		fileinto :flags "\\Seen" "Lists.golang";
+//		stop;
+//	}
+//	if size :over 10M {
+//		discard;
+//	}
+func sieve_load(homedir string) (*SieveScript, error) {
+	pathname := filepath.Join(homedir, ".pmda.sieve")
+	data, err := os.ReadFile(pathname)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	script, err := sieve_parse(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", pathname, err)
+	}
+	return script, nil
+}
+
+// SieveContext is the state of a script run over a message: the
+// variables, the internal flags of imap4flags and whether the implicit
+// keep still holds.
+type SieveContext struct {
+	script    *SieveScript
+	hdr       *Header
+	env       *Envelope
+	size      int64
+	variables map[string]string
+	matches   []string
+	flags     []string
+	implicit  bool
+	stopped   bool
+	result    *SieveResult
+}
+
+// sieve_evaluate runs a script over a message, a nil script having no
+// result. Runtime errors are logged and fall back to the implicit keep,
+// as RFC 5228 wants.
+func sieve_evaluate(script *SieveScript, hdr *Header, env *Envelope, size int64) *SieveResult {
+	if script == nil {
+		return nil
+	}
+	ctx := &SieveContext{
+		script:    script,
+		hdr:       hdr,
+		env:       env,
+		size:      size,
+		variables: make(map[string]string),
+		implicit:  true,
+		result:    &SieveResult{},
+	}
+	ctx.run(script.Commands)
+	if ctx.implicit && ctx.result.Reject == "" {
+		ctx.deliver("", ctx.flags)
+	}
+	return ctx.result
+}
+
+func (ctx *SieveContext) run(commands []*SieveNode) {
+	branched := false
+	for _, command := range commands {
+		if ctx.stopped {
+			return
+		}
+		switch command.Name {
+		case "if":
+			if branched = ctx.test(command.Tests[0]); branched {
+				ctx.run(command.Block)
+			}
+		case "elsif":
+			if !branched {
+				if branched = ctx.test(command.Tests[0]); branched {
+					ctx.run(command.Block)
+				}
+			}
+		case "else":
+			if !branched {
+				ctx.run(command.Block)
+			}
+		case "stop":
+			ctx.stopped = true
+		case "keep":
+			ctx.deliver("", ctx.action_flags(command))
+			ctx.implicit = false
+		case "discard":
+			ctx.implicit = false
+		case "fileinto":
+			name := ctx.expand(command.Position[0].Strings[0])
+			folder, err := sieve_mailbox(name)
+			if err != nil {
+				log_info("sieve: line %d: %s, keeping", command.Line, err)
+				ctx.deliver("", ctx.flags)
+				break
+			}
+			ctx.deliver(folder, ctx.action_flags(command))
+			if _, copy := command.Tags[":copy"]; !copy {
+				ctx.implicit = false
+			}
+		case "redirect":
+			address := strings.TrimSpace(ctx.expand(command.Position[0].Strings[0]))
+			if !addressRegexp.MatchString(address) || len(ctx.result.Redirects) >= SIEVE_MAX_REDIRECTS {
+				log_info("sieve: line %d: not redirecting to %s", command.Line, address)
+				break
+			}
+			ctx.result.Redirects = append(ctx.result.Redirects, address)
+			if _, copy := command.Tags[":copy"]; !copy {
+				ctx.implicit = false
+			}
+		case "reject", "ereject":
+			ctx.result.Reject = ctx.expand(command.Position[0].Strings[0])
+			ctx.implicit = false
+		case "setflag", "addflag", "removeflag":
+			variable := ""
+			list := command.Position[0]
+			if len(command.Position) == 2 {
+				variable, list = ctx.expand(command.Position[0].Strings[0]), command.Position[1]
+			}
+			flags := sieve_flags(ctx.expand_all(list.Strings))
+			current := ctx.flags_get(variable)
+			switch command.Name {
+			case "addflag":
+				flags = sieve_flags(append(current, flags...))
+			case "removeflag":
+				kept := make([]string, 0, len(current))
+				for _, flag := range current {
+					if !sieve_flag_member(flags, flag) {
+						kept = append(kept, flag)
+					}
+				}
+				flags = kept
+			}
+			ctx.flags_set(variable, flags)
+		case "set":
+			ctx.variables[strings.ToLower(command.Position[0].Strings[0])] = sieve_modify(command, ctx.expand(command.Position[1].Strings[0]))
+		case "vacation":
+			if ctx.result.Vacation == nil {
+				ctx.result.Vacation = ctx.vacation(command)
+			}
+		}
+	}
+}
+
+// deliver adds a folder to those the message goes to, a folder given
+// twice gets a single copy.
+func (ctx *SieveContext) deliver(folder string, flags []string) {
+	for _, delivery := range ctx.result.Deliveries {
+		if delivery.Folder == folder {
+			return
+		}
+	}
+	ctx.result.Deliveries = append(ctx.result.Deliveries, SieveDelivery{Folder: folder, Flags: append([]string{}, flags...)})
+}
+
+func (ctx *SieveContext) action_flags(command *SieveNode) []string {
+	if list, exists := command.Tags[":flags"]; exists {
+		return sieve_flags(ctx.expand_all(list.Strings))
+	}
+	return ctx.flags
+}
+
+// flags_get returns the flags of a variable, the internal variable when
+// the name is empty.
+func (ctx *SieveContext) flags_get(variable string) []string {
+	if variable == "" {
+		return ctx.flags
+	}
+	return sieve_flags([]string{ctx.variables[strings.ToLower(variable)]})
+}
+
+func (ctx *SieveContext) flags_set(variable string, flags []string) {
+	if variable == "" {
+		ctx.flags = flags
+		return
+	}
+	ctx.variables[strings.ToLower(variable)] = strings.Join(flags, " ")
+}
+
+func (ctx *SieveContext) vacation(command *SieveNode) *SieveVacation {
+	vacation := &SieveVacation{Reason: ctx.expand(command.Position[0].Strings[0]), Days: 7}
+	if days, exists := command.Tags[":days"]; exists {
+		vacation.Days = int(max(1, min(days.Number, 365)))
+	}
+	if subject, exists := command.Tags[":subject"]; exists {
+		vacation.Subject = ctx.expand(subject.Strings[0])
+	}
+	if from, exists := command.Tags[":from"]; exists {
+		vacation.From = ctx.expand(from.Strings[0])
+	}
+	if addresses, exists := command.Tags[":addresses"]; exists {
+		vacation.Addresses = ctx.expand_all(addresses.Strings)
+	}
+	if handle, exists := command.Tags[":handle"]; exists {
+		vacation.Handle = ctx.expand(handle.Strings[0])
+	}
+	_, vacation.Mime = command.Tags[":mime"]
+	return vacation
+}
+
+func (ctx *SieveContext) test(test *SieveNode) bool {
+	switch test.Name {
+	case "true":
+		return true
+	case "false":
+		return false
+	case "not":
+		return !ctx.test(test.Tests[0])
+	case "allof":
+		for _, subtest := range test.Tests {
+			if !ctx.test(subtest) {
+				return false
+			}
+		}
+		return true
+	case "anyof":
+		for _, subtest := range test.Tests {
+			if ctx.test(subtest) {
+				return true
+			}
+		}
+		return false
+	case "exists":
+		for _, name := range ctx.expand_all(test.Position[0].Strings) {
+			if len(ctx.hdr.Values(name)) == 0 {
+				return false
+			}
+		}
+		return true
+	case "size":
+		if _, over := test.Tags[":over"]; over {
+			return ctx.size > test.Position[0].Number
+		}
+		return ctx.size < test.Position[0].Number
+	case "header":
+		values := make([]string, 0)
+		decoder := &mime.WordDecoder{}
+		for _, name := range ctx.expand_all(test.Position[0].Strings) {
+			for _, value := range ctx.hdr.Values(name) {
+				if decoded, err := decoder.DecodeHeader(value); err == nil {
+					value = decoded
+				}
+				values = append(values, value)
+			}
+		}
+		return ctx.match(test, values, test.Position[1].Strings)
+	case "address":
+		addresses := make([]string, 0)
+		for _, name := range ctx.expand_all(test.Position[0].Strings) {
+			addresses = append(addresses, ctx.hdr.Addresses(name)...)
+		}
+		return ctx.match(test, sieve_address_parts(test, addresses), test.Position[1].Strings)
+	case "envelope":
+		addresses := make([]string, 0)
+		for _, part := range ctx.expand_all(test.Position[0].Strings) {
+			switch strings.ToLower(part) {
+			case "from":
+				addresses = append(addresses, ctx.env.Sender)
+			case "to":
+				addresses = append(addresses, ctx.env.Recipient)
+			}
+		}
+		return ctx.match(test, sieve_address_parts(test, addresses), test.Position[1].Strings)
+	case "string":
+		return ctx.match(test, ctx.expand_all(test.Position[0].Strings), test.Position[1].Strings)
+	case "hasflag":
+		flags := ctx.flags
+		keys := test.Position[0].Strings
+		if len(test.Position) == 2 {
+			flags = make([]string, 0)
+			for _, variable := range ctx.expand_all(test.Position[0].Strings) {
+				flags = append(flags, ctx.flags_get(variable)...)
+			}
+			keys = test.Position[1].Strings
+		}
+		return ctx.match(test, flags, keys)
+	}
+	return false
+}
+
+// match compares values to keys with the match type and comparator of a
+// test, a successful :matches setting the match variables.
+func (ctx *SieveContext) match(test *SieveNode, values []string, keys []string) bool {
+	casemap := true
+	if comparator, exists := test.Tags[":comparator"]; exists {
+		casemap = comparator.Strings[0] == "i;ascii-casemap"
+	}
+	keys = ctx.expand_all(keys)
+	for _, value := range values {
+		for _, key := range keys {
+			switch {
+			case test.Tags[":contains"] != nil:
+				if casemap && strings.Contains(sieve_casemap(value), sieve_casemap(key)) || !casemap && strings.Contains(value, key) {
+					return true
+				}
+			case test.Tags[":matches"] != nil:
+				if matches := sieve_glob(key, value, casemap); matches != nil {
+					ctx.matches = matches
+					return true
+				}
+			default:
+				if casemap && sieve_casemap(value) == sieve_casemap(key) || !casemap && value == key {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// sieve_address_parts reduces addresses to the part a test asks for.
+func sieve_address_parts(test *SieveNode, addresses []string) []string {
+	parts := make([]string, 0, len(addresses))
+	for _, address := range addresses {
+		at := strings.LastIndexByte(address, '@')
+		switch {
+		case test.Tags[":localpart"] != nil && at >= 0:
+			address = address[:at]
+		case test.Tags[":domain"] != nil && at >= 0:
+			address = address[at+1:]
+		case test.Tags[":domain"] != nil:
+			address = ""
+		}
+		parts = append(parts, address)
+	}
+	return parts
+}
+
+// sieve_casemap is the i;ascii-casemap comparator, only ASCII letters
+// fold.
+func sieve_casemap(value string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'A' && r <= 'Z' {
+			return r + 'a' - 'A'
+		}
+		return r
+	}, value)
+}
+
+// sieve_glob matches a value against a :matches pattern and returns what
+// the whole pattern and each wildcard matched, or nil.
+func sieve_glob(pattern string, value string, casemap bool) []string {
+	var expression strings.Builder
+	expression.WriteString("(?s)")
+	if casemap {
+		expression.WriteString("(?i)")
+	}
+	expression.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; {
+		case c == '*':
+			expression.WriteString("(.*?)")
+		case c == '?':
+			expression.WriteString("(.)")
+		case c == '\\' && i+1 < len(pattern):
+			i++
+			expression.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		default:
+			expression.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		}
+	}
+	expression.WriteString("$")
+	compiled, err := regexp.Compile(expression.String())
+	if err != nil {
+		return nil
+	}
+	return compiled.FindStringSubmatch(value)
+}
+
+// expand substitutes variables in a string when the script requires
+// the variables extension, unknown ones expanding to nothing.
+func (ctx *SieveContext) expand(value string) string {
+	if !ctx.script.Extensions["variables"] || !strings.Contains(value, "${") {
+		return value
+	}
+	var expanded strings.Builder
+	for {
+		start := strings.Index(value, "${")
+		if start == -1 {
+			break
+		}
+		end := strings.IndexByte(value[start:], '}')
+		if end == -1 {
+			break
+		}
+		name := value[start+2 : start+end]
+		if !sieve_variable(name) && !sieve_digits(name) {
+			expanded.WriteString(value[:start+2])
+			value = value[start+2:]
+			continue
+		}
+		expanded.WriteString(value[:start])
+		if sieve_digits(name) {
+			if index, err := strconv.Atoi(name); err == nil && index < len(ctx.matches) {
+				expanded.WriteString(ctx.matches[index])
+			}
+		} else {
+			expanded.WriteString(ctx.variables[strings.ToLower(name)])
+		}
+		value = value[start+end+1:]
+	}
+	expanded.WriteString(value)
+	return expanded.String()
+}
+
+func (ctx *SieveContext) expand_all(values []string) []string {
+	expanded := make([]string, 0, len(values))
+	for _, value := range values {
+		expanded = append(expanded, ctx.expand(value))
+	}
+	return expanded
+}
+
+func sieve_variable(name string) bool {
+	if name == "" || name[0] >= '0' && name[0] <= '9' {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if !sieve_identifier(name[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func sieve_digits(name string) bool {
+	return name != "" && strings.Trim(name, "0123456789") == ""
+}
+
+// sieve_modify applies the modifiers of set to a value, in the order of
+// precedence RFC 5229 gives them.
+func sieve_modify(command *SieveNode, value string) string {
+	switch {
+	case command.Tags[":lower"] != nil:
+		value = strings.ToLower(value)
+	case command.Tags[":upper"] != nil:
+		value = strings.ToUpper(value)
+	}
+	if first, size := utf8.DecodeRuneInString(value); size != 0 {
+		switch {
+		case command.Tags[":lowerfirst"] != nil:
+			value = string(unicode.ToLower(first)) + value[size:]
+		case command.Tags[":upperfirst"] != nil:
+			value = string(unicode.ToUpper(first)) + value[size:]
+		}
+	}
+	if command.Tags[":quotewildcard"] != nil {
+		value = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`).Replace(value)
+	}
+	if command.Tags[":length"] != nil {
+		value = strconv.Itoa(utf8.RuneCountInString(value))
+	}
+	return value
+}
@@ -0,0 +1,322 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const SIEVE_VACATION_NS = "vacation"
+
+// redirects and vacation responses are handed to the local MTA
+const SIEVE_SENDMAIL = "/usr/sbin/sendmail"
+const SIEVE_SENDMAIL_TIMEOUT = 30 * time.Second
+
+// SieveDelivery is a folder a script files the message into, with the
+// IMAP flags it gets there.
+type SieveDelivery struct {
+	Folder string
+	Flags  []string
+}
+
+// SieveVacation is the vacation response of a script, Days being how
+// long the same sender is not answered again.
+type SieveVacation struct {
+	Reason    string
+	Subject   string
+	From      string
+	Addresses []string
+	Handle    string
+	Days      int
+	Mime      bool
+}
+
+// SieveResult is what a script decided: the folders the message goes to,
+// the first one being the delivery and the others copies, none meaning
+// it is discarded, or the reason it is rejected. Redirects and vacation
+// responses are sent once the message is delivered.
+type SieveResult struct {
+	Deliveries []SieveDelivery
+	Reject     string
+	Redirects  []string
+	Vacation   *SieveVacation
+}
+
+func sieve_identifier(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+// sieve_mailbox maps the IMAP name of a mailbox, with or without INBOX
+// and whichever hierarchy separator, to a Maildir++ folder.
+func sieve_mailbox(name string) (string, error) {
+	if strings.EqualFold(name, "INBOX") {
+		return "", nil
+	}
+	if len(name) > 6 && strings.EqualFold(name[:5], "INBOX") && (name[5] == '.' || name[5] == '/') {
+		name = name[6:]
+	}
+	name = strings.ReplaceAll(name, "/", ".")
+	for _, component := range strings.Split(name, ".") {
+		if component == "" || strings.IndexFunc(component, func(r rune) bool { return r < ' ' || r == 0x7f }) >= 0 {
+			return "", fmt.Errorf("invalid mailbox name %q", name)
+		}
+	}
+	return "." + name, nil
+}
+
+var sieveSystemFlags = map[string]rune{
+	`\draft`:    'D',
+	`\flagged`:  'F',
+	`\answered`: 'R',
+	`\seen`:     'S',
+	`\deleted`:  'T',
+}
+
+// sieve_maildir_flags turns IMAP flags into the info of a maildir
+// filename, keywords getting the letters of the folder.
+func sieve_maildir_flags(folder string, flags []string) (string, error) {
+	letters := make([]rune, 0, len(flags))
+	keywords := make([]string, 0)
+	for _, flag := range flags {
+		if letter, system := sieveSystemFlags[strings.ToLower(flag)]; system {
+			letters = append(letters, letter)
+		} else if !strings.HasPrefix(flag, `\`) {
+			keywords = append(keywords, flag)
+		}
+	}
+	keywordLetters, err := keywords_letters(folder, keywords)
+	if err != nil {
+		return "", err
+	}
+	letters = append(letters, []rune(keywordLetters)...)
+	sort.Slice(letters, func(i, j int) bool { return letters[i] < letters[j] })
+	return string(letters), nil
+}
+
+// sieve_flags splits flag lists on spaces, dropping duplicates.
+func sieve_flags(lists []string) []string {
+	flags := make([]string, 0)
+	for _, list := range lists {
+		for _, flag := range strings.Fields(list) {
+			if !sieve_flag_member(flags, flag) {
+				flags = append(flags, flag)
+			}
+		}
+	}
+	return flags
+}
+
+func sieve_flag_member(flags []string, flag string) bool {
+	for _, known := range flags {
+		if strings.EqualFold(known, flag) {
+			return true
+		}
+	}
+	return false
+}
+
+// sieve_copy files a copy of a delivered message into another folder,
+// linking it when the filesystem allows.
+func sieve_copy(cfg *Config, root string, maildir string, destination string, delivery SieveDelivery) error {
+	maildir_folder(cfg, maildir, delivery.Folder)
+	subdir, target := "new", maildir_unique(filepath.Base(destination))
+	if len(delivery.Flags) != 0 {
+		flags, err := sieve_maildir_flags(filepath.Join(maildir, delivery.Folder), delivery.Flags)
+		if err != nil {
+			return err
+		}
+		subdir, target = "cur", target+":2,"+flags
+	}
+	pathname, err := maildir_path(filepath.Join(maildir, delivery.Folder, subdir), target, maildir_layout(cfg, root))
+	if err != nil {
+		return err
+	}
+	if err := os.Link(destination, pathname); err != nil {
+		if err := sieve_copy_file(destination, pathname, filepath.Join(maildir, delivery.Folder, "tmp", target)); err != nil {
+			return err
+		}
+	}
+	quota_add(cfg, root, message_size(pathname), 1)
+	return nil
+}
+
+func sieve_copy_file(source string, pathname string, tmpname string) error {
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(tmpname, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(tmpname)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmpname)
+		return err
+	}
+	return os.Rename(tmpname, pathname)
+}
+
+// sieve_sendmail hands a message to the local MTA.
+func sieve_sendmail(message io.Reader, sender string, recipient string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), SIEVE_SENDMAIL_TIMEOUT)
+	defer cancel()
+	defer usage_exec(time.Now())
+	cmd := exec.CommandContext(ctx, SIEVE_SENDMAIL, "-oi", "-f", sender, "--", recipient)
+	cmd.Stdin = message
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %s: %s", SIEVE_SENDMAIL, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// sieve_actions sends the redirects and vacation response of a script
+// once the message, at pathname, is delivered or about to be discarded.
+func sieve_actions(cfg *Config, env *Envelope, hdr *Header, result *SieveResult, pathname string) {
+	for _, address := range result.Redirects {
+		file, err := os.Open(pathname)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error redirecting to %s: %s\n", address, err)
+			continue
+		}
+		if err := sieve_sendmail(file, env.Sender, address); err != nil {
+			fmt.Fprintf(os.Stderr, "Error redirecting to %s: %s\n", address, err)
+		} else {
+			log_info("sieve: redirected to %s", address)
+		}
+		file.Close()
+	}
+	if result.Vacation != nil {
+		if err := sieve_vacation(cfg, env, hdr, result.Vacation); err != nil {
+			fmt.Fprintf(os.Stderr, "Error sending vacation response: %s\n", err)
+		}
+	}
+}
+
+// sieve_vacation_due tells whether a message deserves a vacation
+// response as of RFC 5230: not to bounces, lists, automated mail, nor to
+// mail the user is not a direct recipient of.
+func sieve_vacation_due(env *Envelope, hdr *Header, vacation *SieveVacation) bool {
+	sender := strings.ToLower(env.Sender)
+	if sender == "" || strings.HasPrefix(sender, "mailer-daemon@") || strings.HasPrefix(sender, "owner-") ||
+		strings.Contains(sender, "-request@") {
+		return false
+	}
+	if value := strings.ToLower(hdr.Get("Auto-Submitted")); value != "" && value != "no" {
+		return false
+	}
+	switch strings.ToLower(hdr.Get("Precedence")) {
+	case "bulk", "list", "junk":
+		return false
+	}
+	if hdr.Get("List-Id") != "" || hdr.Get("List-Unsubscribe") != "" {
+		return false
+	}
+
+	mine := map[string]bool{strings.ToLower(env.Recipient): true, strings.ToLower(env.OriginalRecipient): true}
+	for _, address := range vacation.Addresses {
+		mine[strings.ToLower(address)] = true
+	}
+	if mine[sender] {
+		return false
+	}
+	for _, name := range []string{"To", "Cc", "Bcc", "Resent-To", "Resent-Cc", "Resent-Bcc"} {
+		for _, address := range hdr.Addresses(name) {
+			if address != "" && mine[address] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// sieve_vacation answers the sender of a message with the vacation
+// response, once every so many days per response and sender.
+func sieve_vacation(cfg *Config, env *Envelope, hdr *Header, vacation *SieveVacation) error {
+	if !sieve_vacation_due(env, hdr, vacation) {
+		return nil
+	}
+	handle := vacation.Handle
+	if handle == "" {
+		sum := sha256.Sum256([]byte(vacation.Subject + "\x00" + vacation.From + "\x00" + vacation.Reason))
+		handle = hex.EncodeToString(sum[:8])
+	}
+
+	store, err := state_open(cfg, env.Home)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	due, err := store.SetNX(SIEVE_VACATION_NS, handle+":"+strings.ToLower(env.Sender), "1", time.Duration(vacation.Days)*24*time.Hour)
+	if err != nil || !due {
+		return err
+	}
+
+	random := make([]byte, 8)
+	rand.Read(random)
+	hostname, _ := os.Hostname()
+	from := vacation.From
+	if from == "" {
+		from = env.Recipient
+	}
+	subject := vacation.Subject
+	if subject == "" {
+		subject = "Auto: " + header_oneline(hdr.Get("Subject"))
+	}
+
+	var message strings.Builder
+	fmt.Fprintf(&message, "From: %s\r\n", from)
+	fmt.Fprintf(&message, "To: %s\r\n", env.Sender)
+	fmt.Fprintf(&message, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&message, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&message, "Message-ID: <%s.%s@%s>\r\n", time.Now().Format("20060102150405"), hex.EncodeToString(random), hostname)
+	if id := message_id(hdr.Get("Message-ID")); id != "" {
+		fmt.Fprintf(&message, "In-Reply-To: %s\r\n", id)
+		fmt.Fprintf(&message, "References: %s\r\n", strings.TrimSpace(strings.Join(message_ids(hdr.Get("References")), " ")+" "+id))
+	}
+	fmt.Fprintf(&message, "Auto-Submitted: auto-replied\r\n")
+	fmt.Fprintf(&message, "MIME-Version: 1.0\r\n")
+	if vacation.Mime {
+		message.WriteString(vacation.Reason)
+	} else {
+		fmt.Fprintf(&message, "Content-Type: text/plain; charset=utf-8\r\n\r\n%s", vacation.Reason)
+	}
+
+	if err := sieve_sendmail(strings.NewReader(message.String()), "", env.Sender); err != nil {
+		store.Delete(SIEVE_VACATION_NS, handle+":"+strings.ToLower(env.Sender))
+		return err
+	}
+	log_info("vacation response sent to %s", env.Sender)
+	return nil
+}
@@ -0,0 +1,470 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"math/big"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// BER encodings nested deeper than this are refused
+const SMIME_MAX_DEPTH = 64
+
+// SMIMEConfig enables the verification of S/MIME signatures:
+//
+//	smime anchors ".pmda/smime.pem"
+//
+// Signers chain to the system trust store or to the PEM certificates of
+// the anchors file, relative to the home directory, which is used when
+// it exists. The status of every message, valid, invalid or none, is
+// available to the smime condition of rules and signed messages get an
+// X-PMDA-SMIME header.
+type SMIMEConfig struct {
+	Anchors string
+}
+
+func smime_default() *SMIMEConfig {
+	return &SMIMEConfig{Anchors: filepath.Join(".pmda", "smime.pem")}
+}
+
+func smime_parse(args []string) (*SMIMEConfig, error) {
+	smime := smime_default()
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == "anchors" && i+1 < len(args):
+			smime.Anchors = args[i+1]
+			i++
+		default:
+			return nil, fmt.Errorf("usage: smime [anchors path]")
+		}
+	}
+	return smime, nil
+}
+
+var (
+	oidData          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidSignedData    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidMessageDigest = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidEmailAddress  = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 1}
+)
+
+var smimeDigests = map[string]crypto.Hash{
+	"1.3.14.3.2.26":          crypto.SHA1,
+	"2.16.840.1.101.3.4.2.1": crypto.SHA256,
+	"2.16.840.1.101.3.4.2.2": crypto.SHA384,
+	"2.16.840.1.101.3.4.2.3": crypto.SHA512,
+}
+
+var smimeSignatureAlgorithms = map[x509.PublicKeyAlgorithm]map[crypto.Hash]x509.SignatureAlgorithm{
+	x509.RSA: {
+		crypto.SHA1:   x509.SHA1WithRSA,
+		crypto.SHA256: x509.SHA256WithRSA,
+		crypto.SHA384: x509.SHA384WithRSA,
+		crypto.SHA512: x509.SHA512WithRSA,
+	},
+	x509.ECDSA: {
+		crypto.SHA1:   x509.ECDSAWithSHA1,
+		crypto.SHA256: x509.ECDSAWithSHA256,
+		crypto.SHA384: x509.ECDSAWithSHA384,
+		crypto.SHA512: x509.ECDSAWithSHA512,
+	},
+}
+
+// the CMS structures of RFC 5652 needed to verify a SignedData
+type cmsContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,tag:0"`
+}
+
+type cmsSignedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	EncapContentInfo cmsEncapsulatedContentInfo
+	Certificates     asn1.RawValue   `asn1:"optional,tag:0"`
+	CRLs             asn1.RawValue   `asn1:"optional,tag:1"`
+	SignerInfos      []cmsSignerInfo `asn1:"set"`
+}
+
+type cmsEncapsulatedContentInfo struct {
+	EContentType asn1.ObjectIdentifier
+	EContent     []byte `asn1:"explicit,optional,tag:0"`
+}
+
+type cmsSignerInfo struct {
+	Version            int
+	SID                asn1.RawValue
+	DigestAlgorithm    pkix.AlgorithmIdentifier
+	SignedAttrs        asn1.RawValue `asn1:"optional,tag:0"`
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          []byte
+	UnsignedAttrs      asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+type cmsIssuerAndSerial struct {
+	Issuer asn1.RawValue
+	Serial *big.Int
+}
+
+type cmsAttribute struct {
+	Type   asn1.ObjectIdentifier
+	Values asn1.RawValue `asn1:"set"`
+}
+
+// smime_der rewrites BER, as streamed by most S/MIME agents, into the DER
+// encoding/asn1 wants: indefinite lengths become definite and constructed
+// octet strings are flattened.
+func smime_der(data []byte) ([]byte, error) {
+	der, rest, err := smime_der_element(data, 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(bytes.TrimRight(rest, "\x00")) != 0 {
+		return nil, fmt.Errorf("trailing data after signature")
+	}
+	return der, nil
+}
+
+func smime_der_element(data []byte, depth int) ([]byte, []byte, error) {
+	if depth > SMIME_MAX_DEPTH {
+		return nil, nil, fmt.Errorf("signature nested too deep")
+	}
+	if len(data) < 2 {
+		return nil, nil, fmt.Errorf("truncated signature")
+	}
+	tag := data[0]
+	offset := 1
+	if tag&0x1f == 0x1f {
+		for offset < len(data) && data[offset]&0x80 != 0 {
+			offset++
+		}
+		offset++
+	}
+	if offset >= len(data) {
+		return nil, nil, fmt.Errorf("truncated signature")
+	}
+	header := data[:offset]
+	constructed := tag&0x20 != 0
+
+	length := int(data[offset])
+	offset++
+	indefinite := length == 0x80
+	if length > 0x80 {
+		count := length & 0x7f
+		if count > 4 || offset+count > len(data) {
+			return nil, nil, fmt.Errorf("invalid length in signature")
+		}
+		length = 0
+		for _, b := range data[offset : offset+count] {
+			length = length<<8 | int(b)
+		}
+		offset += count
+	}
+	if indefinite && !constructed {
+		return nil, nil, fmt.Errorf("indefinite length of a primitive in signature")
+	}
+	if !indefinite && (length < 0 || offset+length > len(data)) {
+		return nil, nil, fmt.Errorf("truncated signature")
+	}
+	if !constructed {
+		return smime_der_encode(header, data[offset:offset+length]), data[offset+length:], nil
+	}
+
+	rest := data[offset:]
+	content := rest
+	if !indefinite {
+		content, rest = rest[:length], rest[length:]
+	}
+	var children bytes.Buffer
+	flatten := tag == 0x24
+	for {
+		if indefinite && len(content) >= 2 && content[0] == 0 && content[1] == 0 {
+			rest = content[2:]
+			break
+		}
+		if !indefinite && len(content) == 0 {
+			break
+		}
+		child, remainder, err := smime_der_element(content, depth+1)
+		if err != nil {
+			return nil, nil, err
+		}
+		content = remainder
+		if flatten {
+			_, value, _ := smime_der_split(child)
+			children.Write(value)
+		} else {
+			children.Write(child)
+		}
+	}
+	if flatten {
+		return smime_der_encode([]byte{0x04}, children.Bytes()), rest, nil
+	}
+	return smime_der_encode(header, children.Bytes()), rest, nil
+}
+
+func smime_der_encode(header []byte, content []byte) []byte {
+	encoded := append([]byte{}, header...)
+	switch length := len(content); {
+	case length < 0x80:
+		encoded = append(encoded, byte(length))
+	case length < 0x100:
+		encoded = append(encoded, 0x81, byte(length))
+	case length < 0x10000:
+		encoded = append(encoded, 0x82, byte(length>>8), byte(length))
+	case length < 0x1000000:
+		encoded = append(encoded, 0x83, byte(length>>16), byte(length>>8), byte(length))
+	default:
+		encoded = append(encoded, 0x84, byte(length>>24), byte(length>>16), byte(length>>8), byte(length))
+	}
+	return append(encoded, content...)
+}
+
+// smime_der_split returns the header and content of a DER element.
+func smime_der_split(element []byte) ([]byte, []byte, error) {
+	var value asn1.RawValue
+	if _, err := asn1.Unmarshal(element, &value); err != nil {
+		return nil, nil, err
+	}
+	return element[:len(element)-len(value.Bytes)], value.Bytes, nil
+}
+
+// smime_verify checks a CMS SignedData over content, or over the content
+// it encapsulates when content is nil, and returns the certificate of
+// the signer once it chains to roots.
+func smime_verify(signature []byte, content []byte, roots *x509.CertPool, now time.Time) (*x509.Certificate, error) {
+	der, err := smime_der(signature)
+	if err != nil {
+		return nil, err
+	}
+	var info cmsContentInfo
+	if _, err := asn1.Unmarshal(der, &info); err != nil {
+		return nil, fmt.Errorf("invalid signature: %s", err)
+	}
+	if !info.ContentType.Equal(oidSignedData) {
+		return nil, fmt.Errorf("not a signed-data signature")
+	}
+	var signed cmsSignedData
+	if _, err := asn1.Unmarshal(info.Content.Bytes, &signed); err != nil {
+		return nil, fmt.Errorf("invalid signed-data: %s", err)
+	}
+	if content == nil {
+		content = signed.EncapContentInfo.EContent
+	}
+	if content == nil {
+		return nil, fmt.Errorf("no signed content")
+	}
+	certificates, err := x509.ParseCertificates(signed.Certificates.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid certificates: %s", err)
+	}
+	if len(signed.SignerInfos) == 0 {
+		return nil, fmt.Errorf("no signer")
+	}
+
+	// every signer must verify, as a single bad one makes the message
+	// suspicious enough
+	intermediates := x509.NewCertPool()
+	for _, certificate := range certificates {
+		intermediates.AddCert(certificate)
+	}
+	var signer *x509.Certificate
+	for _, signerInfo := range signed.SignerInfos {
+		certificate, err := smime_verify_signer(&signed, &signerInfo, certificates, content)
+		if err != nil {
+			return nil, err
+		}
+		_, err = certificate.Verify(x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: intermediates,
+			CurrentTime:   now,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageEmailProtection},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if signer == nil {
+			signer = certificate
+		}
+	}
+	return signer, nil
+}
+
+func smime_verify_signer(signed *cmsSignedData, signerInfo *cmsSignerInfo, certificates []*x509.Certificate, content []byte) (*x509.Certificate, error) {
+	var certificate *x509.Certificate
+	var issuerAndSerial cmsIssuerAndSerial
+	if signerInfo.SID.Class == asn1.ClassContextSpecific && signerInfo.SID.Tag == 0 {
+		for _, candidate := range certificates {
+			if bytes.Equal(candidate.SubjectKeyId, signerInfo.SID.Bytes) {
+				certificate = candidate
+			}
+		}
+	} else if _, err := asn1.Unmarshal(signerInfo.SID.FullBytes, &issuerAndSerial); err == nil {
+		for _, candidate := range certificates {
+			if bytes.Equal(candidate.RawIssuer, issuerAndSerial.Issuer.FullBytes) && candidate.SerialNumber.Cmp(issuerAndSerial.Serial) == 0 {
+				certificate = candidate
+			}
+		}
+	}
+	if certificate == nil {
+		return nil, fmt.Errorf("signer certificate not found")
+	}
+
+	hash, known := smimeDigests[signerInfo.DigestAlgorithm.Algorithm.String()]
+	if !known || !hash.Available() {
+		return nil, fmt.Errorf("unsupported digest %s", signerInfo.DigestAlgorithm.Algorithm)
+	}
+	algorithm := x509.PureEd25519
+	if certificate.PublicKeyAlgorithm != x509.Ed25519 {
+		if algorithm, known = smimeSignatureAlgorithms[certificate.PublicKeyAlgorithm][hash]; !known {
+			return nil, fmt.Errorf("unsupported signature algorithm %s", signerInfo.SignatureAlgorithm.Algorithm)
+		}
+	}
+
+	// without signed attributes the signature is over the content, with
+	// them it is over their DER encoding as a SET and they carry the
+	// digest of the content
+	message := content
+	if len(signerInfo.SignedAttrs.FullBytes) != 0 {
+		digest := hash.New()
+		digest.Write(content)
+		message = append([]byte{0x31}, signerInfo.SignedAttrs.FullBytes[1:]...)
+		var attributes []cmsAttribute
+		if _, err := asn1.UnmarshalWithParams(message, &attributes, "set"); err != nil {
+			return nil, fmt.Errorf("invalid signed attributes: %s", err)
+		}
+		verified := false
+		for _, attribute := range attributes {
+			var value []byte
+			if !attribute.Type.Equal(oidMessageDigest) {
+				continue
+			}
+			if _, err := asn1.Unmarshal(attribute.Values.Bytes, &value); err != nil {
+				return nil, fmt.Errorf("invalid message digest: %s", err)
+			}
+			if !bytes.Equal(value, digest.Sum(nil)) {
+				return nil, fmt.Errorf("message digest mismatch")
+			}
+			verified = true
+		}
+		if !verified {
+			return nil, fmt.Errorf("no message digest")
+		}
+	} else if !signed.EncapContentInfo.EContentType.Equal(oidData) {
+		return nil, fmt.Errorf("unsupported content type")
+	}
+	if err := certificate.CheckSignature(algorithm, message, signerInfo.Signature); err != nil {
+		return nil, fmt.Errorf("bad signature: %s", err)
+	}
+	return certificate, nil
+}
+
+// smime_roots returns the system trust store along with the anchors of
+// the user.
+func smime_roots(cfg *Config, homedir string) *x509.CertPool {
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		roots = x509.NewCertPool()
+	}
+	if cfg.SMIME == nil {
+		return roots
+	}
+	pathname := cfg.SMIME.Anchors
+	if !filepath.IsAbs(pathname) {
+		pathname = filepath.Join(homedir, pathname)
+	}
+	data, err := os.ReadFile(pathname)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log_info("error reading S/MIME anchors: %s", err)
+		}
+		return roots
+	}
+	if !roots.AppendCertsFromPEM(data) {
+		log_info("no certificate in %s", pathname)
+	}
+	return roots
+}
+
+func smime_pkcs7(mediaType string) bool {
+	return mediaType == "application/pkcs7-signature" || mediaType == "application/x-pkcs7-signature" ||
+		mediaType == "application/pkcs7-mime" || mediaType == "application/x-pkcs7-mime"
+}
+
+// smime_check verifies the signature of a stored message, detached in a
+// multipart/signed or opaque in an application/pkcs7-mime, and returns
+// its status along with the signer or what is wrong with it. A valid
+// signer must also be the author of the message.
+func smime_check(cfg *Config, env *Envelope, hdr *Header, pathname string) (string, string) {
+	mediaType, params, err := mime.ParseMediaType(hdr.Get("Content-Type"))
+	if err != nil {
+		return "none", ""
+	}
+	signed := mediaType == "multipart/signed" && smime_pkcs7(strings.ToLower(params["protocol"]))
+	opaque := (mediaType == "application/pkcs7-mime" || mediaType == "application/x-pkcs7-mime") &&
+		strings.EqualFold(params["smime-type"], "signed-data")
+	if !signed && !opaque {
+		return "none", ""
+	}
+
+	body, err := mime_read_body(pathname)
+	if err != nil {
+		return "invalid", err.Error()
+	}
+	var content, signature []byte
+	if signed {
+		var partHeader *Header
+		if content, partHeader, signature, err = mime_signed_parts(body, params["boundary"]); err != nil {
+			return "invalid", err.Error()
+		}
+		if partType, _, _ := mime.ParseMediaType(partHeader.Get("Content-Type")); !smime_pkcs7(partType) {
+			return "invalid", "no signature part"
+		}
+	} else if signature, err = mime_decode_body(hdr, body); err != nil {
+		return "invalid", err.Error()
+	}
+
+	signer, err := smime_verify(signature, content, smime_roots(cfg, env.Home), time.Now())
+	if err != nil {
+		return "invalid", err.Error()
+	}
+
+	authors := hdr.Addresses("From")
+	addresses := append([]string{}, signer.EmailAddresses...)
+	for _, name := range signer.Subject.Names {
+		if value, isString := name.Value.(string); isString && name.Type.Equal(oidEmailAddress) {
+			addresses = append(addresses, value)
+		}
+	}
+	for _, address := range addresses {
+		for _, author := range authors {
+			if strings.EqualFold(address, author) {
+				return "valid", author
+			}
+		}
+	}
+	return "invalid", "signer is not the author"
+}
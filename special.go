@@ -0,0 +1,119 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+)
+
+// SPECIAL_FOLDERS are the categories messages get classified into, the
+// folder of each named after it unless configured otherwise. Folders are
+// created when the first message is filed to them.
+var SPECIAL_FOLDERS = []string{"error", "junk", "list", "marketing", "social", "transactional"}
+
+// the folders given with -special-folder, which win over configuration
+// once applied to it by special_folder_flags
+var specialFolderFlags = make(map[string]string)
+
+func init() {
+	flag.Func("special-folder", "file a category to this folder, as in junk=.Spam, or to the inbox with junk=off", func(value string) error {
+		category, folder, found := strings.Cut(value, "=")
+		if !found {
+			return fmt.Errorf("usage: category=folder")
+		}
+		if err := special_folder_check(category, folder); err != nil {
+			return err
+		}
+		specialFolderFlags[category] = folder
+		return nil
+	})
+}
+
+// special_folder_parse handles a special-folder directive, which maps
+// a category to a folder of the user's choosing, localized names
+// included, or turns it off for its messages to stay in the inbox:
+//
+//	special-folder junk ".Spam"
+//	special-folder marketing ".Werbung"
+//	special-folder social off
+func special_folder_parse(cfg *Config, args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: special-folder category folder|off")
+	}
+	if err := special_folder_check(args[0], args[1]); err != nil {
+		return err
+	}
+	cfg.SpecialFolders[args[0]] = args[1]
+	return nil
+}
+
+// special_folder_flags applies the -special-folder flags over the
+// configuration of the delivery.
+func special_folder_flags(cfg *Config) {
+	for category, folder := range specialFolderFlags {
+		cfg.SpecialFolders[category] = folder
+	}
+}
+
+func special_folder_check(category string, folder string) error {
+	known := false
+	for _, name := range SPECIAL_FOLDERS {
+		known = known || name == category
+	}
+	if !known {
+		return fmt.Errorf("unknown category: %s", category)
+	}
+	if folder == "off" {
+		return nil
+	}
+	return folder_check(folder)
+}
+
+// folder_check refuses the names that are not Maildir++ folders: "..",
+// or empty components, would point outside the maildir.
+func folder_check(folder string) error {
+	if !strings.HasPrefix(folder, ".") || strings.Contains(folder, "/") {
+		return fmt.Errorf("invalid folder: %s", folder)
+	}
+	for _, component := range strings.Split(folder[1:], ".") {
+		if component == "" || strings.IndexFunc(component, func(r rune) bool { return r < ' ' || r == 0x7f }) >= 0 {
+			return fmt.Errorf("invalid folder: %s", folder)
+		}
+	}
+	return nil
+}
+
+// special_folder returns the folder of a category: .Junk for junk when
+// nothing says otherwise, empty for the inbox when it is off.
+func special_folder(cfg *Config, category string) string {
+	folder, found := cfg.SpecialFolders[category]
+	switch {
+	case !found:
+		return "." + strings.ToUpper(category[:1]) + category[1:]
+	case folder == "off":
+		return ""
+	}
+	return folder
+}
+
+// special_folder_is reports whether a folder is that of a category, the
+// inbox never is.
+func special_folder_is(cfg *Config, folder string, category string) bool {
+	return folder != "" && folder == special_folder(cfg, category)
+}
@@ -0,0 +1,64 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+)
+
+var noSync = flag.Bool("nosync", false, "do not wait for messages to reach the disk before reporting delivery")
+
+// file_sync flushes a message to the disk, unless told not to. It opens
+// the file anew as header fields prepended since the copy replaced it.
+func file_sync(pathname string) error {
+	if *noSync {
+		return nil
+	}
+	file, err := os.Open(pathname)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
+
+// dir_sync flushes the entries of directory and of its parents up to
+// top, which covers shard directories created for the delivery. A rename
+// only survives a crash once the directories involved are on disk.
+func dir_sync(directory string, top string) error {
+	if *noSync {
+		return nil
+	}
+	for {
+		dir, err := os.Open(directory)
+		if err != nil {
+			return err
+		}
+		err = dir.Sync()
+		dir.Close()
+		if err != nil {
+			return err
+		}
+		parent := filepath.Dir(directory)
+		if directory == top || len(parent) < len(top) || parent == directory {
+			return nil
+		}
+		directory = parent
+	}
+}
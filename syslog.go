@@ -0,0 +1,93 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/syslog"
+	"os"
+	"time"
+)
+
+var quiet = flag.Bool("q", false, "keep stderr for errors when logging to syslog")
+
+// the syslog connection of the delivery, nil unless configured
+var syslogWriter *syslog.Writer
+
+// the delivery as it is logged once over, to syslog and the event log
+var deliveryLog struct {
+	Start     time.Time
+	Sender    string
+	Recipient string
+	MessageId string
+	Verdict   string
+	Rule      *Rule
+	Trace     []string
+	Filename  string
+}
+
+// syslog_parse handles the syslog directive, which logs deliveries and
+// their failures with the mail facility:
+//
+//	syslog on
+func syslog_parse(args []string) (bool, error) {
+	if len(args) != 1 || (args[0] != "on" && args[0] != "off") {
+		return false, fmt.Errorf("usage: syslog on|off")
+	}
+	return args[0] == "on", nil
+}
+
+// syslog_open connects to syslog if the configuration asks for it, the
+// delivery proceeds without should that fail.
+func syslog_open(cfg *Config, env *Envelope) {
+	deliveryLog.Start = time.Now()
+	deliveryLog.Sender, deliveryLog.Recipient = env.Sender, env.Recipient
+	if !cfg.Syslog {
+		return
+	}
+	writer, err := syslog.New(syslog.LOG_MAIL|syslog.LOG_INFO, "mail.pmda")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error opening syslog: %s\n", err)
+		return
+	}
+	syslogWriter = writer
+}
+
+// syslog_delivery logs the outcome of a delivery, in the key=value style
+// of MTA logs, which lets analyzers join our lines to theirs on the
+// Message-ID:
+//
+//	delivered: from=<alice@example.org>, to=<bob@example.net>, message-id=<x@example.org>, size=2048, folder=INBOX, duration=0.012s
+func syslog_delivery(outcome string) {
+	if syslogWriter == nil {
+		return
+	}
+	folder := usage.Folder
+	if folder == "" {
+		folder = "-"
+	}
+	line := fmt.Sprintf("%s: from=<%s>, to=<%s>, message-id=%s, size=%d, folder=%s, duration=%.3fs", outcome,
+		header_oneline(deliveryLog.Sender), header_oneline(deliveryLog.Recipient), header_oneline(deliveryLog.MessageId),
+		usage.Bytes, folder, time.Since(deliveryLog.Start).Seconds())
+	switch outcome {
+	case "rejected", "limited":
+		syslogWriter.Warning(line)
+	default:
+		syslogWriter.Info(line)
+	}
+}
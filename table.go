@@ -0,0 +1,126 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+)
+
+const TABLE_PROTOCOL = "0.1"
+
+var tableFlags = flag.NewFlagSet("table", flag.ExitOnError)
+
+// table_main implements "mail.pmda table", an OpenSMTPD proc-exec table:
+//
+//	table users proc-exec:"/usr/local/bin/mail.pmda table"
+//	action "local" mda "/usr/local/bin/mail.pmda" userbase <users>
+//
+// smtpd sends a few config lines ending with "config|ready", we register
+// the services we provide and then answer requests of the form
+//
+//	table|<version>|<timestamp>|<table>|<operation>|<service>|<id>[|<key>]
+//
+// with "<operation>-result|<id>|found|<value>", "...|not-found" or
+// "...|failure". The userinfo service resolves system users, the string
+// service returns the maildir a user delivers to, as the MDA computes it.
+func table_main(args []string) int {
+	tableFlags.Parse(args)
+	if tableFlags.NArg() != 0 {
+		fmt.Fprintf(os.Stderr, "Usage: %s table\n", os.Args[0])
+		return 1
+	}
+
+	scanner := bufio.NewScanner(os.Stdin)
+	writer := bufio.NewWriter(os.Stdout)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "|")
+		if len(fields) < 2 {
+			continue
+		}
+
+		switch fields[0] {
+		case "config":
+			if fields[1] == "ready" {
+				fmt.Fprintf(writer, "register|userinfo\n")
+				fmt.Fprintf(writer, "register|string\n")
+				fmt.Fprintf(writer, "register|ready\n")
+			}
+
+		case "table":
+			if len(fields) < 7 {
+				fmt.Fprintf(os.Stderr, "invalid table request: %s\n", scanner.Text())
+				return 1
+			}
+			if fields[1] != TABLE_PROTOCOL {
+				fmt.Fprintf(os.Stderr, "unsupported table protocol version: %s\n", fields[1])
+				return 1
+			}
+			operation, service, id := fields[4], fields[5], fields[6]
+			key := strings.Join(fields[7:], "|")
+
+			switch operation {
+			case "check", "lookup":
+				value, status := table_lookup(service, key)
+				if operation == "check" || status != "found" {
+					fmt.Fprintf(writer, "%s-result|%s|%s\n", operation, id, status)
+				} else {
+					fmt.Fprintf(writer, "%s-result|%s|%s|%s\n", operation, id, status, value)
+				}
+			case "update":
+				fmt.Fprintf(writer, "update-result|%s|ok\n", id)
+			default:
+				fmt.Fprintf(writer, "%s-result|%s|failure\n", operation, id)
+			}
+		}
+		writer.Flush()
+	}
+	writer.Flush()
+	return 0
+}
+
+// table_lookup resolves a key for a service, returning the value and the
+// protocol status.
+func table_lookup(service string, key string) (string, string) {
+	// keys may come as full addresses depending on the action
+	username, _, _ := strings.Cut(strings.ToLower(key), "@")
+	username, _, _ = strings.Cut(username, "+")
+
+	account, err := user.Lookup(username)
+	if err != nil {
+		if _, unknown := err.(user.UnknownUserError); unknown {
+			return "", "not-found"
+		}
+		return "", "failure"
+	}
+
+	switch service {
+	case "userinfo":
+		return fmt.Sprintf("%s:%s:%s", account.Uid, account.Gid, account.HomeDir), "found"
+	case "string":
+		cfg, err := config_read(filepath.Join(account.HomeDir, ".pmda.conf"))
+		if err != nil {
+			return "", "failure"
+		}
+		return maildir_resolve(cfg, account.HomeDir), "found"
+	}
+	return "", "failure"
+}
@@ -0,0 +1,146 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// the accounting log is polled, deliveries are not worth a watcher
+const TAIL_POLL = 500 * time.Millisecond
+
+var tailFlags = flag.NewFlagSet("tail", flag.ExitOnError)
+var tailLines = tailFlags.Int("n", 10, "number of past deliveries to print first")
+var tailJson = tailFlags.Bool("json", false, "output deliveries as JSON, one object per line")
+
+func tail_print(entry *UsageEntry) {
+	if *tailJson {
+		data, _ := json.Marshal(entry)
+		fmt.Printf("%s\n", data)
+		return
+	}
+	folder := entry.Folder
+	if folder == "" {
+		folder = "-"
+	}
+	fmt.Printf("%s %-10s %-24s %8d bytes %8s cpu\n", entry.Time.Format("2006-01-02 15:04:05"), entry.Outcome,
+		folder, entry.Bytes, entry.CPU.Round(time.Millisecond/10))
+}
+
+// tail_history prints the last deliveries of the log and returns the
+// offset following them.
+func tail_history(file *os.File, count int) (int64, error) {
+	history := make([]*UsageEntry, 0, count)
+	reader := bufio.NewReader(file)
+	offset := int64(0)
+	for {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		offset += int64(len(line))
+		if entry, ok := usage_parse(line); ok && count != 0 {
+			if len(history) == count {
+				history = history[1:]
+			}
+			history = append(history, entry)
+		}
+	}
+	for _, entry := range history {
+		tail_print(entry)
+	}
+	return offset, nil
+}
+
+// tail_main implements "mail.pmda tail", which follows the accounting
+// log of deliveries and prints them as they happen. The log is reopened
+// when it is rotated or truncated.
+func tail_main(args []string) int {
+	tailFlags.Parse(args)
+	if tailFlags.NArg() != 0 || *tailLines < 0 {
+		fmt.Fprintf(os.Stderr, "Usage: %s tail [-json] [-n count]\n", os.Args[0])
+		return 1
+	}
+
+	pathname := filepath.Join(os.Getenv("HOME"), ".pmda", "usage")
+	var file *os.File
+	var reader *bufio.Reader
+	offset, partial := int64(0), ""
+	defer func() {
+		if file != nil {
+			file.Close()
+		}
+	}()
+	for first := true; ; first = false {
+		if file == nil {
+			var err error
+			if file, err = os.Open(pathname); err != nil && !os.IsNotExist(err) {
+				fmt.Fprintf(os.Stderr, "Error opening %s: %s\n", pathname, err)
+				return 1
+			}
+			if file != nil {
+				// a log reopened only holds deliveries not printed yet
+				offset = 0
+				if first {
+					if offset, err = tail_history(file, *tailLines); err != nil {
+						fmt.Fprintf(os.Stderr, "Error reading %s: %s\n", pathname, err)
+						return 1
+					}
+				}
+				reader, partial = bufio.NewReader(file), ""
+			}
+		}
+
+		for file != nil {
+			line, err := reader.ReadString('\n')
+			offset += int64(len(line))
+			if err == io.EOF {
+				partial += line
+				break
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error reading %s: %s\n", pathname, err)
+				return 1
+			}
+			if entry, ok := usage_parse(partial + line); ok {
+				tail_print(entry)
+			}
+			partial = ""
+		}
+		time.Sleep(TAIL_POLL)
+
+		if file == nil {
+			continue
+		}
+		current, err := os.Stat(pathname)
+		opened, _ := file.Stat()
+		if err != nil || opened == nil || !os.SameFile(current, opened) || current.Size() < offset {
+			file.Close()
+			file = nil
+		}
+	}
+}
@@ -0,0 +1,75 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"strconv"
+	"time"
+)
+
+const THREADS_NS = "threads"
+
+// threads are forgotten this long after they started
+const THREAD_TTL = 90 * 24 * time.Hour
+
+// The thread index maps the Message-ID of every message delivered to the
+// root of its thread, and counts the messages of each thread, so that a
+// reply lacking References still finds its thread from In-Reply-To.
+
+// thread_root returns the root of the thread of a message: the first of
+// its References, the thread of the message it replies to, or itself.
+func thread_root(store StateStore, hdr *Header) string {
+	for _, references := range hdr.Values("References") {
+		if ids := message_ids(references); len(ids) != 0 {
+			return ids[0]
+		}
+	}
+	if parent := message_id(hdr.Get("In-Reply-To")); parent != "" {
+		if root, found, err := store.Get(THREADS_NS, "msg:"+parent); err == nil && found {
+			return root
+		}
+		return parent
+	}
+	return message_id(hdr.Get("Message-ID"))
+}
+
+// thread_activity returns how many messages of the thread of a message
+// were delivered before it.
+func thread_activity(store StateStore, hdr *Header) int64 {
+	root := thread_root(store, hdr)
+	if root == "" {
+		return 0
+	}
+	value, _, _ := store.Get(THREADS_NS, "count:"+root)
+	count, _ := strconv.ParseInt(value, 10, 64)
+	return count
+}
+
+// thread_record adds a delivered message to the index.
+func thread_record(store StateStore, hdr *Header) error {
+	root := thread_root(store, hdr)
+	if root == "" {
+		return nil
+	}
+	if id := message_id(hdr.Get("Message-ID")); id != "" {
+		if err := store.Set(THREADS_NS, "msg:"+id, root, THREAD_TTL); err != nil {
+			return err
+		}
+	}
+	_, err := store.Incr(THREADS_NS, "count:"+root, THREAD_TTL)
+	return err
+}
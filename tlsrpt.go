@@ -0,0 +1,184 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// tlsrptReport is the part of an RFC 8460 report kept.
+type tlsrptReport struct {
+	Organization string `json:"organization-name"`
+	ReportId     string `json:"report-id"`
+	DateRange    struct {
+		Start time.Time `json:"start-datetime"`
+		End   time.Time `json:"end-datetime"`
+	} `json:"date-range"`
+	Policies []struct {
+		Policy struct {
+			Type   string `json:"policy-type"`
+			Domain string `json:"policy-domain"`
+		} `json:"policy"`
+		Summary struct {
+			Successful int64 `json:"total-successful-session-count"`
+			Failed     int64 `json:"total-failure-session-count"`
+		} `json:"summary"`
+		FailureDetails []struct {
+			ResultType string `json:"result-type"`
+			Count      int64  `json:"failed-session-count"`
+		} `json:"failure-details"`
+	} `json:"policies"`
+}
+
+// TlsReport is the normalized summary of a TLS report.
+type TlsReport struct {
+	Org      string      `json:"org"`
+	ReportId string      `json:"report_id"`
+	Begin    time.Time   `json:"begin"`
+	End      time.Time   `json:"end"`
+	Policies []TlsPolicy `json:"policies"`
+}
+
+// TlsPolicy counts the sessions of a policy, failures by result type.
+type TlsPolicy struct {
+	Domain     string           `json:"domain"`
+	Type       string           `json:"type"`
+	Successful int64            `json:"successful"`
+	Failed     int64            `json:"failed"`
+	Failures   map[string]int64 `json:"failures,omitempty"`
+}
+
+func init() {
+	report_register(&ReportKind{
+		Name:      "tls",
+		Folder:    ".Reports.TLS",
+		parse:     tlsrpt_parse,
+		key:       tlsrpt_key,
+		summarize: tlsrpt_summarize,
+	})
+}
+
+// tlsrpt_parse recognizes a TLS report by its media type, the JSON
+// document being gzipped or not.
+func tlsrpt_parse(part *MimePart) (any, error) {
+	if part.MediaType != "application/tlsrpt+gzip" && part.MediaType != "application/tlsrpt+json" {
+		return nil, nil
+	}
+
+	data, err := report_payload(part)
+	if err != nil {
+		return nil, err
+	}
+	var raw tlsrptReport
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	report := &TlsReport{
+		Org:      raw.Organization,
+		ReportId: raw.ReportId,
+		Begin:    raw.DateRange.Start.UTC(),
+		End:      raw.DateRange.End.UTC(),
+		Policies: make([]TlsPolicy, 0, len(raw.Policies)),
+	}
+	for _, policy := range raw.Policies {
+		normalized := TlsPolicy{
+			Domain:     strings.ToLower(policy.Policy.Domain),
+			Type:       policy.Policy.Type,
+			Successful: policy.Summary.Successful,
+			Failed:     policy.Summary.Failed,
+		}
+		for _, failure := range policy.FailureDetails {
+			if normalized.Failures == nil {
+				normalized.Failures = make(map[string]int64)
+			}
+			normalized.Failures[failure.ResultType] += failure.Count
+		}
+		report.Policies = append(report.Policies, normalized)
+	}
+	return report, nil
+}
+
+func tlsrpt_key(summary json.RawMessage) string {
+	var report TlsReport
+	if json.Unmarshal(summary, &report) != nil || report.ReportId == "" {
+		return ""
+	}
+	return report.Org + "\x00" + report.ReportId
+}
+
+// tlsrpt_summarize reports, per policy, how many sessions reporters
+// established and why the others failed.
+func tlsrpt_summarize(summaries []json.RawMessage, asJson bool) error {
+	policies := make(map[string]*TlsPolicy)
+	for _, summary := range summaries {
+		var report TlsReport
+		if err := json.Unmarshal(summary, &report); err != nil {
+			continue
+		}
+		for _, policy := range report.Policies {
+			key := policy.Domain + " " + policy.Type
+			total, exists := policies[key]
+			if !exists {
+				total = &TlsPolicy{Domain: policy.Domain, Type: policy.Type, Failures: make(map[string]int64)}
+				policies[key] = total
+			}
+			total.Successful += policy.Successful
+			total.Failed += policy.Failed
+			for result, count := range policy.Failures {
+				total.Failures[result] += count
+			}
+		}
+	}
+
+	sorted := make([]*TlsPolicy, 0, len(policies))
+	for _, policy := range policies {
+		sorted = append(sorted, policy)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Domain != sorted[j].Domain {
+			return sorted[i].Domain < sorted[j].Domain
+		}
+		return sorted[i].Type < sorted[j].Type
+	})
+
+	if asJson {
+		data, err := json.MarshalIndent(sorted, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s\n", data)
+		return nil
+	}
+
+	fmt.Printf("%d reports\n", len(summaries))
+	for _, policy := range sorted {
+		fmt.Printf("%s %s: %d successful, %d failed\n", policy.Domain, policy.Type, policy.Successful, policy.Failed)
+		results := make([]string, 0, len(policy.Failures))
+		for result := range policy.Failures {
+			results = append(results, result)
+		}
+		sort.Strings(results)
+		for _, result := range results {
+			fmt.Printf("  %s: %d\n", result, policy.Failures[result])
+		}
+	}
+	return nil
+}
@@ -0,0 +1,422 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// TrashConfig is where the messages deleted by expiry, dedup and the
+// other automated features go before they are purged for good, after a
+// window left for restoring them:
+//
+//	trash folder ".Trash" keep 30
+//	trash off
+//
+// Only messages put there by us are ever purged, those the user deleted
+// into the same folder are left to the MUA.
+type TrashConfig struct {
+	Folder string
+	Days   int
+}
+
+func trash_default() *TrashConfig {
+	return &TrashConfig{Folder: ".Trash", Days: 30}
+}
+
+func trash_parse(args []string) (*TrashConfig, error) {
+	if len(args) == 1 && args[0] == "off" {
+		return nil, nil
+	}
+	trash := trash_default()
+	if len(args) == 0 || len(args)%2 != 0 {
+		return nil, fmt.Errorf("usage: trash [folder name] [keep days] | trash off")
+	}
+	for i := 0; i < len(args); i += 2 {
+		switch args[i] {
+		case "folder":
+			if args[i+1] == "" || args[i+1][0] != '.' {
+				return nil, fmt.Errorf("invalid folder: %s", args[i+1])
+			}
+			trash.Folder = args[i+1]
+		case "keep":
+			days, err := strconv.Atoi(args[i+1])
+			if err != nil || days < 1 {
+				return nil, fmt.Errorf("invalid retention: %s", args[i+1])
+			}
+			trash.Days = days
+		default:
+			return nil, fmt.Errorf("usage: trash [folder name] [keep days] | trash off")
+		}
+	}
+	return trash, nil
+}
+
+// TrashEntry records a message moved to the trash, File being its maildir
+// unique name and Folder the one it is restored to.
+type TrashEntry struct {
+	Time    time.Time `json:"time"`
+	Maildir string    `json:"maildir"`
+	Folder  string    `json:"folder"`
+	File    string    `json:"file"`
+	Reason  string    `json:"reason"`
+}
+
+func trash_path(homedir string) string {
+	return filepath.Join(homedir, ".pmda", "trash")
+}
+
+// trash_lock serializes the changes to the trash index, deliveries
+// appending to it as purges rewrite it.
+func trash_lock(homedir string) (*os.File, error) {
+	pathname := trash_path(homedir) + ".lock"
+	if err := os.MkdirAll(filepath.Dir(pathname), 0700); err != nil {
+		return nil, err
+	}
+	lock, err := os.OpenFile(pathname, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := lock_file(lock, LOCK_TIMEOUT); err != nil {
+		lock.Close()
+		return nil, err
+	}
+	return lock, nil
+}
+
+// trash_load reads the trash index, the caller holding the lock.
+func trash_load(homedir string) ([]*TrashEntry, error) {
+	file, err := os.Open(trash_path(homedir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	entries := make([]*TrashEntry, 0)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), LINE_READ_MAX)
+	for scanner.Scan() {
+		entry := &TrashEntry{}
+		if json.Unmarshal(scanner.Bytes(), entry) == nil {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// trash_save replaces the trash index, the caller holding the lock.
+func trash_save(homedir string, entries []*TrashEntry) error {
+	pathname := trash_path(homedir)
+	tmpname := fmt.Sprintf("%s.%d", pathname, os.Getpid())
+	file, err := os.OpenFile(tmpname, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	for _, entry := range entries {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			file.Close()
+			os.Remove(tmpname)
+			return err
+		}
+		writer.Write(append(data, '\n'))
+	}
+	err = writer.Flush()
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpname, pathname)
+	}
+	if err != nil {
+		os.Remove(tmpname)
+	}
+	return err
+}
+
+// trash_subdir returns the new or cur subdirectory a message is in, that
+// of a message of tmp being new.
+func trash_subdir(pathname string) string {
+	for directory := filepath.Dir(pathname); directory != filepath.Dir(directory); directory = filepath.Dir(directory) {
+		switch name := filepath.Base(directory); name {
+		case "new", "cur":
+			return name
+		case "tmp":
+			return "new"
+		}
+	}
+	return "new"
+}
+
+// trash_move moves a message to the trash of a maildir and records where
+// it came from, leaving the quota to the caller as moves within the
+// maildir leave it unchanged.
+func trash_move(cfg *Config, homedir string, maildir string, pathname string, folder string, reason string) error {
+	trash := filepath.Join(maildir, cfg.Trash.Folder)
+	if maildir_mkdirs(trash) {
+		folder_metadata(cfg, cfg.Trash.Folder)
+		folder_subscribe(maildir, cfg.Trash.Folder)
+	}
+	target, err := maildir_path(filepath.Join(trash, trash_subdir(pathname)), filepath.Base(pathname), shard_depth(maildir))
+	if err != nil {
+		return err
+	}
+
+	lock, err := trash_lock(homedir)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err := os.Rename(pathname, target); err != nil {
+		return err
+	}
+	entry := &TrashEntry{
+		Time:    time.Now(),
+		Maildir: maildir,
+		Folder:  folder,
+		File:    maildir_unique(filepath.Base(pathname)),
+		Reason:  reason,
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(trash_path(homedir), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.Write(append(data, '\n'))
+	return err
+}
+
+// trash_remove deletes a stored message of a folder, moving it to the
+// trash unless it is off.
+func trash_remove(cfg *Config, homedir string, maildir string, pathname string, folder string, reason string) error {
+	if cfg.Trash != nil {
+		return trash_move(cfg, homedir, maildir, pathname, folder, reason)
+	}
+	size := message_size(pathname)
+	if err := os.Remove(pathname); err != nil {
+		return err
+	}
+	quota_add(cfg, maildir, -size, -1)
+	return nil
+}
+
+// trash_locate returns where the message of an entry is in the trash,
+// empty if it is no longer there.
+func trash_locate(cfg *Config, entry *TrashEntry) string {
+	found := ""
+	for _, subdir := range []string{"new", "cur"} {
+		maildir_walk(filepath.Join(entry.Maildir, cfg.Trash.Folder, subdir), func(pathname string, dirent fs.DirEntry) error {
+			if maildir_unique(dirent.Name()) == entry.File {
+				found = pathname
+				return errWalkStop
+			}
+			return nil
+		})
+		if found != "" {
+			break
+		}
+	}
+	return found
+}
+
+// trash_purge deletes for good the messages trashed before limit, and
+// forgets those no longer in the trash, returning how many were deleted.
+func trash_purge(cfg *Config, homedir string, limit time.Time) (int, error) {
+	lock, err := trash_lock(homedir)
+	if err != nil {
+		return 0, err
+	}
+	defer lock.Close()
+	entries, err := trash_load(homedir)
+	if err != nil || len(entries) == 0 {
+		return 0, err
+	}
+
+	kept := make([]*TrashEntry, 0, len(entries))
+	purged := 0
+	for _, entry := range entries {
+		pathname := trash_locate(cfg, entry)
+		if pathname == "" {
+			continue
+		}
+		if !entry.Time.Before(limit) {
+			kept = append(kept, entry)
+			continue
+		}
+		size := message_size(pathname)
+		if err := os.Remove(pathname); err != nil && !os.IsNotExist(err) {
+			kept = append(kept, entry)
+			continue
+		}
+		quota_add(cfg, entry.Maildir, -size, -1)
+		purged++
+	}
+	return purged, trash_save(homedir, kept)
+}
+
+// trash_expire is the purge as run after a delivery, once a day at
+// most.
+func trash_expire(cfg *Config, env *Envelope, now time.Time) {
+	if cfg.Trash == nil {
+		return
+	}
+	store := &LocalStore{directory: filepath.Join(env.Home, ".pmda", "state")}
+	if due, err := store.SetNX(EXPIRE_NS, "trash", "1", EXPIRE_INTERVAL); err != nil || !due {
+		return
+	}
+	purged, err := trash_purge(cfg, env.Home, now.AddDate(0, 0, -cfg.Trash.Days))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error purging trash: %s\n", err)
+		return
+	}
+	if purged != 0 {
+		log_info("trash: %d purged", purged)
+	}
+}
+
+var purgeFlags = flag.NewFlagSet("purge", flag.ExitOnError)
+var purgeAll = purgeFlags.Bool("all", false, "purge the whole trash rather than what is past its retention")
+
+// purge_main implements "mail.pmda purge", which deletes for good the
+// messages the trash kept for their retention, or all of them.
+func purge_main(args []string) int {
+	purgeFlags.Parse(args)
+	if purgeFlags.NArg() != 0 {
+		fmt.Fprintf(os.Stderr, "Usage: %s purge [-all]\n", os.Args[0])
+		return 1
+	}
+	homedir := os.Getenv("HOME")
+	cfg, err := config_read(filepath.Join(homedir, ".pmda.conf"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading configuration: %s\n", err)
+		return 1
+	}
+	if cfg.Trash == nil {
+		fmt.Fprintf(os.Stderr, "Error: the trash is off\n")
+		return 1
+	}
+
+	limit := time.Now().AddDate(0, 0, -cfg.Trash.Days)
+	if *purgeAll {
+		limit = time.Now().Add(time.Second)
+	}
+	purged, err := trash_purge(cfg, homedir, limit)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error purging trash: %s\n", err)
+		return 1
+	}
+	fmt.Printf("%d purged\n", purged)
+	return 0
+}
+
+var restoreFlags = flag.NewFlagSet("restore", flag.ExitOnError)
+
+// restore_main implements "mail.pmda restore", which lists the messages
+// in the trash or moves those named back to where they were deleted
+// from:
+//
+//	1718000000.M1P2Q3.host,S=2048,W=2090  .Junk.Trash  expire  2024-06-10 08:13
+func restore_main(args []string) int {
+	restoreFlags.Parse(args)
+	homedir := os.Getenv("HOME")
+	cfg, err := config_read(filepath.Join(homedir, ".pmda.conf"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading configuration: %s\n", err)
+		return 1
+	}
+	if cfg.Trash == nil {
+		fmt.Fprintf(os.Stderr, "Error: the trash is off\n")
+		return 1
+	}
+
+	lock, err := trash_lock(homedir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error locking trash: %s\n", err)
+		return 1
+	}
+	defer lock.Close()
+	entries, err := trash_load(homedir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading trash: %s\n", err)
+		return 1
+	}
+	if restoreFlags.NArg() == 0 {
+		for _, entry := range entries {
+			if trash_locate(cfg, entry) != "" {
+				fmt.Printf("%s  %s  %s  %s\n", entry.File, folder_name(entry.Folder), entry.Reason, entry.Time.Local().Format("2006-01-02 15:04"))
+			}
+		}
+		return 0
+	}
+
+	wanted := make(map[string]bool)
+	for _, file := range restoreFlags.Args() {
+		wanted[maildir_unique(filepath.Base(file))] = true
+	}
+	kept := make([]*TrashEntry, 0, len(entries))
+	status := 0
+	for _, entry := range entries {
+		if !wanted[entry.File] {
+			kept = append(kept, entry)
+			continue
+		}
+		delete(wanted, entry.File)
+		pathname := trash_locate(cfg, entry)
+		if pathname == "" {
+			fmt.Fprintf(os.Stderr, "Error: %s is no longer in the trash\n", entry.File)
+			status = 1
+			continue
+		}
+		maildir_folder(cfg, entry.Maildir, entry.Folder)
+		target, err := maildir_path(filepath.Join(entry.Maildir, entry.Folder, trash_subdir(pathname)), filepath.Base(pathname), shard_depth(entry.Maildir))
+		if err == nil {
+			err = os.Rename(pathname, target)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error restoring %s: %s\n", entry.File, err)
+			kept = append(kept, entry)
+			status = 1
+			continue
+		}
+		fmt.Printf("%s restored to %s\n", entry.File, folder_name(entry.Folder))
+	}
+	for file := range wanted {
+		fmt.Fprintf(os.Stderr, "Error: %s is not in the trash\n", file)
+		status = 1
+	}
+	if err := trash_save(homedir, kept); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing trash: %s\n", err)
+		return 1
+	}
+	return status
+}
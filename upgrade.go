@@ -0,0 +1,286 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const UPGRADE_TIMEOUT = 5 * time.Minute
+
+// a manifest larger than this is not one
+const UPGRADE_MANIFEST_MAX = 1024 * 1024
+
+// nor is a binary larger than this
+const UPGRADE_BINARY_MAX = 512 * 1024 * 1024
+
+// UpgradeConfig is where releases are published, for deployments of the
+// single binary without a package manager. It is only read from the
+// system configuration:
+//
+//	upgrade manifest "https://example.org/mail.pmda/manifest.json" key "/etc/mail.pmda.pub"
+//
+// The manifest lists the binary of each platform with its checksum and
+// comes with an Ed25519 signature of its bytes, base64 encoded in the
+// same URL with .sig appended. The key file holds the base64 encoded
+// public key the signature is checked against:
+//
+//	{"version": "1.3.0", "binaries": {"linux/amd64": {"url": "https://...", "sha256": "..."}}}
+type UpgradeConfig struct {
+	Manifest string
+	Key      string
+}
+
+type UpgradeBinary struct {
+	URL    string `json:"url"`
+	SHA256 string `json:"sha256"`
+}
+
+type UpgradeManifest struct {
+	Version  string                   `json:"version"`
+	Binaries map[string]UpgradeBinary `json:"binaries"`
+}
+
+func upgrade_parse(args []string) (*UpgradeConfig, error) {
+	if len(args) != 4 || args[0] != "manifest" || args[2] != "key" {
+		return nil, fmt.Errorf("usage: upgrade manifest url key path")
+	}
+	if !strings.HasPrefix(args[1], "https://") {
+		return nil, fmt.Errorf("invalid url: %s", args[1])
+	}
+	return &UpgradeConfig{Manifest: args[1], Key: args[3]}, nil
+}
+
+var upgradeClient = &http.Client{Timeout: UPGRADE_TIMEOUT}
+
+func upgrade_fetch(url string, w io.Writer, max int64) error {
+	resp, err := upgradeClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: unexpected status: %s", url, resp.Status)
+	}
+	n, err := io.Copy(w, io.LimitReader(resp.Body, max+1))
+	if err != nil {
+		return err
+	}
+	if n > max {
+		return fmt.Errorf("%s: exceeds %d bytes", url, max)
+	}
+	return nil
+}
+
+// signature_verify checks the base64 encoded Ed25519 signature of data
+// against the base64 encoded public key held in keyfile.
+func signature_verify(keyfile string, data []byte, sig []byte) error {
+	encoded, err := os.ReadFile(keyfile)
+	if err != nil {
+		return err
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encoded)))
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return fmt.Errorf("%s: not an Ed25519 public key", keyfile)
+	}
+	signature, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(sig)))
+	if err != nil || !ed25519.Verify(ed25519.PublicKey(key), data, signature) {
+		return fmt.Errorf("bad signature")
+	}
+	return nil
+}
+
+// upgrade_manifest fetches the manifest and returns it once its
+// signature checked.
+func upgrade_manifest(upgrade *UpgradeConfig) (*UpgradeManifest, error) {
+	var data, sig bytes.Buffer
+	if err := upgrade_fetch(upgrade.Manifest, &data, UPGRADE_MANIFEST_MAX); err != nil {
+		return nil, err
+	}
+	if err := upgrade_fetch(upgrade.Manifest+".sig", &sig, UPGRADE_MANIFEST_MAX); err != nil {
+		return nil, err
+	}
+	if err := signature_verify(upgrade.Key, data.Bytes(), sig.Bytes()); err != nil {
+		return nil, fmt.Errorf("manifest: %s", err)
+	}
+
+	manifest := &UpgradeManifest{}
+	if err := json.Unmarshal(data.Bytes(), manifest); err != nil {
+		return nil, err
+	}
+	if manifest.Version == "" {
+		return nil, fmt.Errorf("manifest has no version")
+	}
+	return manifest, nil
+}
+
+// version_newer reports whether release a follows release b, comparing
+// their dot-separated numbers. Development builds precede every release.
+func version_newer(a string, b string) bool {
+	if b == "dev" {
+		return a != "dev"
+	}
+	x, y := strings.Split(strings.TrimPrefix(a, "v"), "."), strings.Split(strings.TrimPrefix(b, "v"), ".")
+	for i := 0; i < max(len(x), len(y)); i++ {
+		m, n := 0, 0
+		if i < len(x) {
+			m, _ = strconv.Atoi(x[i])
+		}
+		if i < len(y) {
+			n, _ = strconv.Atoi(y[i])
+		}
+		if m != n {
+			return m > n
+		}
+	}
+	return false
+}
+
+// upgrade_stage downloads the binary of a release next to the running
+// one and checks it is what the manifest says, down to running it.
+func upgrade_stage(manifest *UpgradeManifest, binary UpgradeBinary, staged string) error {
+	file, err := os.OpenFile(staged, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
+	if err != nil {
+		return err
+	}
+	hash := sha256.New()
+	err = upgrade_fetch(binary.URL, io.MultiWriter(file, hash), UPGRADE_BINARY_MAX)
+	if err == nil {
+		err = file.Sync()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if sum := hex.EncodeToString(hash.Sum(nil)); !strings.EqualFold(sum, binary.SHA256) {
+		return fmt.Errorf("checksum mismatch: %s", sum)
+	}
+
+	output, err := exec.Command(staged, "version", "-json").Output()
+	if err != nil {
+		return fmt.Errorf("staged binary does not run: %s", err)
+	}
+	description := &buildDescription{}
+	if err := json.Unmarshal(output, description); err != nil || description.Version != manifest.Version {
+		return fmt.Errorf("staged binary is not version %s", manifest.Version)
+	}
+	return nil
+}
+
+var upgradeFlags = flag.NewFlagSet("upgrade", flag.ExitOnError)
+var upgradeCheck = upgradeFlags.Bool("n", false, "only check whether a newer release is available")
+
+// upgrade_main implements "mail.pmda upgrade", which replaces the binary
+// by the newest release of the manifest. The new binary is staged and
+// checked first, then swapped in by a rename so that deliveries starting
+// meanwhile run one or the other, the previous one being kept as .old
+// for "mail.pmda upgrade rollback" to swap back.
+func upgrade_main(args []string) int {
+	upgradeFlags.Parse(args)
+	if upgradeFlags.NArg() > 1 || (upgradeFlags.NArg() == 1 && upgradeFlags.Arg(0) != "rollback") {
+		fmt.Fprintf(os.Stderr, "Usage: %s upgrade [-n] [rollback]\n", os.Args[0])
+		return 1
+	}
+
+	executable, err := os.Executable()
+	if err == nil {
+		executable, err = filepath.EvalSymlinks(executable)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error locating binary: %s\n", err)
+		return 1
+	}
+	previous, staged := executable+".old", executable+".new"
+
+	if upgradeFlags.Arg(0) == "rollback" {
+		if err := os.Rename(previous, executable); err != nil {
+			fmt.Fprintf(os.Stderr, "Error rolling back: %s\n", err)
+			return 1
+		}
+		fmt.Printf("rolled back to %s\n", previous)
+		return 0
+	}
+
+	// only the system file says where root fetches binaries from
+	cfg, err := config_system()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading configuration: %s\n", err)
+		return 1
+	}
+	if cfg.Upgrade == nil {
+		fmt.Fprintf(os.Stderr, "Error: no upgrade manifest in %s\n", systemConfig)
+		return 1
+	}
+	manifest, err := upgrade_manifest(cfg.Upgrade)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading manifest: %s\n", err)
+		return 1
+	}
+	if !version_newer(manifest.Version, version) {
+		fmt.Printf("mail.pmda %s is up to date\n", version)
+		return 0
+	}
+	platform := runtime.GOOS + "/" + runtime.GOARCH
+	binary, found := manifest.Binaries[platform]
+	if !found {
+		fmt.Fprintf(os.Stderr, "Error: release %s has no binary for %s\n", manifest.Version, platform)
+		return 1
+	}
+	if *upgradeCheck {
+		fmt.Printf("mail.pmda %s is available, running %s\n", manifest.Version, version)
+		return 0
+	}
+
+	if err := upgrade_stage(manifest, binary, staged); err != nil {
+		os.Remove(staged)
+		fmt.Fprintf(os.Stderr, "Error staging %s: %s\n", manifest.Version, err)
+		return 1
+	}
+	os.Remove(previous)
+	if err := os.Link(executable, previous); err != nil {
+		os.Remove(staged)
+		fmt.Fprintf(os.Stderr, "Error keeping %s: %s\n", previous, err)
+		return 1
+	}
+	if err := os.Rename(staged, executable); err != nil {
+		os.Remove(staged)
+		os.Remove(previous)
+		fmt.Fprintf(os.Stderr, "Error installing %s: %s\n", manifest.Version, err)
+		return 1
+	}
+	dir_sync(filepath.Dir(executable), filepath.Dir(executable))
+	fmt.Printf("upgraded from %s to %s\n", version, manifest.Version)
+	return 0
+}
@@ -0,0 +1,247 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// UsageLimits are the per-delivery ceilings of a user, zero means none.
+// A delivery going beyond one is tempfailed before the message is
+// committed, protecting shared hosts from pathological rules.
+type UsageLimits struct {
+	CPU  time.Duration
+	Size int64
+	Exec time.Duration
+}
+
+// Usage accounts for the resources consumed by the current delivery,
+// and the folder it filed the message to once decided.
+type Usage struct {
+	CPU    time.Duration
+	Bytes  int64
+	Exec   time.Duration
+	Folder string
+}
+
+var usage Usage
+
+// usage_exec accounts for the wall time of an external command, callers
+// record the start time and defer or call this once it has returned.
+func usage_exec(started time.Time) {
+	usage.Exec += time.Since(started)
+}
+
+// usage_cpu returns the user and system time of the process and of the
+// commands it waited for.
+func usage_cpu() time.Duration {
+	total := time.Duration(0)
+	for _, who := range []int{syscall.RUSAGE_SELF, syscall.RUSAGE_CHILDREN} {
+		var rusage syscall.Rusage
+		if err := syscall.Getrusage(who, &rusage); err == nil {
+			total += time.Duration(rusage.Utime.Nano() + rusage.Stime.Nano())
+		}
+	}
+	return total
+}
+
+// usage_check captures the usage so far and reports the first ceiling
+// exceeded, pathname being the message written so far.
+func usage_check(cfg *Config, pathname string) error {
+	usage.CPU = usage_cpu()
+	if st, err := os.Stat(pathname); err == nil {
+		usage.Bytes = st.Size()
+	}
+
+	limits := cfg.Limits
+	switch {
+	case limits.CPU != 0 && usage.CPU > limits.CPU:
+		return fmt.Errorf("cpu time %s exceeds limit of %s", usage.CPU, limits.CPU)
+	case limits.Size != 0 && usage.Bytes > limits.Size:
+		return fmt.Errorf("message size %d exceeds limit of %d", usage.Bytes, limits.Size)
+	case limits.Exec != 0 && usage.Exec > limits.Exec:
+		return fmt.Errorf("external command time %s exceeds limit of %s", usage.Exec, limits.Exec)
+	}
+	return nil
+}
+
+// usage_record appends the accounting of the delivery to the user log,
+// one short line per delivery:
+//
+//	<unix time> <outcome> <cpu µs> <bytes> <exec µs> <folder>
+//
+// The folder is where the message was headed once decided, - if it was
+// not, and missing from the lines of older versions.
+func usage_record(homedir string, outcome string) {
+	usage.CPU = usage_cpu()
+	syslog_delivery(outcome)
+	events_delivery(outcome)
+	metrics_delivery(outcome)
+
+	pathname := filepath.Join(homedir, ".pmda", "usage")
+	if err := os.MkdirAll(filepath.Dir(pathname), 0700); err != nil {
+		fmt.Fprintf(os.Stderr, "Error recording usage: %s\n", err)
+		return
+	}
+	file, err := os.OpenFile(pathname, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error recording usage: %s\n", err)
+		return
+	}
+	defer file.Close()
+
+	folder := usage.Folder
+	if folder == "" {
+		folder = "-"
+	}
+	fmt.Fprintf(file, "%d %s %d %d %d %s\n", time.Now().Unix(), outcome,
+		usage.CPU.Microseconds(), usage.Bytes, usage.Exec.Microseconds(), folder)
+}
+
+// UsageEntry is a line of the accounting log.
+type UsageEntry struct {
+	Time    time.Time     `json:"time"`
+	Outcome string        `json:"outcome"`
+	CPU     time.Duration `json:"cpu_ns"`
+	Bytes   int64         `json:"bytes"`
+	Exec    time.Duration `json:"exec_ns"`
+	Folder  string        `json:"folder,omitempty"`
+}
+
+func usage_parse(line string) (*UsageEntry, bool) {
+	fields := strings.Fields(line)
+	if len(fields) != 5 && len(fields) != 6 {
+		return nil, false
+	}
+	values := make([]int64, 0, 4)
+	for _, field := range []string{fields[0], fields[2], fields[3], fields[4]} {
+		value, err := strconv.ParseInt(field, 10, 64)
+		if err != nil {
+			return nil, false
+		}
+		values = append(values, value)
+	}
+	entry := &UsageEntry{
+		Time:    time.Unix(values[0], 0),
+		Outcome: fields[1],
+		CPU:     time.Duration(values[1]) * time.Microsecond,
+		Bytes:   values[2],
+		Exec:    time.Duration(values[3]) * time.Microsecond,
+	}
+	if len(fields) == 6 && fields[5] != "-" {
+		entry.Folder = fields[5]
+	}
+	return entry, true
+}
+
+// UsageStats aggregates the accounting log.
+type UsageStats struct {
+	Deliveries int64         `json:"deliveries"`
+	Limited    int64         `json:"limited"`
+	CPU        time.Duration `json:"cpu_ns"`
+	MaxCPU     time.Duration `json:"max_cpu_ns"`
+	Bytes      int64         `json:"bytes"`
+	MaxBytes   int64         `json:"max_bytes"`
+	Exec       time.Duration `json:"exec_ns"`
+	MaxExec    time.Duration `json:"max_exec_ns"`
+}
+
+func usage_stats(homedir string, since time.Time) (*UsageStats, error) {
+	stats := &UsageStats{}
+	file, err := os.Open(filepath.Join(homedir, ".pmda", "usage"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return stats, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		entry, ok := usage_parse(scanner.Text())
+		if !ok || entry.Time.Before(since) {
+			continue
+		}
+
+		stats.Deliveries++
+		if entry.Outcome == "limited" {
+			stats.Limited++
+		}
+		stats.CPU += entry.CPU
+		stats.MaxCPU = max(stats.MaxCPU, entry.CPU)
+		stats.Bytes += entry.Bytes
+		stats.MaxBytes = max(stats.MaxBytes, entry.Bytes)
+		stats.Exec += entry.Exec
+		stats.MaxExec = max(stats.MaxExec, entry.Exec)
+	}
+	return stats, scanner.Err()
+}
+
+var statsFlags = flag.NewFlagSet("stats", flag.ExitOnError)
+var statsSince = statsFlags.Duration("since", 0, "only account for deliveries within this duration")
+var statsJson = statsFlags.Bool("json", false, "output statistics as JSON")
+
+// stats_main implements "mail.pmda stats", which reports the resources
+// consumed by deliveries.
+func stats_main(args []string) int {
+	statsFlags.Parse(args)
+	if statsFlags.NArg() != 0 {
+		fmt.Fprintf(os.Stderr, "Usage: %s stats [-json] [-since duration]\n", os.Args[0])
+		return 1
+	}
+
+	since := time.Time{}
+	if *statsSince != 0 {
+		since = time.Now().Add(-*statsSince)
+	}
+	stats, err := usage_stats(os.Getenv("HOME"), since)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading usage: %s\n", err)
+		return 1
+	}
+
+	if *statsJson {
+		data, err := json.MarshalIndent(stats, "", "  ")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error encoding stats: %s\n", err)
+			return 1
+		}
+		fmt.Printf("%s\n", data)
+		return 0
+	}
+
+	average := func(total time.Duration) time.Duration {
+		if stats.Deliveries == 0 {
+			return 0
+		}
+		return total / time.Duration(stats.Deliveries)
+	}
+	fmt.Printf("deliveries: %d (%d over limits)\n", stats.Deliveries, stats.Limited)
+	fmt.Printf("cpu time:   %s total, %s average, %s max\n", stats.CPU, average(stats.CPU), stats.MaxCPU)
+	fmt.Printf("written:    %d bytes total, %d max\n", stats.Bytes, stats.MaxBytes)
+	fmt.Printf("commands:   %s total, %s average, %s max\n", stats.Exec, average(stats.Exec), stats.MaxExec)
+	return 0
+}
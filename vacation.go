@@ -0,0 +1,126 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// VacationConfig is the out-of-office responder, on when configured or
+// when the message file exists:
+//
+//	vacation days 7 address "me@example.org" address "me@example.com"
+//	vacation file ".vacation.msg" subject "Away: $SUBJECT"
+//
+// The message file is the body of the response, optionally preceded by
+// From and Subject header fields and an empty line as for vacation(1),
+// $SUBJECT standing for the subject of the message answered. A sender is
+// answered once every so many days, bounces, lists, bulk mail and mail
+// the user is not a direct recipient of never are, nor is junk.
+type VacationConfig struct {
+	File      string
+	Days      int
+	Subject   string
+	Addresses []string
+}
+
+func vacation_default() *VacationConfig {
+	return &VacationConfig{File: ".vacation.msg", Days: 7}
+}
+
+func vacation_parse(args []string) (*VacationConfig, error) {
+	vacation := vacation_default()
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == "file" && i+1 < len(args):
+			vacation.File = args[i+1]
+			i++
+		case args[i] == "days" && i+1 < len(args):
+			days, err := strconv.Atoi(args[i+1])
+			if err != nil || days < 1 {
+				return nil, fmt.Errorf("invalid days: %s", args[i+1])
+			}
+			vacation.Days = days
+			i++
+		case args[i] == "subject" && i+1 < len(args):
+			vacation.Subject = args[i+1]
+			i++
+		case args[i] == "address" && i+1 < len(args):
+			vacation.Addresses = append(vacation.Addresses, args[i+1])
+			i++
+		default:
+			return nil, fmt.Errorf("usage: vacation [file path] [days n] [subject text] [address address ...]")
+		}
+	}
+	return vacation, nil
+}
+
+// vacation_message builds the response to a message from the message
+// file, nil when there is none.
+func vacation_message(vacation *VacationConfig, homedir string, hdr *Header) (*SieveVacation, error) {
+	data, err := os.ReadFile(backend_resolve(homedir, vacation.File))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	subject := header_oneline(hdr.Get("Subject"))
+	response := &SieveVacation{Subject: vacation.Subject, Addresses: vacation.Addresses, Days: vacation.Days}
+
+	body := strings.ReplaceAll(string(data), "\r\n", "\n")
+	if head, rest, found := strings.Cut(body, "\n\n"); found {
+		fields := &Header{}
+		for _, line := range strings.Split(head, "\n") {
+			fields.add_line(line)
+		}
+		if fields.Get("Subject") != "" || fields.Get("From") != "" {
+			if fields.Get("Subject") != "" {
+				response.Subject = fields.Get("Subject")
+			}
+			response.From = fields.Get("From")
+			body = rest
+		}
+	}
+	if response.Subject == "" {
+		response.Subject = "Auto: $SUBJECT"
+	}
+	response.Subject = strings.ReplaceAll(response.Subject, "$SUBJECT", subject)
+	response.Reason = strings.ReplaceAll(strings.ReplaceAll(body, "$SUBJECT", subject), "\n", "\r\n")
+	return response, nil
+}
+
+// vacation_respond answers a delivered message if the responder is on.
+func vacation_respond(cfg *Config, env *Envelope, hdr *Header, folder string) {
+	if special_folder_is(cfg, folder, "junk") || special_folder_is(cfg, folder, "error") {
+		return
+	}
+	vacation := cfg.Vacation
+	if vacation == nil {
+		vacation = vacation_default()
+	}
+	response, err := vacation_message(vacation, env.Home, hdr)
+	if err == nil && response != nil {
+		err = sieve_vacation(cfg, env, hdr, response)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error sending vacation response: %s\n", err)
+	}
+}
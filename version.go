@@ -0,0 +1,146 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+)
+
+// version is set at release time:
+//
+//	go build -ldflags "-X main.version=1.2.0"
+var version = "dev"
+
+// features records the optional subsystems compiled in, each registers
+// itself from an init() in a file guarded by its build tag. Subsystems
+// known to the build but left out report as false. Tags are negative so
+// that a plain go build has everything:
+//
+//	go build -tags nopostgresql,noredis
+//
+// The tiny profile leaves out every subsystem that talks to an external
+// service or needs a helper program, which is the classic standalone MDA:
+//
+//	go build -tags tiny
+var features = map[string]bool{
+	"classifier":  false,
+	"ingest":      false,
+	"kafka":       false,
+	"managesieve": false,
+	"nats":        false,
+	"pgp":         false,
+	"postgresql":  false,
+	"redis":       false,
+	"rules-api":   false,
+	"sieve":       false,
+}
+
+func feature_register(name string) {
+	features[name] = true
+}
+
+type buildDescription struct {
+	Version  string          `json:"version"`
+	Go       string          `json:"go"`
+	OS       string          `json:"os"`
+	Arch     string          `json:"arch"`
+	Module   string          `json:"module,omitempty"`
+	Tags     string          `json:"tags,omitempty"`
+	Revision string          `json:"revision,omitempty"`
+	Time     string          `json:"time,omitempty"`
+	Modified bool            `json:"modified,omitempty"`
+	Features map[string]bool `json:"features"`
+}
+
+func build_describe() *buildDescription {
+	description := &buildDescription{
+		Version:  version,
+		Go:       runtime.Version(),
+		OS:       runtime.GOOS,
+		Arch:     runtime.GOARCH,
+		Features: features,
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		description.Module = info.Main.Path
+		for _, setting := range info.Settings {
+			switch setting.Key {
+			case "-tags":
+				description.Tags = setting.Value
+			case "vcs.revision":
+				description.Revision = setting.Value
+			case "vcs.time":
+				description.Time = setting.Value
+			case "vcs.modified":
+				description.Modified = setting.Value == "true"
+			}
+		}
+	}
+	return description
+}
+
+var versionFlags = flag.NewFlagSet("version", flag.ExitOnError)
+var versionJson = versionFlags.Bool("json", false, "output build information as JSON")
+
+// version_main implements "mail.pmda version".
+func version_main(args []string) int {
+	versionFlags.Parse(args)
+	if versionFlags.NArg() != 0 {
+		fmt.Fprintf(os.Stderr, "Usage: %s version [-json]\n", os.Args[0])
+		return 1
+	}
+
+	description := build_describe()
+	if *versionJson {
+		data, err := json.MarshalIndent(description, "", "  ")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error describing build: %s\n", err)
+			return 1
+		}
+		fmt.Printf("%s\n", data)
+		return 0
+	}
+
+	fmt.Printf("mail.pmda %s (%s %s/%s)\n", description.Version, description.Go, description.OS, description.Arch)
+	if description.Revision != "" {
+		modified := ""
+		if description.Modified {
+			modified = "+modified"
+		}
+		fmt.Printf("revision %s%s %s\n", description.Revision, modified, description.Time)
+	}
+
+	names := make([]string, 0, len(features))
+	for name := range features {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		if features[name] {
+			names[i] = "+" + name
+		} else {
+			names[i] = "-" + name
+		}
+	}
+	fmt.Printf("features: %s\n", strings.Join(names, " "))
+	return 0
+}
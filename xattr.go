@@ -0,0 +1,58 @@
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// MetadataField is a piece of delivery metadata attached to a message.
+type MetadataField struct {
+	Name  string
+	Value string
+}
+
+// metadata_store attaches delivery metadata to a stored message as user
+// extended attributes, which travel with the file on copy. Filesystems or
+// systems without xattr support get a sidecar file in the pmda-meta
+// directory of the folder instead, IMAP servers ignore it there.
+func metadata_store(maildir string, folder string, pathname string, fields []MetadataField) {
+	err := error(nil)
+	for _, field := range fields {
+		if err = xattr_set(pathname, "user.pmda."+field.Name, field.Value); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		return
+	}
+
+	sidecar := filepath.Join(maildir, folder, "pmda-meta", maildir_unique(filepath.Base(pathname))+".meta")
+	if err := os.MkdirAll(filepath.Dir(sidecar), 0700); err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating %s: %s\n", filepath.Dir(sidecar), err)
+		return
+	}
+	var content strings.Builder
+	for _, field := range fields {
+		fmt.Fprintf(&content, "%s: %s\n", field.Name, field.Value)
+	}
+	if err := os.WriteFile(sidecar, []byte(content.String()), 0600); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing %s: %s\n", sidecar, err)
+	}
+}